@@ -1,9 +0,0 @@
-package main
-
-import (
-	"github.com/Simply-kk/go-multithreaded-proxy/internal/proxy"
-)
-
-func main() {
-	proxy.StartServer()
-}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/proxy"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "prime":
+			prime(os.Args[2:])
+			return
+		case "route-test":
+			routeTest(os.Args[2:])
+			return
+		}
+	}
+	cfg, err := configure(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := proxy.StartServer(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// usageNotes explain where settings come from, after the flags in -help
+const usageNotes = `
+Settings are taken from, each overriding the ones before:
+  1. the defaults
+  2. the configuration file of -config, or of PROXY_CONFIG without it
+  3. PROXY_* environment variables, one per setting of the file, e.g.
+     PROXY_TRANSPORT_REQUEST_TIMEOUT=5s or PROXY_CLIENT_ACL_ALLOW=10.0.0.0/8,192.168.0.0/16;
+     lists of tables and maps are JSON, e.g. PROXY_ROUTES='[{"name": "api", ...}]'
+  4. the flags given
+-list-env prints every variable. SIGHUP reloads the file and the environment,
+putting new ACLs, routes, rate limits, blocklists and log levels in force.`
+
+// options are the settings given as flags
+type options struct {
+	configPath      string
+	port            int
+	cacheCapacity   int
+	requestTimeout  time.Duration
+	dialTimeout     time.Duration
+	shutdownTimeout time.Duration
+	logLevel        string
+	// set are the names of the flags given
+	set map[string]bool
+}
+
+// configure builds the configuration from the defaults, the configuration
+// file, the environment and then the flags, each overriding the one
+// before; flags only override settings when given. The configuration
+// reloads from the same sources. -version and -list-env print and exit.
+func configure(fs *flag.FlagSet, args []string) (proxy.Config, error) {
+	defaults := proxy.DefaultConfig()
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: proxy [flags]\n       proxy prime [flags] ACCESS_LOG\n       proxy route-test [flags] METHOD URL [Header:value ...]")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), usageNotes)
+	}
+	var opts options
+	fs.StringVar(&opts.configPath, "config", os.Getenv("PROXY_CONFIG"), "TOML or JSON configuration `file`; defaults apply without one")
+	fs.IntVar(&opts.port, "port", 8080, "`port` to listen on, on every address; replaces the listen addresses of the file")
+	fs.IntVar(&opts.cacheCapacity, "cache-capacity", defaults.CacheCapacity, "number of responses the memory cache holds")
+	fs.DurationVar(&opts.requestTimeout, "request-timeout", defaults.Transport.RequestTimeout, "bound on an upstream exchange until its response headers")
+	fs.DurationVar(&opts.dialTimeout, "dial-timeout", defaults.Transport.DialTimeout, "bound on connecting to an upstream")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", defaults.ShutdownTimeout, "wait for requests in flight on shutdown")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "minimum `level` logged: debug, info, warn or error")
+	version := fs.Bool("version", false, "print the version and exit")
+	listEnv := fs.Bool("list-env", false, "print the environment variables that set the configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return proxy.Config{}, err
+	}
+	if *version {
+		fmt.Println("go-multithreaded-proxy", proxy.BuildVersion())
+		os.Exit(0)
+	}
+	if *listEnv {
+		for _, name := range proxy.EnvNames() {
+			fmt.Println(name)
+		}
+		os.Exit(0)
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return proxy.Config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	opts.set = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { opts.set[f.Name] = true })
+
+	cfg, unknown, err := opts.load()
+	if err != nil {
+		return proxy.Config{}, err
+	}
+	for _, name := range unknown {
+		if name != "PROXY_CONFIG" {
+			fmt.Fprintln(os.Stderr, "Ignoring environment variable", name, "that names no setting")
+		}
+	}
+	cfg.Source = func() (proxy.Config, error) {
+		cfg, _, err := opts.load()
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// load reads the configuration file and the environment over the defaults
+// and applies the flags given, returning the PROXY_ variables that name no
+// setting
+func (opts *options) load() (proxy.Config, []string, error) {
+	cfg := proxy.DefaultConfig()
+	if opts.configPath != "" {
+		var err error
+		if cfg, err = proxy.LoadConfigFile(opts.configPath); err != nil {
+			return proxy.Config{}, nil, err
+		}
+	}
+	unknown, err := proxy.ApplyEnv(&cfg, os.Environ())
+	if err != nil {
+		return proxy.Config{}, nil, err
+	}
+	if opts.set["port"] {
+		if opts.port < 1 || opts.port > 65535 {
+			return proxy.Config{}, nil, fmt.Errorf("invalid port %d", opts.port)
+		}
+		cfg.ListenAddrs = []string{":" + strconv.Itoa(opts.port)}
+		cfg.ListenIPv4, cfg.ListenIPv6 = nil, nil
+	}
+	if opts.set["cache-capacity"] {
+		if opts.cacheCapacity < 1 {
+			return proxy.Config{}, nil, fmt.Errorf("invalid cache capacity %d", opts.cacheCapacity)
+		}
+		cfg.CacheCapacity = opts.cacheCapacity
+	}
+	if opts.set["request-timeout"] {
+		cfg.Transport.RequestTimeout = opts.requestTimeout
+	}
+	if opts.set["dial-timeout"] {
+		cfg.Transport.DialTimeout = opts.dialTimeout
+	}
+	if opts.set["shutdown-timeout"] {
+		cfg.ShutdownTimeout = opts.shutdownTimeout
+	}
+	if opts.set["log-level"] {
+		cfg.Logging.Level = opts.logLevel
+	}
+	return cfg, unknown, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/proxy"
+)
+
+// prime warms the proxy's cache with the hottest URLs of an access log
+func prime(args []string) {
+	fs := flag.NewFlagSet("prime", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: proxy prime [flags] ACCESS_LOG")
+		fs.PrintDefaults()
+	}
+	var opts proxy.PrimeOptions
+	fs.StringVar(&opts.ProxyURL, "proxy", "http://127.0.0.1:8080", "proxy to warm through")
+	fs.StringVar(&opts.Origin, "origin", "", "base URL of nginx log lines that record only a path")
+	fs.IntVar(&opts.Top, "top", 100, "number of most requested URLs to warm")
+	fs.IntVar(&opts.Concurrency, "concurrency", 4, "requests in flight")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	log, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer log.Close()
+	urls, err := proxy.HottestURLs(log, opts.Origin, opts.Top)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Reading access log failed:", err)
+		os.Exit(1)
+	}
+	warmed, failed, err := proxy.PrimeCache(urls, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("Primed", warmed, "URLs,", failed, "failed")
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/proxy"
+)
+
+// routeTest prints how the configuration would handle a request, without
+// starting the proxy
+func routeTest(args []string) {
+	fs := flag.NewFlagSet("route-test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: proxy route-test [flags] METHOD URL [Header:value ...]")
+		fs.PrintDefaults()
+	}
+	client := fs.String("client", "127.0.0.1", "client IP the request comes from")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	r, err := http.NewRequest(strings.ToUpper(fs.Arg(0)), fs.Arg(1), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid request:", err)
+		os.Exit(2)
+	}
+	for _, header := range fs.Args()[2:] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid header %q, want Name:value\n", header)
+			os.Exit(2)
+		}
+		r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	r.RemoteAddr = net.JoinHostPort(*client, "0")
+
+	ex, err := proxy.ExplainRequest(proxy.DefaultConfig(), r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(1)
+	}
+	line := func(label string, value any) {
+		fmt.Printf("%-12s %v\n", label+":", value)
+	}
+	line("Mode", ex.Mode)
+	for _, l := range ex.Listeners {
+		verdict := "accepts"
+		if !l.Accepts {
+			verdict = "refuses"
+		}
+		line("Listener", l.Addr+" "+verdict+" "+*client)
+	}
+	if ex.Denied != "" {
+		line("Destination", "refused, "+ex.Denied)
+		return
+	}
+	if ex.Redirect != "" {
+		line("Redirect", ex.Redirect)
+		return
+	}
+	if ex.Target == "" {
+		line("Route", "none, answered 404")
+		return
+	}
+	route := ex.Route
+	if route == "" {
+		route = "none"
+	}
+	line("Route", route)
+	line("Target", ex.Target)
+	for _, mirror := range ex.Mirrors {
+		line("Mirror", mirror)
+	}
+	if ex.Policy != nil {
+		p := ex.Policy
+		line("Policy", fmt.Sprintf("%s (timeout %v, %d retries, %d hedges)", p.Name, p.Timeout, p.Retries, p.Hedges))
+	} else {
+		line("Policy", "none")
+	}
+	line("Class", ex.Class)
+	line("Cache", ex.Cache)
+}
@@ -0,0 +1,451 @@
+// Package configfile loads settings from TOML and JSON files into Go
+// structs, reporting every unknown key and mistyped value at once.
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Document is a parsed settings file
+type Document struct {
+	// Values are the top-level keys of the file
+	Values map[string]any
+	// lines holds the line of each key path, e.g. "routes[1].path"; JSON
+	// files have none
+	lines map[string]int
+	// sources holds the environment variable that set each key path
+	sources map[string]string
+}
+
+// Error lists the problems found decoding a file
+type Error struct {
+	File     string
+	Problems []Problem
+}
+
+// Problem is one unknown key or invalid value
+type Problem struct {
+	// Path is the key path, e.g. "routes[1].path"
+	Path string
+	// Line is the line of the key, or 0 if unknown
+	Line int
+	// Source is the environment variable that set the key, if any
+	Source  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d problem", e.File, len(e.Problems))
+	if len(e.Problems) != 1 {
+		b.WriteString("s")
+	}
+	for _, p := range e.Problems {
+		b.WriteString("\n  ")
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "line %d: ", p.Line)
+		}
+		if p.Source != "" {
+			b.WriteString(p.Source + ": ")
+		}
+		b.WriteString(p.Path + ": " + p.Message)
+	}
+	return b.String()
+}
+
+// Load reads the file at path into v, which must point to a struct. Keys
+// absent from the file leave v as it is, so v may hold the defaults. The
+// format is chosen by extension: .json is JSON, anything else TOML.
+func Load(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc, err := Parse(data, filepath.Ext(path) == ".json")
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := doc.Decode(v); err != nil {
+		var decodeErr *Error
+		if errors.As(err, &decodeErr) {
+			decodeErr.File = path
+		}
+		return err
+	}
+	return nil
+}
+
+// Parse parses a TOML document, or a JSON one when isJSON is set
+func Parse(data []byte, isJSON bool) (*Document, error) {
+	if !isJSON {
+		return parseTOML(data)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var values map[string]any
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	return &Document{Values: values, lines: map[string]int{}}, nil
+}
+
+// Decode stores the document in v, which must point to a struct. Keys
+// match field names or JSON tags regardless of case, underscores and
+// dashes, so max_object_bytes sets MaxObjectBytes. Durations are strings
+// such as "30s". Slices and maps replace the values already there.
+func (d *Document) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("configfile: Decode needs a pointer to a struct, not %T", v)
+	}
+	dec := &decoder{doc: d}
+	dec.decodeStruct(rv.Elem(), d.Values, "")
+	if len(dec.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(dec.problems, func(i, j int) bool {
+		a, b := dec.problems[i], dec.problems[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Path < b.Path
+	})
+	return &Error{File: "config", Problems: dec.problems}
+}
+
+// decoder collects the problems of one Decode
+type decoder struct {
+	doc      *Document
+	problems []Problem
+}
+
+func (d *decoder) fail(path, format string, args ...any) {
+	d.problems = append(d.problems, Problem{
+		Path:    path,
+		Line:    enclosing(d.doc.lines, path),
+		Source:  enclosing(d.doc.sources, path),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// enclosing returns the entry of m for path, or for the nearest enclosing
+// key that has one
+func enclosing[T any](m map[string]T, path string) T {
+	for path != "" {
+		if v, found := m[path]; found {
+			return v
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	var zero T
+	return zero
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// decode stores value in v
+func (d *decoder) decode(v reflect.Value, value any, path string) {
+	if v.Type() == durationType {
+		s, ok := value.(string)
+		if !ok {
+			d.fail(path, "expected a duration string such as \"30s\", got %s", describe(value))
+			return
+		}
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			d.fail(path, "invalid duration %q", s)
+			return
+		}
+		v.SetInt(int64(duration))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.decode(v.Elem(), value, path)
+	case reflect.Struct:
+		table, ok := value.(map[string]any)
+		if !ok {
+			d.fail(path, "expected a table, got %s", describe(value))
+			return
+		}
+		d.decodeStruct(v, table, path)
+	case reflect.Map:
+		table, ok := value.(map[string]any)
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			d.fail(path, "expected a table, got %s", describe(value))
+			return
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(table))
+		for key, item := range table {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.decode(elem, item, join(path, key))
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+	case reflect.Slice:
+		items, ok := value.([]any)
+		if !ok {
+			d.fail(path, "expected an array, got %s", describe(value))
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			d.decode(s.Index(i), item, fmt.Sprintf("%s[%d]", path, i))
+		}
+		v.Set(s)
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			d.fail(path, "expected a string, got %s", describe(value))
+			return
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			d.fail(path, "expected true or false, got %s", describe(value))
+			return
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := integer(value)
+		if !ok || v.OverflowInt(i) {
+			d.fail(path, "expected an integer, got %s", describe(value))
+			return
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := integer(value)
+		if !ok || i < 0 || v.OverflowUint(uint64(i)) {
+			d.fail(path, "expected a non-negative integer, got %s", describe(value))
+			return
+		}
+		v.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		f, ok := float(value)
+		if !ok {
+			d.fail(path, "expected a number, got %s", describe(value))
+			return
+		}
+		v.SetFloat(f)
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			d.fail(path, "cannot be set from a file")
+			return
+		}
+		if value == nil {
+			v.SetZero()
+			return
+		}
+		v.Set(reflect.ValueOf(untyped(value)))
+	default:
+		d.fail(path, "cannot be set from a file")
+	}
+}
+
+// untyped returns value as free-form settings hold it, with the numbers of
+// JSON files as int64 or float64 like those of TOML files
+func untyped(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[key] = untyped(item)
+		}
+		return m
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = untyped(item)
+		}
+		return items
+	}
+	return value
+}
+
+// decodeStruct stores the keys of table in the fields of v, reporting the
+// keys no field takes
+func (d *decoder) decodeStruct(v reflect.Value, table map[string]any, path string) {
+	fields := make(map[string]field)
+	collectFields(v, fields)
+	var unknown []string
+	for key, value := range table {
+		field, found := fields[normalize(key)]
+		if !found {
+			unknown = append(unknown, key)
+			continue
+		}
+		d.decode(field.value, value, join(path, key))
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		d.fail(join(path, key), "unknown key%s", suggest(key, fields))
+	}
+}
+
+// field is a struct field a key may set
+type field struct {
+	value reflect.Value
+	// name is the key suggested for the field
+	name string
+}
+
+// collectFields adds the settable fields of v by normalized name and JSON
+// tag, including those promoted from embedded structs
+func collectFields(v reflect.Value, fields map[string]field) {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "" {
+			collectFields(v.Field(i), fields)
+			continue
+		}
+		name := snakeCase(f.Name)
+		if tag != "" {
+			name = tag
+			fields[normalize(tag)] = field{v.Field(i), name}
+		}
+		if _, taken := fields[normalize(f.Name)]; !taken {
+			fields[normalize(f.Name)] = field{v.Field(i), name}
+		}
+	}
+}
+
+// suggest names the field a misspelt key most likely meant
+func suggest(key string, fields map[string]field) string {
+	best, bestDistance := "", 3
+	for normalized, f := range fields {
+		if d := distance(normalize(key), normalized); d < bestDistance || d == bestDistance && f.name < best {
+			best, bestDistance = f.name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %s?)", best)
+}
+
+// distance is the Levenshtein distance between a and b
+func distance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			prev, row[j] = row[j], min(row[j]+1, row[j-1]+1, prev+cost)
+		}
+	}
+	return row[len(b)]
+}
+
+// snakeCase spells a field name as a key, e.g. CacheMaxObjectBytes as
+// cache_max_object_bytes
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		upper := c >= 'A' && c <= 'Z'
+		if upper && i > 0 {
+			// An acronym ends before a capitalized word, so DNSCache is
+			// dns_cache, but keeps a plural or version, as in ACLs and IPv4
+			prev := name[i-1]
+			word := i+2 < len(name) && isLower(name[i+1]) && isLower(name[i+2])
+			if isLower(prev) || prev >= '0' && prev <= '9' || prev >= 'A' && prev <= 'Z' && word {
+				b.WriteByte('_')
+			}
+		}
+		if upper {
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func isLower(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+// normalize folds a key or field name for matching
+func normalize(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// integer returns value as an integer if it is a whole number
+func integer(value any) (int64, bool) {
+	switch n := value.(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n), true
+		}
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// float returns value as a float if it is a number
+func float(value any) (float64, bool) {
+	switch n := value.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// describe names the type of a parsed value for error messages
+func describe(value any) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case int64, json.Number:
+		return fmt.Sprintf("number %v", v)
+	case float64:
+		return fmt.Sprintf("number %v", v)
+	case bool:
+		return fmt.Sprintf("%v", v)
+	case []any:
+		return "an array"
+	case map[string]any:
+		return "a table"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,205 @@
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envSetting is a field an environment variable sets
+type envSetting struct {
+	// name is the variable, e.g. PROXY_TRANSPORT_REQUEST_TIMEOUT
+	name string
+	// keys are the key path of the field
+	keys []string
+	typ  reflect.Type
+}
+
+// EnvNames lists the environment variables that set the fields of the
+// struct v points to, by the key path of the field after prefix, e.g.
+// PROXY_TRANSPORT_REQUEST_TIMEOUT for transport.request_timeout
+func EnvNames(prefix string, v any) []string {
+	settings := envSettings(prefix, reflect.TypeOf(v).Elem())
+	names := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		names = append(names, setting.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadEnv stores the variables of environ, in the form returned by
+// os.Environ, that start with prefix in the struct v points to. Nested
+// structs are reached through their fields, e.g. PROXY_DNS_CACHE_TTL=30s;
+// lists of plain values are comma-separated, and other lists and maps are
+// JSON, e.g. PROXY_ROUTES='[{"name": "api", "backend": "http://api:9000"}]'.
+// Underscores are optional, so PROXY_RESOLVER_DOH names the same field as
+// PROXY_RESOLVER_DO_H. Variables naming no field are returned rather than
+// failing, as orchestrators set variables of their own under many prefixes.
+func LoadEnv(prefix string, environ []string, v any) (unknown []string, err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("configfile: LoadEnv needs a pointer to a struct, not %T", v)
+	}
+	settings := envSettings(prefix, rv.Elem().Type())
+	doc := &Document{Values: map[string]any{}, lines: map[string]int{}, sources: map[string]string{}}
+	var problems []Problem
+	for _, kv := range environ {
+		name, text, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		setting, found := settings[envKey(name)]
+		if !found {
+			unknown = append(unknown, name)
+			continue
+		}
+		path := strings.Join(setting.keys, ".")
+		value, err := envValue(setting.typ, text)
+		if err != nil {
+			problems = append(problems, Problem{Path: path, Source: name, Message: err.Error()})
+			continue
+		}
+		table := doc.Values
+		for _, key := range setting.keys[:len(setting.keys)-1] {
+			next, ok := table[key].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				table[key] = next
+			}
+			table = next
+		}
+		table[setting.keys[len(setting.keys)-1]] = value
+		doc.sources[path] = name
+	}
+	sort.Strings(unknown)
+	if err := doc.Decode(v); err != nil {
+		problems = append(problems, err.(*Error).Problems...)
+	}
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool { return problems[i].Source < problems[j].Source })
+		return unknown, &Error{File: "environment", Problems: problems}
+	}
+	return unknown, nil
+}
+
+// envSettings maps the fields of t by the envKey of their variables
+func envSettings(prefix string, t reflect.Type) map[string]envSetting {
+	settings := make(map[string]envSetting)
+	collectEnv(t, strings.TrimSuffix(prefix, "_"), nil, settings, map[reflect.Type]bool{})
+	return settings
+}
+
+// collectEnv adds the fields of struct type t, reached by keys, under
+// prefix. Structs are entered so each of their fields has a variable;
+// visiting guards against types that contain themselves.
+func collectEnv(t reflect.Type, prefix string, keys []string, settings map[string]envSetting, visiting map[reflect.Type]bool) {
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "" {
+			collectEnv(f.Type, prefix, keys, settings, visiting)
+			continue
+		}
+		key := snakeCase(f.Name)
+		if tag != "" {
+			key = tag
+		}
+		name := prefix + "_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		path := append(keys[:len(keys):len(keys)], key)
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct && !visiting[ft]:
+			collectEnv(ft, name, path, settings, visiting)
+		case ft.Kind() == reflect.Func, ft.Kind() == reflect.Interface, ft.Kind() == reflect.Chan:
+		default:
+			// A field spelt as a nested one, CacheMaxObjectBytes beside
+			// Cache.MaxObjectBytes say, keeps the outer field's name
+			if taken, found := settings[envKey(name)]; !found || len(path) < len(taken.keys) {
+				settings[envKey(name)] = envSetting{name: name, keys: path, typ: ft}
+			}
+		}
+	}
+}
+
+// envKey folds a variable name for matching
+func envKey(name string) string {
+	return strings.ReplaceAll(name, "_", "")
+}
+
+// envValue converts the text of a variable setting a field of type t to
+// the value a file would hold; the decoder then checks it
+func envValue(t reflect.Type, text string) (any, error) {
+	if t == durationType {
+		return text, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return text, nil
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, err := strconv.ParseInt(strings.ReplaceAll(text, "_", ""), 0, 64); err == nil {
+			return i, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	case reflect.Slice:
+		if elem := t.Elem(); !strings.HasPrefix(strings.TrimSpace(text), "[") && isPlain(elem) {
+			items := []any{}
+			for item := range strings.SplitSeq(text, ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				v, err := envValue(elem, item)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, v)
+			}
+			return items, nil
+		}
+		return envJSON(text)
+	case reflect.Map, reflect.Struct:
+		return envJSON(text)
+	}
+	// Left as text for the decoder to report with the expected type
+	return text, nil
+}
+
+// isPlain reports whether values of t are written without structure
+func isPlain(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Struct, reflect.Pointer, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// envJSON parses the JSON value of a variable
+func envJSON(text string) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(text)))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return v, nil
+}
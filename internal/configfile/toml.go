@@ -0,0 +1,550 @@
+package configfile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses a TOML document into tables of string, int64, float64,
+// bool, []any and map[string]any values. Dates and times, which no
+// setting takes, are refused.
+func parseTOML(data []byte) (*Document, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("file is not UTF-8")
+	}
+	p := &tomlParser{
+		src:   string(data),
+		line:  1,
+		doc:   &Document{Values: map[string]any{}, lines: map[string]int{}},
+		fixed: map[string]bool{},
+	}
+	p.table, p.tablePath = p.doc.Values, ""
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return p.doc, nil
+}
+
+// tomlParser reads a document one character at a time
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+	doc  *Document
+
+	// table receives the key-value pairs of the current section, whose
+	// path in the document is tablePath
+	table     map[string]any
+	tablePath string
+	// fixed are the paths of tables defined by a header or inline, which
+	// may not be defined again
+	fixed map[string]bool
+}
+
+func (p *tomlParser) parse() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		switch {
+		case p.peek() == '\n':
+			p.next()
+		case strings.HasPrefix(p.src[p.pos:], "[["):
+			p.pos += 2
+			if err := p.arrayTableHeader(); err != nil {
+				return err
+			}
+		case p.peek() == '[':
+			p.pos++
+			if err := p.tableHeader(); err != nil {
+				return err
+			}
+		default:
+			if err := p.keyValue(p.table, p.tablePath); err != nil {
+				return err
+			}
+			if err := p.endOfLine(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// tableHeader reads the rest of a [table] header and makes it current
+func (p *tomlParser) tableHeader() error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if p.eof() || p.peek() != ']' {
+		return fmt.Errorf("expected ] after table name")
+	}
+	p.pos++
+	table, path, err := p.descend(p.doc.Values, "", keys)
+	if err != nil {
+		return err
+	}
+	if p.fixed[path] {
+		return fmt.Errorf("table %s defined twice", path)
+	}
+	p.fixed[path] = true
+	p.doc.lines[path] = p.line
+	p.table, p.tablePath = table, path
+	return p.endOfLine()
+}
+
+// arrayTableHeader reads the rest of a [[table]] header, appends a table to
+// the array it names and makes it current
+func (p *tomlParser) arrayTableHeader() error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if !strings.HasPrefix(p.src[p.pos:], "]]") {
+		return fmt.Errorf("expected ]] after table array name")
+	}
+	p.pos += 2
+	parent, path, err := p.descend(p.doc.Values, "", keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	path = join(path, last)
+	var array []any
+	switch v := parent[last].(type) {
+	case nil:
+	case []any:
+		if !p.fixed[path+"[]"] {
+			return fmt.Errorf("%s is an array, not an array of tables", path)
+		}
+		array = v
+	default:
+		return fmt.Errorf("%s is already a value", path)
+	}
+	table := map[string]any{}
+	parent[last] = append(array, table)
+	p.fixed[path+"[]"] = true
+	path = fmt.Sprintf("%s[%d]", path, len(array))
+	p.fixed[path] = true
+	p.doc.lines[path] = p.line
+	p.table, p.tablePath = table, path
+	return p.endOfLine()
+}
+
+// descend returns the table at keys below table, creating missing ones;
+// arrays of tables lead to their last element
+func (p *tomlParser) descend(table map[string]any, path string, keys []string) (map[string]any, string, error) {
+	for _, key := range keys {
+		path = join(path, key)
+		switch v := table[key].(type) {
+		case nil:
+			next := map[string]any{}
+			table[key] = next
+			table = next
+		case map[string]any:
+			table = v
+		case []any:
+			if !p.fixed[path+"[]"] || len(v) == 0 {
+				return nil, "", fmt.Errorf("%s is already a value", path)
+			}
+			path = fmt.Sprintf("%s[%d]", path, len(v)-1)
+			table = v[len(v)-1].(map[string]any)
+		default:
+			return nil, "", fmt.Errorf("%s is already a value", path)
+		}
+	}
+	return table, path, nil
+}
+
+// keyValue reads a key = value pair into table, whose path is path
+func (p *tomlParser) keyValue(table map[string]any, path string) error {
+	line := p.line
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if p.eof() || p.peek() != '=' {
+		return fmt.Errorf("expected = after key %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpaces()
+	value, err := p.value(join(path, strings.Join(keys, ".")))
+	if err != nil {
+		return err
+	}
+	table, path, err = p.descend(table, path, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	path = join(path, last)
+	if _, dup := table[last]; dup {
+		return fmt.Errorf("key %s defined twice", path)
+	}
+	table[last] = value
+	p.doc.lines[path] = line
+	return nil
+}
+
+// key reads a bare, quoted or dotted key
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			return nil, fmt.Errorf("expected a key")
+		}
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.basicString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, s)
+		case c == '\'':
+			s, err := p.literalString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, s)
+		case isBareKeyChar(c):
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			keys = append(keys, p.src[start:p.pos])
+		default:
+			return nil, fmt.Errorf("unexpected %q in key", c)
+		}
+		p.skipSpaces()
+		if p.eof() || p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+// value reads a value; path names it in errors and records the lines of
+// the keys of inline tables
+func (p *tomlParser) value(path string) (any, error) {
+	if p.eof() {
+		return nil, fmt.Errorf("expected a value")
+	}
+	switch c := p.peek(); {
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		return p.multilineBasicString()
+	case strings.HasPrefix(p.src[p.pos:], "'''"):
+		return p.multilineLiteralString()
+	case c == '"':
+		return p.basicString()
+	case c == '\'':
+		return p.literalString()
+	case c == '[':
+		return p.array(path)
+	case c == '{':
+		return p.inlineTable(path)
+	case strings.HasPrefix(p.src[p.pos:], "true"):
+		p.pos += 4
+		return true, nil
+	case strings.HasPrefix(p.src[p.pos:], "false"):
+		p.pos += 5
+		return false, nil
+	}
+	return p.number()
+}
+
+// number reads an integer or float
+func (p *tomlParser) number() (any, error) {
+	start := p.pos
+	// Take the whole bare word, so that errors quote all of it
+	for !p.eof() && (isBareKeyChar(p.peek()) || strings.IndexByte("+.:", p.peek()) >= 0) {
+		p.pos++
+	}
+	text := p.src[start:p.pos]
+	if text == "" {
+		return nil, fmt.Errorf("unexpected %q in value; strings must be quoted", p.peek())
+	}
+	if strings.ContainsAny(text, ":T") || strings.Count(text, "-") > 1 && !strings.ContainsAny(text, "eE") {
+		return nil, fmt.Errorf("dates and times are not supported; write durations as strings such as \"30s\"")
+	}
+	switch text {
+	case "inf", "+inf", "-inf", "nan", "+nan", "-nan":
+		return nil, fmt.Errorf("%s is not a supported number", text)
+	}
+	clean := strings.ReplaceAll(text, "_", "")
+	if i, err := strconv.ParseInt(clean, 0, 64); err == nil {
+		if len(clean) > 1 && clean[0] == '0' && clean[1] >= '0' && clean[1] <= '9' {
+			return nil, fmt.Errorf("integer %s has a leading zero", text)
+		}
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil && !strings.HasPrefix(clean, "0x") {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %s; strings must be quoted", text)
+}
+
+// array reads an array, which may span lines
+func (p *tomlParser) array(path string) ([]any, error) {
+	p.pos++
+	values := []any{}
+	for {
+		p.skipWhitespaceAndComments()
+		if p.eof() {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		v, err := p.value(fmt.Sprintf("%s[%d]", path, len(values)))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		p.skipWhitespaceAndComments()
+		if p.eof() {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// inlineTable reads a table written on one line as { key = value, ... }
+func (p *tomlParser) inlineTable(path string) (map[string]any, error) {
+	p.pos++
+	table := map[string]any{}
+	p.skipSpaces()
+	if !p.eof() && p.peek() == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		if err := p.keyValue(table, path); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.eof() {
+			return nil, fmt.Errorf("unterminated inline table")
+		}
+		switch p.next() {
+		case ',':
+		case '}':
+			return table, nil
+		default:
+			return nil, fmt.Errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// basicString reads a "quoted" string with escapes
+func (p *tomlParser) basicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.next()
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// multilineBasicString reads a """quoted""" string, which may span lines
+func (p *tomlParser) multilineBasicString() (string, error) {
+	p.pos += 3
+	p.trimNewline()
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			p.pos += 3
+			return b.String(), nil
+		}
+		c := p.next()
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		// A backslash at the end of a line trims the whitespace that follows
+		if rest := strings.TrimLeft(p.src[p.pos:], " \t"); strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+			for !p.eof() && strings.IndexByte(" \t\r\n", p.peek()) >= 0 {
+				p.next()
+			}
+			continue
+		}
+		if err := p.escape(&b); err != nil {
+			return "", err
+		}
+	}
+}
+
+// escape reads the escape sequence after a backslash into b
+func (p *tomlParser) escape(b *strings.Builder) error {
+	if p.eof() {
+		return fmt.Errorf("unterminated string")
+	}
+	switch c := p.next(); c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return fmt.Errorf("short \\%c escape", c)
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return fmt.Errorf("invalid \\%c escape", c)
+		}
+		p.pos += n
+		b.WriteRune(rune(code))
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// literalString reads a 'quoted' string without escapes
+func (p *tomlParser) literalString() (string, error) {
+	p.pos++
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// multilineLiteralString reads a literal string between triple single
+// quotes, which may span lines
+func (p *tomlParser) multilineLiteralString() (string, error) {
+	p.pos += 3
+	p.trimNewline()
+	end := strings.Index(p.src[p.pos:], "'''")
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.line += strings.Count(s, "\n")
+	p.pos += end + 3
+	return s, nil
+}
+
+// trimNewline skips a newline right after the opening quotes of a
+// multiline string
+func (p *tomlParser) trimNewline() {
+	if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+		p.pos += 2
+		p.line++
+	} else if strings.HasPrefix(p.src[p.pos:], "\n") {
+		p.pos++
+		p.line++
+	}
+}
+
+// endOfLine expects nothing but a comment up to the end of the line
+func (p *tomlParser) endOfLine() error {
+	p.skipBlank()
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return fmt.Errorf("unexpected %q after value", p.peek())
+	}
+	p.next()
+	return nil
+}
+
+// skipBlank skips spaces, tabs, carriage returns and a comment
+func (p *tomlParser) skipBlank() {
+	p.skipSpaces()
+	if !p.eof() && p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipWhitespaceAndComments skips blank lines and comments, inside arrays
+func (p *tomlParser) skipWhitespaceAndComments() {
+	for {
+		p.skipBlank()
+		if p.eof() || p.peek() != '\n' {
+			return
+		}
+		p.next()
+	}
+}
+
+func (p *tomlParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.src[p.pos]
+}
+
+// next consumes a character, counting lines
+func (p *tomlParser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// join appends key to a dotted path
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
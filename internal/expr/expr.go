@@ -0,0 +1,525 @@
+// Package expr evaluates the small expression language of the proxy's
+// configuration, in which operators write per-request decisions such as
+//
+//	req.Host endsWith ".test" && req.Method == "GET"
+//
+// Expressions combine strings, numbers, booleans, null and lists with
+// || && ! == != < <= > >= + and -, the word operators in, contains,
+// startsWith, endsWith and matches (a regular expression), the functions
+// lower, upper and len, field access with . and indexing with [ ].
+// Strings take double or single quotes.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Object is a value whose fields are looked up as an expression is
+// evaluated, such as the request it inspects. Field returns nil for a
+// field it lacks.
+type Object interface {
+	Field(name string) any
+}
+
+// Program is a compiled expression, safe for concurrent use
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses src. The keys of schema are the variables src may use;
+// the value of each describes its fields: a map[string]any of field
+// schemas for an object whose fields are known, nil for one whose fields
+// are only known when evaluated, and any other value for a plain value.
+// Access to fields the schema lacks is reported here rather than when
+// evaluated.
+func Compile(src string, schema map[string]any) (*Program, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, schema: schema}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("expected an operator")
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+// String returns the source of the program
+func (p *Program) String() string {
+	return p.src
+}
+
+// Eval evaluates the program with the values of its variables
+func (p *Program) Eval(vars map[string]any) (any, error) {
+	return p.root.eval(vars)
+}
+
+// Bool evaluates a program that decides something, failing unless it
+// yields a boolean
+func (p *Program) Bool(vars map[string]any) (bool, error) {
+	v, err := p.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression yields %s, not a boolean", typeName(v))
+	}
+	return b, nil
+}
+
+// node is an element of the syntax tree
+type node interface {
+	eval(vars map[string]any) (any, error)
+}
+
+type literal struct{ value any }
+
+func (n *literal) eval(map[string]any) (any, error) { return n.value, nil }
+
+type variable struct {
+	name string
+	col  int
+}
+
+func (n *variable) eval(vars map[string]any) (any, error) {
+	v, found := vars[n.name]
+	if !found {
+		return nil, fmt.Errorf("column %d: %s is not set", n.col, n.name)
+	}
+	return v, nil
+}
+
+type list struct{ items []node }
+
+func (n *list) eval(vars map[string]any) (any, error) {
+	out := make([]any, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+type field struct {
+	operand node
+	name    string
+	col     int
+}
+
+func (n *field) eval(vars map[string]any) (any, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return lookup(v, n.name, n.col)
+}
+
+type indexing struct {
+	operand, index node
+	col            int
+}
+
+func (n *indexing) eval(vars map[string]any) (any, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if items, ok := v.([]any); ok {
+		i, ok := index.(int64)
+		if !ok {
+			return nil, fmt.Errorf("column %d: lists are indexed by integers, not %s", n.col, typeName(index))
+		}
+		if i < 0 || i >= int64(len(items)) {
+			return nil, nil
+		}
+		return items[i], nil
+	}
+	key, ok := index.(string)
+	if !ok {
+		return nil, fmt.Errorf("column %d: cannot index %s with %s", n.col, typeName(v), typeName(index))
+	}
+	return lookup(v, key, n.col)
+}
+
+// lookup returns the field name of v
+func lookup(v any, name string, col int) (any, error) {
+	switch v := v.(type) {
+	case Object:
+		return v.Field(name), nil
+	case map[string]any:
+		return v[name], nil
+	case map[string]string:
+		if s, ok := v[name]; ok {
+			return s, nil
+		}
+		return nil, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("column %d: %s has no field %s", col, typeName(v), name)
+}
+
+type call struct {
+	name string
+	fn   func(args []any) (any, error)
+	args []node
+	col  int
+}
+
+func (n *call) eval(vars map[string]any) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("column %d: %s: %w", n.col, n.name, err)
+	}
+	return v, nil
+}
+
+// builtins are the functions expressions may call
+var builtins = map[string]func(args []any) (any, error){
+	"lower": stringFunc(strings.ToLower),
+	"upper": stringFunc(strings.ToUpper),
+	"len": func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("takes one argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return int64(len(v)), nil
+		case []any:
+			return int64(len(v)), nil
+		case map[string]any:
+			return int64(len(v)), nil
+		case nil:
+			return int64(0), nil
+		}
+		return nil, fmt.Errorf("cannot take the length of %s", typeName(args[0]))
+	},
+}
+
+// stringFunc adapts a function of one string
+func stringFunc(fn func(string) string) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("takes one argument")
+		}
+		switch s := args[0].(type) {
+		case string:
+			return fn(s), nil
+		case nil:
+			return "", nil
+		}
+		return nil, fmt.Errorf("expects a string, not %s", typeName(args[0]))
+	}
+}
+
+type unary struct {
+	op      string
+	operand node
+	col     int
+}
+
+func (n *unary) eval(vars map[string]any) (any, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("column %d: cannot apply %s to %s", n.col, n.op, typeName(v))
+}
+
+type logical struct {
+	or          bool
+	left, right node
+}
+
+// eval short-circuits, so the right operand may rely on the left one
+func (n *logical) eval(vars map[string]any) (any, error) {
+	b, err := n.operand(n.left, vars)
+	if err != nil || b == n.or {
+		return b, err
+	}
+	return n.operand(n.right, vars)
+}
+
+// operand evaluates an operand, which must be a boolean
+func (n *logical) operand(operand node, vars map[string]any) (bool, error) {
+	v, err := operand.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		op := "&&"
+		if n.or {
+			op = "||"
+		}
+		return false, fmt.Errorf("operands of %s must be booleans, not %s", op, typeName(v))
+	}
+	return b, nil
+}
+
+type arithmetic struct {
+	op          string
+	left, right node
+	col         int
+}
+
+func (n *arithmetic) eval(vars map[string]any) (any, error) {
+	a, b, err := operands(vars, n.left, n.right)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "+" {
+		if x, ok := a.(string); ok {
+			if y, ok := b.(string); ok {
+				return x + y, nil
+			}
+		}
+	}
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			if n.op == "+" {
+				return x + y, nil
+			}
+			return x - y, nil
+		}
+	}
+	x, okA := number(a)
+	y, okB := number(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("column %d: cannot apply %s to %s and %s", n.col, n.op, typeName(a), typeName(b))
+	}
+	if n.op == "+" {
+		return x + y, nil
+	}
+	return x - y, nil
+}
+
+type comparison struct {
+	op          string
+	left, right node
+	// re is the pattern of matches with a literal pattern
+	re  *regexp.Regexp
+	col int
+}
+
+func (n *comparison) eval(vars map[string]any) (any, error) {
+	a, b, err := operands(vars, n.left, n.right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(a, b), nil
+	case "!=":
+		return !equal(a, b), nil
+	case "<", "<=", ">", ">=":
+		c, ok := compare(a, b)
+		if !ok {
+			return nil, fmt.Errorf("column %d: cannot compare %s and %s", n.col, typeName(a), typeName(b))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		return contains(b, a, n.col)
+	case "contains":
+		return contains(a, b, n.col)
+	}
+
+	// The string operators treat a missing value as empty
+	s, ok := stringOrEmpty(a)
+	if !ok {
+		return nil, fmt.Errorf("column %d: %s needs strings, not %s", n.col, n.op, typeName(a))
+	}
+	t, ok := stringOrEmpty(b)
+	if !ok {
+		return nil, fmt.Errorf("column %d: %s needs strings, not %s", n.col, n.op, typeName(b))
+	}
+	switch n.op {
+	case "startsWith":
+		return strings.HasPrefix(s, t), nil
+	case "endsWith":
+		return strings.HasSuffix(s, t), nil
+	}
+	re := n.re
+	if re == nil {
+		if re, err = regexp.Compile(t); err != nil {
+			return nil, fmt.Errorf("column %d: %v", n.col, err)
+		}
+	}
+	return re.MatchString(s), nil
+}
+
+// operands evaluates the operands of a binary operator
+func operands(vars map[string]any, left, right node) (any, any, error) {
+	a, err := left.eval(vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := right.eval(vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+// contains reports whether the list, object keys or string container holds
+// item
+func contains(container, item any, col int) (bool, error) {
+	switch c := container.(type) {
+	case []any:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("column %d: a string can only contain strings, not %s", col, typeName(item))
+		}
+		return strings.Contains(c, s), nil
+	case map[string]any:
+		key, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c[key]
+		return found, nil
+	case nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("column %d: %s cannot contain values", col, typeName(container))
+}
+
+// equal compares values, numbers by value whatever their type
+func equal(a, b any) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case string, bool, nil:
+		return a == b
+	case []any:
+		items, ok := b.([]any)
+		if !ok || len(items) != len(a) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], items[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compare orders two numbers or two strings
+func compare(a, b any) (int, bool) {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	x, okA := a.(string)
+	y, okB := b.(string)
+	if !okA || !okB {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+// number returns a numeric value as a float64
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// stringOrEmpty returns a string value, taking null as empty
+func stringOrEmpty(v any) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case nil:
+		return "", true
+	}
+	return "", false
+}
+
+// typeName names the type of a value in error messages
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case int64, float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []any:
+		return "a list"
+	case map[string]any, map[string]string, Object:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,377 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenKind classifies a token
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+// token is a lexeme and the column it starts at
+type token struct {
+	kind tokenKind
+	text string
+	col  int
+}
+
+// operators are the symbolic operators, longest first so that <= is not
+// read as <
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "(", ")", "[", "]", ",", "."}
+
+// lex splits src into tokens
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(src) && rune(src[end]) != c {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("column %d: unterminated string", i+1)
+			}
+			text := src[i : end+1]
+			if c == '\'' {
+				// Single quotes spare quoting inside TOML and JSON strings
+				text = `"` + strings.ReplaceAll(strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			s, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, fmt.Errorf("column %d: invalid string %s", i+1, src[i:end+1])
+			}
+			toks = append(toks, token{tokString, s, i + 1})
+			i = end + 1
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(src) && (src[end] >= '0' && src[end] <= '9' || src[end] == '.' || src[end] == '_') {
+				end++
+			}
+			toks = append(toks, token{tokNumber, src[i:end], i + 1})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i
+			for end < len(src) && (src[end] == '_' || unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			toks = append(toks, token{tokIdent, src[i:end], i + 1})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("column %d: unexpected %q", i+1, c)
+			}
+			toks = append(toks, token{tokOp, op, i + 1})
+			i += len(op)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src) + 1}), nil
+}
+
+// wordOperators are the comparison operators spelt as words
+var wordOperators = map[string]bool{"in": true, "contains": true, "startsWith": true, "endsWith": true, "matches": true}
+
+// parser builds the syntax tree of an expression by recursive descent
+type parser struct {
+	toks   []token
+	pos    int
+	schema map[string]any
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the operator op if it is next
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		return p.unexpected("expected " + strconv.Quote(op))
+	}
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("column %d: %s, found the end", t.col, want)
+	}
+	return fmt.Errorf("column %d: %s, found %q", t.col, want, t.text)
+}
+
+// parseOr parses a || b
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right node
+		right, err = p.parseAnd()
+		left = &logical{or: true, left: left, right: right}
+	}
+	return left, err
+}
+
+// parseAnd parses a && b
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseComparison()
+	for err == nil && p.accept("&&") {
+		var right node
+		right, err = p.parseComparison()
+		left = &logical{left: left, right: right}
+	}
+	return left, err
+}
+
+// parseComparison parses a == b, a endsWith b and the like
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+	case t.kind == tokIdent && wordOperators[t.text]:
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	c := &comparison{op: t.text, left: left, right: right, col: t.col}
+	if lit, ok := right.(*literal); ok && t.text == "matches" {
+		s, ok := lit.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("column %d: matches needs a pattern string", t.col)
+		}
+		if c.re, err = regexp.Compile(s); err != nil {
+			return nil, fmt.Errorf("column %d: %v", t.col, err)
+		}
+	}
+	return c, nil
+}
+
+// parseSum parses a + b and a - b
+func (p *parser) parseSum() (node, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-") {
+			break
+		}
+		p.next()
+		var right node
+		right, err = p.parseUnary()
+		left = &arithmetic{op: t.text, left: left, right: right, col: t.col}
+	}
+	return left, err
+}
+
+// parseUnary parses !a and -a
+func (p *parser) parseUnary() (node, error) {
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "!" || t.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: t.text, operand: operand, col: t.col}, nil
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses field access, indexing and calls
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	for err == nil {
+		t := p.peek()
+		switch {
+		case t.kind == tokOp && t.text == ".":
+			p.next()
+			name := p.peek()
+			if name.kind != tokIdent {
+				return nil, p.unexpected("expected a field name")
+			}
+			p.next()
+			if err := p.checkField(n, name); err != nil {
+				return nil, err
+			}
+			n = &field{operand: n, name: name.text, col: name.col}
+		case t.kind == tokOp && t.text == "[":
+			p.next()
+			var index node
+			if index, err = p.parseOr(); err == nil {
+				err = p.expect("]")
+			}
+			n = &indexing{operand: n, index: index, col: t.col}
+		case t.kind == tokOp && t.text == "(":
+			v, ok := n.(*variable)
+			if !ok || builtins[v.name] == nil {
+				return nil, fmt.Errorf("column %d: only functions may be called", t.col)
+			}
+			p.next()
+			var args []node
+			if args, err = p.parseList(")"); err == nil {
+				n = &call{name: v.name, fn: builtins[v.name], args: args, col: v.col}
+			}
+		default:
+			return n, nil
+		}
+	}
+	return nil, err
+}
+
+// parsePrimary parses literals, variables and parenthesized expressions
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		text := strings.ReplaceAll(t.text, "_", "")
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return &literal{value: i}, nil
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: invalid number %s", t.col, t.text)
+		}
+		return &literal{value: f}, nil
+	case tokString:
+		return &literal{value: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		}
+		if builtins[t.text] != nil {
+			return &variable{name: t.text, col: t.col}, nil
+		}
+		if _, known := p.schema[t.text]; !known {
+			return nil, fmt.Errorf("column %d: unknown name %s", t.col, t.text)
+		}
+		return &variable{name: t.text, col: t.col}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			items, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return &list{items: items}, nil
+		}
+	}
+	p.pos--
+	if t.kind == tokEOF {
+		p.pos = len(p.toks) - 1
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+// parseList parses comma-separated expressions up to the closing operator
+func (p *parser) parseList(closing string) ([]node, error) {
+	var items []node
+	if p.accept(closing) {
+		return items, nil
+	}
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept(closing) {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkField rejects access to a field the schema of operand lacks
+func (p *parser) checkField(operand node, name token) error {
+	path, schema, ok := p.schemaOf(operand)
+	if !ok {
+		return nil
+	}
+	fields, isObject := schema.(map[string]any)
+	if schema == nil || (isObject && fields == nil) {
+		// Fields known only when evaluated
+		return nil
+	}
+	if !isObject {
+		return fmt.Errorf("column %d: %s has no fields", name.col, path)
+	}
+	if _, found := fields[name.text]; !found {
+		return fmt.Errorf("column %d: %s has no field %s", name.col, path, name.text)
+	}
+	return nil
+}
+
+// schemaOf returns the path and schema of a variable or a field of one
+func (p *parser) schemaOf(n node) (string, any, bool) {
+	switch n := n.(type) {
+	case *variable:
+		schema, found := p.schema[n.name]
+		return n.name, schema, found
+	case *field:
+		path, schema, ok := p.schemaOf(n.operand)
+		if !ok {
+			return "", nil, false
+		}
+		fields, _ := schema.(map[string]any)
+		if fields == nil {
+			return "", nil, false
+		}
+		return path + "." + n.name, fields[n.name], true
+	}
+	return "", nil, false
+}
@@ -1 +1,303 @@
+// Package logging builds the structured, leveled loggers of the proxy.
+// Records go to standard output as logfmt-style text or JSON, and the level
+// of each logger can be changed while running.
 package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats of the log output
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config holds the logging settings
+type Config struct {
+	// Level is the minimum level logged: "debug", "info", "warn" or
+	// "error"; info when empty
+	Level string `json:",omitempty"`
+	// Format is FormatText or FormatJSON; text when empty
+	Format string `json:",omitempty"`
+}
+
+// errFixedLevel is returned when changing the level of a logger whose
+// handler was given by the application
+var errFixedLevel = errors.New("the level is set by the handler of the logger given to the proxy")
+
+// stdout writes to os.Stdout as it is at the time of each write, so that
+// redirecting standard output also redirects the log
+type stdout struct{}
+
+func (stdout) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+// Logger is a slog logger whose minimum level can be changed while
+// running. Loggers built by New also take preformatted Records.
+type Logger struct {
+	*slog.Logger
+	// level is nil for loggers wrapping a handler of the application,
+	// which then decides the level
+	level *slog.LevelVar
+	json  bool
+	out   io.Writer
+}
+
+// New returns the logger described by cfg, writing to standard output
+func New(cfg Config) (*Logger, error) {
+	l, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	level := new(slog.LevelVar)
+	level.Set(l)
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(stdout{}, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(stdout{}, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	return &Logger{
+		Logger: slog.New(contextHandler{handler}),
+		level:  level,
+		json:   cfg.Format == FormatJSON,
+		out:    stdout{},
+	}, nil
+}
+
+// Wrap returns a Logger logging through l, whose handler decides the level
+// logged; its level cannot be changed and it takes no Records
+func Wrap(l *slog.Logger) *Logger {
+	return &Logger{Logger: slog.New(contextHandler{l.Handler()})}
+}
+
+// SetLevel changes the minimum level logged, taking effect immediately;
+// an empty name selects info
+func (l *Logger) SetLevel(name string) error {
+	lvl, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	if l.level == nil {
+		return errFixedLevel
+	}
+	l.level.Set(lvl)
+	return nil
+}
+
+// ParseLevel returns the level called name; an empty name is info
+func ParseLevel(name string) (slog.Level, error) {
+	if name == "" {
+		name = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return l, nil
+}
+
+// Level returns the name of the minimum level logged
+func (l *Logger) Level() string {
+	if l.level != nil {
+		return strings.ToLower(l.level.Level().String())
+	}
+	for _, lvl := range []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn} {
+		if l.Handler().Enabled(context.Background(), lvl) {
+			return strings.ToLower(lvl.String())
+		}
+	}
+	return "error"
+}
+
+// Preformatted reports whether l takes Records, which holds for loggers
+// built by New
+func (l *Logger) Preformatted() bool {
+	return l.out != nil
+}
+
+type attrsKey struct{}
+
+// WithAttrs returns a copy of ctx carrying attrs, which every record logged
+// with the context then includes, e.g. the ID of the request being served
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	if parent, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		attrs = append(slices.Clip(parent), attrs...)
+	}
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// contextHandler adds the attributes carried by the context of a record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Record builds a log record in the format of a Logger in a caller-owned
+// buffer, for hot paths that must not allocate; the output matches what the
+// Logger writes for the same attributes
+type Record struct {
+	buf  []byte
+	json bool
+	out  io.Writer
+}
+
+// Start begins a record of log at l with msg, reusing buf; log must be
+// Preformatted
+func (r *Record) Start(log *Logger, buf []byte, l slog.Level, msg string) {
+	now := time.Now()
+	r.json, r.out = log.json, log.out
+	if r.json {
+		r.buf = append(buf[:0], `{"time":"`...)
+		r.buf = now.AppendFormat(r.buf, time.RFC3339Nano)
+		r.buf = append(r.buf, `","level":"`...)
+		r.buf = append(r.buf, l.String()...)
+		r.buf = append(r.buf, `","msg":`...)
+		r.buf = appendJSONString(r.buf, msg)
+		return
+	}
+	r.buf = append(buf[:0], "time="...)
+	r.buf = now.AppendFormat(r.buf, "2006-01-02T15:04:05.000Z07:00")
+	r.buf = append(r.buf, " level="...)
+	r.buf = append(r.buf, l.String()...)
+	r.buf = append(r.buf, " msg="...)
+	r.buf = appendText(r.buf, msg)
+}
+
+// String adds a string attribute
+func (r *Record) String(key, value string) {
+	r.key(key)
+	if r.json {
+		r.buf = appendJSONString(r.buf, value)
+		return
+	}
+	r.buf = appendText(r.buf, value)
+}
+
+// Bytes adds a string attribute held in a byte slice
+func (r *Record) Bytes(key string, value []byte) {
+	r.key(key)
+	if r.json {
+		r.buf = appendJSONString(r.buf, value)
+		return
+	}
+	r.buf = appendText(r.buf, value)
+}
+
+// Int adds an integer attribute
+func (r *Record) Int(key string, value int64) {
+	r.key(key)
+	r.buf = strconv.AppendInt(r.buf, value, 10)
+}
+
+// Float adds a floating-point attribute
+func (r *Record) Float(key string, value float64) {
+	r.key(key)
+	r.buf = strconv.AppendFloat(r.buf, value, 'g', -1, 64)
+}
+
+// key starts an attribute named key
+func (r *Record) key(key string) {
+	if r.json {
+		r.buf = append(r.buf, ',')
+		r.buf = appendJSONString(r.buf, key)
+		r.buf = append(r.buf, ':')
+		return
+	}
+	r.buf = append(r.buf, ' ')
+	r.buf = append(r.buf, key...)
+	r.buf = append(r.buf, '=')
+}
+
+// End terminates the record, writes it to the output of its logger and
+// returns the buffer for reuse
+func (r *Record) End() []byte {
+	if r.json {
+		r.buf = append(r.buf, '}')
+	}
+	r.buf = append(r.buf, '\n')
+	r.out.Write(r.buf)
+	return r.buf
+}
+
+// appendText appends s to b, quoted when the text format needs it to
+// stay parseable
+func appendText[S string | []byte](b []byte, s S) []byte {
+	if !needsQuoting(s) {
+		return append(b, s...)
+	}
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' || c == 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// needsQuoting reports whether s is empty or holds spaces, quotes, equals
+// signs or anything but printable ASCII
+func needsQuoting[S string | []byte](s S) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '=' || c == '"' || c >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// appendJSONString appends s to b as a JSON string
+func appendJSONString[S string | []byte](b []byte, s S) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ':
+			b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
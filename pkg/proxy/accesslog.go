@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Access log formats
+const (
+	// AccessLogCommon is the Apache common log format
+	AccessLogCommon = "common"
+	// AccessLogCombined is the common format followed by the Referer and
+	// User-Agent headers
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes one JSON object per request
+	AccessLogJSON = "json"
+)
+
+// AccessLogConfig controls the access log, which records one entry per
+// request the proxy serves
+type AccessLogConfig struct {
+	// Path of the access log; empty disables it
+	Path string
+	// Format is AccessLogCommon, AccessLogCombined or AccessLogJSON;
+	// combined when empty
+	Format string
+	// MaxBytes rotates the log to Path.1 once it would exceed this size
+	MaxBytes int64
+	// MaxAge rotates the log to Path.1 once it has been written to for
+	// this long, e.g. 24h
+	MaxAge time.Duration
+	// QuietPaths are request paths, e.g. "/healthz", whose successful
+	// responses without a body are not logged, keeping load balancer
+	// health checks out of the log
+	QuietPaths []string
+}
+
+// AccessEntry is one line of the access log in JSON format
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_ms"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Cache     string    `json:"cache,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// openAccessLog validates cfg and opens the log it names
+func openAccessLog(cfg AccessLogConfig) (*logFile, error) {
+	switch cfg.Format {
+	case "", AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+	return openLogFile(cfg.Path, cfg.MaxBytes, cfg.MaxAge)
+}
+
+// withAccessLog serves r with next and writes its access log entry
+func (s *Server) withAccessLog(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		s.logAccess(r, rec.Status(), rec.n, start)
+	}()
+	next(rec, r)
+}
+
+// logAccess writes the access log entry of r, answered with status and n
+// body bytes, unless it is a quiet health check
+func (s *Server) logAccess(r *http.Request, status int, n int64, start time.Time) {
+	cfg := s.cfg.AccessLog
+	if n == 0 && status < http.StatusBadRequest && slices.Contains(cfg.QuietPaths, r.URL.Path) {
+		return
+	}
+	user, _ := Annotation(r, ProxyUserAnnotation)
+	if cfg.Format == AccessLogJSON {
+		cache, _ := Annotation(r, CacheAnnotation)
+		s.accessLog.writeJSON(AccessEntry{
+			Time:      start,
+			Client:    clientIP(r),
+			User:      user,
+			Method:    r.Method,
+			URL:       auditURL(r),
+			Proto:     r.Proto,
+			Status:    status,
+			Bytes:     n,
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Cache:     cache,
+			RequestID: r.Header.Get(requestIDHeader),
+		})
+		return
+	}
+
+	// host ident authuser [time] "request" status bytes
+	buf := getTextBuffer()
+	defer putTextBuffer(buf)
+	line := buf.AvailableBuffer()
+	line = append(line, clientIP(r)...)
+	line = append(line, " - "...)
+	line = appendCommonField(line, user)
+	line = append(line, " ["...)
+	line = start.AppendFormat(line, "02/Jan/2006:15:04:05 -0700")
+	line = append(line, "] "...)
+	line = appendQuotedField(line, r.Method+" "+r.RequestURI+" "+r.Proto)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(status), 10)
+	line = append(line, ' ')
+	if n > 0 {
+		line = strconv.AppendInt(line, n, 10)
+	} else {
+		line = append(line, '-')
+	}
+	if cfg.Format != AccessLogCommon {
+		line = append(line, ' ')
+		line = appendQuotedField(line, r.Referer())
+		line = append(line, ' ')
+		line = appendQuotedField(line, r.UserAgent())
+	}
+	line = append(line, '\n')
+	s.accessLog.writeLine(line)
+	// Keep the grown line for the next user of the buffer
+	buf.Write(line)
+}
+
+// appendCommonField appends an unquoted field, "-" when it is empty
+func appendCommonField(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	return appendEscaped(b, s)
+}
+
+// appendQuotedField appends a quoted field, "-" when it is empty
+func appendQuotedField(b []byte, s string) []byte {
+	b = append(b, '"')
+	if s == "" {
+		b = append(b, '-')
+	} else {
+		b = appendEscaped(b, s)
+	}
+	return append(b, '"')
+}
+
+// appendEscaped appends s with quotes, backslashes and control characters
+// escaped as Apache does
+func appendEscaped(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < ' ' || c == 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
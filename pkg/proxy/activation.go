@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets on
+const listenFDsStart = 3
+
+// activatedListeners returns the listening sockets systemd passed to the
+// process by socket activation, in the order of the socket unit. They let
+// an unprivileged proxy serve privileged ports, and connections queue on
+// them while the proxy restarts. The variables passing them are unset so
+// that child processes do not take them too.
+func activatedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := range n {
+		fd := listenFDsStart + i
+		name := "fd " + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// FileListener duplicates the descriptor
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("socket %s passed by systemd: %w", name, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
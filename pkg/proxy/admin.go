@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AdminStatus is the report of GET /status
+type AdminStatus struct {
+	// Status is "serving", or "draining" once a drain has been requested
+	Status   string       `json:"status"`
+	Uptime   string       `json:"uptime"`
+	InFlight int64        `json:"in_flight"`
+	Cache    CacheStorage `json:"cache"`
+	LogLevel string       `json:"log_level"`
+}
+
+// startAdmin serves the admin API on addr in the background, returning the
+// server so that it can be shut down. When operators is not nil every
+// request must carry one of its tokens.
+func (s *Server) startAdmin(addr string, operators *tokenDatabase) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("POST /drain", s.handleDrain)
+	mux.HandleFunc("DELETE /drain", s.handleResume)
+	mux.HandleFunc("GET /acl", s.handleACLs)
+	mux.HandleFunc("PUT /acl", s.handleReplaceACLs)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("GET /cache", s.handleCacheStorage)
+	mux.HandleFunc("POST /cache/clear", s.handleCacheClear)
+	mux.HandleFunc("GET /bypass", s.handleBypassList)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /capture", s.handleCaptureStatus)
+	mux.HandleFunc("POST /capture", s.handleStartCapture)
+	mux.HandleFunc("DELETE /capture", s.handleStopCapture)
+	mux.HandleFunc("GET /capture/har", s.handleCaptureHAR)
+	mux.HandleFunc("POST /capture/clear", s.handleCaptureClear)
+	mux.HandleFunc("GET /latency", s.handleLatency)
+	mux.HandleFunc("GET /dashboard", handleDashboard)
+	mux.HandleFunc("GET /dashboard/data", s.handleDashboardData)
+	mux.HandleFunc("GET /debug/vars", s.handleVars)
+	mux.HandleFunc("GET /routes", s.handleRouteList)
+	mux.HandleFunc("GET /vhosts", s.handleSiteList)
+	mux.HandleFunc("GET /config", s.handleConfig)
+	mux.HandleFunc("GET /health", s.handleHealth)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("POST /cache/purge", s.handlePurge)
+	mux.HandleFunc("GET /cache/integrity", s.handleIntegrity)
+	mux.HandleFunc("GET /cache/digest", s.handleCacheDigest)
+	mux.HandleFunc("GET /egress", s.handleEgressUsage)
+	mux.HandleFunc("GET /subsystems", handleSubsystems)
+	mux.HandleFunc("GET /breakers", s.handleBreakers)
+	mux.HandleFunc("GET /backends", s.handleBackends)
+	mux.HandleFunc("POST /backends/drain", s.handleDrainBackend)
+	mux.HandleFunc("DELETE /backends/drain", s.handleDrainBackend)
+	mux.HandleFunc("GET /health/upstreams", s.handleUpstreamHealth)
+	mux.HandleFunc("GET /terminations", s.handleTerminations)
+	mux.HandleFunc("GET /stubs", s.handleStubs)
+	mux.HandleFunc("GET /chaos", s.handleChaos)
+	mux.HandleFunc("POST /chaos", s.handleSetChaos)
+	mux.HandleFunc("GET /maintenance", s.handleMaintenance)
+	mux.HandleFunc("POST /maintenance", s.handleSetMaintenance)
+	mux.HandleFunc("DELETE /maintenance", s.handleClearMaintenance)
+	mux.HandleFunc("GET /toggles", s.handleToggles)
+	mux.HandleFunc("POST /toggles", s.handleSetToggle)
+	mux.HandleFunc("DELETE /toggles", s.handleClearToggle)
+	mux.HandleFunc("GET /log-level", s.handleLogLevel)
+	mux.HandleFunc("POST /log-level", s.handleSetLogLevel)
+
+	var handler http.Handler = mux
+	if operators != nil {
+		handler = s.requireOperator(operators, mux)
+	} else {
+		s.log.Warn("Admin API is not authenticated; set AdminTokens unless it is on loopback", "addr", addr)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		ln, err := s.listenGuarded("tcp", addr)
+		if err != nil {
+			s.log.Error("Admin API failed", "err", err)
+			return
+		}
+		s.log.Info("Admin API is running", "addr", addr)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.log.Error("Admin API failed", "err", err)
+		}
+	}()
+	return srv
+}
+
+// requireOperator answers 401 to admin requests without a valid bearer
+// token, and logs the operator behind every change. The dashboard page is
+// exempt, since browsers cannot attach a token when opening it; it holds
+// no data and asks for a token to fetch its figures. So are the probes of
+// orchestrators, /healthz and /readyz.
+func (s *Server) requireOperator(operators *tokenDatabase, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && (r.URL.Path == "/dashboard" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		operator, ok := operators.identify(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			s.log.Info("Admin request", "operator", operator, "method", r.Method, "path", r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// handleBypassList reports the destinations that bypass caching and interception
+func (s *Server) handleBypassList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.bypass.Rules())
+}
+
+// handleRouteList reports the reverse-proxy route table in match order
+func (s *Server) handleRouteList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.routes.Load().Routes())
+}
+
+// handleSiteList reports the virtual hosts in force
+func (s *Server) handleSiteList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.routes.Load().Sites())
+}
+
+// handleConfig reports the active configuration
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.activeConfig())
+}
+
+// activeConfig returns the configuration with the reloaded settings and
+// ACLs in force and secrets masked
+func (s *Server) activeConfig() Config {
+	cfg := s.cfg
+	if r := s.reloaded.Load(); r != nil {
+		cfg.Routes, cfg.VirtualHosts, cfg.RateLimit, cfg.Blocklist = r.Routes, r.VirtualHosts, r.RateLimit, r.Blocklist
+	}
+	cfg.Logging.Level = s.log.Level()
+	if acls := s.activeACLs.Load(); acls != nil {
+		cfg.ClientACL, cfg.ListenerACLs, cfg.DestinationACL = acls.ClientACL, acls.ListenerACLs, acls.DestinationACL
+	}
+	cfg.AdminTokens = maskSecrets(cfg.AdminTokens)
+	cfg.TokenAuth.Identities = maskSecrets(cfg.TokenAuth.Identities)
+	cfg.ErrorReporting.DSN = maskURL(cfg.ErrorReporting.DSN)
+	cfg.ParentProxy.URL = maskURL(cfg.ParentProxy.URL)
+	cfg.Tracing.Headers = maskSecrets(cfg.Tracing.Headers)
+	cfg.Routes = maskRoutes(cfg.Routes)
+	cfg.VirtualHosts = slices.Clone(cfg.VirtualHosts)
+	for i := range cfg.VirtualHosts {
+		site := &cfg.VirtualHosts[i]
+		site.Routes = maskRoutes(site.Routes)
+		site.RequestHeaders = site.RequestHeaders.masked()
+	}
+	cfg.HostHeaders = slices.Clone(cfg.HostHeaders)
+	for i := range cfg.HostHeaders {
+		cfg.HostHeaders[i].Request = cfg.HostHeaders[i].Request.masked()
+	}
+	return cfg
+}
+
+// maskRoutes returns a copy of routes with their login forms and the
+// header values they send to backends masked
+func maskRoutes(routes []Route) []Route {
+	routes = slices.Clone(routes)
+	for i := range routes {
+		route := &routes[i]
+		if route.Session != nil {
+			session := *route.Session
+			session.Form = maskSecrets(session.Form)
+			route.Session = &session
+		}
+		route.RequestHeaders = route.RequestHeaders.masked()
+	}
+	return routes
+}
+
+// masked returns the rules with the values they set or add masked, since
+// requests may carry credentials that way; response rules, which every
+// client sees, are reported as they are
+func (rules HeaderRules) masked() HeaderRules {
+	rules.Set = maskSecrets(rules.Set)
+	rules.Add = maskSecrets(rules.Add)
+	return rules
+}
+
+// maskURL returns raw with the user information masked
+func maskURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return strings.Replace(raw, u.User.String()+"@", maskedValue+"@", 1)
+}
+
+// maskSecrets returns secrets with the values masked, except references
+// to environment variables
+func maskSecrets(secrets map[string]string) map[string]string {
+	if secrets == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(secrets))
+	for name, secret := range secrets {
+		if !strings.HasPrefix(secret, "$") {
+			secret = maskedValue
+		}
+		masked[name] = secret
+	}
+	return masked
+}
+
+// handleHealth reports whether the proxy is serving, failing once it is
+// draining
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+		return
+	}
+	writeJSON(w, map[string]string{"status": "serving"})
+}
+
+// handleStatus reports the state of the proxy
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := "serving"
+	if s.draining.Load() {
+		status = "draining"
+	}
+	writeJSON(w, AdminStatus{
+		Status:   status,
+		Uptime:   time.Since(s.started).Round(time.Second).String(),
+		InFlight: s.stats.InFlight.Load(),
+		Cache:    s.cache.Storage(),
+		LogLevel: s.log.Level(),
+	})
+}
+
+// handleDrain starts draining the proxy ahead of a shutdown
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	s.draining.Store(true)
+	s.log.Info("Draining")
+	s.handleStatus(w, r)
+}
+
+// handleResume stops draining
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	s.draining.Store(false)
+	s.log.Info("Drain cancelled")
+	s.handleStatus(w, r)
+}
+
+// handleACLs reports the access control lists in force
+func (s *Server) handleACLs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.activeACLs.Load())
+}
+
+// handleReplaceACLs puts the access control lists in the request body in
+// force, replacing all of them; new client rules apply to connections
+// accepted from then on
+func (s *Server) handleReplaceACLs(w http.ResponseWriter, r *http.Request) {
+	var acls ACLs
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&acls); err != nil {
+		http.Error(w, "Invalid ACLs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.applyACLs(acls); err != nil {
+		http.Error(w, "Invalid ACLs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.log.Info("ACLs replaced")
+	s.handleACLs(w, r)
+}
+
+// handleCacheStorage reports the entries and bytes held by the memory cache
+func (s *Server) handleCacheStorage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.cache.Storage())
+}
+
+// handleCacheClear empties the memory cache and the disk tier
+func (s *Server) handleCacheClear(w http.ResponseWriter, r *http.Request) {
+	keys := s.cache.Keys()
+	if s.diskCache != nil {
+		keys = append(keys, s.diskCache.Keys()...)
+	}
+	purged := 0
+	for _, key := range keys {
+		if s.cacheDelete(key) {
+			purged++
+		}
+	}
+	s.log.Info("Cache cleared", "entries", purged)
+	writeJSON(w, map[string]int{"purged": purged})
+}
+
+// handleLogLevel reports the minimum level logged
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"level": s.log.Level()})
+}
+
+// handleSetLogLevel changes the minimum level logged, e.g.
+// POST /log-level?level=debug
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if err := s.log.SetLevel(r.URL.Query().Get("level")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.log.Info("Log level changed", "level", s.log.Level())
+	s.handleLogLevel(w, r)
+}
+
+// handlePurge removes the URL given by the url query parameter from the cache
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("url")
+	if key == "" {
+		http.Error(w, "Missing url parameter", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]bool{"purged": s.cacheDelete(key)})
+}
+
+// handleIntegrity reports the result of the startup disk cache check
+func (s *Server) handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	if s.diskCache == nil {
+		http.Error(w, "Disk cache not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.integrity)
+}
+
+// handleSubsystems reports the optional subsystems compiled into the binary
+func handleSubsystems(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Subsystems())
+}
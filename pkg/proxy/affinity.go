@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Session affinity modes of a load-balanced route
+const (
+	// AffinityCookie pins clients to a backend with a cookie the proxy sets
+	AffinityCookie = "cookie"
+	// AffinityClientIP pins clients to a backend by a hash of their
+	// address, which moves only the clients of a backend that leaves
+	// rotation
+	AffinityClientIP = "client_ip"
+)
+
+// AffinityConfig keeps the clients of a load-balanced route on the same
+// backend, for stateful backends. Clients of a backend that is drained or
+// fails its health checks are assigned another one, to which they then
+// stick.
+type AffinityConfig struct {
+	// Mode is AffinityCookie or AffinityClientIP
+	Mode string `json:"mode"`
+	// Cookie names the cookie of AffinityCookie; it defaults to
+	// "proxy_backend"
+	Cookie string `json:"cookie,omitempty"`
+	// MaxAge is the lifetime of the cookie; zero ends it with the browser
+	// session
+	MaxAge time.Duration `json:"max_age,omitempty"`
+}
+
+// withDefaults validates cfg and fills in its defaults
+func (cfg AffinityConfig) withDefaults() (AffinityConfig, error) {
+	switch cfg.Mode {
+	case AffinityCookie:
+		if cfg.Cookie == "" {
+			cfg.Cookie = "proxy_backend"
+		}
+	case AffinityClientIP:
+	default:
+		return cfg, fmt.Errorf("unknown affinity mode %q", cfg.Mode)
+	}
+	if cfg.MaxAge < 0 {
+		return cfg, fmt.Errorf("negative affinity max age")
+	}
+	return cfg, nil
+}
+
+// backendToken identifies a backend in affinity cookies without revealing
+// its address
+func backendToken(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pickBackend chooses the backend of the route for r, keeping the client
+// on the one it is pinned to while that one is in rotation, unless r
+// forces another version
+func (route *Route) pickBackend(w http.ResponseWriter, r *http.Request) *poolBackend {
+	version, forced := route.version(r)
+	a := route.Affinity
+	if a == nil {
+		return route.pool.pick(version)
+	}
+	if a.Mode == AffinityClientIP {
+		return route.pool.pickHashed(clientIP(r), version)
+	}
+	pinned := ""
+	if c, err := r.Cookie(a.Cookie); err == nil {
+		keep := ""
+		if forced {
+			keep = version
+		}
+		if b := route.pool.pickPinned(c.Value, keep); b != nil {
+			return b
+		}
+		pinned = c.Value
+	}
+	b := route.pool.pick(version)
+	if pinned != "" {
+		route.pool.log.DebugContext(r.Context(), "Client reassigned to another backend", "route", route.Name, "backend", b.name)
+	}
+	cookie := &http.Cookie{Name: a.Cookie, Value: b.token, Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode}
+	if a.MaxAge > 0 {
+		cookie.MaxAge = int(a.MaxAge / time.Second)
+	}
+	http.SetCookie(w, cookie)
+	return b
+}
+
+// pickPinned is pick for the backend whose token is token while it is in
+// rotation and, unless version is empty, of version, or nil
+func (p *backendPool) pickPinned(token, version string) *poolBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, b := range p.backends {
+		if b.token == token && b.inRotation(now) && (version == "" || b.version == version) {
+			b.active++
+			return b
+		}
+	}
+	return nil
+}
+
+// pickHashed is pick for the candidate backend that key hashes to, by
+// weighted rendezvous hashing
+func (p *backendPool) pickHashed(key, version string) *poolBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var chosen *poolBackend
+	var best uint64
+	for _, b := range p.candidates(version, time.Now()) {
+		sum := sha256.Sum256([]byte(key + "\x00" + b.name))
+		score := binary.BigEndian.Uint64(sum[:8]) / uint64(b.weight)
+		if chosen == nil || score < best {
+			chosen, best = b, score
+		}
+	}
+	chosen.active++
+	return chosen
+}
+
+// setDraining takes the backend called name out of rotation, or returns
+// it, reporting whether the pool has one
+func (p *backendPool) setDraining(name string, draining bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		if b.name == name {
+			b.draining = draining
+			return true
+		}
+	}
+	return false
+}
+
+// handleDrainBackend drains the backend given by the backend query
+// parameter on the route given by route, e.g.
+// POST /backends/drain?route=api&backend=api-2: it gets no new clients,
+// and those pinned to it move to other backends, while its requests in
+// flight finish. Draining lasts until it is cancelled with DELETE or the
+// routes are reloaded.
+func (s *Server) handleDrainBackend(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name, backend := query.Get("route"), query.Get("backend")
+	drain := r.Method != http.MethodDelete
+	found := false
+	for _, route := range s.routes.Load().routes {
+		if route.Name == name && route.pool != nil && route.pool.setDraining(backend, drain) {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "No such backend", http.StatusNotFound)
+		return
+	}
+	if drain {
+		s.log.Info("Draining backend", "route", name, "backend", backend)
+	} else {
+		s.log.Info("Backend drain cancelled", "route", name, "backend", backend)
+	}
+	s.handleBackends(w, r)
+}
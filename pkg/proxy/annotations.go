@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// AnnotationKey identifies a typed request annotation. Keys are compared by
+// identity, so declare each one once as a package-level variable.
+type AnnotationKey[T any] struct {
+	// Name labels the annotation in logs
+	Name string
+}
+
+// NewAnnotationKey returns a key for annotations of type T
+func NewAnnotationKey[T any](name string) *AnnotationKey[T] {
+	return &AnnotationKey[T]{Name: name}
+}
+
+// Annotations is the per-request store shared by middlewares, hooks and
+// the logger, so metadata such as an authenticated identity travels with
+// the request instead of in headers
+type Annotations struct {
+	mu     sync.Mutex
+	values map[any]any
+	names  map[any]string
+}
+
+type annotationsKey struct{}
+
+// WithAnnotations returns r with an empty annotation store, or r itself
+// when it already has one
+func WithAnnotations(r *http.Request) *http.Request {
+	if annotationsOf(r) != nil {
+		return r
+	}
+	a := &Annotations{values: make(map[any]any), names: make(map[any]string)}
+	return r.WithContext(context.WithValue(r.Context(), annotationsKey{}, a))
+}
+
+// annotationsOf returns the annotation store of r, if it has one
+func annotationsOf(r *http.Request) *Annotations {
+	a, _ := r.Context().Value(annotationsKey{}).(*Annotations)
+	return a
+}
+
+// Annotate sets the annotation key of r to v. It does nothing for requests
+// that were not given a store with WithAnnotations.
+func Annotate[T any](r *http.Request, key *AnnotationKey[T], v T) {
+	a := annotationsOf(r)
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.values[key] = v
+	a.names[key] = key.Name
+}
+
+// Annotation returns the annotation key of r and whether it is set
+func Annotation[T any](r *http.Request, key *AnnotationKey[T]) (T, bool) {
+	var zero T
+	a := annotationsOf(r)
+	if a == nil {
+		return zero, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	v, ok := a.values[key]
+	if !ok {
+		return zero, false
+	}
+	return v.(T), true
+}
+
+// Snapshot returns the annotations keyed by name, for logging
+func (a *Annotations) Snapshot() map[string]any {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.values) == 0 {
+		return nil
+	}
+	out := make(map[string]any, len(a.values))
+	for key, v := range a.values {
+		out[a.names[key]] = v
+	}
+	return out
+}
+
+// Annotations set by the proxy itself
+var (
+	// RouteAnnotation is the name of the route that matched the request
+	RouteAnnotation = NewAnnotationKey[string]("route")
+	// TenantAnnotation is the tenant the request is accounted to
+	TenantAnnotation = NewAnnotationKey[string]("tenant")
+	// ClientSubjectAnnotation is the subject of the client certificate
+	ClientSubjectAnnotation = NewAnnotationKey[string]("client_subject")
+	// ProxyUserAnnotation is the user the client authenticated to the proxy as
+	ProxyUserAnnotation = NewAnnotationKey[string]("proxy_user")
+	// TrafficClassAnnotation is the configured traffic class of the request
+	TrafficClassAnnotation = NewAnnotationKey[string]("class")
+	// CacheAnnotation is "hit" or "miss" for requests the cache could answer
+	CacheAnnotation = NewAnnotationKey[string]("cache")
+)
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// AuditLogConfig controls the audit log of refused requests, kept apart
+// from the access log so denials can be retained and reviewed on their own
+type AuditLogConfig struct {
+	// Path of the JSON-lines audit log; empty disables it
+	Path string
+	// MaxBytes bounds the log; when exceeded it is rotated to Path.1
+	MaxBytes int64
+}
+
+// Audit events, naming the mechanism that refused a request
+const (
+	AuditClientACL      = "client_acl"
+	AuditDestinationACL = "destination_acl"
+	AuditBlocklist      = "blocklist"
+	AuditGeoIP          = "geoip"
+	AuditAuth           = "auth"
+	AuditRateLimit      = "rate_limit"
+	AuditLoadShed       = "load_shed"
+	AuditEgressBudget   = "egress_budget"
+	AuditSSRF           = "ssrf"
+	AuditSchemePolicy   = "scheme_policy"
+	AuditContentType    = "content_type"
+	AuditContentFilter  = "content_filter"
+	AuditICAP           = "icap"
+	AuditScript         = "script"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Rule is the rule or reason behind the refusal
+	Rule   string `json:"rule,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Client string `json:"client"`
+	// Identity is the authenticated proxy user or token identity
+	Identity string `json:"identity,omitempty"`
+	// Subject is the verified client certificate subject
+	Subject   string `json:"subject,omitempty"`
+	Method    string `json:"method,omitempty"`
+	URL       string `json:"url,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// auditRequest records that r was refused with status by the mechanism
+// event under rule
+func (s *Server) auditRequest(r *http.Request, event, rule string, status int) {
+	if s.auditLog == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:      time.Now(),
+		Event:     event,
+		Rule:      rule,
+		Status:    status,
+		Client:    clientIP(r),
+		Subject:   clientSubject(r),
+		Method:    r.Method,
+		URL:       auditURL(r),
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+	if user, ok := Annotation(r, ProxyUserAnnotation); ok {
+		entry.Identity = user
+	}
+	s.auditLog.writeJSON(entry)
+}
+
+// auditConnection records a refused connection or tunnel that carries no
+// HTTP request, such as SOCKS5 and transparent sessions
+func (s *Server) auditConnection(client, target, event, rule string) {
+	if s.auditLog == nil {
+		return
+	}
+	s.auditLog.writeJSON(AuditEntry{Time: time.Now(), Event: event, Rule: rule, Client: client, URL: target})
+}
+
+// auditURL returns the target of r as the client named it
+func auditURL(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodConnect:
+		return r.Host
+	case r.URL.IsAbs():
+		return r.URL.String()
+	}
+	return r.Host + r.URL.RequestURI()
+}
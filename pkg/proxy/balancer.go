@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies of a route with several backends
+const (
+	// BalanceRoundRobin sends requests to each backend in turn
+	BalanceRoundRobin = "round_robin"
+	// BalanceLeastConn sends requests to the backend with the fewest
+	// requests in flight relative to its weight
+	BalanceLeastConn = "least_conn"
+	// BalanceWeighted spreads requests in proportion to backend weights
+	BalanceWeighted = "weighted"
+)
+
+// Backend is one replica serving a route
+type Backend struct {
+	// Name identifies the replica in upstream overrides; it defaults to the
+	// host of URL
+	Name string `json:"name,omitempty"`
+	// URL is the replica's base URL, e.g. http://api-2:9000
+	URL string `json:"url"`
+	// Weight defaults to 1
+	Weight int `json:"weight,omitempty"`
+	// Version is the release the replica runs, which a route's
+	// TrafficSplit divides requests by
+	Version string `json:"version,omitempty"`
+}
+
+// Passive health checking: a backend failing this many requests in a row is
+// taken out of rotation for backendEjectFor
+const (
+	backendMaxFails = 3
+	backendEjectFor = 10 * time.Second
+)
+
+// poolBackend is a backend and its balancing state
+type poolBackend struct {
+	name    string
+	url     *url.URL
+	weight  int
+	version string
+	// token identifies the backend in affinity cookies
+	token string
+	// draining takes the backend out of rotation at an operator's request
+	draining bool
+
+	active    int
+	current   int
+	fails     int
+	downUntil time.Time
+
+	// Active health check state
+	checkedDown bool
+	rises       int
+	falls       int
+	lastCheck   time.Time
+	checkError  string
+}
+
+// available reports whether b is healthy
+func (b *poolBackend) available(now time.Time) bool {
+	return now.After(b.downUntil) && !b.checkedDown
+}
+
+// inRotation reports whether b is healthy and not draining
+func (b *poolBackend) inRotation(now time.Time) bool {
+	return b.available(now) && !b.draining
+}
+
+// backendPool balances the requests of one route over its backends
+type backendPool struct {
+	strategy string
+	log      *slog.Logger
+
+	mu       sync.Mutex
+	backends []*poolBackend
+	next     int
+}
+
+// newBackendPool parses the backends of a route
+func newBackendPool(strategy string, backends []Backend) (*backendPool, error) {
+	switch strategy {
+	case "":
+		strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceWeighted:
+	default:
+		return nil, fmt.Errorf("unknown balance strategy %q", strategy)
+	}
+
+	p := &backendPool{strategy: strategy}
+	for _, b := range backends {
+		u, err := url.Parse(b.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend %q", b.URL)
+		}
+		if b.Weight < 0 {
+			return nil, fmt.Errorf("backend %q has a negative weight", b.URL)
+		}
+		name := b.Name
+		if name == "" {
+			name = u.Host
+		}
+		p.backends = append(p.backends, &poolBackend{name: name, url: u, weight: max(b.Weight, 1), version: b.Version, token: backendToken(name)})
+	}
+	return p, nil
+}
+
+// candidates returns the backends of version, or of any version when it is
+// empty, that are in rotation. Without any it falls back to the backends
+// of other versions in rotation and then to every backend, which is tried
+// rather than failing outright.
+func (p *backendPool) candidates(version string, now time.Time) []*poolBackend {
+	candidates := make([]*poolBackend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.inRotation(now) && (version == "" || b.version == version) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 && version != "" {
+		return p.candidates("", now)
+	}
+	if len(candidates) == 0 {
+		return p.backends
+	}
+	return candidates
+}
+
+// pick chooses a backend of version, or of any version when it is empty,
+// for a request and counts it as active until release
+func (p *backendPool) pick(version string) *poolBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := p.candidates(version, time.Now())
+
+	var chosen *poolBackend
+	switch p.strategy {
+	case BalanceLeastConn:
+		// Start from a rotating offset so ties are shared
+		p.next++
+		for i := range candidates {
+			b := candidates[(p.next+i)%len(candidates)]
+			if chosen == nil || b.active*chosen.weight < chosen.active*b.weight {
+				chosen = b
+			}
+		}
+	case BalanceWeighted:
+		// Smooth weighted round-robin, which interleaves heavier backends
+		// instead of sending them bursts
+		total := 0
+		for _, b := range candidates {
+			b.current += b.weight
+			total += b.weight
+			if chosen == nil || b.current > chosen.current {
+				chosen = b
+			}
+		}
+		chosen.current -= total
+	default:
+		chosen = candidates[p.next%len(candidates)]
+		p.next++
+	}
+	chosen.active++
+	return chosen
+}
+
+// pickNamed is pick for the backend called name, whether or not it is in
+// rotation, or nil when there is none
+func (p *backendPool) pickNamed(name string) *poolBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		if b.name == name {
+			b.active++
+			return b
+		}
+	}
+	return nil
+}
+
+// release ends a request started by pick
+func (p *backendPool) release(b *poolBackend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active--
+}
+
+// report records whether a request to the backend at host reached it,
+// taking backends that keep failing out of rotation
+func (p *backendPool) report(host string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		if b.url.Host != host {
+			continue
+		}
+		if ok {
+			b.fails = 0
+			continue
+		}
+		b.fails++
+		if b.fails >= backendMaxFails {
+			b.downUntil = time.Now().Add(backendEjectFor)
+			p.log.Warn("Backend taken out of rotation", "backend", b.url.String())
+		}
+	}
+}
+
+// BackendStatus describes a backend for the admin API
+type BackendStatus struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Weight  int    `json:"weight"`
+	Version string `json:"version,omitempty"`
+	Active  int    `json:"active"`
+	Healthy bool   `json:"healthy"`
+	// Draining is set while an operator drains the backend
+	Draining bool `json:"draining,omitempty"`
+	// LastCheck and CheckError describe the latest active health check
+	LastCheck  *time.Time `json:"last_check,omitempty"`
+	CheckError string     `json:"check_error,omitempty"`
+}
+
+// status returns the state of every backend in the pool
+func (p *backendPool) status() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	out := make([]BackendStatus, len(p.backends))
+	for i, b := range p.backends {
+		out[i] = BackendStatus{Name: b.name, URL: b.url.String(), Weight: b.weight, Version: b.version, Active: b.active, Healthy: b.available(now), Draining: b.draining, CheckError: b.checkError}
+		if !b.lastCheck.IsZero() {
+			out[i].LastCheck = &b.lastCheck
+		}
+	}
+	return out
+}
+
+// handleBackends reports the backends of every load-balanced route
+func (s *Server) handleBackends(w http.ResponseWriter, r *http.Request) {
+	out := make(map[string][]BackendStatus)
+	for _, route := range s.routes.Load().Routes() {
+		if route.pool != nil {
+			out[route.Name] = route.pool.status()
+		}
+	}
+	writeJSON(w, out)
+}
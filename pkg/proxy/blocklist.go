@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// BlocklistConfig turns the proxy into a network-level ad and tracker
+// blocker. Requests to listed hosts and their subdomains are answered at
+// once; tunnels to them are refused.
+type BlocklistConfig struct {
+	// Sources are files or http(s) URLs of hosts files ("0.0.0.0
+	// ads.example"), plain domain lists or EasyList-style filter lists, of
+	// which the "||domain^" rules and their "@@" exceptions are used
+	Sources []string
+	// Refresh reloads the sources this often; zero loads them once
+	Refresh time.Duration
+	// Status answers blocked requests; it defaults to 204
+	Status int
+}
+
+// blockedHosts is one loaded generation of the blocklist
+type blockedHosts struct {
+	blocked map[string]struct{}
+	allowed map[string]struct{}
+}
+
+// hostBlocklist holds the current generation, swapped on refresh
+type hostBlocklist struct {
+	sources []string
+	status  int
+	hosts   atomic.Pointer[blockedHosts]
+	// retired is closed when a reload replaces the blocklist, stopping
+	// its refreshes
+	retired chan struct{}
+}
+
+// loadHostBlocklist loads the sources of cfg, failing when one cannot be
+// loaded
+func (s *Server) loadHostBlocklist(cfg BlocklistConfig) (*hostBlocklist, error) {
+	b := &hostBlocklist{sources: cfg.Sources, status: cfg.Status, retired: make(chan struct{})}
+	if b.status == 0 {
+		b.status = http.StatusNoContent
+	}
+	hosts, err := s.loadBlocklist(cfg.Sources)
+	if err != nil {
+		return nil, err
+	}
+	b.hosts.Store(hosts)
+	s.log.Info("Blocklist loaded", "hosts", len(hosts.blocked))
+	return b, nil
+}
+
+// refreshBlocklist reloads the sources of b every interval, if positive,
+// until b is retired or the server shuts down. Failures keep the previous
+// generation.
+func (s *Server) refreshBlocklist(b *hostBlocklist, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.goBackground(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.retired:
+				return
+			case <-s.background.Done():
+				return
+			}
+			hosts, err := s.loadBlocklist(b.sources)
+			if err != nil {
+				s.log.Warn("Blocklist refresh failed", "err", err)
+				continue
+			}
+			b.hosts.Store(hosts)
+		}
+	})
+}
+
+// replaceBlocklist puts b in force, nil disabling blocking, and retires
+// the blocklist it replaces
+func (s *Server) replaceBlocklist(b *hostBlocklist) {
+	if old := s.blocklist.Swap(b); old != nil && old != b {
+		close(old.retired)
+	}
+}
+
+// loadBlocklist reads and merges all sources
+func (s *Server) loadBlocklist(sources []string) (*blockedHosts, error) {
+	hosts := &blockedHosts{blocked: make(map[string]struct{}), allowed: make(map[string]struct{})}
+	for _, source := range sources {
+		if err := s.readBlocklistSource(source, hosts); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+	}
+	return hosts, nil
+}
+
+// readBlocklistSource adds the rules of one file or URL to hosts
+func (s *Server) readBlocklistSource(source string, hosts *blockedHosts) error {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := s.client.Get(source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		host, allow := parseBlocklistLine(scanner.Text())
+		switch {
+		case host == "":
+		case allow:
+			hosts.allowed[host] = struct{}{}
+		default:
+			hosts.blocked[host] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseBlocklistLine returns the host a line blocks, or allows for an
+// exception rule, and "" for comments and rules it does not understand
+func parseBlocklistLine(line string) (host string, allow bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return "", false
+	}
+	if rule, ok := strings.CutPrefix(line, "||"); ok || strings.HasPrefix(line, "@@||") {
+		// EasyList network rule; only plain domain anchors without options
+		// are unambiguous at the host level
+		if !ok {
+			rule, allow = line[len("@@||"):], true
+		}
+		host, ok = strings.CutSuffix(rule, "^")
+		if !ok || strings.ContainsAny(host, "/*$^|") {
+			return "", false
+		}
+		return strings.ToLower(host), allow
+	}
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") {
+		return "", false
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+		host = fields[1]
+	case len(fields) == 1:
+		host = fields[0]
+	default:
+		return "", false
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" || strings.ContainsAny(host, "/:*") || !strings.Contains(host, ".") {
+		return "", false
+	}
+	return host, false
+}
+
+// blocks reports whether host or one of its parent domains is listed and
+// not excepted
+func (b *hostBlocklist) blocks(host string) bool {
+	hosts := b.hosts.Load()
+	host = strings.ToLower(strings.TrimSuffix(utils.StripPort(host), "."))
+	for name := host; name != ""; {
+		if _, found := hosts.allowed[name]; found {
+			return false
+		}
+		if _, found := hosts.blocked[name]; found {
+			return true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	return false
+}
+
+// checkBlocklist answers requests to blocked hosts and reports whether r
+// may proceed. Tunnels are refused with 403, as they cannot carry an
+// empty answer.
+func (s *Server) checkBlocklist(w http.ResponseWriter, r *http.Request, host string) bool {
+	b := s.blocklist.Load()
+	if b == nil || !b.blocks(host) {
+		return true
+	}
+	s.stats.Blocklisted.Add(1)
+	s.log.InfoContext(r.Context(), "Blocklisted", "host", host)
+	w.Header().Set(denyReasonHeader, "blocklisted")
+	if r.Method == http.MethodConnect {
+		s.auditRequest(r, AuditBlocklist, host, http.StatusForbidden)
+		s.httpError(w, r, "Destination blocklisted", http.StatusForbidden)
+		return false
+	}
+	s.auditRequest(r, AuditBlocklist, host, b.status)
+	w.WriteHeader(b.status)
+	return false
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerConfig controls the per-host circuit breaker, which fails requests
+// fast with 503 while an origin is failing so it cannot tie up workers and
+// client connections
+type BreakerConfig struct {
+	Enabled bool `json:"enabled"`
+	// FailureRate opens the circuit once this fraction of requests in a
+	// window failed, e.g. 0.5; connection errors, timeouts and 5xx
+	// responses count as failures
+	FailureRate float64 `json:"failure_rate"`
+	// MinRequests is how many requests a window needs before its failure
+	// rate is judged
+	MinRequests int `json:"min_requests"`
+	// Window is the period over which the failure rate is measured
+	Window time.Duration `json:"window"`
+	// OpenFor is how long the circuit stays open before probing
+	OpenFor time.Duration `json:"open_for"`
+	// HalfOpenProbes is how many requests may probe a recovering origin at
+	// once; the first success closes the circuit and a failure reopens it
+	HalfOpenProbes int `json:"half_open_probes"`
+}
+
+// Validate reports settings under which the breaker cannot work
+func (cfg BreakerConfig) Validate() error {
+	switch {
+	case !cfg.Enabled:
+		return nil
+	case cfg.FailureRate <= 0 || cfg.FailureRate > 1:
+		return fmt.Errorf("breaker failure rate %v is not in (0, 1]", cfg.FailureRate)
+	case cfg.MinRequests < 1 || cfg.HalfOpenProbes < 1:
+		return fmt.Errorf("breaker needs at least one request and one probe")
+	case cfg.Window <= 0 || cfg.OpenFor <= 0:
+		return fmt.Errorf("breaker window and open duration must be positive")
+	}
+	return nil
+}
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker tracks the failure rate of one origin
+type CircuitBreaker struct {
+	cfg BreakerConfig
+	log *slog.Logger
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	total       int
+	failures    int
+	openedAt    time.Time
+	probes      int
+}
+
+// NewCircuitBreaker returns a closed breaker
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{cfg: cfg, log: slog.Default(), state: BreakerClosed, windowStart: time.Now()}
+}
+
+// Allow reports whether a request may go to the origin. While half-open
+// it reserves one of the probes, which Record must release.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.cfg.OpenFor {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.cfg.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Record notes the outcome of a request that Allow let through
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probes--
+		if success {
+			b.state = BreakerClosed
+			b.windowStart, b.total, b.failures = now, 0, 0
+		} else {
+			b.state, b.openedAt = BreakerOpen, now
+		}
+		return
+	case BreakerOpen:
+		// A request admitted before the circuit opened
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.windowStart, b.total, b.failures = now, 0, 0
+	}
+	b.total++
+	if !success {
+		b.failures++
+	}
+	if b.total >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.FailureRate*float64(b.total) {
+		b.state, b.openedAt = BreakerOpen, now
+		b.log.Warn("Circuit opened", "failures", b.failures, "requests", b.total)
+	}
+}
+
+// Forget releases a request that Allow let through without judging the
+// origin by it, such as one the client abandoned
+func (b *CircuitBreaker) Forget() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probes--
+	}
+}
+
+// BreakerStatus describes a breaker for the admin API
+type BreakerStatus struct {
+	State    string `json:"state"`
+	Requests int    `json:"requests"`
+	Failures int    `json:"failures"`
+	// RetryIn is how long an open circuit stays open
+	RetryIn string `json:"retry_in,omitempty"`
+}
+
+// Status returns the current state of the breaker
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerStatus{State: b.state, Requests: b.total, Failures: b.failures}
+	if b.state == BreakerOpen {
+		s.RetryIn = max(b.cfg.OpenFor-time.Since(b.openedAt), 0).Round(time.Second).String()
+	}
+	return s
+}
+
+// retryAfter is how long until an open breaker probes again
+func (b *CircuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.cfg.OpenFor-time.Since(b.openedAt), 0)
+}
+
+// breakerTable holds a breaker per policy and origin host
+type breakerTable struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// breakerFor returns the breaker for requests to host under policy p, or
+// nil when no breaker applies. A policy's breaker settings override the
+// global ones, and its origins get breakers of their own.
+func (s *Server) breakerFor(p *Policy, host string) *CircuitBreaker {
+	cfg, key := s.cfg.CircuitBreaker, host
+	if p != nil && p.Breaker != nil {
+		cfg, key = *p.Breaker, p.Name+"|"+host
+	}
+	if !cfg.Enabled {
+		return nil
+	}
+
+	s.breakers.mu.Lock()
+	defer s.breakers.mu.Unlock()
+	b, found := s.breakers.breakers[key]
+	if !found {
+		b = NewCircuitBreaker(cfg)
+		b.log = s.log.With("origin", host)
+		s.breakers.breakers[key] = b
+	}
+	return b
+}
+
+// rejectOpenCircuit answers a request refused by an open breaker
+func (s *Server) rejectOpenCircuit(w http.ResponseWriter, r *http.Request, b *CircuitBreaker) {
+	s.stats.BreakerRejected.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(b.retryAfter().Seconds())+1))
+	s.httpError(w, r, "Upstream circuit open", http.StatusServiceUnavailable)
+}
+
+// handleBreakers reports the state of every circuit breaker
+func (s *Server) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	s.breakers.mu.Lock()
+	out := make(map[string]BreakerStatus, len(s.breakers.breakers))
+	for key, b := range s.breakers.breakers {
+		out[key] = b.Status()
+	}
+	s.breakers.mu.Unlock()
+	writeJSON(w, out)
+}
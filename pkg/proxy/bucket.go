@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket refilled continuously at a fixed rate
+type TokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+// NewTokenBucket creates a full bucket holding capacity tokens and refilled
+// at rate tokens per second
+func NewTokenBucket(capacity, rate float64) *TokenBucket {
+	return &TokenBucket{capacity: capacity, rate: rate, tokens: capacity, last: time.Now()}
+}
+
+// refill adds the tokens earned since the last update; b.mu must be held
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Take removes n tokens if they are available
+func (b *TokenBucket) Take(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Charge removes n tokens unconditionally, letting the bucket go into debt
+// that must be repaid before the next Take succeeds
+func (b *TokenBucket) Charge(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= n
+}
+
+// Available returns the current number of tokens, negative when in debt
+func (b *TokenBucket) Available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+// Wait returns how long until n tokens are available
+func (b *TokenBucket) Wait(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens >= n || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
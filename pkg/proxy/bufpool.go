@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers used for the length of one request are pooled, since under load
+// allocating them per request costs GC work shared by every request.
+// Buffers whose contents outlive the request, such as cached bodies, are
+// not: they are allocated at their final size instead.
+
+// copyBufferSize is the size of the buffers bodies are copied through
+const copyBufferSize = 32 << 10
+
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// getCopyBuffer returns a buffer to copy a body through, to be returned
+// with putCopyBuffer
+func getCopyBuffer() *[]byte {
+	return copyBuffers.Get().(*[]byte)
+}
+
+func putCopyBuffer(buf *[]byte) {
+	copyBuffers.Put(buf)
+}
+
+// maxPooledBuffer bounds the buffers returned to textBuffers, so that one
+// large page does not stay pinned in the pool
+const maxPooledBuffer = 64 << 10
+
+var textBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// getTextBuffer returns an empty buffer for a log line, a rendered page or
+// the like, to be returned with putTextBuffer once written out
+func getTextBuffer() *bytes.Buffer {
+	return textBuffers.Get().(*bytes.Buffer)
+}
+
+func putTextBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	textBuffers.Put(buf)
+}
+
+// maxPresize bounds the buffer readSized allocates up front, so that a
+// false Content-Length cannot make it allocate much
+const maxPresize = 8 << 20
+
+// readSized reads r to the end like io.ReadAll, allocating size bytes at
+// once when size, the expected length, is known, rather than growing the
+// buffer as it fills
+func readSized(r io.Reader, size int64) ([]byte, error) {
+	if size <= 0 || size > maxPresize {
+		return io.ReadAll(r)
+	}
+	// One spare byte lets the read that reports EOF find room
+	buf := make([]byte, 0, size+1)
+	for {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// BypassRule names a destination that must never be cached, transformed or
+// intercepted, such as banking, healthcare or OS update hosts
+type BypassRule struct {
+	// Host is an exact host name or a "*.example.com" wildcard
+	Host string `json:"host"`
+	// PathPrefix limits the rule to matching paths; empty matches every path
+	PathPrefix string `json:"path_prefix,omitempty"`
+}
+
+// BypassList is the set of destinations excluded from caching, transforms
+// and TLS interception
+type BypassList struct {
+	rules []BypassRule
+}
+
+// NewBypassList creates a bypass list from the given rules
+func NewBypassList(rules []BypassRule) *BypassList {
+	return &BypassList{rules: append([]BypassRule(nil), rules...)}
+}
+
+// Match reports whether the destination u must bypass the proxy's processing
+func (b *BypassList) Match(u *url.URL) bool {
+	for _, rule := range b.rules {
+		if utils.MatchHost(rule.Host, u.Host) && strings.HasPrefix(u.Path, rule.PathPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns a copy of the configured rules
+func (b *BypassList) Rules() []BypassRule {
+	return append([]BypassRule(nil), b.rules...)
+}
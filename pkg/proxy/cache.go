@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ! LRUCache is a bounded cache that evicts approximately the least
+// ! recently used items; the name predates the approximation. Bodies are
+// ! stored by content hash
+// ! with reference counts, so the same payload cached under many URLs
+// ! (versioned asset URLs, say) is held in memory once.
+// !
+// ! Recency is approximated with the second-chance (clock) algorithm so
+// ! that lookups share a read lock instead of serializing on one mutex:
+// ! a hit only flags its item as referenced, and eviction moves flagged
+// ! items back to the front, clearing the flag, rather than dropping them.
+// ! Items hit since the last eviction are thus kept over those that were
+// ! not, but in insertion order among themselves, whatever the order of
+// ! their hits.
+type LRUCache struct {
+	capacity int
+	cache    map[string]*list.Element
+	blobs    map[[sha256.Size]byte]*cacheBlob
+	list     *list.List
+	mu       sync.RWMutex
+}
+
+// ! CacheItem represents an item in the cache
+type CacheItem struct {
+	key    string
+	value  []byte
+	hash   [sha256.Size]byte
+	stored time.Time
+	// ? status and header are replayed with the body; they are shared
+	// ? with every hit, so they are never modified
+	status int
+	header http.Header
+	// ? referenced is set by hits since the item was last passed over
+	// ? for eviction
+	referenced atomic.Bool
+}
+
+// ! CachedResponse is a cached response: the status and headers replayed
+// ! with its body
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// ? marshal encodes resp in the HTTP/1.1 wire format, for tiers that store
+// ? plain bytes
+func (resp CachedResponse) marshal() []byte {
+	var buf bytes.Buffer
+	(&http.Response{
+		StatusCode:    resp.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        resp.Header,
+		Body:          io.NopCloser(bytes.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+	}).Write(&buf)
+	return buf.Bytes()
+}
+
+// ? unmarshalCachedResponse decodes a response encoded by marshal,
+// ? reporting false for anything else
+func unmarshalCachedResponse(b []byte) (CachedResponse, bool) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return CachedResponse{}, false
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return CachedResponse{}, false
+	}
+	resp.Header.Del("Content-Length")
+	return CachedResponse{Status: resp.StatusCode, Header: resp.Header, Body: body}, true
+}
+
+// ? cacheBlob is a stored body and the number of items sharing it
+type cacheBlob struct {
+	value []byte
+	refs  int
+}
+
+// ! CacheStorage describes the memory held by the cache
+type CacheStorage struct {
+	// Entries is the number of cached keys
+	Entries int `json:"entries"`
+	// Bodies is the number of distinct bodies they share
+	Bodies int `json:"bodies"`
+	// Bytes is the size of the distinct bodies
+	Bytes int64 `json:"bytes"`
+	// SavedBytes is the size deduplication avoids storing again
+	SavedBytes int64 `json:"saved_bytes"`
+}
+
+// ! NewLRUCache creates a new LRU cache with the given capacity
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		cache:    make(map[string]*list.Element),
+		blobs:    make(map[[sha256.Size]byte]*cacheBlob),
+		list:     list.New(),
+	}
+}
+
+// ? intern returns the stored copy of value, sharing an identical body
+// ? already held; the caller holds the lock
+func (lru *LRUCache) intern(value []byte) ([]byte, [sha256.Size]byte) {
+	hash := sha256.Sum256(value)
+	blob, found := lru.blobs[hash]
+	if !found {
+		blob = &cacheBlob{value: value}
+		lru.blobs[hash] = blob
+	}
+	blob.refs++
+	return blob.value, hash
+}
+
+// ? release drops a reference to the body of item, freeing the body when
+// ? no item shares it any more; the caller holds the lock
+func (lru *LRUCache) release(item *CacheItem) {
+	blob := lru.blobs[item.hash]
+	if blob == nil {
+		return
+	}
+	if blob.refs--; blob.refs == 0 {
+		delete(lru.blobs, item.hash)
+	}
+}
+
+// ! Get retrieves a value from the cache
+func (lru *LRUCache) Get(key string) ([]byte, bool) {
+	resp, found := lru.GetResponse(key)
+	return resp.Body, found
+}
+
+// ! GetResponse retrieves a response from the cache
+func (lru *LRUCache) GetResponse(key string) (CachedResponse, bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if elem, found := lru.cache[key]; found {
+		return lru.hit(elem), true
+	}
+	return CachedResponse{}, false
+}
+
+// ! GetBytes is GetResponse for a key held in a byte slice, which it does
+// ! not copy
+func (lru *LRUCache) GetBytes(key []byte) (CachedResponse, bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if elem, found := lru.cache[string(key)]; found {
+		return lru.hit(elem), true
+	}
+	return CachedResponse{}, false
+}
+
+// ? hit marks the item of elem as recently used and returns its response;
+// ? the caller holds at least the read lock. The flag is only written when
+// ? unset, so hot items do not bounce a cache line between readers.
+func (lru *LRUCache) hit(elem *list.Element) CachedResponse {
+	item := elem.Value.(*CacheItem)
+	if !item.referenced.Load() {
+		item.referenced.Store(true)
+	}
+	return CachedResponse{Status: item.status, Header: item.header, Body: item.value}
+}
+
+// ! Put adds a value to the cache, as a 200 response without headers
+func (lru *LRUCache) Put(key string, value []byte) {
+	lru.PutResponse(key, CachedResponse{Status: http.StatusOK, Body: value})
+}
+
+// ! PutResponse adds a response to the cache
+func (lru *LRUCache) PutResponse(key string, resp CachedResponse) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	value := resp.Body
+	if elem, found := lru.cache[key]; found {
+		lru.list.MoveToFront(elem) //? Update existing item
+		item := elem.Value.(*CacheItem)
+		lru.release(item)
+		item.value, item.hash = lru.intern(value)
+		item.status, item.header = resp.Status, resp.Header
+		item.stored = time.Now()
+		return
+	}
+
+	if len(lru.cache) >= lru.capacity {
+		lru.evict(len(lru.cache) - lru.capacity + 1)
+	}
+
+	//! Add new item to the cache
+	stored, hash := lru.intern(value)
+	newItem := &CacheItem{key: key, value: stored, hash: hash, stored: time.Now(), status: resp.Status, header: resp.Header}
+	elem := lru.list.PushFront(newItem)
+	lru.cache[key] = elem
+}
+
+// ? evict drops n items, oldest first, giving items hit since they were
+// ? last passed over a second chance at the front; the caller holds the
+// ? lock. Each pass clears a flag and readers cannot set one meanwhile, so
+// ? it ends within a turn of the list.
+func (lru *LRUCache) evict(n int) {
+	for n > 0 {
+		lastElem := lru.list.Back()
+		if lastElem == nil {
+			return
+		}
+		item := lastElem.Value.(*CacheItem)
+		if item.referenced.Load() {
+			item.referenced.Store(false)
+			lru.list.MoveToFront(lastElem)
+			continue
+		}
+		lru.release(item)
+		delete(lru.cache, item.key)
+		lru.list.Remove(lastElem)
+		n--
+	}
+}
+
+// ! SetCapacity changes the number of items the cache holds, evicting
+// ! items beyond it as Put does
+func (lru *LRUCache) SetCapacity(capacity int) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.capacity = capacity
+	lru.evict(len(lru.cache) - capacity)
+}
+
+// ! Age reports how long ago the value under key was stored
+func (lru *LRUCache) Age(key string) (time.Duration, bool) {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	if elem, found := lru.cache[key]; found {
+		return time.Since(elem.Value.(*CacheItem).stored), true
+	}
+	return 0, false
+}
+
+// ! Keys returns the cached keys
+func (lru *LRUCache) Keys() []string {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	keys := make([]string, 0, len(lru.cache))
+	for key := range lru.cache {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ! Delete removes a value from the cache, reporting whether it was present
+func (lru *LRUCache) Delete(key string) bool {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	elem, found := lru.cache[key]
+	if !found {
+		return false
+	}
+	lru.release(elem.Value.(*CacheItem))
+	delete(lru.cache, key)
+	lru.list.Remove(elem)
+	return true
+}
+
+// ! Storage reports the entries and distinct bodies held
+func (lru *LRUCache) Storage() CacheStorage {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+
+	s := CacheStorage{Entries: len(lru.cache), Bodies: len(lru.blobs)}
+	for _, blob := range lru.blobs {
+		s.Bytes += int64(len(blob.value))
+		s.SavedBytes += int64(len(blob.value)) * int64(blob.refs-1)
+	}
+	return s
+}
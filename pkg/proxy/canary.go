@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+)
+
+// TrafficSplit divides the requests of a balanced route between versions
+// of its backends, for canary rollouts: {"v1": 95, "v2": 5} sends one
+// request in twenty to the backends of version v2. Requests are balanced
+// over the backends of the version they are sent to, and go to other
+// versions only when none of its backends is in rotation.
+type TrafficSplit struct {
+	// Weights maps backend versions to their share of requests; versions
+	// left out get requests only by Header or Cookie
+	Weights map[string]int `json:"weights"`
+	// Header and Cookie name a request header and a cookie whose value
+	// forces a version, e.g. X-Version: v2 for testers. Forced requests
+	// bypass the cache.
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+}
+
+// versionSplit is a compiled TrafficSplit
+type versionSplit struct {
+	TrafficSplit
+	versions []string
+	// bounds are the cumulative weights of versions
+	bounds []int
+	known  map[string]bool
+}
+
+// compileSplit checks split against the backends of pool
+func compileSplit(split TrafficSplit, pool *backendPool) (*versionSplit, error) {
+	s := &versionSplit{TrafficSplit: split, known: make(map[string]bool)}
+	for _, b := range pool.backends {
+		s.known[b.version] = true
+	}
+	for version := range split.Weights {
+		s.versions = append(s.versions, version)
+	}
+	sort.Strings(s.versions)
+	total := 0
+	for _, version := range s.versions {
+		weight := split.Weights[version]
+		if weight < 0 {
+			return nil, fmt.Errorf("version %q has a negative weight", version)
+		}
+		if !s.known[version] {
+			return nil, fmt.Errorf("no backend has version %q", version)
+		}
+		total += weight
+		s.bounds = append(s.bounds, total)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("traffic split has no weight")
+	}
+	return s, nil
+}
+
+// forced returns the version r forces, if any
+func (s *versionSplit) forced(r *http.Request) (string, bool) {
+	version := ""
+	if s.Header != "" {
+		version = r.Header.Get(s.Header)
+	}
+	if version == "" && s.Cookie != "" {
+		if c, err := r.Cookie(s.Cookie); err == nil {
+			version = c.Value
+		}
+	}
+	return version, version != "" && s.known[version]
+}
+
+// forcesVersion reports whether r forces a version of the route
+func (route *Route) forcesVersion(r *http.Request) bool {
+	if route == nil || route.split == nil {
+		return false
+	}
+	_, forced := route.split.forced(r)
+	return forced
+}
+
+// version returns the backend version r is sent to, reporting whether r
+// forced it, or "" when the route does not split traffic. Clients pinned
+// by address keep to one version.
+func (route *Route) version(r *http.Request) (string, bool) {
+	s := route.split
+	if s == nil {
+		return "", false
+	}
+	if version, ok := s.forced(r); ok {
+		return version, true
+	}
+	var n int
+	if route.Affinity != nil && route.Affinity.Mode == AffinityClientIP {
+		sum := sha256.Sum256([]byte(clientIP(r)))
+		n = int(binary.BigEndian.Uint64(sum[:8]) % uint64(s.bounds[len(s.bounds)-1]))
+	} else {
+		n = rand.IntN(s.bounds[len(s.bounds)-1])
+	}
+	i := sort.SearchInts(s.bounds, n+1)
+	return s.versions[i], false
+}
@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CaptureConfig controls traffic capture, which keeps the latest request
+// and response exchanges, headers and bodies included, for export as HAR
+// from the admin API. Credentials and cookies are redacted as in logs, and
+// CONNECT tunnels, whose contents are opaque, are not captured.
+type CaptureConfig struct {
+	// Enabled captures from startup; the admin API starts and stops
+	// capturing at any time
+	Enabled bool
+	// MaxEntries bounds the exchanges kept, dropping the oldest; it
+	// defaults to 500
+	MaxEntries int
+	// MaxBodyBytes bounds the bytes kept of each request and response
+	// body; it defaults to 64 KiB
+	MaxBodyBytes int64
+}
+
+// HAR is an HTTP Archive 1.2 document
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the log of an HTTP Archive
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator names the application that wrote an HTTP Archive
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is one captured exchange
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	// RequestID is the ID of the request when request IDs are enabled
+	RequestID string `json:"_requestId,omitempty"`
+}
+
+// HARRequest is a captured request
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse is a captured response
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARNameValue is a header or query parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is a captured request body
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARContent is a captured response body; binary bodies are base64
+// encoded, and Comment notes bodies cut off at MaxBodyBytes
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings splits the time of an exchange; the proxy only measures the
+// whole of it, which is reported as waiting
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// captureBuffer keeps the latest captured exchanges
+type captureBuffer struct {
+	maxEntries   int
+	maxBodyBytes int64
+
+	mu      sync.Mutex
+	entries []HAREntry
+	next    int
+}
+
+// newCaptureBuffer applies the defaults of cfg
+func newCaptureBuffer(cfg CaptureConfig) *captureBuffer {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 500
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 64 << 10
+	}
+	return &captureBuffer{maxEntries: cfg.MaxEntries, maxBodyBytes: cfg.MaxBodyBytes}
+}
+
+// add keeps e, replacing the oldest entry once the buffer is full
+func (c *captureBuffer) add(e HAREntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) < c.maxEntries {
+		c.entries = append(c.entries, e)
+		return
+	}
+	c.entries[c.next] = e
+	c.next = (c.next + 1) % c.maxEntries
+}
+
+// list copies the entries, oldest first as HAR viewers expect
+func (c *captureBuffer) list() []HAREntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]HAREntry, 0, len(c.entries))
+	out = append(out, c.entries[c.next:]...)
+	return append(out, c.entries[:c.next]...)
+}
+
+// size returns the number of entries
+func (c *captureBuffer) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// clear drops the entries, returning how many there were
+func (c *captureBuffer) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries, c.next = nil, 0
+	return n
+}
+
+// limitedBuffer keeps the first max bytes written to it and counts the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	max   int64
+	total int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.max - int64(b.Len()); room > 0 {
+		b.Buffer.Write(p[:min(int64(len(p)), room)])
+	}
+	return len(p), nil
+}
+
+// truncated reports whether bytes were left out
+func (b *limitedBuffer) truncated() bool {
+	return b.total > int64(b.Len())
+}
+
+// capturedBody keeps what the handler reads of a request body
+type capturedBody struct {
+	io.ReadCloser
+	buf *limitedBuffer
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// captureWriter keeps the headers and body of a response
+type captureWriter struct {
+	responseRecorder
+	header http.Header
+	body   *limitedBuffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.header == nil && status >= 200 {
+		w.header = w.Header().Clone()
+	}
+	w.responseRecorder.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.header == nil {
+		w.header = w.Header().Clone()
+	}
+	n, err := w.responseRecorder.Write(p)
+	w.body.Write(p[:n])
+	return n, err
+}
+
+// withCapture serves r with next and captures the exchange
+func (s *Server) withCapture(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	if r.Method == http.MethodConnect {
+		next(w, r)
+		return
+	}
+	buf := s.capture
+	start := time.Now()
+	// The headers are copied before the handler chain modifies them
+	entry := HAREntry{
+		StartedDateTime: start,
+		Request: HARRequest{
+			Method:      r.Method,
+			URL:         absoluteURL(r),
+			HTTPVersion: r.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(s.SanitizeHeaders(r.Header)),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+		},
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{name, value})
+		}
+	}
+	reqBody := &limitedBuffer{max: buf.maxBodyBytes}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &capturedBody{ReadCloser: r.Body, buf: reqBody}
+	}
+	cw := &captureWriter{responseRecorder: responseRecorder{ResponseWriter: w}, body: &limitedBuffer{max: buf.maxBodyBytes}}
+	defer func() {
+		elapsed := milliseconds(time.Since(start))
+		entry.Time = elapsed
+		entry.Timings = HARTimings{Wait: elapsed}
+		entry.Request.BodySize = reqBody.total
+		if reqBody.total > 0 {
+			text, encoding := harText(reqBody.Bytes())
+			entry.Request.PostData = &HARPostData{
+				MimeType: r.Header.Get("Content-Type"),
+				Text:     text,
+				Encoding: encoding,
+				Comment:  truncationComment(reqBody),
+			}
+		}
+		header := cw.header
+		if header == nil {
+			header = cw.Header()
+		}
+		text, encoding := harText(cw.body.Bytes())
+		entry.Response = HARResponse{
+			Status:      cw.Status(),
+			StatusText:  http.StatusText(cw.Status()),
+			HTTPVersion: r.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(s.SanitizeHeaders(header)),
+			Content: HARContent{
+				Size:     cw.body.total,
+				MimeType: header.Get("Content-Type"),
+				Text:     text,
+				Encoding: encoding,
+				Comment:  truncationComment(cw.body),
+			},
+			RedirectURL: header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    cw.body.total,
+		}
+		buf.add(entry)
+	}()
+	next(cw, r)
+}
+
+// absoluteURL returns the full URL of r, which reverse-proxy and
+// transparent requests carry only in parts
+func absoluteURL(r *http.Request) string {
+	if r.URL.IsAbs() {
+		return r.URL.String()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// harHeaders lists h as HAR name-value pairs
+func harHeaders(h http.Header) []HARNameValue {
+	out := make([]HARNameValue, 0, len(h))
+	for name, values := range h {
+		for _, value := range values {
+			out = append(out, HARNameValue{name, value})
+		}
+	}
+	return out
+}
+
+// harText returns body as HAR text, base64 encoded unless it is UTF-8
+func harText(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// truncationComment notes a body cut off at MaxBodyBytes
+func truncationComment(b *limitedBuffer) string {
+	if !b.truncated() {
+		return ""
+	}
+	return "truncated to " + strconv.Itoa(b.Len()) + " of " + strconv.FormatInt(b.total, 10) + " bytes"
+}
+
+// CaptureStatus is the report of GET /capture
+type CaptureStatus struct {
+	Capturing bool `json:"capturing"`
+	Entries   int  `json:"entries"`
+}
+
+// handleCaptureStatus reports whether exchanges are being captured
+func (s *Server) handleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, CaptureStatus{Capturing: s.capturing.Load(), Entries: s.capture.size()})
+}
+
+// handleStartCapture starts capturing exchanges
+func (s *Server) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	s.capturing.Store(true)
+	s.handleCaptureStatus(w, r)
+}
+
+// handleStopCapture stops capturing, keeping the exchanges captured
+func (s *Server) handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	s.capturing.Store(false)
+	s.handleCaptureStatus(w, r)
+}
+
+// handleCaptureHAR exports the captured exchanges as HAR
+func (s *Server) handleCaptureHAR(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Disposition", `attachment; filename="capture.har"`)
+	writeJSON(w, HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "go-multithreaded-proxy", Version: BuildVersion()},
+		Entries: s.capture.list(),
+	}})
+}
+
+// handleCaptureClear drops the captured exchanges
+func (s *Server) handleCaptureClear(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]int{"cleared": s.capture.clear()})
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// Faults chaos rules inject
+const (
+	// FaultLatency delays requests before they proceed
+	FaultLatency = "latency"
+	// FaultReset resets the client connection without answering
+	FaultReset = "reset"
+	// FaultTruncate aborts the connection partway through the response
+	// body
+	FaultTruncate = "truncate"
+	// FaultStatus answers with an error status instead of proceeding
+	FaultStatus = "status"
+)
+
+// ChaosConfig injects faults into a share of the requests, to test how
+// clients cope with a slow or failing proxy. Injection is off unless
+// enabled, and the admin API switches it and each rule at runtime.
+type ChaosConfig struct {
+	// Enabled injects faults from startup
+	Enabled bool
+	// Rules are tried in order; latency adds up over the rules that apply,
+	// and the first reset or status ends the request
+	Rules []ChaosRule
+}
+
+// ChaosRule injects a fault into a share of the requests it matches.
+// Requests addressed to the proxy itself and CONNECT tunnels are spared.
+type ChaosRule struct {
+	// Name identifies the rule in logs and the admin API
+	Name string `json:"name"`
+	// Methods, Host and Path select requests as for stubs; empty ones
+	// match any
+	Methods []string `json:"methods,omitempty"`
+	Host    string   `json:"host,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	// Percent of the matching requests the fault is injected into
+	Percent float64 `json:"percent"`
+	// Fault is FaultLatency, FaultReset, FaultTruncate or FaultStatus
+	Fault string `json:"fault"`
+	// Latency is the delay of FaultLatency, to which up to Jitter more is
+	// added at random
+	Latency time.Duration `json:"latency,omitempty"`
+	Jitter  time.Duration `json:"jitter,omitempty"`
+	// Status answers FaultStatus; it defaults to 503
+	Status int `json:"status,omitempty"`
+	// TruncateBytes is how much of the body FaultTruncate relays
+	TruncateBytes int64 `json:"truncate_bytes,omitempty"`
+}
+
+// chaosRule is a ChaosRule with its runtime state
+type chaosRule struct {
+	ChaosRule
+	enabled  atomic.Bool
+	injected atomic.Int64
+}
+
+// chaosInjector holds the chaos rules in force
+type chaosInjector struct {
+	enabled atomic.Bool
+	rules   []*chaosRule
+}
+
+// newChaosInjector validates cfg
+func newChaosInjector(cfg ChaosConfig) (*chaosInjector, error) {
+	c := &chaosInjector{}
+	c.enabled.Store(cfg.Enabled)
+	seen := make(map[string]bool)
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("chaos rule %d has no name", i)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate chaos rule %q", rule.Name)
+		}
+		seen[rule.Name] = true
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("chaos rule %q: %w", rule.Name, err)
+		}
+		compiled := &chaosRule{ChaosRule: rule}
+		compiled.enabled.Store(true)
+		c.rules = append(c.rules, compiled)
+	}
+	return c, nil
+}
+
+// check validates the rule and fills in its defaults
+func (rule *ChaosRule) check() error {
+	if err := checkPathPattern(rule.Path); err != nil {
+		return err
+	}
+	if rule.Percent <= 0 || rule.Percent > 100 {
+		return fmt.Errorf("percent %v is not in (0, 100]", rule.Percent)
+	}
+	if rule.Latency < 0 || rule.Jitter < 0 || rule.TruncateBytes < 0 {
+		return fmt.Errorf("negative fault setting")
+	}
+	switch rule.Fault {
+	case FaultLatency:
+		if rule.Latency == 0 && rule.Jitter == 0 {
+			return fmt.Errorf("latency fault without latency")
+		}
+	case FaultStatus:
+		if rule.Status == 0 {
+			rule.Status = http.StatusServiceUnavailable
+		}
+		if rule.Status < 200 || rule.Status > 599 {
+			return fmt.Errorf("invalid status %d", rule.Status)
+		}
+	case FaultReset, FaultTruncate:
+	default:
+		return fmt.Errorf("unknown fault %q", rule.Fault)
+	}
+	return nil
+}
+
+// active reports whether faults may be injected
+func (c *chaosInjector) active() bool {
+	return c.enabled.Load() && len(c.rules) > 0
+}
+
+// rule returns the rule called name, or nil
+func (c *chaosInjector) rule(name string) *chaosRule {
+	for _, rule := range c.rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// injectFaults runs next with the faults of the chaos rules injected
+func (s *Server) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.chaos
+		if !c.active() || r.Method == http.MethodConnect || s.isEndpoint(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := utils.StripPort(r.Host)
+		var truncate *truncatingWriter
+		for _, rule := range c.rules {
+			if !rule.enabled.Load() || !matchRequest(r, host, rule.Methods, rule.Host, rule.Path) || rand.Float64()*100 >= rule.Percent {
+				continue
+			}
+			rule.injected.Add(1)
+			s.log.DebugContext(r.Context(), "Injecting fault", "rule", rule.Name, "fault", rule.Fault, "url", r.URL.String())
+			switch rule.Fault {
+			case FaultLatency:
+				delay := rule.Latency
+				if rule.Jitter > 0 {
+					delay += rand.N(rule.Jitter)
+				}
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+			case FaultReset:
+				resetConnection(w)
+				return
+			case FaultStatus:
+				s.httpError(w, r, "Fault injected by chaos rule "+rule.Name, rule.Status)
+				return
+			case FaultTruncate:
+				if truncate == nil {
+					truncate = &truncatingWriter{ResponseWriter: w, left: rule.TruncateBytes}
+					w = truncate
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+		if truncate != nil && truncate.cut {
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// resetConnection closes the client connection of w so that the client
+// sees a reset, or resets the stream of an HTTP/2 request
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	raw := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		raw = tlsConn.NetConn()
+	}
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	raw.Close()
+}
+
+// errTruncated fails the writes a truncated response refuses
+var errTruncated = errors.New("response truncated by chaos rule")
+
+// truncatingWriter relays the first left bytes of a body and refuses the
+// rest; injectFaults then aborts the connection
+type truncatingWriter struct {
+	http.ResponseWriter
+	left int64
+	cut  bool
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.left {
+		n, err := w.ResponseWriter.Write(p)
+		w.left -= int64(n)
+		return n, err
+	}
+	n, _ := w.ResponseWriter.Write(p[:w.left])
+	w.left -= int64(n)
+	w.cut = true
+	// What was relayed reaches the client before the connection is
+	// aborted, by this handler or the one writing
+	http.NewResponseController(w.ResponseWriter).Flush()
+	return n, errTruncated
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *truncatingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ChaosStatus reports the chaos rules
+type ChaosStatus struct {
+	Enabled bool              `json:"enabled"`
+	Rules   []ChaosRuleStatus `json:"rules"`
+}
+
+// ChaosRuleStatus reports a chaos rule and how often it injected its fault
+type ChaosRuleStatus struct {
+	Name     string  `json:"name"`
+	Fault    string  `json:"fault"`
+	Percent  float64 `json:"percent"`
+	Enabled  bool    `json:"enabled"`
+	Injected int64   `json:"injected"`
+}
+
+// handleChaos reports the chaos rules
+func (s *Server) handleChaos(w http.ResponseWriter, r *http.Request) {
+	c := s.chaos
+	out := ChaosStatus{Enabled: c.enabled.Load(), Rules: []ChaosRuleStatus{}}
+	for _, rule := range c.rules {
+		out.Rules = append(out.Rules, ChaosRuleStatus{
+			Name:     rule.Name,
+			Fault:    rule.Fault,
+			Percent:  rule.Percent,
+			Enabled:  rule.enabled.Load(),
+			Injected: rule.injected.Load(),
+		})
+	}
+	writeJSON(w, out)
+}
+
+// handleSetChaos switches fault injection, e.g. POST /chaos?enabled=true,
+// or one rule, e.g. POST /chaos?rule=slow-api&enabled=false
+func (s *Server) handleSetChaos(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	enabled, err := strconv.ParseBool(q.Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+	if name := q.Get("rule"); name != "" {
+		rule := s.chaos.rule(name)
+		if rule == nil {
+			http.Error(w, "Unknown chaos rule", http.StatusNotFound)
+			return
+		}
+		rule.enabled.Store(enabled)
+	} else {
+		s.chaos.enabled.Store(enabled)
+	}
+	s.log.Info("Toggled chaos", "enabled", enabled, "rule", q.Get("rule"))
+	s.handleChaos(w, r)
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// TrafficClass names a kind of traffic, such as "static" or "api", that
+// labels the proxy's metrics and logs in place of individual URLs
+type TrafficClass struct {
+	// Name labels matching requests
+	Name string `json:"name"`
+	// Host matches the requested host; empty matches any host
+	Host string `json:"host,omitempty"`
+	// PathPrefix matches the start of the request path
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Methods restricts the class to these methods; empty matches any
+	Methods []string `json:"methods,omitempty"`
+	// Conditions must all hold, as for routes
+	Conditions []RouteCondition `json:"conditions,omitempty"`
+
+	matches requestMatcher
+}
+
+// defaultTrafficClass labels requests matching no class
+const defaultTrafficClass = "other"
+
+// TrafficClassifier assigns requests the first class they match
+type TrafficClassifier struct {
+	classes []TrafficClass
+}
+
+// NewTrafficClassifier validates classes, which are tried in order
+func NewTrafficClassifier(classes []TrafficClass) (*TrafficClassifier, error) {
+	c := &TrafficClassifier{}
+	for _, class := range classes {
+		if class.Name == "" {
+			return nil, fmt.Errorf("traffic class without a name")
+		}
+		matches, err := compileConditions(class.Conditions)
+		if err != nil {
+			return nil, fmt.Errorf("traffic class %q: %w", class.Name, err)
+		}
+		class.matches = matches
+		c.classes = append(c.classes, class)
+	}
+	return c, nil
+}
+
+// Classify returns the class of r
+func (c *TrafficClassifier) Classify(r *http.Request) string {
+	for _, class := range c.classes {
+		if class.Host != "" && !utils.MatchHost(class.Host, r.Host) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, class.PathPrefix) {
+			continue
+		}
+		if len(class.Methods) > 0 && !slices.Contains(class.Methods, r.Method) {
+			continue
+		}
+		if class.matches(r) {
+			return class.Name
+		}
+	}
+	return defaultTrafficClass
+}
+
+// classCounters are the request counters of one traffic class
+type classCounters struct {
+	Requests     atomic.Int64
+	ClientErrors atomic.Int64
+	ServerErrors atomic.Int64
+	Bytes        atomic.Int64
+	Duration     atomic.Int64
+}
+
+// ClassStats is a point-in-time copy of the counters of a traffic class
+type ClassStats struct {
+	Requests     int64   `json:"requests"`
+	ClientErrors int64   `json:"client_errors"`
+	ServerErrors int64   `json:"server_errors"`
+	Bytes        int64   `json:"bytes"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// classTable holds the counters of every traffic class seen
+type classTable struct {
+	classes sync.Map
+}
+
+// record counts a finished request of class
+func (t *classTable) record(class string, status int, bytes int64, elapsed time.Duration) {
+	v, found := t.classes.Load(class)
+	if !found {
+		v, _ = t.classes.LoadOrStore(class, &classCounters{})
+	}
+	c := v.(*classCounters)
+	c.Requests.Add(1)
+	switch {
+	case status >= 500:
+		c.ServerErrors.Add(1)
+	case status >= 400:
+		c.ClientErrors.Add(1)
+	}
+	c.Bytes.Add(bytes)
+	c.Duration.Add(int64(elapsed))
+}
+
+// snapshot copies the counters of every class
+func (t *classTable) snapshot() map[string]ClassStats {
+	var out map[string]ClassStats
+	t.classes.Range(func(k, v any) bool {
+		c := v.(*classCounters)
+		s := ClassStats{
+			Requests:     c.Requests.Load(),
+			ClientErrors: c.ClientErrors.Load(),
+			ServerErrors: c.ServerErrors.Load(),
+			Bytes:        c.Bytes.Load(),
+		}
+		if s.Requests > 0 {
+			s.AvgLatencyMs = float64(c.Duration.Load()) / float64(s.Requests) / float64(time.Millisecond)
+		}
+		if out == nil {
+			out = make(map[string]ClassStats)
+		}
+		out[k.(string)] = s
+		return true
+	})
+	return out
+}
+
+// withTrafficClass labels r with its class, counts it under that class
+// and logs its outcome once served, keeping server errors for the dashboard
+// and running the OnComplete hook
+func (s *Server) withTrafficClass(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	class := s.classifier.Classify(r)
+	Annotate(r, TrafficClassAnnotation, class)
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		elapsed := time.Since(start)
+		status := rec.Status()
+		s.stats.classes.record(class, status, rec.n, elapsed)
+		if status >= http.StatusInternalServerError {
+			s.recordError(r, status)
+		}
+		s.logCompleted(r, status, elapsed)
+		s.hooks.complete(r, status, rec.n, elapsed)
+	}()
+	next(rec, r)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ClientACL allows or denies client source addresses by CIDR block, e.g.
+// "10.0.0.0/8" or "::1/128". Deny rules win; with an empty allow list every
+// address not denied is allowed. Connections are refused as they are
+// accepted, before any bytes are read.
+type ClientACL struct {
+	// Allow lists the permitted client networks
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists the forbidden client networks
+	Deny []string `json:"deny,omitempty"`
+}
+
+// clientRules is a compiled ClientACL
+type clientRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// compileClientACL parses the networks of acl, returning nil when it has
+// no rules
+func compileClientACL(acl ClientACL) (*clientRules, error) {
+	if len(acl.Allow) == 0 && len(acl.Deny) == 0 {
+		return nil, nil
+	}
+	rules := &clientRules{}
+	for _, set := range []struct {
+		networks []string
+		into     *[]netip.Prefix
+	}{{acl.Allow, &rules.allow}, {acl.Deny, &rules.deny}} {
+		for _, network := range set.networks {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client network %q", network)
+			}
+			*set.into = append(*set.into, prefix.Masked())
+		}
+	}
+	return rules, nil
+}
+
+// allows reports whether the client at addr may connect
+func (rules *clientRules) allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range rules.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, prefix := range rules.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACLs are the access control lists that can be replaced while the proxy
+// runs, through the admin API
+type ACLs struct {
+	ClientACL      ClientACL            `json:"client_acl"`
+	ListenerACLs   map[string]ClientACL `json:"listener_acls,omitempty"`
+	DestinationACL HostACL              `json:"destination_acl"`
+}
+
+// applyACLs compiles acls and puts them in force, keeping the lists in
+// force when they are invalid
+func (s *Server) applyACLs(acls ACLs) error {
+	compiled, err := compileClientACLs(acls.ClientACL, acls.ListenerACLs)
+	if err != nil {
+		return err
+	}
+	s.clientACLs.Store(&compiled)
+	s.activeACLs.Store(&acls)
+	return nil
+}
+
+// compileClientACLs compiles the default and per-listener rule sets
+func compileClientACLs(def ClientACL, listeners map[string]ClientACL) (map[string]*clientRules, error) {
+	compiled := make(map[string]*clientRules)
+	rules, err := compileClientACL(def)
+	if err != nil {
+		return nil, err
+	}
+	compiled[""] = rules
+	for addr, acl := range listeners {
+		rules, err := compileClientACL(acl)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", addr, err)
+		}
+		compiled[addr] = rules
+	}
+	return compiled, nil
+}
+
+// clientRulesFor returns the rules of the listener at addr, nil when it
+// accepts every client
+func (s *Server) clientRulesFor(addr string) *clientRules {
+	acls := s.clientACLs.Load()
+	if acls == nil {
+		return nil
+	}
+	rules, found := (*acls)[addr]
+	if !found {
+		rules = (*acls)[""]
+	}
+	return rules
+}
+
+// guardListener applies the client rules of the listener at addr to ln,
+// as they are when each connection is accepted
+func (s *Server) guardListener(addr string, ln net.Listener) net.Listener {
+	return &aclListener{Listener: ln, addr: addr, server: s}
+}
+
+// listenGuarded listens on addr under the client rules of that listener
+func (s *Server) listenGuarded(network, addr string) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.guardListener(addr, ln), nil
+}
+
+// aclListener closes accepted connections from refused clients
+type aclListener struct {
+	net.Listener
+	addr   string
+	server *Server
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		s := l.server
+		rules := s.clientRulesFor(l.addr)
+		if rules == nil {
+			return conn, nil
+		}
+		if peer, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err != nil || rules.allows(peer.Addr()) {
+			return conn, nil
+		}
+		s.stats.ClientDenied.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), "", AuditClientACL, "listener "+l.Addr().String())
+		s.log.Info("Client refused", "listener", l.Addr().String(), "client", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
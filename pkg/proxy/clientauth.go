@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ClientAuthConfig controls mutual TLS on the proxy's TLS listener
+type ClientAuthConfig struct {
+	// CAFile is a PEM bundle of the CAs that client certificates must chain to
+	CAFile string
+	// Require rejects TLS handshakes without a valid client certificate;
+	// otherwise certificates are verified only when presented
+	Require bool
+}
+
+// clientAuthTLSConfig returns the listener TLS configuration that verifies
+// client certificates against the configured CA bundle
+func (s *Server) clientAuthTLSConfig(cfg ClientAuthConfig) (*tls.Config, error) {
+	if s.cfg.TLSCertFile == "" {
+		return nil, errors.New("client certificate authentication requires TLSCertFile and TLSKeyFile")
+	}
+	bundle, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+	}
+
+	mode := tls.VerifyClientCertIfGiven
+	if cfg.Require {
+		mode = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: mode}, nil
+}
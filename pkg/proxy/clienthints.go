@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// deviceClassHeader carries the device class to the origin and keys the
+// cached variant for it
+const deviceClassHeader = "X-Device-Class"
+
+// DeviceClass is a bucket of client hint values that share one cached
+// variant, so adaptive pages are not cached per exact viewport width
+type DeviceClass struct {
+	// Name identifies the class to the origin, e.g. "mobile"
+	Name string `json:"name"`
+	// MaxViewportWidth matches clients whose reported viewport is at most
+	// this wide; zero matches any width
+	MaxViewportWidth int `json:"max_viewport_width,omitempty"`
+	// Mobile matches only clients reporting Sec-CH-UA-Mobile: ?1
+	Mobile bool `json:"mobile,omitempty"`
+}
+
+// defaultDeviceClass is used for clients that match no configured class
+const defaultDeviceClass = "default"
+
+// deviceClass returns the device class of r under the route's buckets, or
+// an empty string when the route does not vary by device
+func deviceClass(route *Route, r *http.Request) string {
+	if route == nil || len(route.DeviceClasses) == 0 {
+		return ""
+	}
+
+	width := 0
+	for _, name := range []string{"Sec-CH-Viewport-Width", "Viewport-Width"} {
+		if v, err := strconv.Atoi(r.Header.Get(name)); err == nil {
+			width = v
+			break
+		}
+	}
+	mobile := r.Header.Get("Sec-CH-UA-Mobile") == "?1"
+
+	for _, class := range route.DeviceClasses {
+		if class.Mobile && !mobile {
+			continue
+		}
+		if class.MaxViewportWidth > 0 && (width == 0 || width > class.MaxViewportWidth) {
+			continue
+		}
+		return class.Name
+	}
+	return defaultDeviceClass
+}
+
+// applyDeviceClass tags r with its device class, so the class is sent to
+// the origin and becomes part of the cache key, and asks the client for the
+// hints the classes depend on
+func applyDeviceClass(w http.ResponseWriter, r *http.Request, route *Route) string {
+	class := deviceClass(route, r)
+	if class == "" {
+		return ""
+	}
+	r.Header.Set(deviceClassHeader, class)
+	w.Header().Set("Accept-CH", "Sec-CH-Viewport-Width, Sec-CH-UA-Mobile")
+	return class
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig controls gzip compression of responses for clients
+// that accept it. Brotli is not offered: the standard library has no
+// encoder for it and this module takes no dependencies, so clients that
+// accept only br get uncompressed responses.
+type CompressionConfig struct {
+	Enabled bool
+	// MinBytes is the smallest body worth compressing. Bodies of unknown
+	// length are held back until this much has arrived.
+	MinBytes int
+	// Types are the compressible media types; a trailing /* matches a
+	// whole family such as text/*
+	Types []string
+	// Level is a compress/gzip level from 1 to 9; zero means
+	// gzip.DefaultCompression
+	Level int
+}
+
+// withCompression compresses the response to r when the client, the
+// response and the compression toggle of its route allow it
+func (s *Server) withCompression(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	if !s.cfg.Compression.Enabled || r.Method == http.MethodConnect || r.Method == http.MethodHead || !acceptsGzip(r.Header) {
+		next(w, r)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, r: r, cfg: s.cfg.Compression, toggles: s.toggles}
+	defer cw.finish()
+	next(cw, r)
+}
+
+// acceptsGzip reports whether h's Accept-Encoding allows gzip
+func acceptsGzip(h http.Header) bool {
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter decides when the response header is written whether to
+// gzip the body, waiting for MinBytes of a body of unknown length
+type compressWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	cfg     CompressionConfig
+	toggles *Toggles
+
+	status  int
+	pending []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if !cw.eligible() {
+		cw.decide(false)
+		return
+	}
+	// Without a Content-Type the type is sniffed from the body, as the
+	// server itself would
+	if cw.Header().Get("Content-Type") == "" {
+		if cw.Header().Get("Trailer") != "" {
+			cw.decide(false)
+		}
+		return
+	}
+	// Bodies of known length and bodies with trailers are decided at once
+	if length := cw.Header().Get("Content-Length"); length != "" {
+		n, _ := strconv.Atoi(length)
+		cw.decide(n >= cw.cfg.MinBytes)
+	} else if cw.Header().Get("Trailer") != "" {
+		cw.decide(true)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.pending = append(cw.pending, p...)
+		if len(cw.pending) >= cw.cfg.MinBytes {
+			cw.decide(cw.compressible())
+		}
+		return len(p), nil
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what was written so far. A response flushed before its
+// compression was decided is sent uncompressed, so streams are never held
+// back.
+func (cw *compressWriter) Flush() {
+	if cw.status != 0 && !cw.decided {
+		cw.decide(false)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// eligible reports whether the response may be compressed at all
+func (cw *compressWriter) eligible() bool {
+	h := cw.Header()
+	switch {
+	case cw.status == http.StatusNoContent || cw.status == http.StatusNotModified || cw.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "":
+		return false
+	case strings.Contains(h.Get("Cache-Control"), "no-transform"):
+		return false
+	}
+	route, _ := Annotation(cw.r, RouteAnnotation)
+	if !cw.toggles.enabledFor(ToggleCompression, route) {
+		return false
+	}
+	return h.Get("Content-Type") == "" || cw.compressible()
+}
+
+// compressible reports whether the media type may be compressed, sniffing
+// it from the held-back body when the response names none
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	if h.Get("Content-Type") == "" {
+		if _, sniffOff := h["Content-Type"]; sniffOff || len(cw.pending) == 0 {
+			return false
+		}
+		h.Set("Content-Type", http.DetectContentType(cw.pending))
+	}
+	return contentTypeAllowed(cw.cfg.Types, h.Get("Content-Type"))
+}
+
+// decide writes the header, compressed or not, and any held-back body
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	h := cw.Header()
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		h.Add("Vary", "Accept-Encoding")
+		// A strong validator names the uncompressed representation
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		level := cw.cfg.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(cw.ResponseWriter, level)
+		if err != nil {
+			gz = gzip.NewWriter(cw.ResponseWriter)
+		}
+		cw.gz = gz
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.pending) > 0 {
+		if cw.gz != nil {
+			cw.gz.Write(cw.pending)
+		} else {
+			cw.ResponseWriter.Write(cw.pending)
+		}
+		cw.pending = nil
+	}
+}
+
+// finish sends a short held-back body uncompressed and ends the gzip stream
+func (cw *compressWriter) finish() {
+	if cw.status != 0 && !cw.decided {
+		cw.decide(false)
+	}
+	if cw.gz != nil {
+		cw.gz.Close()
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Sources a RouteCondition can inspect
+const (
+	CondHeader = "header"
+	CondQuery  = "query"
+	CondCookie = "cookie"
+	// CondCert inspects the verified client certificate; Name is one of
+	// "cn", "o", "ou" or "dns"
+	CondCert = "cert"
+)
+
+// RouteCondition is a declarative predicate on a request attribute
+type RouteCondition struct {
+	// Source is CondHeader, CondQuery, CondCookie or CondCert
+	Source string `json:"source"`
+	// Name is the header, query parameter, cookie or certificate field
+	Name string `json:"name"`
+	// Value requires an exact match; Regex a regular expression match. With
+	// neither set, the attribute only has to be present.
+	Value string `json:"value,omitempty"`
+	Regex string `json:"regex,omitempty"`
+	// Negate inverts the condition
+	Negate bool `json:"negate,omitempty"`
+}
+
+// requestMatcher is a compiled set of conditions that must all hold
+type requestMatcher func(r *http.Request) bool
+
+// compileConditions turns conditions into a single matcher
+func compileConditions(conds []RouteCondition) (requestMatcher, error) {
+	preds := make([]requestMatcher, 0, len(conds))
+	for _, cond := range conds {
+		pred, err := compileCondition(cond)
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	return func(r *http.Request) bool {
+		for _, pred := range preds {
+			if !pred(r) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileCondition builds the predicate for one condition
+func compileCondition(cond RouteCondition) (requestMatcher, error) {
+	var values func(r *http.Request) []string
+	switch cond.Source {
+	case CondHeader:
+		name := http.CanonicalHeaderKey(cond.Name)
+		values = func(r *http.Request) []string { return r.Header.Values(name) }
+	case CondQuery:
+		values = func(r *http.Request) []string { return r.URL.Query()[cond.Name] }
+	case CondCookie:
+		values = func(r *http.Request) []string {
+			var out []string
+			for _, c := range r.Cookies() {
+				if c.Name == cond.Name {
+					out = append(out, c.Value)
+				}
+			}
+			return out
+		}
+	case CondCert:
+		field, err := certField(cond.Name)
+		if err != nil {
+			return nil, err
+		}
+		values = field
+	default:
+		return nil, fmt.Errorf("unknown condition source %q", cond.Source)
+	}
+
+	test := func(vs []string) bool { return len(vs) > 0 }
+	switch {
+	case cond.Regex != "":
+		re, err := regexp.Compile(cond.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("condition on %s %q: %w", cond.Source, cond.Name, err)
+		}
+		test = func(vs []string) bool { return slices.ContainsFunc(vs, re.MatchString) }
+	case cond.Value != "":
+		test = func(vs []string) bool { return slices.Contains(vs, cond.Value) }
+	}
+
+	return func(r *http.Request) bool {
+		return test(values(r)) != cond.Negate
+	}, nil
+}
+
+// certField returns an accessor for a field of the verified client
+// certificate subject
+func certField(name string) (func(r *http.Request) []string, error) {
+	switch strings.ToLower(name) {
+	case "cn":
+		return func(r *http.Request) []string {
+			if cert := peerCert(r); cert != nil && cert.Subject.CommonName != "" {
+				return []string{cert.Subject.CommonName}
+			}
+			return nil
+		}, nil
+	case "o":
+		return func(r *http.Request) []string {
+			if cert := peerCert(r); cert != nil {
+				return cert.Subject.Organization
+			}
+			return nil
+		}, nil
+	case "ou":
+		return func(r *http.Request) []string {
+			if cert := peerCert(r); cert != nil {
+				return cert.Subject.OrganizationalUnit
+			}
+			return nil
+		}, nil
+	case "dns":
+		return func(r *http.Request) []string {
+			if cert := peerCert(r); cert != nil {
+				return cert.DNSNames
+			}
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown certificate field %q", name)
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/configfile"
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/logging"
+)
+
+// Config holds the settings for the proxy server
+type Config struct {
+	// ListenAddrs are the addresses the proxy listens on, e.g. ":8080" or
+	// "127.0.0.1:3128". Whether ":8080" accepts IPv6, IPv4 or both depends
+	// on the host; ListenIPv4 and ListenIPv6 bind one family explicitly.
+	ListenAddrs []string
+	// ListenIPv4 are addresses the proxy listens on over IPv4 only, e.g.
+	// ":8080" for every IPv4 address
+	ListenIPv4 []string
+	// ListenIPv6 are addresses the proxy listens on over IPv6 only, e.g.
+	// "[::]:8080"; listing the same port in ListenIPv4 binds both families
+	// with separate sockets
+	ListenIPv6 []string
+	// Listeners are pre-bound listeners served in addition to ListenAddrs
+	Listeners []net.Listener `json:"-"`
+	// Hooks are callbacks of an embedding application run as requests are
+	// served
+	Hooks Hooks `json:"-"`
+	// Source returns the configuration again when it is reloaded on SIGHUP
+	// or through the admin API, typically by reading the configuration
+	// file; without it the proxy cannot reload
+	Source func() (Config, error) `json:"-"`
+	// Mode is ModeForward or ModeReverse
+	Mode string
+	// SSRF refuses client-chosen destinations on internal networks; it is
+	// on unless disabled
+	SSRF SSRFConfig
+	// ErrorReporting ships batched proxy errors to a Sentry-compatible
+	// tracker
+	ErrorReporting ErrorReportingConfig
+	// RequestIDs gives every request an ID, kept from a valid X-Request-Id
+	// sent by the client or generated, which is passed to the upstream,
+	// returned to the client and included in log lines and error pages
+	RequestIDs bool
+	// JSONErrors answers proxy errors with an ErrorBody in JSON instead of
+	// plain text; clients that accept JSON get it either way. Every error
+	// names its code in the Proxy-Status header.
+	JSONErrors bool
+	// ErrorPages renders the proxy's own error responses from templates
+	ErrorPages ErrorPagesConfig
+	// SlowRequestThreshold logs a warning with the DNS, connect, TLS and
+	// time-to-first-byte timings of every upstream exchange that takes
+	// longer, from sending the request until its body is relayed; zero
+	// disables the slow request log
+	SlowRequestThreshold time.Duration
+	// Tracing exports OpenTelemetry spans of proxied requests over OTLP
+	Tracing TracingConfig
+	// Logging sets the level and format of the structured log
+	Logging logging.Config
+	// DestinationACL allows or denies the destination hosts of forward-proxy
+	// requests, CONNECT tunnels and SOCKS5 and transparent connections
+	DestinationACL HostACL
+	// UpstreamOverride lets trusted clients pick the backend of a request
+	UpstreamOverride UpstreamOverrideConfig
+	// Routes maps host and path prefixes to backends in reverse-proxy mode
+	// and carries per-route settings in both modes
+	Routes []Route
+	// VirtualHosts are the sites fronted in reverse-proxy mode, each with
+	// routes of its own
+	VirtualHosts []VirtualHost
+	// Policies are named upstream timeout, retry and hedging settings that
+	// routes refer to by name
+	Policies []Policy
+	// DefaultPolicy names the policy for requests whose route names none
+	DefaultPolicy string
+	// CircuitBreaker fails requests to failing origins fast
+	CircuitBreaker BreakerConfig
+	// LegacyPathMode also accepts the /http://example.com path form addressed
+	// to the proxy itself, alongside standard forward-proxy requests
+	LegacyPathMode bool
+	// Compression gzips responses for clients that accept it
+	Compression CompressionConfig
+	// Decompression asks origins for every content coding the proxy can
+	// decode before caching
+	Decompression DecompressionConfig
+	// TrafficClasses label requests in metrics and logs, first match wins
+	TrafficClasses []TrafficClass
+	// Endpoints are served by the proxy itself instead of being proxied
+	Endpoints []Endpoint
+	// Stubs answer matching requests with canned responses instead of
+	// fetching them
+	Stubs []StubRule
+	// PAC serves a proxy auto-config file at /proxy.pac
+	PAC PACConfig
+	// Privacy drops cookies, trims Referer and removes fingerprinting
+	// headers on requests to chosen destinations
+	Privacy PrivacyConfig
+	// HeaderSanitization strips or masks sensitive headers upstream, in
+	// responses and in logs
+	HeaderSanitization HeaderSanitizationConfig
+	// HostHeaders edit the headers exchanged with upstream hosts matching
+	// their patterns, after those of routes
+	HostHeaders []HostHeaderRules
+	// ForwardedHeaders controls X-Forwarded-* and Via headers
+	ForwardedHeaders ForwardedHeadersConfig
+	// TLSCertFile and TLSKeyFile serve the proxy over TLS, which also enables
+	// HTTP/2 for clients that negotiate it
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSSelfSigned generates a self-signed certificate into TLSCertFile and
+	// TLSKeyFile when they don't exist, for development only
+	TLSSelfSigned bool
+	// AutoDetectTLS serves plaintext HTTP alongside TLS on the same
+	// listeners, telling them apart by the first byte clients send
+	AutoDetectTLS bool
+	// AutoDetectTimeout bounds the wait for that first byte; clients silent
+	// for longer are disconnected. It defaults to 10s.
+	AutoDetectTimeout time.Duration
+	// ClientAuth verifies client certificates on the TLS listener
+	ClientAuth ClientAuthConfig
+	// ClientACL allows or denies client networks on every listener without
+	// rules of its own in ListenerACLs
+	ClientACL ClientACL
+	// ListenerACLs are the client rules of individual listeners, keyed by
+	// their configured address, e.g. AdminAddr restricted to loopback;
+	// pre-bound Listeners are keyed by their bound address
+	ListenerACLs map[string]ClientACL
+	// ProxyAuth requires Basic proxy credentials from forward-proxy clients
+	ProxyAuth ProxyAuthConfig
+	// TokenAuth authenticates clients by a token header mapped to a named
+	// identity
+	TokenAuth TokenAuthConfig
+	// RequestLimits caps request URL length, query parameters, headers and
+	// bodies
+	RequestLimits RequestLimitsConfig
+	// DisableHTTP2 serves clients over HTTP/1.1 only
+	DisableHTTP2 bool
+	// HTTP1Hosts lists upstream host patterns that must be spoken to over
+	// HTTP/1.1; every other origin uses HTTP/2 when it supports it
+	HTTP1Hosts []string
+	// SchemeRules refuse or upgrade plaintext requests to upstream host
+	// patterns; the first match applies unless a route sets its own policy
+	SchemeRules []SchemeRule
+	// UpstreamTLS sets CA bundles, pins, versions and ciphers of the TLS
+	// connections to upstream host patterns
+	UpstreamTLS []UpstreamTLSRule
+	// Rewrites rewrite or redirect target URLs by regular expression, in
+	// order, before routing and forwarding
+	Rewrites []RewriteRule
+	// ICAP hands requests and responses to external scanning services
+	ICAP []ICAPService
+	// GeoIP allows or denies clients and destinations by country
+	GeoIP GeoIPConfig
+	// Blocklist answers requests to ad and tracker hosts at once
+	Blocklist BlocklistConfig
+	// ContentFilter blocks responses by content type, size or body content
+	ContentFilter ContentFilterConfig
+	// Transforms modify matching responses before they reach clients
+	Transforms []TransformRule
+	// ScriptRules block requests or change their headers as expressions
+	// over the request decide
+	ScriptRules []ScriptRule
+	// Plugins enables registered plugins: filters, authentication
+	// providers and cache backends, created in order at startup
+	Plugins []PluginConfig
+	// HostTimeouts override the phase timeouts of upstream host patterns;
+	// the first match applies
+	HostTimeouts []HostTimeouts
+	// Transparent accepts connections redirected to the proxy by netfilter
+	Transparent TransparentConfig
+	// SOCKS5 serves SOCKS5 clients alongside the HTTP listeners
+	SOCKS5 SOCKS5Config
+	// ParentProxy chains upstream requests and tunnels through another proxy
+	ParentProxy ParentProxyConfig
+	// HTTP3 controls experimental HTTP/3 support
+	HTTP3 HTTP3Config
+	// Workers bounds the number of requests processed concurrently
+	Workers WorkerPoolConfig
+	// Journal records request metadata for crash forensics
+	Journal JournalConfig
+	// AccessLog records every request in Apache or JSON format
+	AccessLog AccessLogConfig
+	// Capture keeps the latest exchanges for export as HAR from the admin
+	// API
+	Capture CaptureConfig
+	// Tape records upstream exchanges to disk or replays them offline
+	Tape TapeConfig
+	// Chaos injects latency and faults into requests for resilience tests
+	Chaos ChaosConfig
+	// AuditLog records requests refused by ACLs, authentication, rate
+	// limits, SSRF protection and content filters
+	AuditLog AuditLogConfig
+	// TenantHeader names the request header identifying the tenant for
+	// accounting; requests without it are accounted to the client IP
+	TenantHeader string
+	// RateLimit limits the request rate of each client
+	RateLimit RateLimitConfig
+	// Throttle limits the bandwidth of client connections
+	Throttle ThrottleConfig
+	// LoadShedding caps the total requests in flight and per second
+	LoadShedding LoadSheddingConfig
+	// EgressBudget limits the bytes each tenant may receive per window
+	EgressBudget EgressBudgetConfig
+	// ShutdownTimeout bounds the graceful shutdown StartServer performs on
+	// SIGINT or SIGTERM
+	ShutdownTimeout time.Duration
+	// AdminAddr is the listen address of the admin API; empty disables it
+	AdminAddr string
+	// AdminTokens maps operator names to the bearer tokens that open the
+	// admin API and the management gRPC API; a token of the form $NAME is read from the environment
+	// variable NAME. Empty leaves the APIs open, which is only safe on
+	// loopback.
+	AdminTokens map[string]string
+	// DebugAddr is the listen address of the pprof profiles and runtime
+	// report; empty disables them. Keep it on loopback or behind a
+	// listener ACL, as profiles reveal the command line and memory contents.
+	DebugAddr string
+	// GRPCAddr is the listen address of the management gRPC API; empty disables it
+	GRPCAddr string
+	// Bypass lists destinations that are never cached, transformed or intercepted
+	Bypass []BypassRule
+	// CacheCapacity is the number of responses the memory cache holds
+	CacheCapacity int
+	// CacheMaxObjectBytes is the largest streamed response kept for the cache
+	CacheMaxObjectBytes int64
+	// CacheRangeRequests fetches the whole object when a range request
+	// misses the cache, caching it and cutting the ranges from it; otherwise
+	// partial responses are relayed uncached. Cache hits are always cut.
+	CacheRangeRequests bool
+	// Prefetch refreshes the links of aged HTML cache hits and fetches the
+	// assets of cached HTML pages
+	Prefetch PrefetchConfig
+	// Resolver selects how upstream hostnames are resolved
+	Resolver ResolverConfig
+	// DNSCache caches upstream name lookups
+	DNSCache DNSCacheConfig
+	// SegmentedFetch fills the cache with large objects in parallel ranges
+	SegmentedFetch SegmentedFetchConfig
+	// DiskCache configures the on-disk cache tier
+	DiskCache DiskCacheConfig
+	// LengthMismatchPolicy decides how upstream bodies shorter than their
+	// Content-Length are relayed: LengthPolicyError, LengthPolicyTruncate or
+	// LengthPolicyCloseDelimit. The latter two need the whole body before
+	// answering, so they turn off response streaming; streamed responses
+	// that come up short are aborted.
+	LengthMismatchPolicy string
+	// ResponseLimit caps upstream response sizes, refusing larger responses
+	// or relaying them without buffering or caching
+	ResponseLimit ResponseLimitConfig
+	// MITM controls HTTPS interception of CONNECT tunnels
+	MITM MITMConfig
+	// SNIPolicy applies destination ACLs to the SNI of CONNECT tunnels
+	SNIPolicy SNIPolicyConfig
+	// Signing adds integrity signatures to responses on selected routes
+	Signing SigningConfig
+	// Transport tunes the upstream connection pool and timeouts
+	Transport TransportConfig
+	// Keepalive controls probing of idle upstream connections
+	Keepalive KeepaliveConfig
+	// Prewarm connects to known upstreams before serving requests, and
+	// keeps the busiest warm
+	Prewarm PrewarmConfig
+}
+
+// SOCKS5Config controls the SOCKS5 listener. Its tunnels share the worker
+// pool, the SNI policy host ACL and the egress budgets with CONNECT tunnels.
+type SOCKS5Config struct {
+	// Addr enables the listener, e.g. ":1080"
+	Addr string
+	// Username and Password require RFC 1929 authentication when set. It
+	// is also required when ProxyAuth or TokenAuth is configured, which
+	// then accept their users, or a token sent as the password.
+	Username string
+	Password string `json:"-"`
+	// AutoDetect also serves SOCKS5 clients on the proxy listeners when
+	// AutoDetectTLS is set, recognising them by their version byte
+	AutoDetect bool
+}
+
+// MITMConfig controls HTTPS interception of CONNECT tunnels
+type MITMConfig struct {
+	// Enabled terminates client TLS with per-host certificates signed by the CA
+	Enabled bool
+	// CACertFile and CAKeyFile hold the PEM encoded signing CA, which clients
+	// must trust
+	CACertFile string
+	CAKeyFile  string
+	// LeafValidity is how long generated host certificates remain valid
+	LeafValidity time.Duration
+	// MaxCertificates bounds the generated host certificates kept for
+	// reuse, the least recently used being dropped first; it defaults to
+	// 1000
+	MaxCertificates int
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		ListenAddrs:          []string{":8080"},
+		Mode:                 ModeForward,
+		ShutdownTimeout:      30 * time.Second,
+		LengthMismatchPolicy: LengthPolicyError,
+		CacheCapacity:        10,
+		CacheMaxObjectBytes:  10 << 20,
+		SegmentedFetch:       SegmentedFetchConfig{Segments: 4},
+		Workers:              WorkerPoolConfig{QueueTimeout: 30 * time.Second, RetryAfter: 5 * time.Second},
+		Prefetch:             PrefetchConfig{MaxLinks: 8, MaxAssets: 32, Concurrency: 4},
+		Compression: CompressionConfig{
+			MinBytes: 1024,
+			Types: []string{"text/*", "application/json", "application/javascript",
+				"application/xml", "image/svg+xml"},
+		},
+		Resolver: ResolverConfig{Timeout: 5 * time.Second},
+		DNSCache: DNSCacheConfig{
+			TTL:         time.Minute,
+			MinTTL:      5 * time.Second,
+			MaxTTL:      time.Hour,
+			NegativeTTL: 5 * time.Second,
+			MaxEntries:  10000,
+		},
+		ForwardedHeaders: ForwardedHeadersConfig{
+			Enabled: true,
+			ViaName: "go-multithreaded-proxy",
+		},
+		RequestLimits: RequestLimitsConfig{
+			MaxURLLength:   8192,
+			MaxQueryParams: 256,
+			MaxHeaderCount: 100,
+		},
+		CircuitBreaker: BreakerConfig{
+			FailureRate:    0.5,
+			MinRequests:    20,
+			Window:         30 * time.Second,
+			OpenFor:        30 * time.Second,
+			HalfOpenProbes: 1,
+		},
+		TenantHeader: "X-Tenant-ID",
+		EgressBudget: EgressBudgetConfig{
+			Window: 24 * time.Hour,
+		},
+		HTTP3: HTTP3Config{
+			Addr:           ":8443",
+			FailureBackoff: 5 * time.Minute,
+		},
+		MITM: MITMConfig{
+			LeafValidity:    30 * 24 * time.Hour,
+			MaxCertificates: 1000,
+		},
+		AutoDetectTimeout: defaultAutoDetectTimeout,
+		SNIPolicy: SNIPolicyConfig{
+			PeekTimeout: defaultPeekTimeout,
+		},
+		Signing: SigningConfig{
+			Algorithm: SignHMACSHA256,
+			Header:    "X-Signature",
+		},
+		Transport: TransportConfig{
+			RequestTimeout:        10 * time.Second,
+			DialTimeout:           30 * time.Second,
+			DialKeepAlive:         30 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   http.DefaultMaxIdleConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		Keepalive: KeepaliveConfig{
+			ProbeInterval: 30 * time.Second,
+			ProbePath:     "/",
+		},
+	}
+}
+
+// LoadConfigFile reads the configuration at path over the defaults. The
+// file is TOML, or JSON when its name ends in .json; its keys are the
+// field names of Config in snake_case, e.g. cache_max_object_bytes, and
+// durations are strings such as "30s". Every unknown key and invalid
+// value is reported with its line.
+func LoadConfigFile(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if err := configfile.Load(path, &cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// EnvPrefix starts the names of the environment variables that set the
+// configuration
+const EnvPrefix = "PROXY_"
+
+// ApplyEnv sets cfg from the PROXY_ variables of environ, in the form
+// returned by os.Environ. Each names a key path of the configuration file
+// in capitals, e.g. PROXY_TRANSPORT_REQUEST_TIMEOUT=5s; lists of plain
+// values are comma-separated, and lists of tables and maps are JSON. The
+// variables naming no setting are returned.
+func ApplyEnv(cfg *Config, environ []string) (unknown []string, err error) {
+	return configfile.LoadEnv(EnvPrefix, environ, cfg)
+}
+
+// EnvNames lists the environment variables ApplyEnv reads
+func EnvNames() []string {
+	return configfile.EnvNames(EnvPrefix, &Config{})
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// handleConnect opens a CONNECT tunnel, intercepting TLS when MITM is enabled
+// and the destination is not on the bypass list
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	s.log.DebugContext(r.Context(), "Received CONNECT", "host", r.Host)
+	if !s.checkBlocklist(w, r, r.Host) || !s.checkDestination(w, r, utils.StripPort(r.Host)) || !s.checkDestinationCountry(w, r, r.Host) {
+		return
+	}
+	if err := s.checkSSRF(r.Context(), &url.URL{Scheme: "https", Host: r.Host}, nil); err != nil {
+		s.refuseInternal(w, r, err)
+		return
+	}
+
+	if s.minter != nil && !s.bypass.Match(&url.URL{Host: r.Host}) {
+		conn, err := acceptTunnel(w, r)
+		if err != nil {
+			s.httpError(w, r, "Tunneling not supported", http.StatusInternalServerError)
+			return
+		}
+		s.intercept(conn, r.Host, r)
+		return
+	}
+
+	upstream, err := s.dialTunnel(r.Context(), r.Host)
+	if err != nil {
+		if r.Context().Err() == nil {
+			s.reportUpstreamError(r.Host, err)
+		}
+		s.upstreamError(w, r, err)
+		return
+	}
+	conn, err := acceptTunnel(w, r)
+	if err != nil {
+		upstream.Close()
+		s.httpError(w, r, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if s.cfg.SNIPolicy.ACL.Enabled() || s.cfg.SNIPolicy.RequireMatch {
+		serverName, hello, err := peekClientHello(conn, s.cfg.SNIPolicy.PeekTimeout)
+		if err != nil {
+			s.log.InfoContext(r.Context(), "Tunnel refused", "host", r.Host, "reason", err.Error())
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		s.log.DebugContext(r.Context(), "CONNECT with SNI", "host", r.Host, "sni", serverName)
+		if ok, reason := s.checkSNI(r.Host, serverName); !ok {
+			s.log.InfoContext(r.Context(), "Tunnel refused", "host", r.Host, "reason", reason)
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		if _, err := upstream.Write(hello); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+	}
+	received := tunnel(conn, upstream)
+
+	// Account tunneled bytes like any other response body
+	for rw := w; rw != nil; {
+		if rec, ok := rw.(*responseRecorder); ok {
+			rec.n += received
+		}
+		unwrapper, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		rw = unwrapper.Unwrap()
+	}
+}
+
+// acceptTunnel confirms a CONNECT request and returns the client side of the
+// tunnel. HTTP/1 connections are hijacked; HTTP/2 tunnels run over the
+// request and response streams.
+func acceptTunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		w.WriteHeader(http.StatusOK)
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			return nil, err
+		}
+		return &streamConn{w: w, body: r.Body}, nil
+	}
+
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	return conn, nil
+}
+
+// tunnel copies bytes in both directions until either side closes and
+// returns the number of bytes sent to the client
+func tunnel(client, upstream net.Conn) int64 {
+	var received int64
+	done := make(chan struct{}, 2)
+	go func() {
+		buf := getCopyBuffer()
+		defer putCopyBuffer(buf)
+		io.CopyBuffer(upstream, client, *buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		buf := getCopyBuffer()
+		defer putCopyBuffer(buf)
+		received, _ = io.CopyBuffer(client, upstream, *buf)
+		done <- struct{}{}
+	}()
+	<-done
+
+	client.Close()
+	upstream.Close()
+	<-done
+	return received
+}
+
+// streamConn presents an HTTP/2 CONNECT stream as a net.Conn
+type streamConn struct {
+	w    http.ResponseWriter
+	body io.ReadCloser
+}
+
+func (c *streamConn) Read(p []byte) (int, error) { return c.body.Read(p) }
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, http.NewResponseController(c.w).Flush()
+}
+
+func (c *streamConn) Close() error                     { return c.body.Close() }
+func (c *streamConn) LocalAddr() net.Addr              { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr             { return streamAddr{} }
+func (c *streamConn) SetDeadline(time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+// streamAddr is the placeholder address of a streamConn
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "h2" }
+func (streamAddr) String() string  { return "h2-stream" }
+
+// singleConnListener hands out one connection and then reports closed
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn == nil {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
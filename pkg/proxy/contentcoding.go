@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// DecompressionConfig controls the content codings requested from origins.
+// The proxy decodes gzip and deflate itself. It cannot decode br, which the
+// standard library lacks, unless a decoder is passed with WithDecoder, so
+// brotli bodies are otherwise neither requested nor cached decoded.
+type DecompressionConfig struct {
+	// Enabled asks origins for every coding the proxy can decode instead of
+	// only the gzip the transport negotiates, so origins that prefer other
+	// codings still send compressed bodies, which are cached as a single
+	// plaintext copy and re-compressed for clients by Compression
+	Enabled bool
+}
+
+// Decoder returns a reader of the decoded form of an encoded body
+type Decoder func(io.Reader) (io.Reader, error)
+
+// WithDecoder decodes the content coding coding, such as br, which the
+// standard library cannot decode, with d
+func WithDecoder(coding string, d Decoder) Option {
+	return func(s *Server) {
+		if s.decoders == nil {
+			s.decoders = make(map[string]Decoder)
+		}
+		s.decoders[strings.ToLower(coding)] = d
+	}
+}
+
+// configureDecompression applies cfg to the requests sent to origins
+func (s *Server) configureDecompression(cfg DecompressionConfig) {
+	s.upstreamAcceptEncoding = ""
+	if !cfg.Enabled {
+		return
+	}
+	// Only codings decodeBody decodes are offered; a built-in one added
+	// here needs a case in TestDecompressionBuiltinCodings too
+	codings := []string{"gzip", "deflate"}
+	for coding := range s.decoders {
+		codings = append(codings, coding)
+	}
+	slices.Sort(codings[2:])
+	s.upstreamAcceptEncoding = strings.Join(codings, ", ")
+}
+
+// decodeBody replaces a gzip, deflate or WithDecoder encoded response body
+// with its decoded form, so the stages after it (the cache, signing and body
+// inspection) always see plaintext. The transport already decodes the
+// gzip it negotiates itself; this covers origins that encode unasked or
+// transports with compression disabled. It reports false for encodings
+// it cannot decode, whose bodies then pass through untouched: the bytes a
+// decoder read before rejecting the stream are put back in front of it.
+func (s *Server) decodeBody(resp *http.Response) bool {
+	coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if coding == "" || coding == "identity" {
+		return true
+	}
+
+	tap := &headerTap{r: resp.Body}
+	var decoded io.Reader
+	var err error
+	switch coding {
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(tap)
+	case "deflate":
+		// HTTP deflate is zlib-wrapped (RFC 9110 section 8.4.1.2), but
+		// some origins send the raw deflate stream instead
+		decoded, err = zlib.NewReader(tap)
+		if err == zlib.ErrHeader {
+			decoded, err = flate.NewReader(tap.replay()), nil
+		}
+	default:
+		decode, found := s.decoders[coding]
+		if !found {
+			return false
+		}
+		decoded, err = decode(tap)
+	}
+	if err != nil {
+		// An empty or broken stream is left for the client to judge
+		resp.Body = &decodedBody{Reader: tap.replay(), closer: resp.Body}
+		return false
+	}
+	tap.stop()
+	resp.Body = &decodedBody{Reader: decoded, closer: resp.Body}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return true
+}
+
+// headerTap keeps what a decoder reads while checking a stream's header,
+// so a stream it rejects can be replayed whole
+type headerTap struct {
+	r       io.Reader
+	seen    []byte
+	stopped bool
+}
+
+func (t *headerTap) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if !t.stopped {
+		t.seen = append(t.seen, p[:n]...)
+	}
+	return n, err
+}
+
+// stop ends recording once the decoder has accepted the stream
+func (t *headerTap) stop() {
+	t.stopped = true
+	t.seen = nil
+}
+
+// replay returns the whole stream: the bytes read so far, then the rest
+func (t *headerTap) replay() io.Reader {
+	t.stopped = true
+	return io.MultiReader(bytes.NewReader(t.seen), t.r)
+}
+
+// decodedBody reads a decoded stream and closes the original body
+type decodedBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return b.closer.Close()
+}
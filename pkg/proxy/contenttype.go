@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Actions for responses whose Content-Type a route does not allow
+const (
+	// ContentTypeReject answers 502 instead of the response
+	ContentTypeReject = "reject"
+	// ContentTypeStrip relays the status without the body
+	ContentTypeStrip = "strip"
+)
+
+// contentTypeAllowed reports whether the media type in contentType matches
+// one of allowed, which may use "type/*" wildcards
+func contentTypeAllowed(allowed []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceContentType applies the route's content-type allowlist to resp.
+// It reports false when the response was answered and must not be relayed.
+func (s *Server) enforceContentType(w http.ResponseWriter, r *http.Request, resp *http.Response, route *Route) bool {
+	if route == nil || len(route.AllowedContentTypes) == 0 {
+		return true
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentTypeAllowed(route.AllowedContentTypes, contentType) {
+		return true
+	}
+
+	s.stats.ContentTypeBlocked.Add(1)
+	s.log.InfoContext(r.Context(), "Blocked content type", "content_type", contentType, "route", route.Name, "url", resp.Request.URL.String())
+
+	if route.ContentTypeAction == ContentTypeStrip {
+		s.auditRequest(r, AuditContentType, "route "+route.Name+" refuses "+contentType, resp.StatusCode)
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Del("Content-Type")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(resp.StatusCode)
+		return false
+	}
+	s.auditRequest(r, AuditContentType, "route "+route.Name+" refuses "+contentType, http.StatusBadGateway)
+	s.httpError(w, r, "Upstream content type not allowed", http.StatusBadGateway)
+	return false
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"cmp"
+	_ "embed"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardPage is the web UI served at GET /dashboard; it polls
+// GET /dashboard/data and derives the request rate from successive totals
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// dashboardTopHosts is the number of hosts listed by the dashboard
+const dashboardTopHosts = 10
+
+// maxRecentErrors bounds the failed requests kept for the dashboard
+const maxRecentErrors = 50
+
+// DashboardData is the report of GET /dashboard/data
+type DashboardData struct {
+	Time   time.Time `json:"time"`
+	Uptime string    `json:"uptime"`
+	// Requests, ClientErrors and ServerErrors total the traffic classes
+	Requests     int64 `json:"requests"`
+	ClientErrors int64 `json:"client_errors"`
+	ServerErrors int64 `json:"server_errors"`
+	// CacheHits, CacheMisses and HitRatio total the origins
+	CacheHits   int64   `json:"cache_hits"`
+	CacheMisses int64   `json:"cache_misses"`
+	HitRatio    float64 `json:"hit_ratio"`
+	Connections int64   `json:"connections"`
+	InFlight    int64   `json:"in_flight"`
+	QueueDepth  int64   `json:"queue_depth"`
+	Draining    bool    `json:"draining"`
+	// TopHosts are the origins with the most cache lookups, busiest first
+	TopHosts []HostActivity `json:"top_hosts"`
+	// RecentErrors are the latest failed requests, newest first
+	RecentErrors []RecentError `json:"recent_errors"`
+}
+
+// HostActivity is the cache activity of one origin host
+type HostActivity struct {
+	Host     string  `json:"host"`
+	Requests int64   `json:"requests"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// RecentError is a request the proxy answered with a server error
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// errorRing keeps the latest failed requests
+type errorRing struct {
+	mu      sync.Mutex
+	entries []RecentError
+	next    int
+}
+
+// add records e, replacing the oldest entry once the ring is full
+func (ring *errorRing) add(e RecentError) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if len(ring.entries) < maxRecentErrors {
+		ring.entries = append(ring.entries, e)
+		return
+	}
+	ring.entries[ring.next] = e
+	ring.next = (ring.next + 1) % maxRecentErrors
+}
+
+// list copies the entries, newest first
+func (ring *errorRing) list() []RecentError {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	out := make([]RecentError, 0, len(ring.entries))
+	out = append(out, ring.entries[ring.next:]...)
+	out = append(out, ring.entries[:ring.next]...)
+	slices.Reverse(out)
+	return out
+}
+
+// recordError keeps r, answered with status, for the dashboard
+func (s *Server) recordError(r *http.Request, status int) {
+	code, _ := Annotation(r, ErrorAnnotation)
+	s.stats.errors.add(RecentError{
+		Time:      time.Now(),
+		Method:    r.Method,
+		URL:       auditURL(r),
+		Status:    status,
+		Error:     code,
+		RequestID: r.Header.Get(requestIDHeader),
+	})
+}
+
+// countConnections tracks the client connections open on the proxy
+// listeners; hijacked connections, such as tunnels, are counted as in-flight
+// requests instead
+func (s *Server) countConnections(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.stats.Connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		s.stats.Connections.Add(-1)
+	}
+}
+
+// handleDashboard serves the dashboard web UI
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardPage)
+}
+
+// handleDashboardData reports the figures the dashboard shows
+func (s *Server) handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	data := DashboardData{
+		Time:         time.Now(),
+		Uptime:       time.Since(s.started).Round(time.Second).String(),
+		Connections:  s.stats.Connections.Load(),
+		InFlight:     s.stats.InFlight.Load(),
+		QueueDepth:   s.stats.QueueDepth.Load(),
+		Draining:     s.draining.Load(),
+		TopHosts:     []HostActivity{},
+		RecentErrors: s.stats.errors.list(),
+	}
+	totals := s.stats.totals()
+	data.Requests, data.ClientErrors, data.ServerErrors = totals.requests, totals.clientErrors, totals.serverErrors
+	data.CacheHits, data.CacheMisses = totals.cacheHits, totals.cacheMisses
+	if lookups := totals.cacheHits + totals.cacheMisses; lookups > 0 {
+		data.HitRatio = float64(totals.cacheHits) / float64(lookups)
+	}
+	for host, o := range s.stats.origins.snapshot() {
+		data.TopHosts = append(data.TopHosts, HostActivity{Host: host, Requests: o.Hits + o.Misses, HitRatio: o.HitRatio})
+	}
+	slices.SortFunc(data.TopHosts, func(a, b HostActivity) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Host, b.Host))
+	})
+	if len(data.TopHosts) > dashboardTopHosts {
+		data.TopHosts = data.TopHosts[:dashboardTopHosts]
+	}
+	writeJSON(w, data)
+}
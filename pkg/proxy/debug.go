@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// RuntimeStats is the runtime report of the debug listener
+type RuntimeStats struct {
+	Uptime       string `json:"uptime"`
+	GoVersion    string `json:"go_version"`
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+	NumCPU       int    `json:"num_cpu"`
+	Goroutines   int    `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapInuse    uint64 `json:"heap_inuse_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	TotalAlloc   uint64 `json:"total_alloc_bytes"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+	LastPauseNs  uint64 `json:"gc_last_pause_ns"`
+	// Cache is the storage held by the memory cache
+	Cache CacheStorage `json:"cache"`
+}
+
+// startDebug serves the pprof profiles and the runtime report on addr in
+// the background, returning the server so that it can be shut down. It is
+// kept off the admin API so that profiling, which exposes command lines
+// and can slow the process down, is enabled separately.
+func (s *Server) startDebug(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/runtime", s.handleRuntimeStats)
+	mux.HandleFunc("POST /debug/gc", s.handleGC)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		ln, err := s.listenGuarded("tcp", addr)
+		if err != nil {
+			s.log.Error("Debug listener failed", "err", err)
+			return
+		}
+		s.log.Info("Debug listener is running", "addr", addr)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.log.Error("Debug listener failed", "err", err)
+		}
+	}()
+	return srv
+}
+
+// handleRuntimeStats reports goroutine, heap and GC figures along with the
+// size of the memory cache
+func (s *Server) handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	writeJSON(w, RuntimeStats{
+		Uptime:       time.Since(s.started).Round(time.Second).String(),
+		GoVersion:    runtime.Version(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		TotalAlloc:   m.TotalAlloc,
+		Mallocs:      m.Mallocs,
+		Frees:        m.Frees,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+		LastPauseNs:  m.PauseNs[(m.NumGC+255)%256],
+		Cache:        s.cache.Storage(),
+	})
+}
+
+// handleGC forces a garbage collection, for telling leaks apart from
+// garbage not yet collected, and reports the heap afterwards
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	runtime.GC()
+	s.handleRuntimeStats(w, r)
+}
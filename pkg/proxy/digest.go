@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"net/http"
+	"strconv"
+)
+
+// CacheDigest is a Cuckoo filter of cache keys. Peers fetch it from the
+// admin API and skip lookups for keys it cannot contain; a key it claims
+// to contain is cached with high probability, not certainty.
+//
+// The wire form is "CKD1", the bucket count as a big-endian uint32, then
+// every bucket's four 16-bit fingerprints in big-endian order.
+type CacheDigest struct {
+	buckets [][digestBucketSize]uint16
+	count   int
+}
+
+const (
+	digestBucketSize = 4
+	digestMaxKicks   = 500
+	digestMagic      = "CKD1"
+)
+
+// NewCacheDigest returns an empty digest sized for about capacity keys
+func NewCacheDigest(capacity int) *CacheDigest {
+	n := max(1, (capacity+digestBucketSize-1)/digestBucketSize)
+	// A power of two keeps the alternate bucket reachable from either one,
+	// and headroom keeps inserts from failing near capacity
+	n = 1 << bits.Len(uint(n*5/4))
+	return &CacheDigest{buckets: make([][digestBucketSize]uint16, n)}
+}
+
+// digestHash returns the fingerprint and first bucket of key
+func (d *CacheDigest) digestHash(key string) (uint16, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	fp := uint16(sum >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, uint32(sum) & uint32(len(d.buckets)-1)
+}
+
+// altBucket returns the other bucket fp may live in
+func (d *CacheDigest) altBucket(i uint32, fp uint16) uint32 {
+	h := uint32(fp) * 0x5bd1e995
+	return (i ^ h) & uint32(len(d.buckets)-1)
+}
+
+// Add inserts key, reporting false when the digest is too full to hold it.
+// A failed Add may have displaced another key, so the digest must then be
+// rebuilt larger.
+func (d *CacheDigest) Add(key string) bool {
+	fp, i1 := d.digestHash(key)
+	i2 := d.altBucket(i1, fp)
+	if d.place(i1, fp) || d.place(i2, fp) {
+		d.count++
+		return true
+	}
+
+	i := i1
+	for kick := 0; kick < digestMaxKicks; kick++ {
+		slot := kick % digestBucketSize
+		fp, d.buckets[i][slot] = d.buckets[i][slot], fp
+		i = d.altBucket(i, fp)
+		if d.place(i, fp) {
+			d.count++
+			return true
+		}
+	}
+	return false
+}
+
+func (d *CacheDigest) place(i uint32, fp uint16) bool {
+	for slot, v := range d.buckets[i] {
+		if v == 0 {
+			d.buckets[i][slot] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether key may be in the digest
+func (d *CacheDigest) Contains(key string) bool {
+	fp, i1 := d.digestHash(key)
+	i2 := d.altBucket(i1, fp)
+	for _, i := range []uint32{i1, i2} {
+		for _, v := range d.buckets[i] {
+			if v == fp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Len returns the number of keys added
+func (d *CacheDigest) Len() int {
+	return d.count
+}
+
+// MarshalBinary encodes the digest in its wire form
+func (d *CacheDigest) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, 8+len(d.buckets)*digestBucketSize*2)
+	out = append(out, digestMagic...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(d.buckets)))
+	for _, bucket := range d.buckets {
+		for _, fp := range bucket {
+			out = binary.BigEndian.AppendUint16(out, fp)
+		}
+	}
+	return out, nil
+}
+
+// ParseCacheDigest decodes a digest from its wire form
+func ParseCacheDigest(data []byte) (*CacheDigest, error) {
+	if len(data) < 8 || string(data[:4]) != digestMagic {
+		return nil, errors.New("not a cache digest")
+	}
+	n := binary.BigEndian.Uint32(data[4:])
+	if n == 0 || n&(n-1) != 0 || uint64(len(data)-8) != uint64(n)*digestBucketSize*2 {
+		return nil, errors.New("malformed cache digest")
+	}
+	d := &CacheDigest{buckets: make([][digestBucketSize]uint16, n)}
+	off := 8
+	for i := range d.buckets {
+		for slot := range d.buckets[i] {
+			fp := binary.BigEndian.Uint16(data[off:])
+			d.buckets[i][slot] = fp
+			if fp != 0 {
+				d.count++
+			}
+			off += 2
+		}
+	}
+	return d, nil
+}
+
+// cacheDigest builds a digest of the keys in every cache tier
+func (s *Server) cacheDigest() *CacheDigest {
+	keys := s.cache.Keys()
+	if s.diskCache != nil {
+		keys = append(keys, s.diskCache.Keys()...)
+	}
+	for capacity := len(keys); ; capacity *= 2 {
+		d := NewCacheDigest(capacity)
+		full := false
+		for _, key := range keys {
+			if !d.Add(key) {
+				full = true
+				break
+			}
+		}
+		if !full {
+			return d
+		}
+	}
+}
+
+// handleCacheDigest serves the digest of the cached keys
+func (s *Server) handleCacheDigest(w http.ResponseWriter, r *http.Request) {
+	d := s.cacheDigest()
+	data, _ := d.MarshalBinary()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Digest-Keys", strconv.Itoa(d.Len()))
+	w.Write(data)
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCacheConfig controls the on-disk cache tier behind the memory cache
+type DiskCacheConfig struct {
+	// Dir holds the cached bodies; empty disables the disk tier
+	Dir string
+	// MaxBytes bounds the total size of cached bodies; zero means unbounded
+	MaxBytes int64
+}
+
+// DiskCache stores response bodies as files. Each entry is a body file and a
+// metadata file recording its key, checksum, status and headers; the
+// metadata is written last,
+// so a crash mid-write leaves an orphan body that the startup check removes.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]diskEntry
+	size    int64
+}
+
+// diskEntry is the metadata stored beside each cached body
+type diskEntry struct {
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Stored time.Time `json:"stored"`
+	// Status and Header are replayed with the body; entries written before
+	// they were recorded are 200 responses without headers
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+// IntegrityReport summarizes a disk cache integrity check
+type IntegrityReport struct {
+	Checked     int `json:"checked"`
+	Valid       int `json:"valid"`
+	Corrupt     int `json:"corrupt"`
+	Missing     int `json:"missing"`
+	Orphans     int `json:"orphans"`
+	Quarantined int `json:"quarantined"`
+}
+
+// OpenDiskCache opens the disk tier in dir, creating it if needed. Call
+// Verify before use to load and check the existing entries.
+func OpenDiskCache(cfg DiskCacheConfig) (*DiskCache, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: cfg.Dir, maxBytes: cfg.MaxBytes, entries: make(map[string]diskEntry)}, nil
+}
+
+// name returns the file name stem used for key
+func (d *DiskCache) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks every stored entry against its body, quarantines corrupt
+// bodies and orphan files, drops metadata whose body is missing and loads
+// the surviving entries
+func (d *DiskCache) Verify() (IntegrityReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var report IntegrityReport
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return report, err
+	}
+
+	bodies := make(map[string]bool)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			// Interrupted write; the entry was never committed
+			report.Orphans++
+			os.Remove(filepath.Join(d.dir, f.Name()))
+			continue
+		}
+		if stem, ok := strings.CutSuffix(f.Name(), ".body"); ok {
+			bodies[stem] = true
+		}
+	}
+
+	d.entries = make(map[string]diskEntry)
+	d.size = 0
+	for _, f := range files {
+		stem, ok := strings.CutSuffix(f.Name(), ".meta")
+		if !ok {
+			continue
+		}
+		report.Checked++
+
+		var entry diskEntry
+		data, err := os.ReadFile(filepath.Join(d.dir, f.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil || entry.Key == "" || d.name(entry.Key) != stem {
+			report.Corrupt++
+			d.quarantine(stem, &report)
+			delete(bodies, stem)
+			continue
+		}
+		if !bodies[stem] {
+			report.Missing++
+			os.Remove(filepath.Join(d.dir, stem+".meta"))
+			continue
+		}
+		delete(bodies, stem)
+
+		body, err := os.ReadFile(filepath.Join(d.dir, stem+".body"))
+		if err != nil || int64(len(body)) != entry.Size || checksum(body) != entry.SHA256 {
+			report.Corrupt++
+			d.quarantine(stem, &report)
+			continue
+		}
+		report.Valid++
+		d.entries[entry.Key] = entry
+		d.size += entry.Size
+	}
+
+	for stem := range bodies {
+		report.Orphans++
+		d.quarantine(stem, &report)
+	}
+	return report, nil
+}
+
+// quarantine moves the files of an entry aside for later inspection
+func (d *DiskCache) quarantine(stem string, report *IntegrityReport) {
+	qdir := filepath.Join(d.dir, "quarantine")
+	os.MkdirAll(qdir, 0o755)
+	for _, ext := range []string{".body", ".meta"} {
+		if os.Rename(filepath.Join(d.dir, stem+ext), filepath.Join(qdir, stem+ext)) == nil {
+			report.Quarantined++
+		}
+	}
+}
+
+// Get reads a cached body, verifying its checksum
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+	resp, found := d.GetResponse(key)
+	return resp.Body, found
+}
+
+// GetResponse reads a cached response, verifying the checksum of its body
+func (d *DiskCache) GetResponse(key string) (CachedResponse, bool) {
+	d.mu.Lock()
+	entry, found := d.entries[key]
+	d.mu.Unlock()
+	if !found {
+		return CachedResponse{}, false
+	}
+
+	body, err := os.ReadFile(filepath.Join(d.dir, d.name(key)+".body"))
+	if err != nil || checksum(body) != entry.SHA256 {
+		d.Delete(key)
+		return CachedResponse{}, false
+	}
+	status := entry.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return CachedResponse{Status: status, Header: entry.Header, Body: body}, true
+}
+
+// Keys returns the keys of the stored bodies
+func (d *DiskCache) Keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]string, 0, len(d.entries))
+	for key := range d.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Put stores a body as a 200 response without headers
+func (d *DiskCache) Put(key string, value []byte) error {
+	return d.PutResponse(key, CachedResponse{Status: http.StatusOK, Body: value})
+}
+
+// PutResponse stores a response, evicting the oldest entries beyond
+// MaxBytes
+func (d *DiskCache) PutResponse(key string, resp CachedResponse) error {
+	stem := d.name(key)
+	value := resp.Body
+	entry := diskEntry{Key: key, Size: int64(len(value)), SHA256: checksum(value), Stored: time.Now(), Status: resp.Status, Header: resp.Header}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(d.dir, stem+".body"), value); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(d.dir, stem+".meta"), meta); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, found := d.entries[key]; found {
+		d.size -= old.Size
+	}
+	d.entries[key] = entry
+	d.size += entry.Size
+
+	for d.maxBytes > 0 && d.size > d.maxBytes && len(d.entries) > 1 {
+		var oldest diskEntry
+		for _, e := range d.entries {
+			if oldest.Key == "" || e.Stored.Before(oldest.Stored) {
+				oldest = e
+			}
+		}
+		d.remove(oldest.Key)
+	}
+	return nil
+}
+
+// Delete removes a cached body, reporting whether it was present
+func (d *DiskCache) Delete(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remove(key)
+}
+
+// remove deletes an entry; d.mu must be held
+func (d *DiskCache) remove(key string) bool {
+	entry, found := d.entries[key]
+	if !found {
+		return false
+	}
+	stem := d.name(key)
+	os.Remove(filepath.Join(d.dir, stem+".meta"))
+	os.Remove(filepath.Join(d.dir, stem+".body"))
+	delete(d.entries, key)
+	d.size -= entry.Size
+	return true
+}
+
+// checksum returns the hex SHA-256 of b
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openDiskCache opens the disk tier and runs the startup integrity check
+func (s *Server) openDiskCache(cfg DiskCacheConfig) error {
+	d, err := OpenDiskCache(cfg)
+	if err != nil {
+		return fmt.Errorf("disk cache setup failed: %w", err)
+	}
+	report, err := d.Verify()
+	if err != nil {
+		return fmt.Errorf("disk cache integrity check failed: %w", err)
+	}
+	s.log.Info("Disk cache checked", "checked", report.Checked, "valid", report.Valid, "corrupt", report.Corrupt,
+		"missing", report.Missing, "orphans", report.Orphans, "quarantined", report.Quarantined)
+	s.diskCache, s.integrity = d, report
+	return nil
+}
+
+// cacheGet looks key up in the memory cache, then the disk tier, then the
+// cache backend plugin
+func (s *Server) cacheGet(key string) (CachedResponse, bool) {
+	if resp, found := s.cache.GetResponse(key); found {
+		return resp, true
+	}
+	if s.diskCache != nil {
+		if resp, found := s.diskCache.GetResponse(key); found {
+			s.cache.PutResponse(key, resp)
+			return resp, true
+		}
+	}
+	if backend := s.plugins.cacheBackend(); backend != nil {
+		if value, found := backend.Get(key); found {
+			if resp, ok := unmarshalCachedResponse(value); ok {
+				s.cache.PutResponse(key, resp)
+				return resp, true
+			}
+		}
+	}
+	return CachedResponse{}, false
+}
+
+// cachePut stores resp in the memory cache, the disk tier and the cache
+// backend plugin
+func (s *Server) cachePut(key string, resp CachedResponse) {
+	s.cache.PutResponse(key, resp)
+	if s.diskCache != nil {
+		if err := s.diskCache.PutResponse(key, resp); err != nil {
+			s.log.Warn("Disk cache write failed", "key", key, "err", err)
+		}
+	}
+	if backend := s.plugins.cacheBackend(); backend != nil {
+		if err := backend.Put(key, resp.marshal()); err != nil {
+			s.log.Warn("Cache backend write failed", "key", key, "err", err)
+		}
+	}
+}
+
+// cacheDelete removes a URL and all its variants from every cache tier
+func (s *Server) cacheDelete(url string) bool {
+	purged := false
+	for _, key := range append(s.variants.Forget(url), url) {
+		if s.cache.Delete(key) {
+			purged = true
+		}
+		if s.diskCache != nil && s.diskCache.Delete(key) {
+			purged = true
+		}
+		if backend := s.plugins.cacheBackend(); backend != nil && backend.Delete(key) {
+			purged = true
+		}
+	}
+	return purged
+}
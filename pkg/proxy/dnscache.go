@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSCacheConfig controls the in-process cache of upstream name lookups
+type DNSCacheConfig struct {
+	Enabled bool
+	// TTL is how long answers are kept when the resolver does not report
+	// their TTL, as the system resolver never does
+	TTL time.Duration
+	// MinTTL and MaxTTL clamp the TTL of every answer; zero leaves that
+	// side unclamped
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long failed lookups are remembered; zero disables
+	// negative caching
+	NegativeTTL time.Duration
+	// MaxEntries bounds the number of cached names
+	MaxEntries int
+}
+
+// resolveFunc resolves host, reporting the TTL of the answer or zero when
+// it is unknown
+type resolveFunc func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+
+// systemResolve resolves host with the system resolver
+func systemResolve(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	return addrs, 0, err
+}
+
+// DNSCache caches the answers of a resolver. Concurrent lookups of the same
+// name share one query.
+type DNSCache struct {
+	cfg     DNSCacheConfig
+	resolve resolveFunc
+	// stats count the hits and misses
+	stats *Stats
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	ready   chan struct{}
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// NewDNSCache returns a cache in front of resolve
+func NewDNSCache(cfg DNSCacheConfig, resolve resolveFunc) *DNSCache {
+	return &DNSCache{cfg: cfg, resolve: resolve, entries: make(map[string]*dnsEntry), stats: &Stats{}}
+}
+
+// Lookup returns the addresses of host, from the cache when it holds a
+// live answer
+func (c *DNSCache) Lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.mu.Lock()
+	e, found := c.entries[host]
+	if found {
+		select {
+		case <-e.ready:
+			if time.Now().After(e.expires) {
+				found = false
+			}
+		default:
+		}
+	}
+	if found {
+		c.mu.Unlock()
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if e.err != nil {
+			c.stats.DNSNegativeHits.Add(1)
+		} else {
+			c.stats.DNSHits.Add(1)
+		}
+		return e.addrs, e.err
+	}
+
+	e = &dnsEntry{ready: make(chan struct{})}
+	c.evict()
+	c.entries[host] = e
+	c.mu.Unlock()
+	c.stats.DNSMisses.Add(1)
+
+	// The query outlives a cancelled caller so that waiters still get an
+	// answer
+	addrs, ttl, err := c.resolve(context.WithoutCancel(ctx), host)
+	e.addrs, e.err = addrs, err
+	e.expires = time.Now().Add(c.ttl(ttl, err))
+	close(e.ready)
+	if err != nil && c.cfg.NegativeTTL <= 0 {
+		c.mu.Lock()
+		if c.entries[host] == e {
+			delete(c.entries, host)
+		}
+		c.mu.Unlock()
+	}
+	return addrs, err
+}
+
+// ttl returns how long an answer with the reported ttl is kept
+func (c *DNSCache) ttl(reported time.Duration, err error) time.Duration {
+	if err != nil {
+		return c.cfg.NegativeTTL
+	}
+	if reported <= 0 {
+		reported = c.cfg.TTL
+	}
+	if c.cfg.MinTTL > 0 && reported < c.cfg.MinTTL {
+		reported = c.cfg.MinTTL
+	}
+	if c.cfg.MaxTTL > 0 && reported > c.cfg.MaxTTL {
+		reported = c.cfg.MaxTTL
+	}
+	return reported
+}
+
+// evict makes room for one entry, dropping expired answers first. The
+// caller holds c.mu.
+func (c *DNSCache) evict() {
+	if c.cfg.MaxEntries <= 0 || len(c.entries) < c.cfg.MaxEntries {
+		return
+	}
+	now := time.Now()
+	for host, e := range c.entries {
+		select {
+		case <-e.ready:
+			if now.After(e.expires) {
+				delete(c.entries, host)
+			}
+		default:
+		}
+	}
+	for host := range c.entries {
+		if len(c.entries) < c.cfg.MaxEntries {
+			break
+		}
+		delete(c.entries, host)
+	}
+}
+
+// Len returns the number of cached names
+func (c *DNSCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// resolveHost resolves an upstream hostname, preferring fixed host
+// overrides and then the DNS cache when one is configured
+func (s *Server) resolveHost(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, found := s.hostOverrides[strings.TrimSuffix(strings.ToLower(host), ".")]; found {
+		return addrs, nil
+	}
+	if s.dnsCache != nil {
+		return s.dnsCache.Lookup(ctx, host)
+	}
+	addrs, _, err := s.upstreamResolve(ctx, host)
+	return addrs, err
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// dnsPins holds the addresses each hostname resolved to within one request
+// chain. Retries, hedges and redirect hops of the request reuse them, so a
+// name that is checked once cannot be rebound to a different address
+// before it is dialed.
+type dnsPins struct {
+	mu    sync.Mutex
+	addrs map[string][]net.IPAddr
+}
+
+type dnsPinsKey struct{}
+
+// withPinnedDNS returns r with an empty pin set, or r itself when it
+// already has one
+func withPinnedDNS(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(dnsPinsKey{}).(*dnsPins); ok {
+		return r
+	}
+	return r.WithContext(pinnedContext(r.Context()))
+}
+
+// pinnedContext returns ctx with an empty pin set, for connections that are
+// not HTTP requests
+func pinnedContext(ctx context.Context) context.Context {
+	pins := &dnsPins{addrs: make(map[string][]net.IPAddr)}
+	return context.WithValue(ctx, dnsPinsKey{}, pins)
+}
+
+// lookupPinned resolves host, reusing the addresses pinned in ctx when the
+// request chain already resolved it
+func (s *Server) lookupPinned(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	pins, _ := ctx.Value(dnsPinsKey{}).(*dnsPins)
+	if pins == nil {
+		return s.resolveHost(ctx, host)
+	}
+
+	// Resolving under the lock keeps concurrent hedges from pinning
+	// different answers
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	if addrs, ok := pins.addrs[host]; ok {
+		return addrs, nil
+	}
+	addrs, err := s.resolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	pins.addrs[host] = addrs
+	return addrs, nil
+}
+
+// dialPinned dials addr over the addresses its host is pinned to, trying
+// each in turn
+func (s *Server) dialPinned(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// The transport only reports the DNS phase of lookups it makes itself
+	var trace *httptrace.ClientTrace
+	if net.ParseIP(host) == nil {
+		trace = httptrace.ContextClientTrace(ctx)
+	}
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	addrs, err := s.lookupPinned(ctx, host)
+	if trace != nil && trace.DNSDone != nil {
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	// Proxied requests carry their own dial timeout
+	d := *s.dialer
+	if t, ok := ctx.Value(phaseTimeoutsKey{}).(PhaseTimeouts); ok && t.Dial > 0 {
+		d.Timeout = t.Dial
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
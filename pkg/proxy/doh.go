@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DNS record types and the response code for a missing name
+const (
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsClassIN    = 1
+	dnsRcodeNXDom = 3
+)
+
+// dohResolver resolves names over DNS-over-HTTPS (RFC 8484)
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newDoHResolver(endpoint string, timeout time.Duration) *dohResolver {
+	// The endpoint is reached without the upstream transport, whose dialer
+	// would resolve its hostname through this very resolver
+	return &dohResolver{endpoint: endpoint, client: &http.Client{Timeout: timeout}}
+}
+
+// resolve queries A and AAAA records of host in parallel, reporting the
+// smallest TTL among the answers
+func (d *dohResolver) resolve(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	type result struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func() {
+			addrs, ttl, err := d.query(ctx, host, qtype)
+			results <- result{addrs, ttl, err}
+		}()
+	}
+
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	var firstErr error
+	for range 2 {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		addrs = append(addrs, r.addrs...)
+		if len(r.addrs) > 0 && (ttl == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+	}
+	if len(addrs) == 0 {
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, 0, firstErr
+	}
+	return addrs, ttl, nil
+}
+
+// query sends one question to the endpoint
+func (d *dohResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	msg, err := dnsQuestion(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH endpoint answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSAnswer(host, qtype, body)
+}
+
+// dnsQuestion encodes a recursive query for host. The ID is zero, as RFC
+// 8484 recommends for cache friendliness.
+func dnsQuestion(host string, qtype uint16) ([]byte, error) {
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid hostname %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN), nil
+}
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// parseDNSAnswer extracts the addresses of type qtype from a response
+func parseDNSAnswer(host string, qtype uint16, msg []byte) ([]net.IPAddr, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, errDNSMessage
+	}
+	if rcode := msg[3] & 0x0f; rcode == dnsRcodeNXDom {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	} else if rcode != 0 {
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("server failure (rcode %d)", rcode), Name: host}
+	}
+	questions := binary.BigEndian.Uint16(msg[4:])
+	answers := binary.BigEndian.Uint16(msg[6:])
+
+	off := 12
+	for range questions {
+		end, err := skipDNSName(msg, off)
+		if err != nil || end+4 > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		off = end + 4
+	}
+
+	var addrs []net.IPAddr
+	var ttl uint32
+	for range answers {
+		end, err := skipDNSName(msg, off)
+		if err != nil || end+10 > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[end:])
+		rttl := binary.BigEndian.Uint32(msg[end+4:])
+		length := int(binary.BigEndian.Uint16(msg[end+8:]))
+		data := end + 10
+		if data+length > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		// CNAME records are skipped; their targets' addresses follow
+		if rtype == qtype && (length == net.IPv4len || length == net.IPv6len) {
+			ip := make(net.IP, length)
+			copy(ip, msg[data:data+length])
+			addrs = append(addrs, net.IPAddr{IP: ip})
+			if ttl == 0 || rttl < ttl {
+				ttl = rttl
+			}
+		}
+		off = data + length
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// skipDNSName returns the offset just past the name starting at off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		}
+		off += 1 + n
+	}
+	return 0, errDNSMessage
+}
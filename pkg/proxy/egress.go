@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EgressBudgetConfig limits the bytes each tenant may receive through the
+// proxy over a rolling window, independently of request rate limits.
+// Tenants are authenticated identities where clients authenticate, else
+// as described for Config.TenantHeader.
+type EgressBudgetConfig struct {
+	// Bytes is the default budget per Window; zero disables budgets
+	Bytes int64
+	// Window is the period over which the budget is replenished, e.g. 24h
+	// for a daily quota or 720h for a monthly one
+	Window time.Duration
+	// Tenants overrides the budget for individual tenants
+	Tenants map[string]int64
+	// CountUploads charges request bodies to the budget as well as
+	// responses
+	CountUploads bool
+	// Action is EgressReject (the default) or EgressThrottle for tenants
+	// that exhausted their budget
+	Action string
+	// ThrottleBytesPerSec is the rate exhausted tenants are slowed to under
+	// EgressThrottle
+	ThrottleBytesPerSec int64
+}
+
+// Actions for tenants that exhausted their egress budget
+const (
+	// EgressReject answers 429 with Retry-After
+	EgressReject = "reject"
+	// EgressThrottle serves them at ThrottleBytesPerSec
+	EgressThrottle = "throttle"
+)
+
+// Validate reports an unknown action or a throttle without a rate
+func (cfg EgressBudgetConfig) Validate() error {
+	switch cfg.Action {
+	case "", EgressReject:
+	case EgressThrottle:
+		if cfg.ThrottleBytesPerSec <= 0 {
+			return errors.New("throttling requires a rate")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", cfg.Action)
+	}
+	if cfg.Window <= 0 {
+		return errors.New("budgets require a window")
+	}
+	return nil
+}
+
+// EgressBudget tracks per-tenant egress against token buckets that refill
+// the full budget once per window
+type EgressBudget struct {
+	cfg EgressBudgetConfig
+
+	mu      sync.Mutex
+	tenants map[string]*tenantEgress
+}
+
+// tenantEgress is the budget state of one tenant
+type tenantEgress struct {
+	bucket *TokenBucket
+	budget int64
+	used   int64
+	// slow paces the tenant once its budget is exhausted under
+	// EgressThrottle
+	slow *TokenBucket
+}
+
+// EgressUsage reports a tenant's budget consumption
+type EgressUsage struct {
+	BudgetBytes    int64 `json:"budget_bytes"`
+	RemainingBytes int64 `json:"remaining_bytes"`
+	TotalBytes     int64 `json:"total_bytes"`
+	// Throttled is set while an exhausted tenant is being slowed down
+	Throttled bool `json:"throttled,omitempty"`
+}
+
+// NewEgressBudget creates a budget tracker for cfg
+func NewEgressBudget(cfg EgressBudgetConfig) *EgressBudget {
+	return &EgressBudget{cfg: cfg, tenants: make(map[string]*tenantEgress)}
+}
+
+// tenant returns the state of tenant, creating it on first use
+func (e *EgressBudget) tenant(name string) *tenantEgress {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, found := e.tenants[name]
+	if !found {
+		budget := e.cfg.Bytes
+		if override, ok := e.cfg.Tenants[name]; ok {
+			budget = override
+		}
+		rate := float64(budget) / e.cfg.Window.Seconds()
+		t = &tenantEgress{bucket: NewTokenBucket(float64(budget), rate), budget: budget}
+		if e.cfg.Action == EgressThrottle {
+			t.slow = newRateBucket(e.cfg.ThrottleBytesPerSec)
+		}
+		e.tenants[name] = t
+	}
+	return t
+}
+
+// Allow reports whether tenant has budget left, and otherwise how long until
+// it has
+func (e *EgressBudget) Allow(tenant string) (bool, time.Duration) {
+	t := e.tenant(tenant)
+	if t.bucket.Available() > 0 {
+		return true, 0
+	}
+	return false, t.bucket.Wait(1)
+}
+
+// Charge records n bytes sent to tenant
+func (e *EgressBudget) Charge(tenant string, n int64) {
+	t := e.tenant(tenant)
+	t.bucket.Charge(float64(n))
+
+	e.mu.Lock()
+	t.used += n
+	e.mu.Unlock()
+}
+
+// Usage returns the consumption of every tenant seen so far
+func (e *EgressBudget) Usage() map[string]EgressUsage {
+	e.mu.Lock()
+	tenants := make(map[string]*tenantEgress, len(e.tenants))
+	for name, t := range e.tenants {
+		tenants[name] = t
+	}
+	e.mu.Unlock()
+
+	usage := make(map[string]EgressUsage, len(tenants))
+	for name, t := range tenants {
+		e.mu.Lock()
+		used := t.used
+		e.mu.Unlock()
+		remaining := int64(t.bucket.Available())
+		usage[name] = EgressUsage{
+			BudgetBytes:    t.budget,
+			RemainingBytes: remaining,
+			TotalBytes:     used,
+			Throttled:      t.slow != nil && remaining <= 0,
+		}
+	}
+	return usage
+}
+
+// withEgressBudget rejects or throttles requests from tenants that
+// exhausted their budget and charges the bytes of every response, and of
+// uploads when counted, to its tenant
+func (s *Server) withEgressBudget(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	tenant := s.tenantOf(r)
+	Annotate(r, TenantAnnotation, tenant)
+	if ok, wait := s.egress.Allow(tenant); !ok {
+		if slow := s.egress.tenant(tenant).slow; slow != nil {
+			w = &pacedWriter{ResponseWriter: w, bucket: slow}
+		} else {
+			s.auditRequest(r, AuditEgressBudget, "tenant "+tenant, http.StatusTooManyRequests)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			s.httpError(w, r, "Egress budget exhausted", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	var upload *countingReader
+	if s.egress.cfg.CountUploads && r.Body != nil && r.Body != http.NoBody {
+		upload = &countingReader{ReadCloser: r.Body}
+		r.Body = upload
+	}
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		n := rec.n
+		if upload != nil {
+			n += upload.n
+		}
+		s.egress.Charge(tenant, n)
+	}()
+	next(rec, r)
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// pacedWriter slows a response down to the rate of bucket
+type pacedWriter struct {
+	http.ResponseWriter
+	bucket *TokenBucket
+}
+
+func (w *pacedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		pace(n, w.bucket)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *pacedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// handleEgressUsage reports per-tenant egress budget usage
+func (s *Server) handleEgressUsage(w http.ResponseWriter, r *http.Request) {
+	if s.egress == nil {
+		http.Error(w, "Egress budgets not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.egress.Usage())
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// Endpoint is a response served by the proxy itself, such as /robots.txt
+// or a JSON status page
+type Endpoint struct {
+	// Path is the exact request path the endpoint answers
+	Path string `json:"path"`
+	// Host restricts the endpoint to a host pattern; empty matches any host
+	Host string `json:"host,omitempty"`
+	// Status defaults to 200
+	Status      int               `json:"status,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Body is a text/template executed with EndpointData
+	Body string `json:"body"`
+
+	tmpl *template.Template
+}
+
+// EndpointData is the data available to endpoint body templates
+type EndpointData struct {
+	Host   string
+	Path   string
+	Query  url.Values
+	Client string
+	Now    time.Time
+	Stats  StatsSnapshot
+}
+
+// endpointFuncs are the functions available to endpoint body templates
+var endpointFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// EndpointSet holds the configured synthetic endpoints
+type EndpointSet struct {
+	endpoints []Endpoint
+	// stats is exposed to the templates, and fail answers requests whose
+	// template failed
+	stats *Stats
+	log   *slog.Logger
+	fail  func(w http.ResponseWriter, r *http.Request, msg string, status int)
+}
+
+// NewEndpointSet validates the endpoints and parses their body templates
+func NewEndpointSet(list []Endpoint) (*EndpointSet, error) {
+	set := &EndpointSet{stats: &Stats{}, log: slog.Default(), fail: func(w http.ResponseWriter, r *http.Request, msg string, status int) {
+		http.Error(w, msg, status)
+	}}
+	for _, e := range list {
+		if e.Path == "" || e.Path[0] != '/' {
+			return nil, fmt.Errorf("endpoint path %q must start with /", e.Path)
+		}
+		tmpl, err := template.New(e.Path).Funcs(endpointFuncs).Parse(e.Body)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", e.Path, err)
+		}
+		e.tmpl = tmpl
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if e.ContentType == "" {
+			e.ContentType = "text/plain; charset=utf-8"
+		}
+		set.endpoints = append(set.endpoints, e)
+	}
+	return set, nil
+}
+
+// Serve answers r from a matching endpoint, reporting whether one matched
+func (s *EndpointSet) Serve(w http.ResponseWriter, r *http.Request) bool {
+	e := s.match(r)
+	if e == nil {
+		return false
+	}
+	host := utils.StripPort(r.Host)
+	var body bytes.Buffer
+	err := e.tmpl.Execute(&body, EndpointData{
+		Host:   host,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Client: clientIP(r),
+		Now:    time.Now(),
+		Stats:  s.stats.Snapshot(),
+	})
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "Endpoint template failed", "path", e.Path, "err", err)
+		s.fail(w, r, "Endpoint template failed", http.StatusInternalServerError)
+		return true
+	}
+
+	for name, value := range e.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", e.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(body.Len()))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(body.Bytes())
+	}
+	return true
+}
+
+// match returns the endpoint answering r, or nil
+func (s *EndpointSet) match(r *http.Request) *Endpoint {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	host := utils.StripPort(r.Host)
+	for i := range s.endpoints {
+		e := &s.endpoints[i]
+		if e.Path == r.URL.Path && (e.Host == "" || utils.MatchHost(e.Host, host)) {
+			return e
+		}
+	}
+	return nil
+}
+
+// serveEndpoint answers requests addressed to the proxy itself, rather
+// than proxied through it, from the PAC file and the synthetic endpoints
+func (s *Server) serveEndpoint(w http.ResponseWriter, r *http.Request) bool {
+	if !s.addressesProxy(r) {
+		return false
+	}
+	return s.servePAC(w, r) || s.endpoints.Serve(w, r)
+}
+
+// isEndpoint reports whether serveEndpoint would answer r
+func (s *Server) isEndpoint(r *http.Request) bool {
+	return s.addressesProxy(r) && (s.isPACRequest(r) || s.endpoints.match(r) != nil)
+}
+
+// addressesProxy reports whether r is addressed to the proxy itself rather
+// than proxied through it
+func (s *Server) addressesProxy(r *http.Request) bool {
+	return s.cfg.Mode == ModeReverse || r.URL.Host == "" || isSelf(r)
+}
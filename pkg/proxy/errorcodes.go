@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Error codes name the failure behind an error the proxy answers with.
+// They are the Proxy-Status error types of RFC 9209 where one fits.
+const (
+	ErrorDNSTimeout       = "dns_timeout"
+	ErrorDNS              = "dns_error"
+	ErrorConnectTimeout   = "connection_timeout"
+	ErrorConnectRefused   = "connection_refused"
+	ErrorConnectionReset  = "connection_terminated"
+	ErrorTLSCertificate   = "tls_certificate_error"
+	ErrorTLS              = "tls_protocol_error"
+	ErrorReadTimeout      = "connection_read_timeout"
+	ErrorResponseTimeout  = "http_response_timeout"
+	ErrorResponseTooLarge = "http_response_body_size"
+	ErrorRequestTooLarge  = "http_request_body_size"
+	ErrorRequestDenied    = "http_request_denied"
+	ErrorRequest          = "http_request_error"
+	ErrorUpstream         = "destination_unavailable"
+	ErrorUpstreamStatus   = "upstream_server_error"
+	ErrorProxyInternal    = "proxy_internal_error"
+)
+
+// ErrorAnnotation is the error code of a failed request
+var ErrorAnnotation = NewAnnotationKey[string]("error")
+
+// ErrorBody is the JSON body of the proxy's error responses
+type ErrorBody struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// codeTable counts errors by code
+type codeTable struct {
+	counts sync.Map
+}
+
+// add counts one error with code
+func (t *codeTable) add(code string) {
+	v, found := t.counts.Load(code)
+	if !found {
+		v, _ = t.counts.LoadOrStore(code, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(1)
+}
+
+// snapshot copies the counts
+func (t *codeTable) snapshot() map[string]int64 {
+	var out map[string]int64
+	t.counts.Range(func(k, v any) bool {
+		if out == nil {
+			out = make(map[string]int64)
+		}
+		out[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return out
+}
+
+// classifyUpstreamError returns the error code and status of the answer to
+// a failed upstream exchange
+func classifyUpstreamError(err error) (string, int) {
+	var phase *phaseError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case errors.As(err, &phase):
+		switch phase.phase {
+		case "TLS handshake":
+			return ErrorTLS, http.StatusGatewayTimeout
+		case "response header", "request":
+			return ErrorResponseTimeout, http.StatusGatewayTimeout
+		}
+		return ErrorReadTimeout, http.StatusGatewayTimeout
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ErrorDNSTimeout, http.StatusGatewayTimeout
+		}
+		return ErrorDNS, http.StatusBadGateway
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return ErrorConnectTimeout, http.StatusGatewayTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectRefused, http.StatusBadGateway
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrorConnectionReset, http.StatusBadGateway
+	case errors.As(err, &certErr):
+		return ErrorTLSCertificate, http.StatusBadGateway
+	case errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return ErrorTLS, http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorResponseTimeout, http.StatusGatewayTimeout
+	}
+	return ErrorUpstream, http.StatusBadGateway
+}
+
+// upstreamErrorMessages explain the error codes of upstream failures
+var upstreamErrorMessages = map[string]string{
+	ErrorDNSTimeout:      "DNS lookup of the target server timed out",
+	ErrorDNS:             "DNS lookup of the target server failed",
+	ErrorConnectTimeout:  "Connecting to the target server timed out",
+	ErrorConnectRefused:  "Target server refused the connection",
+	ErrorConnectionReset: "Target server closed the connection",
+	ErrorTLSCertificate:  "Target server certificate not trusted",
+	ErrorTLS:             "TLS handshake with the target server failed",
+	ErrorReadTimeout:     "Target server stopped sending",
+	ErrorResponseTimeout: "Target server did not answer in time",
+	ErrorUpstream:        "Failed to reach target server",
+}
+
+// upstreamError answers r for an upstream exchange that failed with err
+func (s *Server) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := classifyUpstreamError(err)
+	s.proxyError(w, r, code, upstreamErrorMessages[code], status)
+}
+
+// errorCodeFor returns the error code of a status answered without a more
+// specific one
+func errorCodeFor(status int) string {
+	switch {
+	case status == http.StatusForbidden, status == http.StatusProxyAuthRequired, status == http.StatusUnauthorized, status == http.StatusTooManyRequests:
+		return ErrorRequestDenied
+	case status == http.StatusRequestEntityTooLarge:
+		return ErrorRequestTooLarge
+	case status < http.StatusInternalServerError:
+		return ErrorRequest
+	case status == http.StatusBadGateway:
+		return ErrorUpstream
+	}
+	return ErrorProxyInternal
+}
+
+// proxyError answers r with an error page for code, counts the error and
+// names it in the Proxy-Status header. The page is JSON when configured
+// or when the client accepts JSON, and plain text otherwise, unless error
+// page templates apply.
+func (s *Server) proxyError(w http.ResponseWriter, r *http.Request, code, msg string, status int) {
+	s.stats.errorCodes.add(code)
+	Annotate(r, ErrorAnnotation, code)
+	w.Header().Set("Proxy-Status", s.proxyStatus(code, msg))
+	s.hooks.error(r, status, msg)
+	s.writeErrorPage(w, r, code, msg, status, s.errorPages)
+}
+
+// writeErrorPage answers r with the page for the error of the first of
+// pages that has one, or the built-in page
+func (s *Server) writeErrorPage(w http.ResponseWriter, r *http.Request, code, msg string, status int, pages ...*errorTemplates) {
+	id := r.Header.Get(requestIDHeader)
+	if !s.cfg.RequestIDs {
+		id = ""
+	}
+	asJSON := s.cfg.JSONErrors || acceptsJSON(r.Header)
+	data := errorPageData(r, code, msg, status, id)
+	for _, p := range pages {
+		if p.render(w, r, data, asJSON) {
+			return
+		}
+	}
+	if asJSON {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorBody{Error: code, Message: msg, Status: status, RequestID: id})
+		return
+	}
+	if id != "" {
+		msg += " (request " + id + ")"
+	}
+	http.Error(w, msg, status)
+}
+
+// proxyStatus formats the Proxy-Status header of RFC 9209 for code
+func (s *Server) proxyStatus(code, details string) string {
+	name := s.cfg.ForwardedHeaders.ViaName
+	if name == "" {
+		name = "proxy"
+	}
+	return name + "; error=" + code + "; details=" + strconv.Quote(details)
+}
+
+// acceptsJSON reports whether h asks for JSON responses
+func acceptsJSON(h http.Header) bool {
+	for _, accept := range h.Values("Accept") {
+		if strings.Contains(accept, "application/json") {
+			return true
+		}
+	}
+	return false
+}
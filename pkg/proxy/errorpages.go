@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// ErrorPagesConfig renders the error responses of the proxy itself from
+// template files instead of plain text or ErrorBody. Responses relayed
+// from upstreams are left alone.
+type ErrorPagesConfig struct {
+	// HTML maps statuses such as "404", status classes such as "5xx" and
+	// "default" to html/template files executed with ErrorPageData, for
+	// clients that accept HTML; the most specific applies
+	HTML map[string]string
+	// JSON is a text/template file executed with ErrorPageData that
+	// produces the JSON error body in place of ErrorBody
+	JSON string
+}
+
+// ErrorPageData is the data available to error page templates
+type ErrorPageData struct {
+	Status     int
+	StatusText string
+	// Code is the error code, such as destination_unavailable
+	Code      string
+	Message   string
+	RequestID string
+	Host      string
+	Path      string
+	Time      time.Time
+}
+
+// errorTemplates are compiled error pages
+type errorTemplates struct {
+	html map[string]*htmltemplate.Template
+	json *texttemplate.Template
+	// log reports templates that fail to render
+	log *slog.Logger
+}
+
+// compileErrorPages reads and parses the templates of cfg, returning nil
+// when it has none
+func compileErrorPages(cfg ErrorPagesConfig) (*errorTemplates, error) {
+	if len(cfg.HTML) == 0 && cfg.JSON == "" {
+		return nil, nil
+	}
+	t := &errorTemplates{html: make(map[string]*htmltemplate.Template)}
+	for key, file := range cfg.HTML {
+		if !validErrorPageKey(key) {
+			return nil, fmt.Errorf("error page %q: want a status, a class such as 5xx or default", key)
+		}
+		page, err := parseHTMLPage(file)
+		if err != nil {
+			return nil, err
+		}
+		t.html[strings.ToLower(key)] = page
+	}
+	if cfg.JSON != "" {
+		page, err := parseJSONPage(cfg.JSON)
+		if err != nil {
+			return nil, err
+		}
+		t.json = page
+	}
+	return t, nil
+}
+
+// validErrorPageKey reports whether key names a status, a status class or
+// the default page
+func validErrorPageKey(key string) bool {
+	key = strings.ToLower(key)
+	if key == "default" {
+		return true
+	}
+	if len(key) == 3 && key[0] >= '4' && key[0] <= '5' && key[1:] == "xx" {
+		return true
+	}
+	status, err := strconv.Atoi(key)
+	return err == nil && status >= 400 && status <= 599
+}
+
+// parseHTMLPage reads and parses the html/template file
+func parseHTMLPage(file string) (*htmltemplate.Template, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	page, err := htmltemplate.New(file).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error page %s: %w", file, err)
+	}
+	return page, nil
+}
+
+// parseJSONPage reads and parses the text/template file, which has the
+// json function of endpoint templates to quote values
+func parseJSONPage(file string) (*texttemplate.Template, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	page, err := texttemplate.New(file).Funcs(endpointFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error page %s: %w", file, err)
+	}
+	return page, nil
+}
+
+// htmlPage returns the page for status, or nil
+func (t *errorTemplates) htmlPage(status int) *htmltemplate.Template {
+	code := strconv.Itoa(status)
+	for _, key := range []string{code, code[:1] + "xx", "default"} {
+		if page := t.html[key]; page != nil {
+			return page
+		}
+	}
+	return nil
+}
+
+// render answers r with the page of t for data, reporting false when t has
+// none for the client or it failed, so the built-in answer applies
+func (t *errorTemplates) render(w http.ResponseWriter, r *http.Request, data ErrorPageData, asJSON bool) bool {
+	if t == nil {
+		return false
+	}
+	var body bytes.Buffer
+	var err error
+	contentType := "text/html; charset=utf-8"
+	switch {
+	case asJSON && t.json != nil:
+		contentType = "application/json"
+		err = t.json.Execute(&body, data)
+	case !asJSON && acceptsHTML(r.Header):
+		page := t.htmlPage(data.Status)
+		if page == nil {
+			return false
+		}
+		err = page.Execute(&body, data)
+	default:
+		return false
+	}
+	if err != nil {
+		t.log.ErrorContext(r.Context(), "Error page template failed", "status", data.Status, "err", err)
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(data.Status)
+	if r.Method != http.MethodHead {
+		w.Write(body.Bytes())
+	}
+	return true
+}
+
+// errorPageData describes the error answering r
+func errorPageData(r *http.Request, code, msg string, status int, id string) ErrorPageData {
+	return ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       code,
+		Message:    msg,
+		RequestID:  id,
+		Host:       utils.StripPort(r.Host),
+		Path:       r.URL.Path,
+		Time:       time.Now(),
+	}
+}
+
+// acceptsHTML reports whether h asks for HTML responses, as browsers do
+func acceptsHTML(h http.Header) bool {
+	for _, accept := range h.Values("Accept") {
+		if strings.Contains(accept, "text/html") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrorReportingConfig ships proxy-side errors (panics and upstream
+// failures by class) to a Sentry-compatible endpoint. Errors are batched
+// and deduplicated: each flush sends one event per distinct error with the
+// number of times it occurred.
+type ErrorReportingConfig struct {
+	// DSN is the project DSN, e.g. https://key@sentry.example.com/42; empty
+	// disables reporting
+	DSN string
+	// Environment tags the events, e.g. "production"
+	Environment string
+	// FlushInterval is how often batched errors are sent; it defaults to 10s
+	FlushInterval time.Duration
+	// MaxEvents bounds the events sent per flush, dropping the rest; it
+	// defaults to 20
+	MaxEvents int
+	// SampleRate is the fraction of distinct errors reported; zero reports
+	// all of them
+	SampleRate float64
+}
+
+// maxPendingErrors bounds the distinct errors held between flushes
+const maxPendingErrors = 1000
+
+// errorGroup is one distinct error and how often it occurred
+type errorGroup struct {
+	kind    string
+	message string
+	example string
+	count   int
+	first   time.Time
+	last    time.Time
+}
+
+// errorReporter batches errors and sends them on every flush
+type errorReporter struct {
+	cfg      ErrorReportingConfig
+	dsn      string
+	endpoint string
+	auth     string
+	client   *http.Client
+	log      *slog.Logger
+
+	mu      sync.Mutex
+	pending map[string]*errorGroup
+	dropped int
+	// retryAt honours the endpoint's rate limiting
+	retryAt time.Time
+}
+
+// newErrorReporter parses the DSN and applies defaults
+func newErrorReporter(cfg ErrorReportingConfig) (*errorReporter, error) {
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil || (dsn.Scheme != "http" && dsn.Scheme != "https") || dsn.User == nil || dsn.Host == "" {
+		return nil, fmt.Errorf("invalid DSN %q", cfg.DSN)
+	}
+	prefix, project := "", strings.TrimPrefix(dsn.Path, "/")
+	if i := strings.LastIndex(project, "/"); i != -1 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" {
+		return nil, errors.New("DSN has no project ID")
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 10 * time.Second
+	}
+	if cfg.MaxEvents <= 0 {
+		cfg.MaxEvents = 20
+	}
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		cfg.SampleRate = 1
+	}
+
+	auth := "Sentry sentry_version=7, sentry_client=go-multithreaded-proxy/1.0, sentry_key=" + dsn.User.Username()
+	if secret, ok := dsn.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return &errorReporter{
+		cfg:      cfg,
+		dsn:      cfg.DSN,
+		endpoint: dsn.Scheme + "://" + dsn.Host + prefix + "/api/" + project + "/envelope/",
+		auth:     auth,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		pending:  make(map[string]*errorGroup),
+	}, nil
+}
+
+// add records an occurrence of the error identified by kind and message,
+// keeping example as the latest detail
+func (r *errorReporter) add(kind, message, example string) {
+	if r == nil {
+		return
+	}
+	fingerprint := kind + "\x00" + message
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	group, found := r.pending[fingerprint]
+	if !found {
+		if len(r.pending) >= maxPendingErrors {
+			r.dropped++
+			return
+		}
+		group = &errorGroup{kind: kind, message: message, first: now}
+		r.pending[fingerprint] = group
+	}
+	group.count++
+	group.last = now
+	group.example = example
+}
+
+// run flushes the batched errors every FlushInterval until ctx is done
+func (r *errorReporter) run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush(ctx)
+		}
+	}
+}
+
+// flush sends a sample of the batched errors, at most MaxEvents of them
+func (r *errorReporter) flush(ctx context.Context) {
+	r.mu.Lock()
+	pending, dropped := r.pending, r.dropped
+	r.pending, r.dropped = make(map[string]*errorGroup), 0
+	limited := time.Now().Before(r.retryAt)
+	r.mu.Unlock()
+
+	if limited {
+		dropped += len(pending)
+		pending = nil
+	}
+	sent, seen := 0, 0
+	for _, group := range pending {
+		seen++
+		if sent == r.cfg.MaxEvents || rand.Float64() >= r.cfg.SampleRate {
+			dropped++
+			continue
+		}
+		if err := r.send(ctx, group); err != nil {
+			r.log.Warn("Error report failed", "err", err)
+			dropped += len(pending) - seen + 1
+			break
+		}
+		sent++
+	}
+	if dropped > 0 {
+		r.log.Warn("Error reports dropped", "count", dropped)
+	}
+}
+
+// send posts group as a Sentry envelope holding one event
+func (r *errorReporter) send(ctx context.Context, group *errorGroup) error {
+	eventID := fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+	host, _ := os.Hostname()
+	event, err := json.Marshal(map[string]any{
+		"event_id":    eventID,
+		"timestamp":   group.last.UTC().Format(time.RFC3339),
+		"level":       "error",
+		"logger":      "proxy",
+		"platform":    "go",
+		"server_name": host,
+		"environment": r.cfg.Environment,
+		"message":     map[string]string{"formatted": group.message},
+		"fingerprint": []string{group.kind, group.message},
+		"tags":        map[string]string{"kind": group.kind},
+		"extra": map[string]any{
+			"count":      group.count,
+			"first_seen": group.first.UTC().Format(time.RFC3339),
+			"example":    group.example,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	header, _ := json.Marshal(map[string]string{"event_id": eventID, "dsn": r.dsn, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(event)})
+	for _, line := range [][]byte{header, item, event} {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			wait = 60
+		}
+		r.mu.Lock()
+		r.retryAt = time.Now().Add(time.Duration(wait) * time.Second)
+		r.mu.Unlock()
+		return errors.New("rate limited by the error tracker")
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error tracker answered %s", resp.Status)
+	}
+	return nil
+}
+
+// reportUpstreamError counts a failed upstream exchange with host and
+// reports it under the class of err
+func (s *Server) reportUpstreamError(host string, err error) {
+	s.stats.UpstreamErrors.Add(1)
+	if s.errorReports == nil {
+		return
+	}
+	class := upstreamErrorClass(err)
+	s.errorReports.add("upstream", "Upstream "+class+" error", host+": "+err.Error())
+}
+
+// upstreamErrorClass names the kind of failure behind an upstream error
+func upstreamErrorClass(err error) string {
+	var phase *phaseError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &phase), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "DNS"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &certErr), errors.As(err, &recordErr):
+		return "TLS"
+	}
+	return "transport"
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// Uploads with "Expect: 100-continue" keep the header upstream. The
+// transport then holds the body back until the origin answers 100 Continue
+// (or TransportConfig.ExpectContinueTimeout passes), and only reading the
+// body makes the server send 100 Continue to the client, so a rejected
+// upload is answered without either side transferring the body.
+
+// interimRelay passes informational responses such as 103 Early Hints from
+// the origin to the client until the final response arrives
+type interimRelay struct {
+	mu   sync.Mutex
+	w    http.ResponseWriter
+	done bool
+}
+
+// withInterimRelay returns req reporting its interim responses to w
+func withInterimRelay(req *http.Request, w http.ResponseWriter) (*http.Request, *interimRelay) {
+	relay := &interimRelay{w: w}
+	trace := &httptrace.ClientTrace{Got1xxResponse: relay.got1xx}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), relay
+}
+
+func (ir *interimRelay) got1xx(code int, header textproto.MIMEHeader) error {
+	// The server sends its own 100 Continue once the body is read
+	if code == http.StatusContinue {
+		return nil
+	}
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	if ir.done {
+		return nil
+	}
+	h := ir.w.Header()
+	saved := h.Clone()
+	for name, values := range header {
+		h[name] = values
+	}
+	removeHopHeaders(h)
+	ir.w.WriteHeader(code)
+	// Interim headers must not leak into the final response
+	for name := range h {
+		delete(h, name)
+	}
+	for name, values := range saved {
+		h[name] = values
+	}
+	return nil
+}
+
+// finish stops relaying, before the final response is written
+func (ir *interimRelay) finish() {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	ir.done = true
+}
+
+// hasBody reports whether req carries a request body
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// replayable reports whether req may be sent more than once: its method
+// must be idempotent and its body, if any, able to be read again
+func replayable(req *http.Request) bool {
+	return idempotent(req.Method) && (!hasBody(req) || req.GetBody != nil)
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// ExpvarCounters are the core counters served under "proxy" with the
+// runtime's memstats at GET /debug/vars on the admin listener
+type ExpvarCounters struct {
+	Requests       int64 `json:"requests"`
+	CacheHits      int64 `json:"cache_hits"`
+	CacheMisses    int64 `json:"cache_misses"`
+	UpstreamErrors int64 `json:"upstream_errors"`
+	// BytesSent counts response and tunnel bytes sent to clients
+	BytesSent   int64 `json:"bytes_sent"`
+	InFlight    int64 `json:"in_flight"`
+	Connections int64 `json:"connections"`
+}
+
+// expvarCounters returns the core counters of the proxy
+func (s *Server) expvarCounters() ExpvarCounters {
+	totals := s.stats.totals()
+	return ExpvarCounters{
+		Requests:       totals.requests,
+		CacheHits:      totals.cacheHits,
+		CacheMisses:    totals.cacheMisses,
+		UpstreamErrors: s.stats.UpstreamErrors.Load(),
+		BytesSent:      totals.bytes,
+		InFlight:       s.stats.InFlight.Load(),
+		Connections:    s.stats.Connections.Load(),
+	}
+}
+
+// handleVars serves the published expvars as expvar.Handler does, adding
+// the counters of this proxy under "proxy"; they are not published, as
+// each server of the process has its own
+func (s *Server) handleVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	counters, _ := json.Marshal(s.expvarCounters())
+	fmt.Fprintf(w, "%q: %s\n}\n", "proxy", counters)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/logging"
+)
+
+// The fast hit path answers a plain forward-proxy GET straight from the
+// memory cache without heap allocations: the cache key is built in a
+// pooled buffer and looked up without converting it to a string, and log
+// lines are written from pooled buffers. It only applies when no enabled
+// feature needs the full pipeline, so features that act on every request
+// must be listed in fastHitsAllowed, or in fastHitEligible when they can be
+// switched on at run time, and added to TestFastHitsYieldToFeatures, which
+// fails for any it finds skipped; anything unusual about a request falls
+// back to the regular path, which repeats the lookup.
+
+// fastHitsAllowed reports whether the configuration of s allows the fast
+// hit path at all; it is decided once, when s is configured
+func (s *Server) fastHitsAllowed() bool {
+	switch {
+	case s.cfg.Mode != ModeForward:
+		return false
+	case s.cfg.RequestIDs || s.hooks != nil || s.journal != nil || s.accessLog != nil || s.tracer != nil || s.workers != nil || s.egress != nil || s.signer != nil || s.rewrites != nil || s.geo != nil || s.proxyUsers != nil || s.proxyTokens != nil || s.pipeline.custom || s.scriptRules != nil || s.stubs != nil || s.hostHeaderRules != nil || s.plugins.authenticates():
+		return false
+	// Fast hits log without slog, which a logger given to the server rules
+	// out
+	case s.cfg.HTTP3.Listen || s.cfg.Prefetch.MinAge > 0 || s.cfg.PAC.Enabled || !s.log.Preformatted():
+		return false
+	}
+	return true
+}
+
+// fastHitEligible reports whether the state of s and r allow the fast hit
+// path, given that its configuration does
+func (s *Server) fastHitEligible(r *http.Request) bool {
+	u := r.URL
+	switch {
+	case r.Method != http.MethodGet:
+		return false
+	case u.Scheme != "http" && u.Scheme != "https":
+		return false
+	case u.Host == "" || u.Host != r.Host || u.User != nil || u.Opaque != "" || u.Fragment != "" || u.ForceQuery:
+		return false
+	case r.TLS != nil || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "":
+		return false
+	// Captures, rate limits and chaos can be switched on at run time
+	case s.capturing.Load() || s.limiter.Load() != nil || s.chaos.active():
+		return false
+	case s.cfg.Compression.Enabled && acceptsGzip(r.Header):
+		return false
+	}
+	return !isSelf(r)
+}
+
+// fastHitBuffer holds the cache key and log lines of one request
+type fastHitBuffer struct {
+	key  []byte
+	line []byte
+}
+
+var fastHitBuffers = sync.Pool{New: func() any {
+	return &fastHitBuffer{key: make([]byte, 0, 256), line: make([]byte, 0, 256)}
+}}
+
+// appendTargetURL appends the URL of a forward-proxy request to b, in the
+// form url.URL.String produces for the URLs fastHitEligible admits
+func appendTargetURL(b []byte, r *http.Request) []byte {
+	b = append(b, r.URL.Scheme...)
+	b = append(b, "://"...)
+	b = append(b, r.URL.Host...)
+	b = append(b, r.URL.EscapedPath()...)
+	if r.URL.RawQuery != "" {
+		b = append(b, '?')
+		b = append(b, r.URL.RawQuery...)
+	}
+	return b
+}
+
+// serveFastHit serves r from the memory cache if it can, reporting whether
+// it did
+func (s *Server) serveFastHit(w http.ResponseWriter, r *http.Request) bool {
+	if !s.fastHits || !s.fastHitEligible(r) {
+		return false
+	}
+	route, found := s.routes.Load().Match(r)
+	if found && (len(route.Terminate) > 0 || len(route.DeviceClasses) > 0 || !route.ResponseHeaders.empty() || s.maintenance.inMaintenance(route)) {
+		return false
+	}
+	if s.bypass.Match(r.URL) || !s.toggles.Enabled(ToggleCaching, route) {
+		return false
+	}
+	// Refusals are answered by the regular path
+	if ok, _ := s.currentDestinationACL().Check(r.URL.Host); !ok {
+		return false
+	}
+	if b := s.blocklist.Load(); b != nil && b.blocks(r.URL.Host) {
+		return false
+	}
+
+	buf := fastHitBuffers.Get().(*fastHitBuffer)
+	defer fastHitBuffers.Put(buf)
+	buf.key = appendTargetURL(buf.key[:0], r)
+	if !s.variants.plain(buf.key) {
+		return false
+	}
+	cached, found := s.cache.GetBytes(buf.key)
+	if !found {
+		return false
+	}
+
+	start := time.Now()
+	class := s.classifier.Classify(r)
+	origin := s.stats.origins.get(r.URL.Host)
+	origin.Hits.Add(1)
+	origin.BytesSaved.Add(int64(len(cached.Body)))
+	// The cached headers are never modified, so they are shared rather
+	// than copied
+	header := w.Header()
+	for name, values := range cached.Header {
+		header[name] = values
+	}
+	w.WriteHeader(cached.Status)
+	n, _ := w.Write(cached.Body)
+	elapsed := time.Since(start)
+	s.stats.classes.record(class, cached.Status, int64(n), elapsed)
+	buf.logCompleted(s.log, r, class, cached.Status, elapsed)
+	return true
+}
+
+// logCompleted logs the request as logCompleted in the regular path
+// would, without allocating
+func (b *fastHitBuffer) logCompleted(log *logging.Logger, r *http.Request, class string, status int, elapsed time.Duration) {
+	if !log.Enabled(r.Context(), slog.LevelInfo) {
+		return
+	}
+	var rec logging.Record
+	rec.Start(log, b.line, slog.LevelInfo, "Request completed")
+	rec.String("method", r.Method)
+	rec.String("host", r.Host)
+	rec.Bytes("url", b.key)
+	rec.Int("status", int64(status))
+	rec.Float("duration_ms", float64(elapsed.Microseconds())/1000)
+	rec.String("cache", "hit")
+	if class != defaultTrafficClass {
+		rec.String("class", class)
+	}
+	b.line = rec.End()
+}
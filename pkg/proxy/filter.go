@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ContentFilterConfig blocks upstream responses by content type, size or
+// body content, answering with a block page instead. Bypassed destinations
+// are not filtered.
+type ContentFilterConfig struct {
+	// DenyTypes lists the media types refused, which may use "type/*"
+	// wildcards, e.g. "application/x-msdownload"
+	DenyTypes []string
+	// MaxBytes refuses bodies larger than this; zero disables the check
+	MaxBytes int64
+	// Keywords are refused in textual bodies, matched case-insensitively
+	Keywords []string
+	// Patterns are regular expressions refused in textual bodies
+	Patterns []string
+	// BlockPage is an html/template file rendered with the URL and Reason
+	// of the blocked response; empty uses a built-in page
+	BlockPage string
+	// Status is the status of the block page; it defaults to 403
+	Status int
+}
+
+// defaultBlockPage is rendered when no BlockPage is configured
+const defaultBlockPage = `<!DOCTYPE html>
+<html><head><title>Content blocked</title></head>
+<body><h1>Content blocked</h1><p>{{.URL}} was blocked: {{.Reason}}.</p></body></html>
+`
+
+// contentFilter is the compiled ContentFilterConfig
+type contentFilter struct {
+	denyTypes []string
+	maxBytes  int64
+	patterns  []*regexp.Regexp
+	page      *template.Template
+	status    int
+}
+
+// compileContentFilter validates cfg, returning nil when it filters nothing
+func compileContentFilter(cfg ContentFilterConfig) (*contentFilter, error) {
+	if len(cfg.DenyTypes) == 0 && cfg.MaxBytes <= 0 && len(cfg.Keywords) == 0 && len(cfg.Patterns) == 0 {
+		return nil, nil
+	}
+	f := &contentFilter{denyTypes: cfg.DenyTypes, maxBytes: cfg.MaxBytes, status: cfg.Status}
+	if f.status == 0 {
+		f.status = http.StatusForbidden
+	}
+	if f.status < 200 || f.status > 599 {
+		return nil, fmt.Errorf("invalid block status %d", f.status)
+	}
+	for _, keyword := range cfg.Keywords {
+		f.patterns = append(f.patterns, regexp.MustCompile("(?i)"+regexp.QuoteMeta(keyword)))
+	}
+	for _, pattern := range cfg.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	page := defaultBlockPage
+	if cfg.BlockPage != "" {
+		data, err := os.ReadFile(cfg.BlockPage)
+		if err != nil {
+			return nil, err
+		}
+		page = string(data)
+	}
+	tmpl, err := template.New("block").Parse(page)
+	if err != nil {
+		return nil, err
+	}
+	f.page = tmpl
+	return f, nil
+}
+
+// textual reports whether contentType names a body worth scanning for
+// keywords
+func textual(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+xml"), strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/xhtml+xml":
+		return true
+	}
+	return false
+}
+
+// check returns why resp must be blocked, or "". Bodies it reads are put
+// back for relaying. decoded tells whether the body is plaintext and so
+// may be scanned, and limit bounds the body buffered to scan it.
+func (f *contentFilter) check(resp *http.Response, decoded bool, limit int64) string {
+	contentType := resp.Header.Get("Content-Type")
+	if len(f.denyTypes) > 0 && contentTypeAllowed(f.denyTypes, contentType) {
+		return "content type " + contentType + " is not allowed"
+	}
+	if f.maxBytes > 0 {
+		if resp.ContentLength > f.maxBytes {
+			return "body is too large"
+		}
+		if resp.ContentLength < 0 {
+			body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+			if int64(len(body)) > f.maxBytes {
+				return "body is too large"
+			}
+			if err != nil {
+				return "body could not be read"
+			}
+			replaceBody(resp, body)
+		}
+	}
+	if len(f.patterns) == 0 || !decoded || !textual(contentType) {
+		return ""
+	}
+	body, ok := bufferBody(resp, limit)
+	if !ok {
+		return ""
+	}
+	replaceBody(resp, body)
+	for _, re := range f.patterns {
+		if re.Match(body) {
+			return "body matches " + re.String()
+		}
+	}
+	return ""
+}
+
+// filterContent answers with the block page when the content filter refuses
+// resp, and reports whether the response may be relayed
+func (s *Server) filterContent(w http.ResponseWriter, r *http.Request, target *url.URL, resp *http.Response, decoded bool) bool {
+	if s.filter == nil || s.bypass.Match(target) {
+		return true
+	}
+	reason := s.filter.check(resp, decoded, s.inspectLimit())
+	if reason == "" {
+		return true
+	}
+	s.stats.ContentBlocked.Add(1)
+	s.auditRequest(r, AuditContentFilter, reason, s.filter.status)
+	s.log.InfoContext(r.Context(), "Content blocked", "url", target.String(), "reason", reason)
+	var page bytes.Buffer
+	if err := s.filter.page.Execute(&page, struct{ URL, Reason string }{target.String(), reason}); err != nil {
+		s.log.ErrorContext(r.Context(), "Block page template failed", "err", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set(denyReasonHeader, reason)
+	w.WriteHeader(s.filter.status)
+	w.Write(page.Bytes())
+	return false
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ForwardedHeadersConfig controls the X-Forwarded-* and Via headers added
+// to upstream requests
+type ForwardedHeadersConfig struct {
+	// Enabled adds X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+	Enabled bool
+	// TrustIncoming appends to X-Forwarded-* values sent by the client, as
+	// when running behind another trusted proxy; otherwise they are replaced
+	TrustIncoming bool
+	// ViaName identifies this proxy in Via headers; empty disables Via.
+	// Requests whose Via already names it are refused as loops, so chained
+	// proxies need distinct names.
+	ViaName string
+}
+
+// addForwardedHeaders describes the client of r to the origin in h
+func (s *Server) addForwardedHeaders(h http.Header, r *http.Request) {
+	cfg := s.cfg.ForwardedHeaders
+	if cfg.Enabled {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+
+		if cfg.TrustIncoming {
+			if prior := h.Get("X-Forwarded-For"); prior != "" {
+				h.Set("X-Forwarded-For", prior+", "+clientIP(r))
+			} else {
+				h.Set("X-Forwarded-For", clientIP(r))
+			}
+			if h.Get("X-Forwarded-Proto") == "" {
+				h.Set("X-Forwarded-Proto", proto)
+			}
+			if h.Get("X-Forwarded-Host") == "" {
+				h.Set("X-Forwarded-Host", r.Host)
+			}
+		} else {
+			h.Set("X-Forwarded-For", clientIP(r))
+			h.Set("X-Forwarded-Proto", proto)
+			h.Set("X-Forwarded-Host", r.Host)
+		}
+	}
+	s.addVia(h, r.ProtoMajor, r.ProtoMinor)
+}
+
+// addVia appends this proxy to the Via header of a forwarded message
+func (s *Server) addVia(h http.Header, major, minor int) {
+	if s.cfg.ForwardedHeaders.ViaName == "" {
+		return
+	}
+	// Built without fmt, as it is on every message
+	h.Add("Via", strconv.Itoa(major)+"."+strconv.Itoa(minor)+" "+s.cfg.ForwardedHeaders.ViaName)
+}
+
+// checkLoop answers 508 when the Via header of r shows it already passed
+// this proxy, as when a route or target leads back to the proxy itself. It
+// reports whether r may proceed.
+func (s *Server) checkLoop(w http.ResponseWriter, r *http.Request) bool {
+	name := s.cfg.ForwardedHeaders.ViaName
+	if name == "" {
+		return true
+	}
+	for _, value := range r.Header.Values("Via") {
+		for _, hop := range strings.Split(value, ",") {
+			// Each hop is a protocol version, a name and an optional comment
+			if fields := strings.Fields(hop); len(fields) >= 2 && fields[1] == name {
+				s.httpError(w, r, "Request loop detected", http.StatusLoopDetected)
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// GeoIPConfig places clients and destinations in countries using
+// MaxMind-style CSV databases, to allow or deny them by ISO country code
+// and to tag requests for traffic analysis. Addresses the database does not
+// place, such as private networks, are never refused by country.
+type GeoIPConfig struct {
+	// Blocks are CSV files mapping networks to countries: GeoLite2 or
+	// GeoIP2 Country blocks files, resolved through Locations, or files
+	// whose first two columns are a network and a country code
+	Blocks []string
+	// Locations is the Country Locations CSV file resolving the geoname_id
+	// of MaxMind blocks files to country codes
+	Locations string
+	// AllowClients, when set, lists the only client countries served
+	AllowClients []string
+	// DenyClients lists client countries refused
+	DenyClients []string
+	// AllowDestinations, when set, lists the only destination countries
+	// reachable in forward mode
+	AllowDestinations []string
+	// DenyDestinations lists destination countries refused
+	DenyDestinations []string
+}
+
+// Annotations set by the GeoIP policy
+var (
+	// ClientCountryAnnotation is the country code of the client address
+	ClientCountryAnnotation = NewAnnotationKey[string]("client_country")
+	// DestinationCountryAnnotation is the country code of the destination
+	DestinationCountryAnnotation = NewAnnotationKey[string]("destination_country")
+)
+
+// geoNetwork is one network of the database
+type geoNetwork struct {
+	prefix  netip.Prefix
+	country string
+}
+
+// geoDatabase looks addresses up in networks sorted by their first address
+type geoDatabase struct {
+	networks []geoNetwork
+	cfg      GeoIPConfig
+}
+
+// loadGeoDatabase reads the CSV files of cfg
+func loadGeoDatabase(cfg GeoIPConfig) (*geoDatabase, error) {
+	locations := map[string]string{}
+	if cfg.Locations != "" {
+		err := readCSV(cfg.Locations, func(column func(string) string, row []string) error {
+			if id := column("geoname_id"); id != "" {
+				locations[id] = strings.ToUpper(column("country_iso_code"))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db := &geoDatabase{cfg: cfg}
+	for _, file := range cfg.Blocks {
+		err := readCSV(file, func(column func(string) string, row []string) error {
+			network, country := row[0], ""
+			if column("network") == "" {
+				// Headerless network,country rows
+				if len(row) > 1 {
+					country = row[1]
+				}
+			} else if country = column("country_iso_code"); country == "" {
+				id := column("geoname_id")
+				if id == "" {
+					id = column("registered_country_geoname_id")
+				}
+				country = locations[id]
+			}
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return fmt.Errorf("invalid network %q", network)
+			}
+			if country != "" {
+				db.networks = append(db.networks, geoNetwork{prefix.Masked(), strings.ToUpper(country)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(db.networks, func(a, b geoNetwork) int {
+		return a.prefix.Addr().Compare(b.prefix.Addr())
+	})
+	return db, nil
+}
+
+// readCSV calls fn for every data row of a CSV file. column returns the
+// value of a named column when the file has a header row, and "" otherwise.
+func readCSV(path string, fn func(column func(string) string, row []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+
+	var header map[string]int
+	var row []string
+	column := func(name string) string {
+		if i, found := header[name]; found && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	for n := 1; ; n++ {
+		row, err = r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if n == 1 {
+			if _, err := netip.ParsePrefix(row[0]); err != nil {
+				header = make(map[string]int)
+				for i, name := range row {
+					header[name] = i
+				}
+				continue
+			}
+		}
+		if err := fn(column, row); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+}
+
+// country returns the country code of addr, or "" when it is not placed
+func (db *geoDatabase) country(addr netip.Addr) string {
+	addr = addr.Unmap()
+	i, found := slices.BinarySearchFunc(db.networks, addr, func(n geoNetwork, a netip.Addr) int {
+		return n.prefix.Addr().Compare(a)
+	})
+	if !found {
+		i--
+	}
+	if i >= 0 && db.networks[i].prefix.Contains(addr) {
+		return db.networks[i].country
+	}
+	return ""
+}
+
+// countryAllowed applies an allow and a deny list to country
+func countryAllowed(country string, allow, deny []string) bool {
+	if country == "" {
+		return true
+	}
+	if slices.ContainsFunc(deny, func(c string) bool { return strings.EqualFold(c, country) }) {
+		return false
+	}
+	return len(allow) == 0 || slices.ContainsFunc(allow, func(c string) bool { return strings.EqualFold(c, country) })
+}
+
+// checkClientCountry tags r with the country of its client, counts it and
+// answers 403 when the client country is refused. It reports whether r may
+// proceed.
+func (s *Server) checkClientCountry(w http.ResponseWriter, r *http.Request) bool {
+	if s.geo == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return true
+	}
+	country := s.geo.country(addr)
+	if country == "" {
+		return true
+	}
+	Annotate(r, ClientCountryAnnotation, country)
+	s.stats.countries.add(country)
+	if countryAllowed(country, s.geo.cfg.AllowClients, s.geo.cfg.DenyClients) {
+		return true
+	}
+	s.stats.GeoDenied.Add(1)
+	s.auditRequest(r, AuditGeoIP, "client country "+country, http.StatusForbidden)
+	w.Header().Set(denyReasonHeader, "client country "+country)
+	s.httpError(w, r, "Access from your country is not allowed", http.StatusForbidden)
+	return false
+}
+
+// checkDestinationCountry tags r with the country of host and answers 403
+// when any of its addresses lies in a refused country. It reports whether
+// r may proceed.
+func (s *Server) checkDestinationCountry(w http.ResponseWriter, r *http.Request, host string) bool {
+	country, allowed := s.destinationCountry(r.Context(), host)
+	if country != "" {
+		Annotate(r, DestinationCountryAnnotation, country)
+	}
+	if allowed {
+		return true
+	}
+	s.stats.GeoDenied.Add(1)
+	s.auditRequest(r, AuditGeoIP, "destination country "+country, http.StatusForbidden)
+	w.Header().Set(denyReasonHeader, "destination country "+country)
+	s.httpError(w, r, "Destination not allowed", http.StatusForbidden)
+	return false
+}
+
+// destinationCountry looks host up, pinning its addresses in ctx, and
+// reports whether none of them lies in a refused country, with the country
+// of the refused address or else of the last located one
+func (s *Server) destinationCountry(ctx context.Context, host string) (string, bool) {
+	if s.geo == nil {
+		return "", true
+	}
+	addrs, err := s.lookupPinned(ctx, utils.StripPort(host))
+	if err != nil {
+		// The dial reports the failure
+		return "", true
+	}
+	located := ""
+	for _, ipAddr := range addrs {
+		addr, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok {
+			continue
+		}
+		country := s.geo.country(addr)
+		if country == "" {
+			continue
+		}
+		if !countryAllowed(country, s.geo.cfg.AllowDestinations, s.geo.cfg.DenyDestinations) {
+			return country, false
+		}
+		located = country
+	}
+	return located, true
+}
+
+// countryTable counts requests by client country
+type countryTable struct {
+	mu     sync.RWMutex
+	counts map[string]*atomic.Int64
+}
+
+// add counts one request from country
+func (t *countryTable) add(country string) {
+	t.mu.RLock()
+	c, found := t.counts[country]
+	t.mu.RUnlock()
+	if !found {
+		t.mu.Lock()
+		if t.counts == nil {
+			t.counts = make(map[string]*atomic.Int64)
+		}
+		if c, found = t.counts[country]; !found {
+			c = new(atomic.Int64)
+			t.counts[country] = c
+		}
+		t.mu.Unlock()
+	}
+	c.Add(1)
+}
+
+// snapshot copies the counts
+func (t *countryTable) snapshot() map[string]int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.counts) == 0 {
+		return nil
+	}
+	out := make(map[string]int64, len(t.counts))
+	for country, c := range t.counts {
+		out[country] = c.Load()
+	}
+	return out
+}
@@ -0,0 +1,303 @@
+//go:build !minimal && !nogrpc
+
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The management gRPC API is defined in api/management.proto. It is served
+// with the standard library's cleartext HTTP/2 support and a minimal
+// protobuf codec, so it adds no dependencies.
+
+// gRPC status codes used by the management API
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcMaxMessageSize is the largest request message accepted, gRPC's own
+// default
+const grpcMaxMessageSize = 4 << 20
+
+// errGRPCMessageTooLarge is returned for messages over grpcMaxMessageSize
+var errGRPCMessageTooLarge = fmt.Errorf("message larger than %d bytes", grpcMaxMessageSize)
+
+// Health statuses of HealthResponse
+const (
+	healthServing    = 1
+	healthNotServing = 2
+)
+
+// grpcService is the full name of the management service
+const grpcService = "/proxy.management.v1.Management/"
+
+func init() {
+	registerSubsystem("grpc")
+}
+
+// startGRPC serves the management gRPC API on addr in the background,
+// returning the server so that it can be shut down. Calls need an admin
+// token in their authorization metadata when operators is not nil.
+func (s *Server) startGRPC(addr string, operators *tokenDatabase) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+grpcService+"Purge", grpcUnary(s.grpcPurge))
+	mux.HandleFunc("POST "+grpcService+"GetStats", grpcUnary(s.grpcGetStats))
+	mux.HandleFunc("POST "+grpcService+"GetConfig", grpcUnary(s.grpcGetConfig))
+	mux.HandleFunc("POST "+grpcService+"Health", grpcUnary(s.grpcHealth))
+	mux.HandleFunc("POST "+grpcService+"WatchStats", s.grpcWatchStats)
+
+	var handler http.Handler = mux
+	if operators != nil {
+		handler = s.requireGRPCOperator(operators, mux)
+	} else {
+		s.log.Warn("Management gRPC API is not authenticated; set AdminTokens unless it is on loopback", "addr", addr)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	go func() {
+		ln, err := s.listenGuarded("tcp", addr)
+		if err != nil {
+			s.log.Error("Management gRPC API failed", "err", err)
+			return
+		}
+		s.log.Info("Management gRPC API is running", "addr", addr)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.log.Error("Management gRPC API failed", "err", err)
+		}
+	}()
+	return srv
+}
+
+// requireGRPCOperator fails calls without a valid bearer token with
+// UNAUTHENTICATED, and logs the operator behind every call that changes
+// state
+func (s *Server) requireGRPCOperator(operators *tokenDatabase, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operator, ok := operators.identify(r)
+		if !ok {
+			w.Header().Set("Content-Type", "application/grpc")
+			writeGRPCStatus(w, grpcUnauthenticated, "missing or invalid admin token")
+			return
+		}
+		if r.URL.Path == grpcService+"Purge" {
+			s.log.Info("Admin call", "operator", operator, "method", r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcUnary adapts a unary method implementation to an HTTP handler
+func grpcUnary(method func(req protoMessage) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		req, ok := readGRPCRequest(w, r)
+		if !ok {
+			return
+		}
+		resp, err := method(req)
+		if err != nil {
+			writeGRPCStatus(w, grpcInternal, err.Error())
+			return
+		}
+
+		writeGRPCMessage(w, resp)
+		writeGRPCStatus(w, grpcOK, "")
+	}
+}
+
+func (s *Server) grpcPurge(req protoMessage) ([]byte, error) {
+	purged := s.cacheDelete(string(req.bytes(1)))
+	return appendProtoBool(nil, 1, purged), nil
+}
+
+func (s *Server) grpcGetStats(protoMessage) ([]byte, error) {
+	return encodeStats(s.stats.Snapshot()), nil
+}
+
+// grpcGetConfig returns the configuration as the admin API's /config
+// reports it, secrets masked
+func (s *Server) grpcGetConfig(protoMessage) ([]byte, error) {
+	data, err := json.Marshal(s.activeConfig())
+	if err != nil {
+		return nil, err
+	}
+	return appendProtoBytes(nil, 1, data), nil
+}
+
+// grpcHealth reports NOT_SERVING while draining or shutting down, like
+// /readyz
+func (s *Server) grpcHealth(protoMessage) ([]byte, error) {
+	if s.draining.Load() || s.shuttingDown() {
+		return appendProtoVarint(nil, 1, healthNotServing), nil
+	}
+	return appendProtoVarint(nil, 1, healthServing), nil
+}
+
+// grpcWatchStats streams a Stats message every interval until the client
+// cancels the call
+func (s *Server) grpcWatchStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	req, ok := readGRPCRequest(w, r)
+	if !ok {
+		return
+	}
+	interval := time.Duration(req.varint(1)) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		writeGRPCMessage(w, encodeStats(s.stats.Snapshot()))
+		http.NewResponseController(w).Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// encodeStats encodes a snapshot as a Stats message
+func encodeStats(snapshot StatsSnapshot) []byte {
+	var msg []byte
+	for name, value := range snapshot.Counters() {
+		entry := appendProtoBytes(nil, 1, []byte(name))
+		entry = appendProtoVarint(entry, 2, uint64(value))
+		msg = appendProtoBytes(msg, 1, entry)
+	}
+	return appendProtoVarint(msg, 2, uint64(time.Now().UnixMilli()))
+}
+
+// readGRPCRequest reads and decodes the request message of a call, failing
+// the call when it cannot
+func readGRPCRequest(w http.ResponseWriter, r *http.Request) (protoMessage, bool) {
+	msg, err := readGRPCMessage(r.Body)
+	if errors.Is(err, errGRPCMessageTooLarge) {
+		writeGRPCStatus(w, grpcResourceExhausted, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return nil, false
+	}
+	req, err := parseProto(msg)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return nil, false
+	}
+	return req, true
+}
+
+// readGRPCMessage reads one length-prefixed, uncompressed gRPC message of
+// at most grpcMaxMessageSize bytes
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, errGRPCMessageTooLarge
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// writeGRPCMessage writes msg with the gRPC length prefix
+func writeGRPCMessage(w io.Writer, msg []byte) {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	w.Write(prefix[:])
+	w.Write(msg)
+}
+
+// writeGRPCStatus sets the gRPC status trailers
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+	}
+}
+
+// protoMessage holds the decoded fields of a protobuf message. Only varint
+// and length-delimited fields are supported, which covers the management API.
+type protoMessage map[int]protoField
+
+type protoField struct {
+	varint uint64
+	bytes  []byte
+}
+
+func (m protoMessage) varint(field int) uint64 { return m[field].varint }
+func (m protoMessage) bytes(field int) []byte  { return m[field].bytes }
+
+// parseProto decodes the wire format of a protobuf message
+func parseProto(b []byte) (protoMessage, error) {
+	msg := make(protoMessage)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("malformed protobuf tag")
+		}
+		b = b[n:]
+
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errors.New("malformed protobuf varint")
+			}
+			msg[field] = protoField{varint: v}
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, errors.New("malformed protobuf length")
+			}
+			msg[field] = protoField{bytes: b[n : n+int(size)]}
+			b = b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+	}
+	return msg, nil
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, field, 1)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,9 @@
+//go:build minimal || nogrpc
+
+package proxy
+
+import "net/http"
+
+// startGRPC is never reached in builds without the management gRPC API,
+// since requireSubsystem rejects the configuration first
+func (s *Server) startGRPC(addr string, operators *tokenDatabase) *http.Server { return nil }
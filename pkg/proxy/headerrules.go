@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// HeaderRules edit the headers of a message: Remove deletes headers, then
+// Set replaces their values and Add appends values to them. Names to
+// remove may end in "*" to match a prefix, e.g. "X-Debug-*".
+type HeaderRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// apply edits h
+func (rules HeaderRules) apply(h http.Header) {
+	if len(rules.Remove) > 0 {
+		remove := headerPattern(rules.Remove)
+		for name := range h {
+			if remove.matches(name) {
+				delete(h, name)
+			}
+		}
+	}
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		h.Add(name, value)
+	}
+}
+
+// empty reports whether the rules edit nothing
+func (rules HeaderRules) empty() bool {
+	return len(rules.Set) == 0 && len(rules.Add) == 0 && len(rules.Remove) == 0
+}
+
+// HostHeaderRules edit the headers exchanged with upstream hosts matching
+// a pattern, in forward and reverse mode alike, e.g. to send an internal
+// token to one backend or strip debugging headers toward the internet
+type HostHeaderRules struct {
+	// Host is a host pattern such as api.internal, *.example.com or * for
+	// every host
+	Host string `json:"host"`
+	// Request edits the requests sent to the hosts, and Response the
+	// responses relayed from them
+	Request  HeaderRules `json:"request,omitempty"`
+	Response HeaderRules `json:"response,omitempty"`
+}
+
+// editRequestHeaders applies the request header rules of the site of
+// route, of route itself and of the rules for host, in that order, to h,
+// a request to host
+func (s *Server) editRequestHeaders(h http.Header, route *Route, host string) {
+	if route != nil {
+		if route.site != nil {
+			route.site.RequestHeaders.apply(h)
+		}
+		route.RequestHeaders.apply(h)
+	}
+	for _, rules := range s.hostHeaderRules {
+		if utils.MatchHost(rules.Host, host) {
+			rules.Request.apply(h)
+		}
+	}
+}
+
+// withHeaderRules returns w applying the response header rules of route
+// and of the rules for host, in that order, to the response relayed from
+// host. Those of the site of route apply afterwards, in handleReverse.
+func (s *Server) withHeaderRules(w http.ResponseWriter, route *Route, host string) http.ResponseWriter {
+	var edits []HeaderRules
+	if route != nil && !route.ResponseHeaders.empty() {
+		edits = append(edits, route.ResponseHeaders)
+	}
+	for _, rules := range s.hostHeaderRules {
+		if !rules.Response.empty() && utils.MatchHost(rules.Host, host) {
+			edits = append(edits, rules.Response)
+		}
+	}
+	if len(edits) == 0 {
+		return w
+	}
+	return &headerWriter{ResponseWriter: w, edit: func(h http.Header) {
+		for _, rules := range edits {
+			rules.apply(h)
+		}
+	}}
+}
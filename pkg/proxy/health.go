@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HealthReport is the report of GET /healthz and GET /readyz: the result
+// of each check, "ok" or what failed, and "ok" overall when all passed
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleHealthz answers the liveness probes of orchestrators, failing only
+// when a proxy listener stopped on an error, which a restart may fix.
+// Draining and shutting down are left to readiness so that the pod is not
+// restarted while its requests finish.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]string{"listeners": s.listenerHealth(false)})
+}
+
+// handleReadyz answers the readiness probes of orchestrators, failing until
+// every proxy listener serves, while draining or shutting down, and while
+// some route has no healthy backend, so that traffic goes to other pods
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"listeners": s.listenerHealth(true),
+		"upstreams": s.upstreamHealth(),
+		"draining":  "ok",
+		"shutdown":  "ok",
+	}
+	if s.draining.Load() {
+		checks["draining"] = "draining"
+	}
+	if s.shuttingDown() {
+		checks["shutdown"] = "shutting down"
+	}
+	writeHealth(w, checks)
+}
+
+// writeHealth answers 200 when every check passed and 503 otherwise
+func writeHealth(w http.ResponseWriter, checks map[string]string) {
+	report := HealthReport{Status: "ok", Checks: checks}
+	for _, result := range checks {
+		if result != "ok" {
+			report.Status = "failing"
+		}
+	}
+	if report.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
+
+// setListening records that the listener on addr serves, when err is nil,
+// or stopped on err
+func (s *Server) setListening(addr string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listening == nil {
+		s.listening = make(map[string]error)
+	}
+	s.listening[addr] = err
+}
+
+// shuttingDown reports whether Shutdown has been called
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// listenerHealth checks the proxy listeners: none may have failed and,
+// when serving is set, all must serve and there must be one
+func (s *Server) listenerHealth(serving bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if serving && len(s.listening) == 0 {
+		return "not listening"
+	}
+	var failed []string
+	for addr, err := range s.listening {
+		switch {
+		case err == nil:
+		case errors.Is(err, http.ErrServerClosed):
+			if serving {
+				failed = append(failed, addr+" closed")
+			}
+		default:
+			failed = append(failed, fmt.Sprintf("%s failed: %v", addr, err))
+		}
+	}
+	if len(failed) == 0 {
+		return "ok"
+	}
+	sort.Strings(failed)
+	return strings.Join(failed, "; ")
+}
+
+// upstreamHealth checks that every route balancing over backends has a
+// healthy one left
+func (s *Server) upstreamHealth() string {
+	down := s.unhealthyRoutes()
+	if len(down) == 0 {
+		return "ok"
+	}
+	return "no healthy backend for route " + strings.Join(down, ", ")
+}
+
+// unhealthyRoutes returns the names of the routes balancing over backends
+// none of which is healthy
+func (s *Server) unhealthyRoutes() []string {
+	var down []string
+	for _, route := range s.routes.Load().Routes() {
+		if route.pool == nil {
+			continue
+		}
+		healthy := false
+		for _, b := range route.pool.status() {
+			healthy = healthy || b.Healthy
+		}
+		if !healthy {
+			down = append(down, route.Name)
+		}
+	}
+	return down
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HealthCheckConfig controls active health checks of a route's backends.
+// Backends start healthy, leave the load balancer's rotation after Fall
+// failed checks in a row and return after Rise passed checks in a row.
+type HealthCheckConfig struct {
+	// Path is requested with GET and passes on a 2xx or 3xx status; empty
+	// checks that a TCP connection can be made instead
+	Path string `json:"path,omitempty"`
+	// Interval between checks of each backend
+	Interval time.Duration `json:"interval"`
+	// Timeout bounds each check; it defaults to Interval
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Rise and Fall default to 2 and 3
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+}
+
+// withDefaults validates cfg and fills in its defaults
+func (cfg HealthCheckConfig) withDefaults() (HealthCheckConfig, error) {
+	if cfg.Interval <= 0 {
+		return cfg, fmt.Errorf("health check interval must be positive")
+	}
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		return cfg, fmt.Errorf("health check path %q must start with /", cfg.Path)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = cfg.Interval
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = 2
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = 3
+	}
+	return cfg, nil
+}
+
+// startHealthChecks starts checking the backends of every route that
+// configures health checks
+func (s *Server) startHealthChecks(table *RouteTable) {
+	for _, route := range table.routes {
+		if route.HealthCheck == nil {
+			continue
+		}
+		for _, b := range route.pool.backends {
+			s.goBackground(func() { s.runHealthCheck(route.pool, b, *route.HealthCheck, table.retired) })
+		}
+	}
+}
+
+// runHealthCheck checks one backend every interval until its route table
+// is retired or the server shuts down
+func (s *Server) runHealthCheck(pool *backendPool, b *poolBackend, cfg HealthCheckConfig, retired <-chan struct{}) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		err := s.checkBackend(b, cfg)
+		pool.recordCheck(b, err, cfg)
+		select {
+		case <-ticker.C:
+		case <-retired:
+			return
+		case <-s.background.Done():
+			return
+		}
+	}
+}
+
+// checkBackend runs a single health check against b
+func (s *Server) checkBackend(b *poolBackend, cfg HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(s.background, cfg.Timeout)
+	defer cancel()
+
+	if cfg.Path == "" {
+		addr := b.url.Host
+		if b.url.Port() == "" {
+			addr = net.JoinHostPort(b.url.Hostname(), map[string]string{"http": "80", "https": "443"}[b.url.Scheme])
+		}
+		conn, err := s.dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	u := *b.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + cfg.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordCheck applies the result of a health check to b's rotation
+func (p *backendPool) recordCheck(b *poolBackend, err error, cfg HealthCheckConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.lastCheck = time.Now()
+	if err != nil {
+		b.checkError = err.Error()
+		b.rises = 0
+		b.falls++
+		if !b.checkedDown && b.falls >= cfg.Fall {
+			b.checkedDown = true
+			p.log.Warn("Backend failed health checks", "backend", b.url.String(), "err", err)
+		}
+		return
+	}
+	b.checkError = ""
+	b.falls = 0
+	b.rises++
+	if b.checkedDown && b.rises >= cfg.Rise {
+		b.checkedDown = false
+		p.log.Info("Backend passed health checks", "backend", b.url.String())
+	}
+}
+
+// handleUpstreamHealth reports backend health per route, answering 503 when
+// some route has no healthy backend left
+func (s *Server) handleUpstreamHealth(w http.ResponseWriter, r *http.Request) {
+	out := make(map[string][]BackendStatus)
+	status := http.StatusOK
+	for _, route := range s.routes.Load().Routes() {
+		if route.pool == nil {
+			continue
+		}
+		backends := route.pool.status()
+		healthy := false
+		for _, b := range backends {
+			healthy = healthy || b.Healthy
+		}
+		if !healthy {
+			status = http.StatusServiceUnavailable
+		}
+		out[route.Name] = backends
+	}
+	w.WriteHeader(status)
+	writeJSON(w, out)
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hooks are callbacks through which embedding applications observe and
+// steer requests, for custom logging, header changes or vetoes, without
+// changing the handler. Every hook is optional and may be called
+// concurrently. A hook returning false has answered the request itself,
+// and the proxy handles it no further.
+type Hooks struct {
+	// OnRequest is called once the client of a request is identified,
+	// before it is routed; it may change the request headers sent upstream
+	OnRequest func(w http.ResponseWriter, r *http.Request) bool
+	// OnCacheHit is called before a response is served from the cache; it
+	// may set headers on w
+	OnCacheHit func(w http.ResponseWriter, r *http.Request) bool
+	// OnUpstreamResponse is called once the headers of the upstream
+	// response arrive; it may change resp.Header before they are relayed
+	OnUpstreamResponse func(w http.ResponseWriter, r *http.Request, resp *http.Response) bool
+	// OnError is called when the proxy answers a request with an error
+	// page of its own
+	OnError func(r *http.Request, status int, message string)
+	// OnComplete is called once a request has been answered, with the
+	// status and body size of the response
+	OnComplete func(r *http.Request, status int, bytes int64, elapsed time.Duration)
+}
+
+// empty reports whether no hook is set
+func (h *Hooks) empty() bool {
+	return h.OnRequest == nil && h.OnCacheHit == nil && h.OnUpstreamResponse == nil && h.OnError == nil && h.OnComplete == nil
+}
+
+// request runs OnRequest, reporting whether handling continues
+func (h *Hooks) request(w http.ResponseWriter, r *http.Request) bool {
+	if h == nil || h.OnRequest == nil {
+		return true
+	}
+	return h.OnRequest(w, r)
+}
+
+// cacheHit runs OnCacheHit, reporting whether the cached response is served
+func (h *Hooks) cacheHit(w http.ResponseWriter, r *http.Request) bool {
+	if h == nil || h.OnCacheHit == nil {
+		return true
+	}
+	return h.OnCacheHit(w, r)
+}
+
+// upstreamResponse runs OnUpstreamResponse, reporting whether resp is
+// relayed
+func (h *Hooks) upstreamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) bool {
+	if h == nil || h.OnUpstreamResponse == nil {
+		return true
+	}
+	return h.OnUpstreamResponse(w, r, resp)
+}
+
+// error runs OnError
+func (h *Hooks) error(r *http.Request, status int, message string) {
+	if h != nil && h.OnError != nil {
+		h.OnError(r, status, message)
+	}
+}
+
+// complete runs OnComplete
+func (h *Hooks) complete(r *http.Request, status int, bytes int64, elapsed time.Duration) {
+	if h != nil && h.OnComplete != nil {
+		h.OnComplete(r, status, bytes, elapsed)
+	}
+}
+
+// serveHooked gives the OnRequest hook the chance to handle a request
+func (s *Server) serveHooked(w http.ResponseWriter, r *http.Request) {
+	if !s.hooks.request(w, r) {
+		return
+	}
+	s.serveCompressed(w, r)
+}
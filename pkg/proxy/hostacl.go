@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// HostACL allows or denies destination hosts by pattern. Deny rules win;
+// with an empty allow list every host not denied is allowed.
+type HostACL struct {
+	// Allow lists the permitted host patterns, e.g. "*.example.com" for
+	// subdomains or ".example.com" for the domain and its subdomains
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists the forbidden host patterns
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Enabled reports whether the ACL has any rules
+func (acl HostACL) Enabled() bool {
+	return len(acl.Allow) > 0 || len(acl.Deny) > 0
+}
+
+// Check reports whether host is allowed and, if not, the rule that denied it
+func (acl HostACL) Check(host string) (bool, string) {
+	for _, pattern := range acl.Deny {
+		if utils.MatchHost(pattern, host) {
+			return false, "denied by " + pattern
+		}
+	}
+	if len(acl.Allow) == 0 {
+		return true, ""
+	}
+	for _, pattern := range acl.Allow {
+		if utils.MatchHost(pattern, host) {
+			return true, ""
+		}
+	}
+	return false, "not in allow list"
+}
+
+// currentDestinationACL returns the destination ACL in force
+func (s *Server) currentDestinationACL() *HostACL {
+	if acls := s.activeACLs.Load(); acls != nil {
+		return &acls.DestinationACL
+	}
+	return &HostACL{}
+}
+
+// denyReasonHeader carries the rule behind a 403 from the destination ACL
+const denyReasonHeader = "X-Proxy-Deny-Reason"
+
+// checkDestination answers 403 with the reason when the destination ACL
+// forbids host, before any upstream connection is made, and reports whether
+// the request may proceed
+func (s *Server) checkDestination(w http.ResponseWriter, r *http.Request, host string) bool {
+	ok, reason := s.currentDestinationACL().Check(host)
+	if ok {
+		return true
+	}
+	s.stats.DestinationDenied.Add(1)
+	s.auditRequest(r, AuditDestinationACL, reason, http.StatusForbidden)
+	s.log.InfoContext(r.Context(), "Destination refused", "host", host, "reason", reason)
+	w.Header().Set(denyReasonHeader, reason)
+	s.httpError(w, r, "Destination not allowed", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP3Config controls experimental HTTP/3 support. The QUIC implementation
+// is built on quic-go in binaries built with -tags quic, after adding the
+// module with go get github.com/quic-go/quic-go; default builds depend on the
+// standard library alone and have none. An HTTP3Provider passed to NewServer
+// with WithHTTP3 replaces it. Enabling HTTP/3 without either fails, and
+// otherwise the proxy serves HTTP/1.1 and HTTP/2 only.
+type HTTP3Config struct {
+	// Listen serves clients over HTTP/3 on Addr using the TLS certificate and
+	// advertises it to them with Alt-Svc
+	Listen bool
+	// Addr is the UDP listen address of the HTTP/3 listener
+	Addr string
+	// Upstream fetches over HTTP/3 from origins that advertise it with
+	// Alt-Svc, falling back to HTTP/2 or HTTP/1.1 when it fails
+	Upstream bool
+	// FailureBackoff is how long an origin is kept off HTTP/3 after a failure
+	FailureBackoff time.Duration
+}
+
+// HTTP3Provider supplies an HTTP/3 implementation, such as one built on
+// quic-go, to the proxy
+type HTTP3Provider interface {
+	// Serve serves handler over HTTP/3 on the UDP address addr until ctx is
+	// done
+	Serve(ctx context.Context, addr, certFile, keyFile string, handler http.Handler) error
+	// RoundTripper returns a transport that speaks HTTP/3 to origins
+	RoundTripper() http.RoundTripper
+}
+
+// WithHTTP3 serves and fetches over HTTP/3 with p when Config.HTTP3
+// enables it
+func WithHTTP3(p HTTP3Provider) Option {
+	return func(s *Server) { s.http3 = p }
+}
+
+// checkHTTP3 reports configuration that HTTP/3 cannot satisfy
+func (s *Server) checkHTTP3(cfg HTTP3Config) error {
+	if (cfg.Listen || cfg.Upstream) && s.http3 == nil {
+		return errors.New("HTTP/3 enabled in a binary built without -tags quic and without an HTTP3Provider passed with WithHTTP3")
+	}
+	if cfg.Listen && s.cfg.TLSCertFile == "" {
+		return errors.New("HTTP/3 listener requires TLSCertFile and TLSKeyFile")
+	}
+	return nil
+}
+
+// altSvcHeader is the Alt-Svc value advertising the HTTP/3 listener
+func altSvcHeader(addr string) string {
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	return `h3=":` + port + `"; ma=86400`
+}
+
+// altSvcCache remembers which origins advertised HTTP/3 and which recently
+// failed over it
+type altSvcCache struct {
+	mu      sync.Mutex
+	h3Until map[string]time.Time
+	broken  map[string]time.Time
+}
+
+// learn records an HTTP/3 advertisement in the Alt-Svc header of resp
+func (c *altSvcCache) learn(host string, header http.Header) {
+	value := header.Get("Alt-Svc")
+	if !strings.Contains(value, "h3=") {
+		if value == "clear" {
+			c.mu.Lock()
+			delete(c.h3Until, host)
+			c.mu.Unlock()
+		}
+		return
+	}
+
+	maxAge := 24 * time.Hour
+	for _, param := range strings.Split(value, ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(param), "ma="); ok {
+			if secs, err := strconv.Atoi(v); err == nil {
+				maxAge = time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.h3Until[host] = time.Now().Add(maxAge)
+}
+
+// usable reports whether host should be tried over HTTP/3
+func (c *altSvcCache) usable(host string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	return now.Before(c.h3Until[host]) && !now.Before(c.broken[host])
+}
+
+// markBroken keeps host off HTTP/3 for backoff
+func (c *altSvcCache) markBroken(host string, backoff time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broken[host] = time.Now().Add(backoff)
+}
+
+// roundTripHTTP3 sends req over HTTP/3 when the origin supports it. It
+// reports false when the caller should fall back to HTTP/2 or HTTP/1.1.
+func (s *Server) roundTripHTTP3(req *http.Request) (*http.Response, bool) {
+	if !s.cfg.HTTP3.Upstream || s.http3 == nil || req.URL.Scheme != "https" {
+		return nil, false
+	}
+	if !s.altSvc.usable(req.URL.Host) || (req.Body != nil && req.GetBody == nil) {
+		return nil, false
+	}
+
+	resp, err := s.http3.RoundTripper().RoundTrip(req)
+	if err != nil {
+		s.altSvc.markBroken(req.URL.Host, s.cfg.HTTP3.FailureBackoff)
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+		return nil, false
+	}
+	return resp, true
+}
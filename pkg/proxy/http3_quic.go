@@ -0,0 +1,42 @@
+//go:build quic
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	registerSubsystem("http3")
+}
+
+// builtinHTTP3 is the HTTP/3 implementation over quic-go, used unless
+// another one is passed with WithHTTP3
+func builtinHTTP3() HTTP3Provider {
+	return &quicHTTP3{}
+}
+
+// quicHTTP3 serves and fetches over HTTP/3 with the http3 package of quic-go
+type quicHTTP3 struct {
+	once      sync.Once
+	transport *http3.Transport
+}
+
+// Serve listens on the UDP address addr until ctx is done
+func (q *quicHTTP3) Serve(ctx context.Context, addr, certFile, keyFile string, handler http.Handler) error {
+	srv := &http3.Server{Addr: addr, Handler: handler}
+	stop := context.AfterFunc(ctx, func() { srv.Close() })
+	defer stop()
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// RoundTripper returns the HTTP/3 transport shared by every upstream fetch,
+// so QUIC connections to an origin are reused
+func (q *quicHTTP3) RoundTripper() http.RoundTripper {
+	q.once.Do(func() { q.transport = &http3.Transport{} })
+	return q.transport
+}
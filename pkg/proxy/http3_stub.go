@@ -0,0 +1,7 @@
+//go:build !quic
+
+package proxy
+
+// builtinHTTP3 is nil in builds without the quic tag, leaving HTTP/3 to a
+// provider passed with WithHTTP3
+func builtinHTTP3() HTTP3Provider { return nil }
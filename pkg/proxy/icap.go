@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICAP methods
+const (
+	// ICAPRequestMod hands requests to the service before they are forwarded
+	ICAPRequestMod = "REQMOD"
+	// ICAPResponseMod hands responses to the service before they are relayed
+	ICAPResponseMod = "RESPMOD"
+)
+
+// ICAPService is an external scanning service, such as an antivirus or DLP
+// engine, spoken to over ICAP (RFC 3507). Services of a method are
+// consulted in order; bypassed destinations are not scanned, and cache hits
+// are not rescanned.
+type ICAPService struct {
+	// Name identifies the service in logs
+	Name string `json:"name"`
+	// URL addresses the service, e.g. icap://av.internal:1344/avscan
+	URL string `json:"url"`
+	// Method is ICAPRequestMod or ICAPResponseMod
+	Method string `json:"method"`
+	// FailOpen relays traffic unscanned when the service cannot be reached,
+	// fails or the body is too large to scan; by default such traffic is
+	// refused with 503
+	FailOpen bool `json:"fail_open,omitempty"`
+	// Timeout bounds each exchange; it defaults to 10 seconds
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// defaultICAPTimeout bounds exchanges when no Timeout is configured
+const defaultICAPTimeout = 10 * time.Second
+
+// icapService is a validated ICAPService
+type icapService struct {
+	ICAPService
+	uri  *url.URL
+	addr string
+}
+
+// compileICAPServices validates services
+func compileICAPServices(services []ICAPService) ([]*icapService, error) {
+	var compiled []*icapService
+	for _, s := range services {
+		u, err := url.Parse(s.URL)
+		if err != nil || u.Scheme != "icap" || u.Host == "" {
+			return nil, fmt.Errorf("service %q: invalid URL %q", s.Name, s.URL)
+		}
+		if s.Method != ICAPRequestMod && s.Method != ICAPResponseMod {
+			return nil, fmt.Errorf("service %q: unknown method %q", s.Name, s.Method)
+		}
+		if s.Timeout <= 0 {
+			s.Timeout = defaultICAPTimeout
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "1344")
+		}
+		compiled = append(compiled, &icapService{ICAPService: s, uri: u, addr: addr})
+	}
+	return compiled, nil
+}
+
+// icapSection is one part of an encapsulated HTTP message
+type icapSection struct {
+	name string
+	data []byte
+}
+
+// icapReply is the outcome of an exchange: nothing when the service left
+// the message unmodified, else the encapsulated headers and body it returned
+type icapReply struct {
+	unmodified bool
+	reqHeader  []byte
+	resHeader  []byte
+	body       []byte
+	hasBody    bool
+}
+
+// errICAPBodyTooLarge reports a body beyond the scanning limit
+var errICAPBodyTooLarge = errors.New("body too large to scan")
+
+// exchange sends the encapsulated header sections and body to the service
+// and reads its reply
+func (s *icapService) exchange(ctx context.Context, sections []icapSection, body []byte, hasBody bool, limit int64) (*icapReply, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var msg bytes.Buffer
+	var encapsulated []string
+	offset := 0
+	for _, section := range sections {
+		encapsulated = append(encapsulated, section.name+"-hdr="+strconv.Itoa(offset))
+		offset += len(section.data)
+	}
+	bodyName := "null-body"
+	switch {
+	case hasBody && s.Method == ICAPRequestMod:
+		bodyName = "req-body"
+	case hasBody:
+		bodyName = "res-body"
+	}
+	encapsulated = append(encapsulated, bodyName+"="+strconv.Itoa(offset))
+	fmt.Fprintf(&msg, "%s %s ICAP/1.0\r\n", s.Method, s.uri)
+	fmt.Fprintf(&msg, "Host: %s\r\n", s.uri.Host)
+	msg.WriteString("Allow: 204\r\nConnection: close\r\n")
+	fmt.Fprintf(&msg, "Encapsulated: %s\r\n\r\n", strings.Join(encapsulated, ", "))
+	for _, section := range sections {
+		msg.Write(section.data)
+	}
+	if hasBody {
+		if len(body) > 0 {
+			fmt.Fprintf(&msg, "%x\r\n", len(body))
+			msg.Write(body)
+			msg.WriteString("\r\n")
+		}
+		msg.WriteString("0\r\n\r\n")
+	}
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+	return readICAPReply(bufio.NewReader(conn), limit)
+}
+
+// readICAPReply parses an ICAP response, whose body may hold up to limit
+// bytes
+func readICAPReply(br *bufio.Reader, limit int64) (*icapReply, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return nil, fmt.Errorf("malformed ICAP status line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case "204":
+		return &icapReply{unmodified: true}, nil
+	case "200":
+	default:
+		return nil, fmt.Errorf("ICAP status %s", rest)
+	}
+
+	type entry struct {
+		name   string
+		offset int
+	}
+	var entries []entry
+	for _, field := range strings.Split(header.Get("Encapsulated"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		offset, err := strconv.Atoi(value)
+		if !ok || err != nil || offset < 0 {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", header.Get("Encapsulated"))
+		}
+		entries = append(entries, entry{name, offset})
+	}
+	reply := &icapReply{}
+	for i, e := range entries {
+		if strings.HasSuffix(e.name, "-body") {
+			if i != len(entries)-1 {
+				return nil, errors.New("ICAP body section is not last")
+			}
+			if e.name != "null-body" {
+				reply.hasBody = true
+				reply.body, err = io.ReadAll(io.LimitReader(httputil.NewChunkedReader(br), limit+1))
+				if err != nil {
+					return nil, err
+				}
+				if int64(len(reply.body)) > limit {
+					return nil, errICAPBodyTooLarge
+				}
+			}
+			break
+		}
+		if i == len(entries)-1 || entries[i+1].offset < e.offset {
+			return nil, errors.New("ICAP header section without end")
+		}
+		data := make([]byte, entries[i+1].offset-e.offset)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		switch e.name {
+		case "req-hdr":
+			reply.reqHeader = data
+		case "res-hdr":
+			reply.resHeader = data
+		}
+	}
+	return reply, nil
+}
+
+// encodeRequestHeader serializes the request line and headers of req
+func encodeRequestHeader(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.String(), req.URL.Host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// encodeResponseHeader serializes the status line and headers of resp
+func encodeResponseHeader(resp *http.Response) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// readRequestBody buffers the body of req for scanning and puts it back
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	limit := int64(inspectBodyLimit)
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, errICAPBodyTooLarge
+	}
+	setRequestBody(req, body)
+	return body, nil
+}
+
+// setRequestBody makes body the replayable body of req
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+}
+
+// icapFailed applies the failure policy of svc, answering 503 unless it fails
+// open, and reports whether the exchange may proceed unscanned
+func (s *Server) icapFailed(w http.ResponseWriter, r *http.Request, svc *icapService, target string, err error) bool {
+	s.stats.ICAPErrors.Add(1)
+	s.log.WarnContext(r.Context(), "ICAP service failed", "service", svc.Name, "url", target, "err", err)
+	if svc.FailOpen {
+		return true
+	}
+	s.auditRequest(r, AuditICAP, "service "+svc.Name+" failed: "+err.Error(), http.StatusServiceUnavailable)
+	s.httpError(w, r, "Content scanning unavailable", http.StatusServiceUnavailable)
+	return false
+}
+
+// scanRequest hands req, the upstream request of r, to the REQMOD services,
+// which may modify it or answer in its place. It reports whether req may be
+// forwarded.
+func (s *Server) scanRequest(w http.ResponseWriter, r, req *http.Request, target *url.URL) bool {
+	if len(s.icapServices) == 0 || s.bypass.Match(target) {
+		return true
+	}
+	for _, svc := range s.icapServices {
+		if svc.Method != ICAPRequestMod {
+			continue
+		}
+		body, err := readRequestBody(req)
+		if isBodyLimitError(err) {
+			return s.rejectLimit(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+		}
+		var reply *icapReply
+		if err == nil {
+			hasBody := req.Body != nil && req.Body != http.NoBody
+			reply, err = svc.exchange(req.Context(), []icapSection{{"req", encodeRequestHeader(req)}}, body, hasBody, s.inspectLimit())
+		}
+		if err != nil {
+			if !s.icapFailed(w, r, svc, target.String(), err) {
+				return false
+			}
+			continue
+		}
+		if reply.unmodified {
+			continue
+		}
+		s.stats.ICAPModified.Add(1)
+		if reply.resHeader != nil {
+			// The service answers in place of the upstream, e.g. with a
+			// block page
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply.resHeader)), req)
+			if err != nil {
+				if !s.icapFailed(w, r, svc, target.String(), err) {
+					return false
+				}
+				continue
+			}
+			s.log.InfoContext(r.Context(), "ICAP service answered", "service", svc.Name, "url", target)
+			s.auditRequest(r, AuditICAP, "service "+svc.Name+" answered", resp.StatusCode)
+			removeHopHeaders(resp.Header)
+			resp.Header.Del("Content-Length")
+			copyHeaders(w.Header(), resp.Header)
+			w.WriteHeader(resp.StatusCode)
+			w.Write(reply.body)
+			return false
+		}
+		if reply.reqHeader != nil {
+			modified, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reply.reqHeader)))
+			if err != nil {
+				if !s.icapFailed(w, r, svc, target.String(), err) {
+					return false
+				}
+				continue
+			}
+			removeHopHeaders(modified.Header)
+			modified.Header.Del("Content-Length")
+			req.Header = modified.Header
+			if reply.hasBody {
+				setRequestBody(req, reply.body)
+			}
+		}
+	}
+	return true
+}
+
+// scanResponse hands resp, the answer to req on behalf of r, to the RESPMOD
+// services, which may modify it. It reports whether resp was modified, and false for ok when it answered the
+// client itself.
+func (s *Server) scanResponse(w http.ResponseWriter, r, req *http.Request, target *url.URL, resp *http.Response) (modified, ok bool) {
+	if len(s.icapServices) == 0 || s.bypass.Match(target) {
+		return false, true
+	}
+	for _, svc := range s.icapServices {
+		if svc.Method != ICAPResponseMod {
+			continue
+		}
+		body, buffered := bufferBody(resp, s.inspectLimit())
+		var reply *icapReply
+		var err error
+		if !buffered {
+			err = errICAPBodyTooLarge
+		} else {
+			replaceBody(resp, body)
+			sections := []icapSection{{"req", encodeRequestHeader(req)}, {"res", encodeResponseHeader(resp)}}
+			reply, err = svc.exchange(req.Context(), sections, body, true, s.inspectLimit())
+		}
+		if err != nil {
+			if !s.icapFailed(w, r, svc, target.String(), err) {
+				return modified, false
+			}
+			continue
+		}
+		if reply.unmodified || reply.resHeader == nil {
+			continue
+		}
+		scanned, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply.resHeader)), req)
+		if err != nil {
+			if !s.icapFailed(w, r, svc, target.String(), err) {
+				return modified, false
+			}
+			continue
+		}
+		s.stats.ICAPModified.Add(1)
+		modified = true
+		if scanned.StatusCode >= 400 {
+			s.auditRequest(r, AuditICAP, "service "+svc.Name+" replaced the response", scanned.StatusCode)
+		}
+		removeHopHeaders(scanned.Header)
+		resp.StatusCode = scanned.StatusCode
+		resp.Status = scanned.Status
+		resp.Header = scanned.Header
+		replaceBody(resp, reply.body)
+	}
+	return modified, true
+}
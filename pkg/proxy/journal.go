@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalConfig controls the crash-forensics request journal
+type JournalConfig struct {
+	// Path of the journal file; empty disables the journal
+	Path string
+	// MaxBytes bounds the journal; when exceeded it is rotated to Path.1
+	MaxBytes int64
+}
+
+// Journal appends the start and end of every request to a file, so the
+// requests in flight when the process died can be recovered afterwards
+type Journal struct {
+	log *logFile
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// JournalEntry is one line of the journal
+type JournalEntry struct {
+	ID       uint64    `json:"id"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	// Annotations are the request annotations present when it ended
+	Annotations map[string]any `json:"annotations,omitempty"`
+}
+
+// OpenJournal opens the journal at cfg.Path for appending
+func OpenJournal(cfg JournalConfig) (*Journal, error) {
+	l, err := openLogFile(cfg.Path, cfg.MaxBytes, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{log: l, seq: uint64(time.Now().UnixNano())}, nil
+}
+
+// Start records the start of r and returns its journal ID
+func (j *Journal) Start(r *http.Request) uint64 {
+	j.mu.Lock()
+	j.seq++
+	id := j.seq
+	j.mu.Unlock()
+
+	url := r.URL.String()
+	if r.Method == http.MethodConnect {
+		url = r.Host
+	}
+	j.log.writeJSON(JournalEntry{ID: id, Event: "start", Time: time.Now(), Method: r.Method, URL: url, Client: r.RemoteAddr})
+	return id
+}
+
+// End records the completion of request id
+func (j *Journal) End(id uint64, status int, bytes int64, elapsed time.Duration) {
+	j.EndAnnotated(id, status, bytes, elapsed, nil)
+}
+
+// EndAnnotated records the completion of request id with its annotations
+func (j *Journal) EndAnnotated(id uint64, status int, bytes int64, elapsed time.Duration, annotations map[string]any) {
+	j.log.writeJSON(JournalEntry{ID: id, Event: "end", Time: time.Now(), Status: status, Bytes: bytes, Duration: elapsed.String(), Annotations: annotations})
+}
+
+// InFlight returns the start entries of journal files that have no matching
+// end entry, oldest file first
+func InFlight(path string) ([]JournalEntry, error) {
+	started := make(map[uint64]JournalEntry)
+	var order []uint64
+	for _, name := range []string{path + ".1", path} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry JournalEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue // torn final line after a crash
+			}
+			if entry.Event == "start" {
+				started[entry.ID] = entry
+				order = append(order, entry.ID)
+			} else {
+				delete(started, entry.ID)
+			}
+		}
+		f.Close()
+	}
+
+	var pending []JournalEntry
+	for _, id := range order {
+		if entry, found := started[id]; found {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+// openJournal reports requests left in flight by the previous run and
+// starts journaling
+func (s *Server) openJournal(cfg JournalConfig) error {
+	pending, err := InFlight(cfg.Path)
+	if err != nil {
+		s.log.Warn("Journal scan failed", "err", err)
+	}
+	for _, entry := range pending {
+		s.log.Warn("Request in flight at last shutdown", "method", entry.Method, "url", entry.URL,
+			"client", entry.Client, "started", entry.Time)
+	}
+
+	j, err := OpenJournal(cfg)
+	if err != nil {
+		return fmt.Errorf("journal setup failed: %w", err)
+	}
+	s.journal = j
+	return nil
+}
+
+// withJournal records the start and end of a request in the journal
+func (s *Server) withJournal(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	start := time.Now()
+	id := s.journal.Start(r)
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		s.journal.EndAnnotated(id, rec.Status(), rec.n, time.Since(start), annotationsOf(r).Snapshot())
+	}()
+	next(rec, r)
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"cmp"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeepaliveConfig controls probing of idle pooled upstream connections.
+// Origins are probed while they were used within
+// TransportConfig.IdleConnTimeout, or within 90s when it is zero. To close
+// connections before origins time them out instead, lower IdleConnTimeout.
+type KeepaliveConfig struct {
+	// Enabled turns on background probing of recently used upstream hosts
+	Enabled bool
+	// ProbeInterval is how often idle upstream hosts are probed
+	ProbeInterval time.Duration
+	// ProbePath is requested with HEAD on each probe
+	ProbePath string
+}
+
+// upstreamTracker remembers when each upstream origin was last used and
+// how much
+type upstreamTracker struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+	// requests counts requests per origin, halved by each call to hottest
+	// so that it favours recent traffic
+	requests map[string]int64
+}
+
+// touch records a request to the origin of u
+func (t *upstreamTracker) touch(u *url.URL) {
+	origin := u.Scheme + "://" + u.Host
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastUsed[origin] = time.Now()
+	t.requests[origin]++
+}
+
+// hottest returns up to n origins with the most requests, most first, and
+// then halves the counts, forgetting origins left with none
+func (t *upstreamTracker) hottest(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	origins := make([]string, 0, len(t.requests))
+	for origin := range t.requests {
+		origins = append(origins, origin)
+	}
+	slices.SortFunc(origins, func(a, b string) int {
+		return cmp.Or(cmp.Compare(t.requests[b], t.requests[a]), strings.Compare(a, b))
+	})
+	for origin, count := range t.requests {
+		if count /= 2; count == 0 {
+			delete(t.requests, origin)
+		} else {
+			t.requests[origin] = count
+		}
+	}
+	return origins[:min(n, len(origins))]
+}
+
+// active returns the origins used within maxIdle and forgets the rest
+func (t *upstreamTracker) active(maxIdle time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var origins []string
+	for origin, last := range t.lastUsed {
+		if time.Since(last) > maxIdle {
+			delete(t.lastUsed, origin)
+			continue
+		}
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+// startKeepalive starts the probe loop, which runs until the server shuts
+// down
+func (s *Server) startKeepalive(cfg KeepaliveConfig) {
+	if !cfg.Enabled || cfg.ProbeInterval <= 0 {
+		return
+	}
+
+	s.goBackground(func() {
+		ticker := time.NewTicker(cfg.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.background.Done():
+				return
+			}
+			s.probeUpstreams(cfg)
+		}
+	})
+}
+
+// keepaliveWindow is how recently an origin must have been used to be
+// probed when pooled connections never expire, as IdleConnTimeout zero has
+// them; the origins tracked must still be forgotten some time
+const keepaliveWindow = 90 * time.Second
+
+// probeUpstreams sends a HEAD request to every recently used origin so its
+// pooled connection stays warm. A probe that fails on a pooled connection
+// leaves the origin's other idle connections suspect, so the origin is
+// probed again until a probe dials afresh: the transport reuses idle
+// connections before dialing, so by then none of the stale ones are left,
+// while the pools of other origins stay warm.
+func (s *Server) probeUpstreams(cfg KeepaliveConfig) {
+	window := s.httpTransport.IdleConnTimeout
+	if window <= 0 {
+		window = keepaliveWindow
+	}
+	perHost := s.httpTransport.MaxIdleConnsPerHost
+	if perHost <= 0 {
+		perHost = http.DefaultMaxIdleConnsPerHost
+	}
+	for _, origin := range s.upstreams.active(window) {
+		for range perHost + 1 {
+			reused, err := s.probeUpstream(origin + cfg.ProbePath)
+			if err == nil {
+				break
+			}
+			s.log.Debug("Keepalive probe failed", "origin", origin, "err", err)
+			if !reused {
+				break
+			}
+		}
+	}
+}
+
+// probeUpstream sends one probe to target, reporting whether it went out
+// on a pooled connection
+func (s *Server) probeUpstream(target string) (reused bool, err error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(s.background, trace), http.MethodHead, target, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return reused, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return reused, nil
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets, in
+// milliseconds; a final bucket counts everything slower
+var latencyBounds = [...]float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// latencyCounters is the upstream latency histogram of one host
+type latencyCounters struct {
+	buckets [len(latencyBounds) + 1]atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64
+	max     atomic.Int64
+}
+
+// LatencyBucket counts the exchanges that took at most LeMs milliseconds;
+// the last bucket of a histogram has no bound
+type LatencyBucket struct {
+	LeMs  float64 `json:"le_ms,omitempty"`
+	Count int64   `json:"count"`
+}
+
+// LatencyHistogram is a point-in-time copy of the upstream latency of one
+// host, measured from sending a request until its response headers arrive.
+// Buckets are cumulative; the percentiles are the upper bounds of the
+// buckets they fall in.
+type LatencyHistogram struct {
+	Count   int64           `json:"count"`
+	SumMs   float64         `json:"sum_ms"`
+	MaxMs   float64         `json:"max_ms"`
+	P50Ms   float64         `json:"p50_ms"`
+	P90Ms   float64         `json:"p90_ms"`
+	P99Ms   float64         `json:"p99_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// latencyTable holds the histograms of every upstream host seen
+type latencyTable struct {
+	mu    sync.RWMutex
+	hosts map[string]*latencyCounters
+}
+
+// record adds an exchange with host that took elapsed
+func (t *latencyTable) record(host string, elapsed time.Duration) {
+	c := t.get(host)
+	ms := float64(elapsed) / float64(time.Millisecond)
+	i := 0
+	for i < len(latencyBounds) && ms > latencyBounds[i] {
+		i++
+	}
+	c.buckets[i].Add(1)
+	c.count.Add(1)
+	c.sum.Add(int64(elapsed))
+	for {
+		max := c.max.Load()
+		if int64(elapsed) <= max || c.max.CompareAndSwap(max, int64(elapsed)) {
+			break
+		}
+	}
+}
+
+// get returns the histogram of host, creating it on first use
+func (t *latencyTable) get(host string) *latencyCounters {
+	t.mu.RLock()
+	c, found := t.hosts[host]
+	t.mu.RUnlock()
+	if found {
+		return c
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hosts == nil {
+		t.hosts = make(map[string]*latencyCounters)
+	}
+	if c, found := t.hosts[host]; found {
+		return c
+	}
+	if len(t.hosts) >= maxTrackedOrigins {
+		host = otherOrigins
+		if c, found := t.hosts[host]; found {
+			return c
+		}
+	}
+	c = &latencyCounters{}
+	t.hosts[host] = c
+	return c
+}
+
+// snapshot copies the histogram of every host
+func (t *latencyTable) snapshot() map[string]LatencyHistogram {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[string]LatencyHistogram, len(t.hosts))
+	for host, c := range t.hosts {
+		out[host] = c.snapshot()
+	}
+	return out
+}
+
+// snapshot copies the histogram, estimating its percentiles
+func (c *latencyCounters) snapshot() LatencyHistogram {
+	h := LatencyHistogram{
+		Count:   c.count.Load(),
+		SumMs:   float64(c.sum.Load()) / float64(time.Millisecond),
+		MaxMs:   float64(c.max.Load()) / float64(time.Millisecond),
+		Buckets: make([]LatencyBucket, len(c.buckets)),
+	}
+	var cumulative int64
+	for i := range c.buckets {
+		cumulative += c.buckets[i].Load()
+		h.Buckets[i].Count = cumulative
+		if i < len(latencyBounds) {
+			h.Buckets[i].LeMs = latencyBounds[i]
+		}
+	}
+	h.P50Ms = h.percentile(0.5)
+	h.P90Ms = h.percentile(0.9)
+	h.P99Ms = h.percentile(0.99)
+	return h
+}
+
+// percentile returns the upper bound of the bucket holding quantile q, or
+// the maximum when that is the unbounded bucket
+func (h *LatencyHistogram) percentile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.Count))
+	for _, b := range h.Buckets {
+		if b.Count > rank && b.LeMs > 0 {
+			return min(b.LeMs, h.MaxMs)
+		}
+	}
+	return h.MaxMs
+}
+
+// handleLatency reports the upstream latency histograms, of every host or
+// of the one named by the host parameter
+func (s *Server) handleLatency(w http.ResponseWriter, r *http.Request) {
+	histograms := s.latencies.snapshot()
+	if host := r.URL.Query().Get("host"); host != "" {
+		h, found := histograms[host]
+		if !found {
+			http.Error(w, "Unknown host", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, h)
+		return
+	}
+	writeJSON(w, histograms)
+}
+
+// upstreamTimings collects the phases of an upstream exchange for the
+// slow request log. Retries and hedges may open several connections; the
+// earliest start and latest end of each phase are kept.
+type upstreamTimings struct {
+	start time.Time
+
+	mu                       sync.Mutex
+	dnsStart, dnsDone        time.Time
+	connectStart, connectEnd time.Time
+	tlsStart, tlsDone        time.Time
+	firstByte                time.Time
+	connected, reused        bool
+}
+
+// withUpstreamTimings returns req with its phases timed
+func withUpstreamTimings(req *http.Request) (*http.Request, *upstreamTimings) {
+	t := &upstreamTimings{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		GotConn:              t.gotConn,
+		DNSStart:             func(httptrace.DNSStartInfo) { t.first(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.last(&t.dnsDone) },
+		ConnectStart:         func(string, string) { t.first(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { t.last(&t.connectEnd) },
+		TLSHandshakeStart:    func() { t.first(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.last(&t.tlsDone) },
+		GotFirstResponseByte: func() { t.first(&t.firstByte) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// first records now in at unless an earlier time is there
+func (t *upstreamTimings) first(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// last records now in at
+func (t *upstreamTimings) last(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*at = time.Now()
+}
+
+// gotConn notes whether the first connection used was taken from the
+// pool, in which case there is no DNS, connect or TLS phase
+func (t *upstreamTimings) gotConn(info httptrace.GotConnInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.connected {
+		t.connected, t.reused = true, info.Reused
+	}
+}
+
+// logIfSlow logs the timings t of the exchange of r with host, answered
+// with status, when it has taken longer than the slow request threshold
+func (s *Server) logIfSlow(t *upstreamTimings, r *http.Request, host string, status int) {
+	if t == nil {
+		return
+	}
+	total := time.Since(t.start)
+	if total <= s.cfg.SlowRequestThreshold {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("host", host),
+		slog.String("url", auditURL(r)),
+		slog.Int("status", status),
+		slog.Float64("total_ms", milliseconds(total)),
+		slog.Bool("reused", t.reused),
+	}
+	phases := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"dns_ms", t.dnsStart, t.dnsDone},
+		{"connect_ms", t.connectStart, t.connectEnd},
+		{"tls_ms", t.tlsStart, t.tlsDone},
+		{"ttfb_ms", t.start, t.firstByte},
+	}
+	for _, p := range phases {
+		if !p.start.IsZero() && !p.end.IsZero() {
+			attrs = append(attrs, slog.Float64(p.name, milliseconds(p.end.Sub(p.start))))
+		}
+	}
+	s.log.LogAttrs(r.Context(), slog.LevelWarn, "Slow request", attrs...)
+}
+
+// milliseconds converts d to fractional milliseconds, to the microsecond
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
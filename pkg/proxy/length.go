@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Policies for upstream bodies whose length disagrees with Content-Length
+const (
+	// LengthPolicyError answers 502 instead of relaying the body
+	LengthPolicyError = "error"
+	// LengthPolicyTruncate relays the bytes received with a corrected length
+	LengthPolicyTruncate = "truncate"
+	// LengthPolicyCloseDelimit relays the bytes received without a length and
+	// closes the connection, so the client cannot mistake it for a full body
+	LengthPolicyCloseDelimit = "close-delimit"
+)
+
+// isLengthError reports whether err was caused by conflicting Content-Length
+// headers, which the transport rejects before any body is read
+func isLengthError(err error) bool {
+	return strings.Contains(err.Error(), "Content-Length")
+}
+
+// writeLengthMismatch answers a response whose body ended before the
+// declared Content-Length, according to the configured policy
+func (s *Server) writeLengthMismatch(w http.ResponseWriter, resp *http.Response, body []byte) {
+	s.stats.LengthMismatches.Add(1)
+	s.log.WarnContext(resp.Request.Context(), "Body length mismatch", "url", resp.Request.URL.String(), "declared", resp.ContentLength, "received", len(body))
+
+	switch s.cfg.LengthMismatchPolicy {
+	case LengthPolicyTruncate:
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	case LengthPolicyCloseDelimit:
+		copyHeaders(w.Header(), resp.Header)
+		w.Header().Del("Content-Length")
+		w.Header().Set("Transfer-Encoding", "identity")
+	default:
+		s.httpError(w, resp.Request, "Upstream body length mismatch", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// RequestLimitsConfig caps the size of request lines, headers and bodies,
+// keeping the cache key space bounded, turning away scanners early and
+// stopping a single client from streaming an unbounded upload through the
+// proxy. Zero disables a limit.
+type RequestLimitsConfig struct {
+	// MaxURLLength bounds the request target, answering 414 beyond it
+	MaxURLLength int
+	// MaxQueryParams bounds the query parameters, answering 414 beyond it
+	MaxQueryParams int
+	// MaxHeaderCount bounds the header fields, answering 431 beyond it
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the request body, answering 413 beyond it. Bodies
+	// declaring a larger Content-Length are refused before any of them is
+	// read; others are cut off once they exceed it.
+	MaxBodyBytes int64
+}
+
+// checkRequestLimits answers requests that exceed the configured limits
+// and reports whether r may proceed
+func (s *Server) checkRequestLimits(w http.ResponseWriter, r *http.Request) bool {
+	limits := s.cfg.RequestLimits
+	if limits.MaxURLLength > 0 && len(r.RequestURI) > limits.MaxURLLength {
+		return s.rejectLimit(w, r, http.StatusRequestURITooLong, "Request URL too long")
+	}
+	if limits.MaxQueryParams > 0 && r.URL.RawQuery != "" {
+		// Count separators rather than parsing, which would allocate for
+		// exactly the abusive requests this is meant to shed
+		if strings.Count(r.URL.RawQuery, "&")+1 > limits.MaxQueryParams {
+			return s.rejectLimit(w, r, http.StatusRequestURITooLong, "Too many query parameters")
+		}
+	}
+	if limits.MaxHeaderCount > 0 {
+		count := 0
+		for _, values := range r.Header {
+			count += len(values)
+		}
+		if count > limits.MaxHeaderCount {
+			return s.rejectLimit(w, r, http.StatusRequestHeaderFieldsTooLarge, "Too many request headers")
+		}
+	}
+	if limits.MaxBodyBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > limits.MaxBodyBytes {
+			return s.rejectLimit(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+	}
+	return true
+}
+
+// ResponseLimitConfig caps the size of upstream responses, which would
+// otherwise be buffered whole when a feature needs the complete body
+type ResponseLimitConfig struct {
+	// MaxBytes bounds response bodies; zero disables the guard
+	MaxBytes int64
+	// Action is ResponseLimitAbort (the default) or ResponseLimitStream
+	Action string
+}
+
+// Actions on responses beyond ResponseLimitConfig.MaxBytes
+const (
+	// ResponseLimitAbort answers 502, or cuts off a response whose headers
+	// were already sent
+	ResponseLimitAbort = "abort"
+	// ResponseLimitStream relays the response as it arrives without
+	// buffering or caching it. Signed responses are still refused, as a
+	// signature needs the whole body.
+	ResponseLimitStream = "stream"
+)
+
+// errResponseTooLarge reports a body that grew past MaxBytes
+var errResponseTooLarge = errors.New("response exceeds the size limit")
+
+// Validate reports an unknown action
+func (cfg ResponseLimitConfig) Validate() error {
+	switch cfg.Action {
+	case "", ResponseLimitAbort, ResponseLimitStream:
+		return nil
+	}
+	return fmt.Errorf("unknown response limit action %q", cfg.Action)
+}
+
+// exceeded reports whether a body of n bytes is over the limit
+func (cfg ResponseLimitConfig) exceeded(n int64) bool {
+	return cfg.MaxBytes > 0 && n > cfg.MaxBytes
+}
+
+// streams reports whether oversized responses are relayed rather than
+// refused
+func (cfg ResponseLimitConfig) streams(sign bool) bool {
+	return cfg.Action == ResponseLimitStream && !sign
+}
+
+// rejectOversize answers 502 for a response over the limit
+func (s *Server) rejectOversize(w http.ResponseWriter, r *http.Request, target string) {
+	s.stats.ResponsesTooLarge.Add(1)
+	s.log.WarnContext(r.Context(), "Response too large", "url", target)
+	s.proxyError(w, r, ErrorResponseTooLarge, "Upstream response too large", http.StatusBadGateway)
+}
+
+// guardedBody fails with errResponseTooLarge once more than max bytes were
+// read, returning only the bytes within the limit
+type guardedBody struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (g *guardedBody) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	g.n += int64(n)
+	if over := g.n - g.max; over > 0 {
+		return n - int(over), errResponseTooLarge
+	}
+	return n, err
+}
+
+// isBodyLimitError reports whether err comes from a request body cut off
+// at MaxBodyBytes
+func isBodyLimitError(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// rejectLimit answers with status and counts the rejection
+func (s *Server) rejectLimit(w http.ResponseWriter, r *http.Request, status int, msg string) bool {
+	s.stats.LimitRejected.Add(1)
+	s.httpError(w, r, msg, status)
+	return false
+}
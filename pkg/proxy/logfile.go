@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFile appends lines to a file, rotating it to path.1 once it exceeds
+// maxBytes or has been written to for longer than maxAge
+type logFile struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	// log reports rotation failures
+	log *slog.Logger
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// openLogFile opens the log at path for appending
+func openLogFile(path string, maxBytes int64, maxAge time.Duration) (*logFile, error) {
+	l := &logFile{path: path, maxBytes: maxBytes, maxAge: maxAge, log: slog.Default()}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file and records its size; l.mu must be held
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// writeJSON appends v as one JSON line
+func (l *logFile) writeJSON(v any) {
+	buf := getTextBuffer()
+	defer putTextBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return
+	}
+	l.writeLine(buf.Bytes())
+}
+
+// writeLine appends line, which must end in a newline, rotating the file
+// first when it is due
+func (l *logFile) writeLine(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxBytes > 0 && l.size+int64(len(line)) > l.maxBytes || l.maxAge > 0 && time.Since(l.opened) > l.maxAge {
+		l.file.Close()
+		os.Rename(l.path, l.path+".1")
+		if err := l.open(); err != nil {
+			l.log.Warn("Log rotation failed", "path", l.path, "err", err)
+			return
+		}
+	}
+	n, _ := l.file.Write(line)
+	l.size += int64(n)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaintenanceConfig takes a route down for maintenance, answering its
+// requests with 503 instead of fetching them. The admin API switches
+// maintenance of any route at runtime, overriding Enabled until cleared.
+type MaintenanceConfig struct {
+	// Enabled starts the route in maintenance
+	Enabled bool `json:"enabled,omitempty"`
+	// Message is the message of the page, "Down for maintenance" by
+	// default
+	Message string `json:"message,omitempty"`
+	// HTMLPage and JSONPage are template files of the page, executed with
+	// ErrorPageData; without them the error pages apply
+	HTMLPage string `json:"html_page,omitempty"`
+	JSONPage string `json:"json_page,omitempty"`
+	// RetryAfter tells clients when to come back
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+}
+
+// compileMaintenance validates cfg and parses its pages
+func compileMaintenance(cfg *MaintenanceConfig) (*errorTemplates, error) {
+	if cfg.RetryAfter < 0 {
+		return nil, fmt.Errorf("negative maintenance retry after")
+	}
+	pages := ErrorPagesConfig{JSON: cfg.JSONPage}
+	if cfg.HTMLPage != "" {
+		pages.HTML = map[string]string{"default": cfg.HTMLPage}
+	}
+	return compileErrorPages(pages)
+}
+
+// maintenanceSwitch holds the maintenance overrides of the admin API by
+// route name, which outlive reloads
+type maintenanceSwitch struct {
+	mu        sync.RWMutex
+	overrides map[string]bool
+}
+
+// inMaintenance reports whether the route is down for maintenance
+func (m *maintenanceSwitch) inMaintenance(route *Route) bool {
+	if route == nil {
+		return false
+	}
+	m.mu.RLock()
+	on, found := m.overrides[route.Name]
+	m.mu.RUnlock()
+	if found {
+		return on
+	}
+	return route.Maintenance != nil && route.Maintenance.Enabled
+}
+
+// serveMaintenance answers r with the maintenance page of route when it is
+// down for maintenance, reporting whether it did
+func (s *Server) serveMaintenance(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if !s.maintenance.inMaintenance(route) {
+		return false
+	}
+	msg := "Down for maintenance"
+	if cfg := route.Maintenance; cfg != nil {
+		if cfg.Message != "" {
+			msg = cfg.Message
+		}
+		if cfg.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((cfg.RetryAfter+time.Second-1)/time.Second)))
+		}
+	}
+	s.stats.errorCodes.add(ErrorUpstream)
+	Annotate(r, ErrorAnnotation, ErrorUpstream)
+	w.Header().Set("Proxy-Status", s.proxyStatus(ErrorUpstream, msg))
+	s.writeErrorPage(w, r, ErrorUpstream, msg, http.StatusServiceUnavailable, route.maintenancePages, s.errorPages)
+	return true
+}
+
+// MaintenanceStatus reports whether a route is down for maintenance
+type MaintenanceStatus struct {
+	Route string `json:"route"`
+	// Maintenance is the effective state, and Override the state the
+	// admin API set, if any
+	Maintenance bool  `json:"maintenance"`
+	Override    *bool `json:"override,omitempty"`
+}
+
+// handleMaintenance reports the maintenance state of every route
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	out := []MaintenanceStatus{}
+	s.maintenance.mu.RLock()
+	defer s.maintenance.mu.RUnlock()
+	for _, route := range s.routes.Load().routes {
+		status := MaintenanceStatus{Route: route.Name, Maintenance: route.Maintenance != nil && route.Maintenance.Enabled}
+		if on, found := s.maintenance.overrides[route.Name]; found {
+			status.Maintenance, status.Override = on, &on
+		}
+		out = append(out, status)
+	}
+	writeJSON(w, out)
+}
+
+// handleSetMaintenance switches maintenance of a route, e.g.
+// POST /maintenance?route=api&enabled=true
+func (s *Server) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	enabled, err := strconv.ParseBool(q.Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+	route := q.Get("route")
+	if !s.routeExists(route) {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+	s.maintenance.mu.Lock()
+	s.maintenance.overrides[route] = enabled
+	s.maintenance.mu.Unlock()
+	s.log.Info("Toggled maintenance", "route", route, "enabled", enabled)
+	s.handleMaintenance(w, r)
+}
+
+// handleClearMaintenance returns a route to its configured maintenance
+// state, e.g. DELETE /maintenance?route=api
+func (s *Server) handleClearMaintenance(w http.ResponseWriter, r *http.Request) {
+	s.maintenance.mu.Lock()
+	delete(s.maintenance.overrides, r.URL.Query().Get("route"))
+	s.maintenance.mu.Unlock()
+	s.handleMaintenance(w, r)
+}
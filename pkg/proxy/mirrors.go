@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mirrorTargets returns where target is found on each of the route's
+// mirrors, keeping the path below the backend and the query
+func mirrorTargets(route *Route, target *url.URL) []*url.URL {
+	rel := target.Path
+	if route.backend != nil {
+		rel = strings.TrimPrefix(rel, strings.TrimSuffix(route.backend.Path, "/"))
+	}
+	out := make([]*url.URL, len(route.mirrors))
+	for i, mirror := range route.mirrors {
+		u := *mirror
+		u.Path = strings.TrimSuffix(u.Path, "/") + rel
+		u.RawQuery = target.RawQuery
+		out[i] = &u
+	}
+	return out
+}
+
+// doMirrored fetches req from its origin and the route's mirrors, starting
+// one every MirrorStagger (all at once when zero), and returns the first
+// successful response. When none succeeds the first response received is
+// returned, so a 404 from every mirror still reaches the client as such.
+func (s *Server) doMirrored(req *http.Request, route *Route, p *Policy) (*http.Response, error) {
+	urls := append([]*url.URL{req.URL}, mirrorTargets(route, req.URL)...)
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, len(urls))
+	launched := 0
+	launch := func() {
+		mirrorReq := req.Clone(req.Context())
+		mirrorReq.URL = urls[launched]
+		mirrorReq.Host = ""
+		launched++
+		go func() {
+			resp, err := s.recoverAttempt(func() (*http.Response, error) {
+				return s.doUpstream(mirrorReq, p)
+			})
+			results <- result{resp, err}
+		}()
+	}
+
+	launch()
+	for route.MirrorStagger == 0 && launched < len(urls) {
+		launch()
+	}
+	var stagger <-chan time.Time
+	if route.MirrorStagger > 0 {
+		ticker := time.NewTicker(route.MirrorStagger)
+		defer ticker.Stop()
+		stagger = ticker.C
+	}
+
+	var fallback *http.Response
+	var lastErr error
+	for received := 0; received < launched; {
+		select {
+		case <-stagger:
+			if launched < len(urls) {
+				launch()
+			}
+		case res := <-results:
+			received++
+			switch {
+			case res.err != nil:
+				lastErr = res.err
+			case res.resp.StatusCode < 400:
+				if fallback != nil {
+					fallback.Body.Close()
+				}
+				go func(pending int) {
+					for range pending {
+						if res := <-results; res.err == nil {
+							res.resp.Body.Close()
+						}
+					}
+				}(launched - received)
+				if served := res.resp.Request.URL.String(); served != req.URL.String() {
+					s.log.InfoContext(req.Context(), "Served from mirror", "url", served)
+				}
+				return res.resp, nil
+			case fallback == nil:
+				fallback = res.resp
+			default:
+				res.resp.Body.Close()
+			}
+			// Fail over at once rather than waiting out the stagger
+			if launched < len(urls) && received == launched {
+				launch()
+			}
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,182 @@
+//go:build !minimal && !nomitm
+
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// certMinter issues leaf certificates signed by the MITM CA and keeps the
+// most recently used ones for reuse
+type certMinter struct {
+	ca       tls.Certificate
+	validity time.Duration
+	capacity int
+
+	mu    sync.Mutex
+	certs map[string]*list.Element
+	order *list.List
+}
+
+// mintedCert is a generated certificate in the minter's recency list
+type mintedCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+func init() {
+	registerSubsystem("mitm")
+}
+
+// newCertMinter loads the CA described by cfg
+func newCertMinter(cfg MITMConfig) (*certMinter, error) {
+	ca, err := tls.LoadX509KeyPair(cfg.CACertFile, cfg.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Leaf == nil {
+		if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	if !ca.Leaf.IsCA {
+		return nil, errors.New("MITM certificate is not a CA")
+	}
+	capacity := cfg.MaxCertificates
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &certMinter{
+		ca:       ca,
+		validity: cfg.LeafValidity,
+		capacity: capacity,
+		certs:    make(map[string]*list.Element),
+		order:    list.New(),
+	}, nil
+}
+
+// certFor returns a certificate for host, generating it unless a valid one
+// is still kept
+func (m *certMinter) certFor(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if elem, found := m.certs[host]; found {
+		if cert := elem.Value.(*mintedCert).cert; now.Before(cert.Leaf.NotAfter) {
+			m.order.MoveToFront(elem)
+			return cert, nil
+		}
+		m.order.Remove(elem)
+		delete(m.certs, host)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := now.Add(m.validity)
+	if notAfter.After(m.ca.Leaf.NotAfter) {
+		notAfter = m.ca.Leaf.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca.Leaf, &key.PublicKey, m.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	m.certs[host] = m.order.PushFront(&mintedCert{host: host, cert: cert})
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.certs, oldest.Value.(*mintedCert).host)
+	}
+	return cert, nil
+}
+
+// intercept terminates TLS on a hijacked CONNECT tunnel to authority and
+// feeds the decrypted requests through the normal proxy pipeline. tunnel is
+// the CONNECT request, whose proxy user the decrypted requests inherit; it
+// is nil for transparently redirected connections.
+func (s *Server) intercept(conn net.Conn, authority string, tunnel *http.Request) {
+	host := utils.StripPort(authority)
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if ok, reason := s.checkSNI(authority, hello.ServerName); !ok {
+				return nil, errors.New(reason)
+			}
+			if hello.ServerName != "" {
+				return s.minter.certFor(hello.ServerName)
+			}
+			return s.minter.certFor(host)
+		},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		s.log.Warn("MITM handshake failed", "host", authority, "err", err)
+		conn.Close()
+		return
+	}
+
+	// Intercepted requests run through the whole pipeline as if sent to
+	// the proxy for https://authority, on behalf of the tunnel's user
+	user, tunnelled := "", false
+	if tunnel != nil {
+		user, tunnelled = Annotation(tunnel, ProxyUserAnnotation)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL = &url.URL{Scheme: "https", Host: authority, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		r.RequestURI = r.URL.String()
+		if r.Host == "" {
+			r.Host = authority
+		}
+		if tunnelled {
+			r = r.WithContext(context.WithValue(r.Context(), tunnelUserKey{}, user))
+		}
+		s.log.Debug("Intercepted request", "url", r.URL.String())
+		s.serveProxy(w, r)
+	})
+	http.Serve(&singleConnListener{conn: tlsConn}, handler)
+}
@@ -0,0 +1,20 @@
+//go:build minimal || nomitm
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// certMinter is not available in builds without MITM support
+type certMinter struct{}
+
+func newCertMinter(MITMConfig) (*certMinter, error) {
+	return nil, errors.New("built without MITM support")
+}
+
+func (s *Server) intercept(conn net.Conn, authority string, tunnel *http.Request) {
+	conn.Close()
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxTrackedOrigins bounds the per-origin breakdown; further origins are
+// counted together under otherOrigins
+const maxTrackedOrigins = 10000
+
+const otherOrigins = "(other)"
+
+// originCounters are the cache counters of one origin host
+type originCounters struct {
+	Hits        atomic.Int64
+	Misses      atomic.Int64
+	BytesSaved  atomic.Int64
+	NotModified atomic.Int64
+}
+
+// OriginStats is a point-in-time copy of the cache counters of one origin.
+// BytesSaved counts body bytes served from the cache instead of the
+// origin; NotModified counts 304 Not Modified answers from the origin to
+// the conditional requests of clients, as the proxy sends none of its own.
+type OriginStats struct {
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRatio    float64 `json:"hit_ratio"`
+	BytesSaved  int64   `json:"bytes_saved"`
+	NotModified int64   `json:"not_modified"`
+}
+
+// originTable holds the counters of every origin seen
+type originTable struct {
+	mu      sync.RWMutex
+	origins map[string]*originCounters
+}
+
+// get returns the counters of host, creating them on first use
+func (t *originTable) get(host string) *originCounters {
+	t.mu.RLock()
+	c, found := t.origins[host]
+	t.mu.RUnlock()
+	if found {
+		return c
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.origins == nil {
+		t.origins = make(map[string]*originCounters)
+	}
+	if c, found := t.origins[host]; found {
+		return c
+	}
+	if len(t.origins) >= maxTrackedOrigins {
+		host = otherOrigins
+		if c, found := t.origins[host]; found {
+			return c
+		}
+	}
+	c = &originCounters{}
+	t.origins[host] = c
+	return c
+}
+
+// snapshot copies the counters of every origin
+func (t *originTable) snapshot() map[string]OriginStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.origins) == 0 {
+		return nil
+	}
+	out := make(map[string]OriginStats, len(t.origins))
+	for host, c := range t.origins {
+		s := OriginStats{
+			Hits:        c.Hits.Load(),
+			Misses:      c.Misses.Load(),
+			BytesSaved:  c.BytesSaved.Load(),
+			NotModified: c.NotModified.Load(),
+		}
+		if total := s.Hits + s.Misses; total > 0 {
+			s.HitRatio = float64(s.Hits) / float64(total)
+		}
+		out[host] = s
+	}
+	return out
+}
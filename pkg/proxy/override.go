@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+)
+
+// UpstreamOverrideConfig lets trusted clients force a reverse-proxy request
+// to one named backend of a balanced route with a header such as
+// X-Upstream-Override: backend-2, to test a specific replica through the
+// production proxy. Overridden requests bypass the cache.
+type UpstreamOverrideConfig struct {
+	// Header carries the backend name; it defaults to X-Upstream-Override
+	Header string
+	// Clients lists the client networks allowed to override, e.g.
+	// "10.1.0.0/16"
+	Clients []string
+	// Subjects lists the client certificate subjects allowed to override
+	Subjects []string
+}
+
+// defaultOverrideHeader is the header read when none is configured
+const defaultOverrideHeader = "X-Upstream-Override"
+
+// overrideACL is the compiled UpstreamOverrideConfig
+type overrideACL struct {
+	header   string
+	clients  []netip.Prefix
+	subjects []string
+}
+
+// compileOverrideACL validates cfg
+func compileOverrideACL(cfg UpstreamOverrideConfig) (*overrideACL, error) {
+	acl := &overrideACL{header: cfg.Header, subjects: cfg.Subjects}
+	if acl.header == "" {
+		acl.header = defaultOverrideHeader
+	}
+	for _, client := range cfg.Clients {
+		prefix, err := netip.ParsePrefix(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network %q", client)
+		}
+		acl.clients = append(acl.clients, prefix.Masked())
+	}
+	return acl, nil
+}
+
+// allows reports whether the client of r may override the upstream
+func (acl *overrideACL) allows(r *http.Request) bool {
+	if subject := clientSubject(r); subject != "" && slices.Contains(acl.subjects, subject) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range acl.clients {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamOverride returns the backend r asks for, removing the header so
+// it never reaches the upstream. It answers 403 and reports false when the
+// client may not override. The header is ignored outside reverse-proxy mode
+// and on routes without a backend pool.
+func (s *Server) upstreamOverride(w http.ResponseWriter, r *http.Request, route *Route) (string, bool) {
+	name := r.Header.Get(s.overrides.header)
+	if name == "" {
+		return "", true
+	}
+	r.Header.Del(s.overrides.header)
+	if s.cfg.Mode != ModeReverse || route == nil || route.pool == nil {
+		return "", true
+	}
+	if !s.overrides.allows(r) {
+		s.log.WarnContext(r.Context(), "Upstream override refused", "client", r.RemoteAddr)
+		s.httpError(w, r, "Upstream override not permitted", http.StatusForbidden)
+		return "", false
+	}
+	return name, true
+}
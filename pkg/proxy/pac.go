@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// PACConfig controls the proxy auto-config file served at /proxy.pac
+type PACConfig struct {
+	Enabled bool
+	// ProxyAddr is the host:port browsers should use; empty uses the
+	// address the PAC file was requested from
+	ProxyAddr string
+	// Direct lists host patterns that browsers reach without the proxy
+	Direct []string
+	// BypassDirect also sends hosts on the bypass list direct, since the
+	// proxy passes them through unprocessed anyway
+	BypassDirect bool
+	// Fallback lets browsers go direct when the proxy is unreachable
+	Fallback bool
+}
+
+// pacPath is where the PAC file is served
+const pacPath = "/proxy.pac"
+
+// pacTemplate is the PAC file; MatchHost semantics are reproduced by
+// matchHost so patterns behave as they do in the proxy
+const pacTemplate = `// Generated by go-multithreaded-proxy
+var proxy = %s;
+var strict = %s;
+var denied = %s;
+var direct = %s;
+
+function matchHost(pattern, host) {
+  if (pattern.charAt(0) == "*") {
+    var suffix = pattern.substring(1);
+    return host.length >= suffix.length && host.substring(host.length - suffix.length) == suffix;
+  }
+  if (pattern.charAt(0) == ".") {
+    return host == pattern.substring(1) ||
+      (host.length >= pattern.length && host.substring(host.length - pattern.length) == pattern);
+  }
+  return host == pattern;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  // Denied hosts stay on the proxy, which refuses them, without fallback
+  for (var i = 0; i < denied.length; i++) {
+    if (matchHost(denied[i], host)) return strict;
+  }
+  if (isPlainHostName(host)) return "DIRECT";
+  for (var i = 0; i < direct.length; i++) {
+    if (matchHost(direct[i], host)) return "DIRECT";
+  }
+  return proxy;
+}
+`
+
+// generatePAC renders the PAC file for a proxy reachable at proxyAddr from
+// the configured direct hosts, the bypass list and the host ACLs
+func (s *Server) generatePAC(cfg PACConfig, proxyAddr string) string {
+	if cfg.ProxyAddr != "" {
+		proxyAddr = cfg.ProxyAddr
+	}
+	proxy := "PROXY " + proxyAddr
+	if s.cfg.TLSCertFile != "" {
+		proxy = "HTTPS " + proxyAddr
+	}
+	strict := proxy
+	if cfg.Fallback {
+		proxy += "; DIRECT"
+	}
+
+	direct := lowerAll(cfg.Direct)
+	if cfg.BypassDirect {
+		for _, rule := range s.bypass.Rules() {
+			// Path-specific rules cannot be expressed per host
+			if rule.PathPrefix == "" {
+				direct = append(direct, strings.ToLower(rule.Host))
+			}
+		}
+	}
+	denied := lowerAll(append(slices.Clone(s.cfg.SNIPolicy.ACL.Deny), s.currentDestinationACL().Deny...))
+	return fmt.Sprintf(pacTemplate, jsLiteral(proxy), jsLiteral(strict), jsLiteral(denied), jsLiteral(direct))
+}
+
+// lowerAll returns the patterns in lower case, never nil
+func lowerAll(patterns []string) []string {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		out = append(out, strings.ToLower(p))
+	}
+	return out
+}
+
+// jsLiteral encodes v as a JavaScript literal
+func jsLiteral(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// isPACRequest reports whether r asks for the PAC file
+func (s *Server) isPACRequest(r *http.Request) bool {
+	return s.cfg.PAC.Enabled && r.URL.Path == pacPath && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// servePAC answers requests for the PAC file, reporting whether it did
+func (s *Server) servePAC(w http.ResponseWriter, r *http.Request) bool {
+	if !s.isPACRequest(r) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "max-age=300")
+	if r.Method == http.MethodGet {
+		fmt.Fprint(w, s.generatePAC(s.cfg.PAC, r.Host))
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Middleware wraps the handler of the later stages of the request
+// pipeline, like any func(http.Handler) http.Handler middleware. It may
+// answer a request itself by not calling the handler it wraps.
+type Middleware func(http.Handler) http.Handler
+
+// Stage is a position in the request pipeline. Once the client of a
+// request is identified, logged and classified, the request passes the
+// stages in order. Middleware added at a stage runs just before the
+// proxy's own handling there, seeing the request as the earlier stages
+// left it.
+type Stage int
+
+const (
+	// StageAuth challenges clients that authentication is required of and
+	// that presented no valid token or credentials. Middleware here may
+	// authenticate clients itself by annotating ProxyUserAnnotation.
+	StageAuth Stage = iota
+	// StageACL refuses clients from blocked countries and applies
+	// ScriptRules
+	StageACL
+	// StageRateLimit enforces client rate limits, worker admission and
+	// egress budgets
+	StageRateLimit
+	// StageCache injects the faults of chaos rules, answers from the
+	// proxy's own endpoints, opens CONNECT tunnels, resolves the
+	// destination and answers from the cache
+	StageCache
+	// StageUpstream fetches cache misses from their origin or backend; it
+	// is reached once per miss, including requests decrypted by MITM
+	StageUpstream
+
+	stageCount
+)
+
+var stageNames = [stageCount]string{"auth", "acl", "rate_limit", "cache", "upstream"}
+
+func (s Stage) String() string {
+	if s < 0 || s >= stageCount {
+		return fmt.Sprintf("Stage(%d)", int(s))
+	}
+	return stageNames[s]
+}
+
+// WithMiddleware adds mw at stage, after middleware added there before:
+// the first added sees requests first
+func WithMiddleware(stage Stage, mw ...Middleware) Option {
+	if stage < 0 || stage >= stageCount {
+		panic("proxy: WithMiddleware with unknown " + stage.String())
+	}
+	return func(s *Server) { s.middleware[stage] = append(s.middleware[stage], mw...) }
+}
+
+// requestPipeline holds the handlers of the stages in force
+type requestPipeline struct {
+	// entry runs a request through every stage from StageAuth
+	entry http.Handler
+	// upstream runs a cache miss through StageUpstream
+	upstream http.Handler
+	// custom reports whether middleware was added, which the fast hit
+	// path must not bypass
+	custom bool
+}
+
+// buildPipeline chains the proxy's handling of each stage after the
+// middleware added there
+func (s *Server) buildPipeline(middleware *[stageCount][]Middleware) requestPipeline {
+	if middleware == nil {
+		middleware = new([stageCount][]Middleware)
+	}
+	custom := false
+	stage := func(st Stage, h http.Handler) http.Handler {
+		custom = custom || len(middleware[st]) > 0
+		for i := len(middleware[st]) - 1; i >= 0; i-- {
+			h = middleware[st][i](h)
+		}
+		return h
+	}
+	h := stage(StageCache, s.injectFaults(http.HandlerFunc(s.dispatch)))
+	h = stage(StageRateLimit, s.limitRate(s.admitWorker(s.spendEgress(h))))
+	h = stage(StageACL, s.checkClientACL(h))
+	h = stage(StageAuth, s.requireAuth(h))
+	upstream := stage(StageUpstream, http.HandlerFunc(s.serveUpstream))
+	return requestPipeline{entry: h, upstream: upstream, custom: custom}
+}
+
+// requireAuth challenges clients authenticate did not identify, unless
+// they address the proxy's own endpoints
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isEndpoint(r) && !s.checkProxyAuth(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkClientACL refuses clients from blocked countries and requests
+// script rules block
+func (s *Server) checkClientACL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkClientCountry(w, r) || !s.applyScriptRules(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitRate refuses clients over their rate
+func (s *Server) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkRateLimit(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// admitWorker runs the request on a worker when the pool is enabled
+func (s *Server) admitWorker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.workers != nil {
+			s.withWorker(w, r, next.ServeHTTP)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// spendEgress enforces the egress budget of the requesting tenant
+func (s *Server) spendEgress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.egress != nil && s.toggles.Enabled(ToggleRateLimiting, s.arrivalRoute(r)) {
+			s.withEgressBudget(w, r, next.ServeHTTP)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,16 @@
+//go:build !minimal && !noplugins
+
+package proxy
+
+import "plugin"
+
+func init() {
+	registerSubsystem("plugins")
+}
+
+// openPluginFile opens the Go plugin at path, running the init functions
+// that register its plugins
+func openPluginFile(path string) error {
+	_, err := plugin.Open(path)
+	return err
+}
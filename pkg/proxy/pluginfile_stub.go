@@ -0,0 +1,11 @@
+//go:build minimal || noplugins
+
+package proxy
+
+import "errors"
+
+// openPluginFile refuses plugin files in builds without plugin loading;
+// plugins compiled into the binary still register
+func openPluginFile(path string) error {
+	return errors.New("plugin files are not supported by this binary")
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// Plugins let third parties ship filters, authentication providers and
+// cache backends without changing the proxy. A plugin package registers a
+// factory under a name from an init function, and is either imported by
+// the binary or built with go build -buildmode=plugin and named by the Path
+// of its configuration entry. The configuration enables plugins by name,
+// and they are created at startup from the settings of their entries.
+
+// PluginFactory creates a plugin from the settings of its configuration
+// entry. The plugin implements one or more of Filter, Authenticator and
+// CacheBackend; one holding resources may implement io.Closer to release
+// them on shutdown.
+type PluginFactory func(settings map[string]any) (any, error)
+
+// Filter is a plugin processing requests at a stage of the pipeline, after
+// the middleware an embedding application added there
+type Filter interface {
+	Stage() Stage
+	Middleware(next http.Handler) http.Handler
+}
+
+// Authenticator is a plugin identifying clients the proxy's own token and
+// Basic authentication did not. Enabling one requires every client to
+// authenticate.
+type Authenticator interface {
+	// Authenticate returns the user r identifies, reporting false when r
+	// carries no credentials the plugin accepts
+	Authenticate(r *http.Request) (user string, ok bool)
+	// Challenge is the challenge sent to clients that did not
+	// authenticate, e.g. `Negotiate`, or empty for none
+	Challenge() string
+}
+
+// CacheBackend is a plugin storing cached responses beyond the memory
+// cache. It is consulted on memory misses after the disk cache, and
+// receives every response stored, status line and headers included, in
+// the HTTP/1.1 wire format.
+type CacheBackend interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, value []byte) error
+	// Delete removes key, reporting whether it was present
+	Delete(key string) bool
+}
+
+// PluginConfig enables a plugin
+type PluginConfig struct {
+	// Name is the name the plugin registered under
+	Name string `json:"name"`
+	// Path is a Go plugin file opened before the plugin is looked up, whose
+	// init functions register the plugins it holds
+	Path string `json:"path,omitempty"`
+	// Settings configure the plugin, in a form of its own
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+// pluginFactories are the registered plugins, by name
+var pluginFactories = map[string]PluginFactory{}
+
+// RegisterPlugin installs a plugin that the configuration may enable by
+// name. It must be called before StartServer, typically from an init
+// function.
+func RegisterPlugin(name string, f PluginFactory) {
+	pluginFactories[name] = f
+}
+
+// Plugins returns the names of the registered plugins
+func Plugins() []string {
+	names := make([]string, 0, len(pluginFactories))
+	for name := range pluginFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pluginSet are the enabled plugins, by what they do
+type pluginSet struct {
+	middleware     [stageCount][]Middleware
+	authenticators []Authenticator
+	cache          CacheBackend
+	closers        []io.Closer
+	log            *slog.Logger
+}
+
+// loadPlugins opens the plugin files of cfgs and creates their plugins
+func (s *Server) loadPlugins(cfgs []PluginConfig) (*pluginSet, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	set := &pluginSet{log: s.log.Logger}
+	for i, cfg := range cfgs {
+		p, err := createPlugin(cfg)
+		if err != nil {
+			set.close()
+			return nil, fmt.Errorf("plugin %d (%s): %w", i+1, cfg.Name, err)
+		}
+		if c, ok := p.(io.Closer); ok {
+			set.closers = append(set.closers, c)
+		}
+		used := false
+		if f, ok := p.(Filter); ok {
+			stage := f.Stage()
+			if stage < 0 || stage >= stageCount {
+				set.close()
+				return nil, fmt.Errorf("plugin %d (%s): filter at unknown %s", i+1, cfg.Name, stage)
+			}
+			set.middleware[stage] = append(set.middleware[stage], f.Middleware)
+			used = true
+		}
+		if a, ok := p.(Authenticator); ok {
+			set.authenticators = append(set.authenticators, a)
+			used = true
+		}
+		if c, ok := p.(CacheBackend); ok {
+			if set.cache != nil {
+				set.close()
+				return nil, fmt.Errorf("plugin %d (%s): a cache backend is already enabled", i+1, cfg.Name)
+			}
+			set.cache = c
+			used = true
+		}
+		if !used {
+			set.close()
+			return nil, fmt.Errorf("plugin %d (%s): %T is neither a Filter, an Authenticator nor a CacheBackend", i+1, cfg.Name, p)
+		}
+		s.log.Info("Plugin loaded", "plugin", cfg.Name)
+	}
+	return set, nil
+}
+
+// createPlugin creates the plugin cfg enables
+func createPlugin(cfg PluginConfig) (any, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if cfg.Path != "" {
+		if err := openPluginFile(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+	factory, found := pluginFactories[cfg.Name]
+	if !found {
+		return nil, errors.New("no plugin of this name is registered")
+	}
+	p, err := factory(cfg.Settings)
+	if err == nil && p == nil {
+		err = errors.New("factory returned no plugin")
+	}
+	return p, err
+}
+
+// filters returns the middleware of the filter plugins at each stage
+func (s *pluginSet) filters() [stageCount][]Middleware {
+	if s == nil {
+		return [stageCount][]Middleware{}
+	}
+	return s.middleware
+}
+
+// cacheBackend returns the cache backend plugin, or nil
+func (s *pluginSet) cacheBackend() CacheBackend {
+	if s == nil {
+		return nil
+	}
+	return s.cache
+}
+
+// authenticates reports whether authenticator plugins are enabled
+func (s *pluginSet) authenticates() bool {
+	return s != nil && len(s.authenticators) > 0
+}
+
+// authenticate returns the user the first accepting authenticator plugin
+// identifies r as
+func (s *pluginSet) authenticate(r *http.Request) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	for _, a := range s.authenticators {
+		if user, ok := a.Authenticate(r); ok {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// challenges returns the challenges of the authenticator plugins
+func (s *pluginSet) challenges() []string {
+	if s == nil {
+		return nil
+	}
+	var out []string
+	for _, a := range s.authenticators {
+		if c := a.Challenge(); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// close releases the resources of the plugins
+func (s *pluginSet) close() {
+	if s == nil {
+		return
+	}
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil {
+			s.log.Warn("Plugin close failed", "err", err)
+		}
+	}
+}
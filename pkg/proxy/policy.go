@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Policy is a named set of upstream timeout, retry and hedging settings,
+// defined once and shared by every route that references it
+type Policy struct {
+	Name string `json:"name"`
+	// Timeout bounds the whole upstream exchange, body included, across all
+	// attempts
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// AttemptTimeout bounds how long the first attempt waits for response
+	// headers; each later attempt waits TimeoutGrowth times longer than the
+	// one before. Attempts also remain bounded by Transport.RequestTimeout.
+	AttemptTimeout time.Duration `json:"attempt_timeout,omitempty"`
+	// TimeoutGrowth defaults to 1, giving every attempt the same timeout
+	TimeoutGrowth float64 `json:"timeout_growth,omitempty"`
+	// Retries is how many more attempts follow a failed one. Connection
+	// errors and attempt timeouts are retried, as are RetryOn statuses.
+	Retries int `json:"retries,omitempty"`
+	// RetryOn defaults to 502, 503 and 504
+	RetryOn []int `json:"retry_on,omitempty"`
+	// RetryBackoff is the delay before the first retry, doubling for each
+	// retry after it up to RetryMaxBackoff. Each delay is jittered down by
+	// up to half so that clients retrying together spread out.
+	RetryBackoff    time.Duration `json:"retry_backoff,omitempty"`
+	RetryMaxBackoff time.Duration `json:"retry_max_backoff,omitempty"`
+	// RetryBudget stops retrying once this long has passed since the first
+	// attempt, whatever retries remain; zero means no budget
+	RetryBudget time.Duration `json:"retry_budget,omitempty"`
+	// Hedges is how many extra concurrent attempts may be started, one each
+	// time HedgeDelay passes without a response; the first response wins
+	Hedges     int           `json:"hedges,omitempty"`
+	HedgeDelay time.Duration `json:"hedge_delay,omitempty"`
+	// Breaker replaces the global circuit breaker settings for the
+	// policy's routes
+	Breaker *BreakerConfig `json:"breaker,omitempty"`
+}
+
+// defaultRetryOn are the statuses retried when a policy lists none
+var defaultRetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// Validate reports settings that are invalid on their own or that
+// contradict each other
+func (p Policy) Validate() error {
+	switch {
+	case p.Name == "":
+		return errors.New("policy has no name")
+	case p.Timeout < 0 || p.AttemptTimeout < 0 || p.HedgeDelay < 0 || p.Retries < 0 || p.Hedges < 0,
+		p.RetryBackoff < 0 || p.RetryMaxBackoff < 0 || p.RetryBudget < 0:
+		return fmt.Errorf("policy %q: negative setting", p.Name)
+	case p.RetryMaxBackoff > 0 && p.RetryMaxBackoff < p.RetryBackoff:
+		return fmt.Errorf("policy %q: retry max backoff is below the retry backoff", p.Name)
+	case (p.RetryBackoff > 0 || p.RetryBudget > 0) && p.Retries == 0:
+		return fmt.Errorf("policy %q: retry backoff or budget is set without retries", p.Name)
+	case p.TimeoutGrowth != 0 && p.TimeoutGrowth < 1:
+		return fmt.Errorf("policy %q: timeout growth must be at least 1", p.Name)
+	case p.Retries > 0 && p.Hedges > 0:
+		return fmt.Errorf("policy %q: retries and hedging cannot be combined", p.Name)
+	case len(p.RetryOn) > 0 && p.Retries == 0:
+		return fmt.Errorf("policy %q: retry_on is set without retries", p.Name)
+	case p.Hedges > 0 && p.HedgeDelay == 0:
+		return fmt.Errorf("policy %q: hedging requires a hedge delay", p.Name)
+	case p.Hedges > 0 && p.AttemptTimeout > 0 && p.HedgeDelay >= p.AttemptTimeout:
+		return fmt.Errorf("policy %q: hedge delay %v never elapses within attempt timeout %v", p.Name, p.HedgeDelay, p.AttemptTimeout)
+	case p.Hedges > 0 && p.Timeout > 0 && p.HedgeDelay >= p.Timeout:
+		return fmt.Errorf("policy %q: hedge delay %v never elapses within timeout %v", p.Name, p.HedgeDelay, p.Timeout)
+	case p.AttemptTimeout > 0 && p.Timeout > 0 && p.worstCase() > p.Timeout:
+		return fmt.Errorf("policy %q: timeout %v cannot fit %d attempts needing up to %v", p.Name, p.Timeout, p.Retries+1, p.worstCase())
+	}
+	if p.Breaker != nil {
+		if err := p.Breaker.Validate(); err != nil {
+			return fmt.Errorf("policy %q: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// attemptTimeout returns the header timeout of the given zero-based attempt
+func (p *Policy) attemptTimeout(attempt int) time.Duration {
+	timeout := float64(p.AttemptTimeout)
+	for range attempt {
+		timeout *= max(p.TimeoutGrowth, 1)
+	}
+	return time.Duration(timeout)
+}
+
+// backoff returns the longest delay before the given one-based retry
+func (p *Policy) backoff(retry int) time.Duration {
+	delay := p.RetryBackoff
+	for i := 1; i < retry && (p.RetryMaxBackoff == 0 || delay < p.RetryMaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.RetryMaxBackoff > 0 {
+		delay = min(delay, p.RetryMaxBackoff)
+	}
+	return delay
+}
+
+// worstCase is the time all attempts take when each one times out
+func (p *Policy) worstCase() time.Duration {
+	var total time.Duration
+	for attempt := range p.Retries + 1 {
+		total += p.attemptTimeout(attempt)
+		if attempt > 0 {
+			total += p.backoff(attempt)
+		}
+	}
+	return total
+}
+
+// retryable reports whether a response status is retried
+func (p *Policy) retryable(status int) bool {
+	if len(p.RetryOn) == 0 {
+		return slices.Contains(defaultRetryOn, status)
+	}
+	return slices.Contains(p.RetryOn, status)
+}
+
+// compilePolicies validates the configured policies and indexes them by name
+func compilePolicies(list []Policy) (map[string]*Policy, error) {
+	byName := make(map[string]*Policy)
+	for i := range list {
+		p := list[i]
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		if _, dup := byName[p.Name]; dup {
+			return nil, fmt.Errorf("policy %q is defined twice", p.Name)
+		}
+		byName[p.Name] = &p
+	}
+	return byName, nil
+}
+
+// routePolicy returns the policy referenced by route, or the default
+// policy for requests without a route or whose route names none
+func (s *Server) routePolicy(route *Route) *Policy {
+	if route == nil || route.Policy == "" {
+		return s.policies[s.cfg.DefaultPolicy]
+	}
+	return s.policies[route.Policy]
+}
+
+// doUpstream sends req to the origin under the policy, or once with the
+// client defaults when there is none
+func (s *Server) doUpstream(req *http.Request, p *Policy) (*http.Response, error) {
+	if p == nil {
+		return s.sendUpstream(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	if p.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), p.Timeout)
+	}
+	var resp *http.Response
+	var err error
+	if p.Hedges > 0 && replayable(req) {
+		resp, err = s.doHedged(ctx, req, p)
+	} else {
+		resp, err = s.doRetried(ctx, req, p)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// doRetried makes sequential attempts, backing off between them, until
+// one succeeds or the retries or retry budget run out. The last response is
+// returned even when its status is retryable. Only replayable requests are
+// retried, and a response that needed retries says how many.
+func (s *Server) doRetried(ctx context.Context, req *http.Request, p *Policy) (*http.Response, error) {
+	start := time.Now()
+	retries := 0
+	for attempt := 0; ; attempt++ {
+		resp, err := s.doAttempt(ctx, req, attempt, p.attemptTimeout(attempt))
+		failed := err != nil || p.retryable(resp.StatusCode)
+		if failed && attempt < p.Retries && replayable(req) {
+			delay := p.backoff(attempt + 1)
+			delay -= time.Duration(rand.Int64N(int64(delay/2) + 1))
+			if p.RetryBudget == 0 || time.Since(start)+delay <= p.RetryBudget {
+				if err == nil {
+					s.log.InfoContext(req.Context(), "Retrying after upstream status", "status", resp.StatusCode, "url", req.URL.String())
+					resp.Body.Close()
+				} else {
+					s.log.InfoContext(req.Context(), "Retrying after upstream error", "url", req.URL.String(), "err", err)
+				}
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				retries++
+				s.stats.Retries.Add(1)
+				continue
+			}
+		}
+
+		if err == nil && retries > 0 {
+			resp.Header.Set(retriesHeader, strconv.Itoa(retries))
+		}
+		return resp, err
+	}
+}
+
+// retriesHeader tells clients how many retries their response needed
+const retriesHeader = "X-Proxy-Retries"
+
+// idempotent reports whether requests with method may safely be repeated
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// doHedged starts another attempt each time HedgeDelay passes without a
+// response, or at once when an attempt fails, up to Hedges extra attempts,
+// and returns the first response
+func (s *Server) doHedged(ctx context.Context, req *http.Request, p *Policy) (*http.Response, error) {
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, p.Hedges+1)
+	launched, pending := 0, 0
+	launch := func() {
+		attempt, timeout := launched, p.attemptTimeout(launched)
+		launched++
+		pending++
+		go func() {
+			resp, err := s.recoverAttempt(func() (*http.Response, error) {
+				return s.doAttempt(ctx, req, attempt, timeout)
+			})
+			results <- result{resp, err}
+		}()
+	}
+
+	launch()
+	hedge := time.NewTicker(p.HedgeDelay)
+	defer hedge.Stop()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-hedge.C:
+			if launched <= p.Hedges {
+				launch()
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				lastErr = res.err
+				if launched <= p.Hedges {
+					launch()
+				}
+				continue
+			}
+			// Losing attempts are abandoned; their bodies are closed, which
+			// cancels them, as they come in
+			go func(pending int) {
+				for range pending {
+					if res := <-results; res.err == nil {
+						res.resp.Body.Close()
+					}
+				}
+			}(pending)
+			return res.resp, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// doAttempt sends one attempt that gives up when response headers take
+// longer than timeout; zero waits as long as ctx allows. Attempts after the
+// first send a fresh copy of the body from GetBody.
+func (s *Server) doAttempt(ctx context.Context, req *http.Request, attempt int, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	clone := req.Clone(ctx)
+	if attempt > 0 && hasBody(req) {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("%s: replaying the request body: %w", req.URL, err)
+		}
+		clone.Body = body
+	}
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	resp, err := s.sendUpstream(clone)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = fmt.Errorf("%s: no response headers within %v", req.URL, timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of an exchange once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
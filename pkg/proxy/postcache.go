@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// PostCacheConfig caches the responses to POST requests on a route whose
+// POSTs are idempotent queries, such as search or GraphQL endpoints. They
+// are cached under the URL and a hash of the request body and its
+// Content-Type, and only successful responses are kept.
+type PostCacheConfig struct {
+	// TTL is how long responses are served from the cache; it defaults to
+	// a minute
+	TTL time.Duration `json:"ttl,omitempty"`
+	// MaxBodyBytes is the largest request body whose response is cached,
+	// 64 KiB by default
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+}
+
+// withDefaults validates cfg and fills in its defaults
+func (cfg PostCacheConfig) withDefaults() (PostCacheConfig, error) {
+	if cfg.TTL < 0 || cfg.MaxBodyBytes < 0 {
+		return cfg, fmt.Errorf("negative POST cache limit")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = time.Minute
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = 64 << 10
+	}
+	return cfg, nil
+}
+
+// postCacheURL reads the body of r, a POST request to targetURL, and
+// returns the URL its response is cached under, reporting false when the
+// body is too large to cache the response. The body is restored for the
+// upstream.
+func postCacheURL(r *http.Request, cfg *PostCacheConfig, targetURL string) (string, bool) {
+	if r.ContentLength > cfg.MaxBodyBytes {
+		return targetURL, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, cfg.MaxBodyBytes+1))
+	if err != nil || int64(len(body)) > cfg.MaxBodyBytes {
+		// What was read still goes upstream, which sees the error
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return targetURL, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	h := sha256.New()
+	io.WriteString(h, r.Header.Get("Content-Type"))
+	h.Write([]byte{0})
+	h.Write(body)
+	return "POST " + targetURL + " " + hex.EncodeToString(h.Sum(nil)), true
+}
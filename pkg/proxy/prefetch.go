@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrefetchConfig controls refreshing the links of aged HTML pages. When an
+// HTML cache hit is older than MinAge, the same-origin pages it links to
+// are fetched again in the background so that browsing stays warm.
+//
+// With Assets set, an HTML page stored in the cache also has the
+// same-origin stylesheets, scripts and images it loads fetched into the
+// cache, so that the next load of the page is served almost entirely from
+// it.
+type PrefetchConfig struct {
+	// MinAge is the age a cached page must reach to trigger a refresh;
+	// zero disables prefetching
+	MinAge time.Duration
+	// MaxLinks bounds the links refreshed per page
+	MaxLinks int
+	// Assets prefetches the assets of HTML pages as they are cached
+	Assets bool
+	// MaxAssets bounds the assets prefetched per page; it defaults to 32
+	MaxAssets int
+	// Concurrency bounds the asset fetches in flight across all pages; it
+	// defaults to 4
+	Concurrency int
+}
+
+// linkPattern finds href attributes in HTML
+var linkPattern = regexp.MustCompile(`(?i)\bhref\s*=\s*["']([^"'#]+)`)
+
+// assetTagPattern finds the tags that load assets, and attrPattern their
+// attributes, quoted or not
+var (
+	assetTagPattern = regexp.MustCompile(`(?is)<(link|script|img|source)\b([^>]*)>`)
+	attrPattern     = regexp.MustCompile(`(?is)\b(rel|href|src|srcset)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// assetRels are the link relations whose targets a page loads
+var assetRels = []string{"stylesheet", "icon", "preload", "modulepreload"}
+
+// prefetcher remembers which pages recently triggered a refresh
+type prefetcher struct {
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+// maybePrefetch refreshes the links of the cached page stored under key
+// when it is old enough, at most once per MinAge for each page
+func (s *Server) maybePrefetch(page *url.URL, key string, body []byte, route *Route) {
+	cfg := s.cfg.Prefetch
+	if cfg.MinAge <= 0 || !s.toggles.Enabled(TogglePrefetching, route) {
+		return
+	}
+	if age, found := s.cache.Age(key); !found || age < cfg.MinAge {
+		return
+	}
+	if !strings.HasPrefix(http.DetectContentType(body), "text/html") {
+		return
+	}
+	if !s.prefetches.claim(key, cfg.MinAge) {
+		return
+	}
+	s.goSafe("prefetch", func() { s.prefetchLinks(page, body, cfg.MaxLinks) })
+}
+
+// claim reports whether key may trigger a refresh now, forgetting claims
+// older than every
+func (p *prefetcher) claim(key string, every time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for k, at := range p.started {
+		if now.Sub(at) >= every {
+			delete(p.started, k)
+		}
+	}
+	if _, found := p.started[key]; found {
+		return false
+	}
+	p.started[key] = now
+	return true
+}
+
+// sameOriginLinks returns up to max distinct links of body that point to
+// the origin of page
+func sameOriginLinks(page *url.URL, body []byte, max int) []*url.URL {
+	seen := map[string]bool{page.String(): true}
+	var links []*url.URL
+	for _, m := range linkPattern.FindAllSubmatch(body, -1) {
+		if len(links) >= max {
+			break
+		}
+		ref, err := url.Parse(string(m[1]))
+		if err != nil {
+			continue
+		}
+		link := page.ResolveReference(ref)
+		if link.Scheme != page.Scheme || link.Host != page.Host || seen[link.String()] {
+			continue
+		}
+		seen[link.String()] = true
+		links = append(links, link)
+	}
+	return links
+}
+
+// prefetchLinks refreshes the cached copies of the pages body links to
+func (s *Server) prefetchLinks(page *url.URL, body []byte, max int) {
+	for _, link := range sameOriginLinks(page, body, max) {
+		if err := s.refreshCached(link); err != nil {
+			s.log.Debug("Prefetch failed", "url", link.String(), "err", err)
+		}
+	}
+}
+
+// refreshCached fetches u and stores a successful response in the cache
+func (s *Server) refreshCached(u *url.URL) error {
+	if s.bypass.Match(u) {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(s.background, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !s.decodeBody(resp) {
+		return nil
+	}
+	key, ok := s.variants.Record(u.String(), req.Header, resp.Header)
+	if !ok {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, s.cfg.CacheMaxObjectBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > s.cfg.CacheMaxObjectBytes {
+		return nil
+	}
+	s.cachePut(key, cachedResponse(resp, body))
+	s.log.Debug("Prefetched", "url", u.String())
+	return nil
+}
+
+// maxQueuedAssets bounds the asset fetches waiting for a slot, beyond
+// which further assets are not prefetched
+const maxQueuedAssets = 256
+
+// assetPrefetcher fetches page assets into the cache with bounded
+// concurrency, each URL once at a time
+type assetPrefetcher struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	slots   chan struct{}
+}
+
+// prefetchAssets fetches the assets of the HTML page resp answered into
+// the cache in the background, once body, its decoded content, was cached
+func (s *Server) prefetchAssets(resp *http.Response, body []byte) {
+	cfg := s.cfg.Prefetch
+	if !cfg.Assets || resp.Request.Method != http.MethodGet || !isHTMLResponse(resp.Header, body) {
+		return
+	}
+	ex, _ := resp.Request.Context().Value(exchangeKey{}).(*exchange)
+	if ex == nil || !s.toggles.Enabled(TogglePrefetching, ex.route) {
+		return
+	}
+	maxAssets := cfg.MaxAssets
+	if maxAssets <= 0 {
+		maxAssets = 32
+	}
+	// Assets are cached under the page's cache URL, as requests for them
+	// will be
+	for _, asset := range pageAssets(ex.target, body, maxAssets) {
+		if _, found := s.cacheGet(s.variants.Key(asset.String(), http.Header{})); found {
+			continue
+		}
+		s.prefetchAsset(asset, cfg.Concurrency)
+	}
+}
+
+// isHTMLResponse reports whether the response with header h and body is an
+// uncompressed HTML page
+func isHTMLResponse(h http.Header, body []byte) bool {
+	if coding := h.Get("Content-Encoding"); coding != "" && coding != "identity" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return strings.HasPrefix(strings.ToLower(contentType), "text/html")
+}
+
+// prefetchAsset queues u for prefetching unless it is already queued or
+// the queue is full
+func (s *Server) prefetchAsset(u *url.URL, concurrency int) {
+	p := s.assetPrefetches
+	key := u.String()
+	p.mu.Lock()
+	if p.pending[key] || len(p.pending) >= maxQueuedAssets {
+		p.mu.Unlock()
+		return
+	}
+	p.pending[key] = true
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	// Fetches already queued keep the slots of the previous setting
+	if cap(p.slots) != concurrency {
+		p.slots = make(chan struct{}, concurrency)
+	}
+	slots := p.slots
+	p.mu.Unlock()
+
+	s.goSafe("asset prefetch", func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.pending, key)
+			p.mu.Unlock()
+		}()
+		slots <- struct{}{}
+		defer func() { <-slots }()
+		if err := s.refreshCached(u); err != nil {
+			s.log.Debug("Asset prefetch failed", "url", key, "err", err)
+		}
+	})
+}
+
+// pageAssets returns up to max distinct stylesheets, scripts and images
+// body loads from the origin of page
+func pageAssets(page *url.URL, body []byte, max int) []*url.URL {
+	seen := map[string]bool{page.String(): true}
+	var assets []*url.URL
+	add := func(ref string) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || len(assets) >= max {
+			return
+		}
+		parsed, err := url.Parse(ref)
+		if err != nil {
+			return
+		}
+		asset := page.ResolveReference(parsed)
+		asset.Fragment = ""
+		if asset.Scheme != page.Scheme || asset.Host != page.Host || seen[asset.String()] {
+			return
+		}
+		seen[asset.String()] = true
+		assets = append(assets, asset)
+	}
+	for _, tag := range assetTagPattern.FindAllSubmatch(body, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attrPattern.FindAllSubmatch(tag[2], -1) {
+			name := strings.ToLower(string(m[1]))
+			if _, found := attrs[name]; !found {
+				attrs[name] = html.UnescapeString(string(m[2]) + string(m[3]) + string(m[4]))
+			}
+		}
+		switch strings.ToLower(string(tag[1])) {
+		case "link":
+			rels := strings.Fields(strings.ToLower(attrs["rel"]))
+			if slices.ContainsFunc(rels, func(rel string) bool { return slices.Contains(assetRels, rel) }) {
+				add(attrs["href"])
+			}
+		default:
+			add(attrs["src"])
+			// Each srcset candidate is a URL followed by a descriptor
+			for _, candidate := range strings.Split(attrs["srcset"], ",") {
+				if fields := strings.Fields(candidate); len(fields) > 0 {
+					add(fields[0])
+				}
+			}
+		}
+	}
+	return assets
+}
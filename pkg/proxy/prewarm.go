@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// PrewarmConfig resolves and connects to known upstreams each time the
+// configuration is applied, before the listeners accept requests, so the
+// first requests after a deploy don't pay for DNS, TCP and TLS setup.
+// With Hot set it also keeps connections to the busiest upstreams warm,
+// so requests after an idle spell don't either.
+type PrewarmConfig struct {
+	// Upstreams are origins to warm, e.g. "https://api.example.com"
+	Upstreams []string
+	// Routes also warms the backends of every route
+	Routes bool
+	// Connections is the number of connections opened to each upstream;
+	// it defaults to 1 and is capped by Transport.MaxIdleConnsPerHost
+	Connections int
+	// Path is requested with HEAD to open each connection; it defaults
+	// to "/"
+	Path string
+	// Timeout bounds the whole warm-up; it defaults to 5s
+	Timeout time.Duration
+	// Hot is the number of most used upstream origins kept warm in the
+	// background, each with Connections idle connections
+	Hot int
+	// Refresh is how often the hot origins are chosen and their
+	// connections reopened or exercised; it defaults to 30s and should stay
+	// below Transport.IdleConnTimeout and the origins' own idle timeouts
+	Refresh time.Duration
+}
+
+// withDefaults fills in the unset fields of cfg, keeping no more
+// connections per origin than the pool holds idle, maxIdle
+func (cfg PrewarmConfig) withDefaults(maxIdle int) PrewarmConfig {
+	cfg.Connections = max(cfg.Connections, 1)
+	if maxIdle > 0 {
+		cfg.Connections = min(cfg.Connections, maxIdle)
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 30 * time.Second
+	}
+	return cfg
+}
+
+// prewarmTargets returns the origins cfg warms, each once
+func (s *Server) prewarmTargets(cfg PrewarmConfig, table *RouteTable) []*url.URL {
+	candidates := append([]string(nil), cfg.Upstreams...)
+	if cfg.Routes {
+		for _, route := range table.Routes() {
+			if route.Backend != "" {
+				candidates = append(candidates, route.Backend)
+			}
+			for _, backend := range route.Backends {
+				candidates = append(candidates, backend.URL)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var targets []*url.URL
+	for _, candidate := range candidates {
+		u, err := url.Parse(candidate)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.log.Warn("Prewarm skipped invalid upstream", "upstream", candidate)
+			continue
+		}
+		origin := u.Scheme + "://" + u.Host
+		if !seen[origin] {
+			seen[origin] = true
+			targets = append(targets, &url.URL{Scheme: u.Scheme, Host: u.Host})
+		}
+	}
+	return targets
+}
+
+// prewarmUpstreams opens the configured number of pooled connections to
+// every target concurrently and waits for them, up to cfg.Timeout. The
+// warmed origins are then kept warm by the keepalive probes.
+func (s *Server) prewarmUpstreams(cfg PrewarmConfig, table *RouteTable) {
+	targets := s.prewarmTargets(cfg, table)
+	if len(targets) == 0 {
+		return
+	}
+	cfg = cfg.withDefaults(s.httpTransport.MaxIdleConnsPerHost)
+	origins := make([]string, len(targets))
+	for i, target := range targets {
+		origins[i] = target.String()
+		s.upstreams.touch(target)
+	}
+	start := time.Now()
+	warmed := s.warmOrigins(cfg, origins)
+	s.log.Info("Prewarmed connections", "connections", warmed, "upstreams", len(targets), "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// startHotPrewarm keeps the cfg.Hot most used upstream origins warm every
+// cfg.Refresh until the server shuts down
+func (s *Server) startHotPrewarm(cfg PrewarmConfig) {
+	if cfg.Hot <= 0 {
+		return
+	}
+	cfg = cfg.withDefaults(s.httpTransport.MaxIdleConnsPerHost)
+	s.goBackground(func() {
+		ticker := time.NewTicker(cfg.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.background.Done():
+				return
+			}
+			if origins := s.upstreams.hottest(cfg.Hot); len(origins) > 0 {
+				warmed := s.warmOrigins(cfg, origins)
+				s.log.Debug("Refreshed hot upstream connections", "connections", warmed, "upstreams", origins)
+			}
+		}
+	})
+}
+
+// warmOrigins sends cfg.Connections concurrent requests to each origin,
+// which take the idle connections it has and dial the ones missing, then
+// leave them all idle in the pool. It waits up to cfg.Timeout and returns
+// the number of requests that succeeded. Origins speaking HTTP/2 share one
+// connection, which the requests keep alive all the same.
+func (s *Server) warmOrigins(cfg PrewarmConfig, origins []string) int {
+	ctx, cancel := context.WithTimeout(s.background, cfg.Timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	warmed := 0
+	for _, origin := range origins {
+		for range cfg.Connections {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.prewarmConnection(ctx, origin+cfg.Path); err != nil {
+					s.log.Warn("Prewarm failed", "upstream", origin, "err", err)
+					return
+				}
+				mu.Lock()
+				warmed++
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+	return warmed
+}
+
+// prewarmConnection sends a HEAD request to target, leaving its connection
+// idle in the pool
+func (s *Server) prewarmConnection(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrimeOptions configures warming the cache from an access log, e.g. to
+// carry a migrating nginx cache over
+type PrimeOptions struct {
+	// ProxyURL is the forward proxy to warm through, e.g.
+	// http://127.0.0.1:8080
+	ProxyURL string
+	// Origin is the base URL, e.g. https://www.example.com, of nginx log
+	// lines that record only a path; they are skipped without it
+	Origin string
+	// Top is how many of the most requested URLs to warm; it defaults to 100
+	Top int
+	// Concurrency bounds the requests in flight; it defaults to 4
+	Concurrency int
+}
+
+// ourLogPrefix starts the proxy's own request log lines
+const ourLogPrefix = "Received request for: "
+
+// nginxRequest matches the request and status of an nginx combined or
+// common log line
+var nginxRequest = regexp.MustCompile(`"GET (\S+) HTTP/[0-9.]+" (\d{3}) `)
+
+// HottestURLs reads an access log in the proxy's own format or nginx's
+// combined or common format and returns the most requested cacheable URLs,
+// at most top of them, most requested first. nginx lines count only for
+// successful GETs; paths are resolved against origin.
+func HottestURLs(log io.Reader, origin string, top int) ([]string, error) {
+	var base *url.URL
+	if origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid origin %q", origin)
+		}
+		base = u
+	}
+
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var target string
+		if rest, ok := strings.CutPrefix(line, ourLogPrefix); ok {
+			target, _, _ = strings.Cut(rest, " ")
+		} else if m := nginxRequest.FindStringSubmatch(line); m != nil && m[2] == "200" {
+			target = m[1]
+		}
+		if u := primeTarget(target, base); u != "" {
+			counts[u]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(counts))
+	for u := range counts {
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if counts[urls[i]] != counts[urls[j]] {
+			return counts[urls[i]] > counts[urls[j]]
+		}
+		return urls[i] < urls[j]
+	})
+	if top > 0 && len(urls) > top {
+		urls = urls[:top]
+	}
+	return urls, nil
+}
+
+// primeTarget returns the absolute http or https URL a logged target names,
+// or an empty string when it names none
+func primeTarget(target string, base *url.URL) string {
+	if target == "" {
+		return ""
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	if !u.IsAbs() {
+		if base == nil || !strings.HasPrefix(target, "/") {
+			return ""
+		}
+		u = base.ResolveReference(u)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// PrimeCache requests urls through the proxy so it caches them, reporting
+// how many were fetched successfully and how many failed
+func PrimeCache(urls []string, opts PrimeOptions) (warmed, failed int, err error) {
+	proxyURL, err := url.Parse(opts.ProxyURL)
+	if err != nil || proxyURL.Host == "" {
+		return 0, 0, fmt.Errorf("invalid proxy URL %q", opts.ProxyURL)
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	c := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, u := range urls {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			ok := primeURL(c, u)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				warmed++
+			} else {
+				failed++
+			}
+		}()
+	}
+	wg.Wait()
+	return warmed, failed, nil
+}
+
+// primeURL fetches u through c, reporting whether it succeeded
+func primeURL(c *http.Client, u string) bool {
+	resp, err := c.Get(u)
+	if err != nil {
+		slog.Warn("Priming failed", "url", u, "err", err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Priming failed", "url", u, "status", resp.StatusCode)
+		return false
+	}
+	slog.Info("Primed", "url", u)
+	return true
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// PrivacyConfig is an opt-in privacy mode for destination patterns: cookies
+// are dropped both ways, Referer is trimmed to its origin and the headers
+// used to fingerprint browsers are removed
+type PrivacyConfig struct {
+	// Hosts are the destination host patterns it applies to, e.g.
+	// ".example.com"; empty disables it
+	Hosts []string
+	// UserAgent replaces the User-Agent of matching requests; empty
+	// removes it
+	UserAgent string
+}
+
+// fingerprintHeaders are removed from private requests; Sec-CH-UA* client
+// hints are removed too
+var fingerprintHeaders = []string{"X-Client-Data", "Device-Memory", "Viewport-Width", "Width", "DPR"}
+
+// private reports whether the privacy mode applies to host
+func (s *Server) private(host string) bool {
+	for _, pattern := range s.cfg.Privacy.Hosts {
+		if utils.MatchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// privatizeRequest strips h, the headers of a request to host, of
+// cookies and fingerprints
+func (s *Server) privatizeRequest(h http.Header, host string) {
+	if !s.private(host) {
+		return
+	}
+	h.Del("Cookie")
+	if referer, err := url.Parse(h.Get("Referer")); err == nil && referer.Host != "" {
+		h.Set("Referer", referer.Scheme+"://"+referer.Host+"/")
+	}
+	if s.cfg.Privacy.UserAgent != "" {
+		h.Set("User-Agent", s.cfg.Privacy.UserAgent)
+	} else {
+		// An empty value stops the transport adding its own
+		h.Set("User-Agent", "")
+	}
+	for _, name := range fingerprintHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(name, "Sec-Ch-Ua") {
+			delete(h, name)
+		}
+	}
+}
+
+// privatizeResponse drops the cookies a response from host would set
+func (s *Server) privatizeResponse(h http.Header, host string) {
+	if s.private(host) {
+		h.Del("Set-Cookie")
+	}
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ProxyAuthConfig requires forward-proxy clients, CONNECT included, to
+// authenticate with Basic credentials before anything is proxied
+type ProxyAuthConfig struct {
+	// UsersFile is an htpasswd-style file of user:hash lines, read at
+	// startup; empty disables authentication. Hashes may be Apache MD5
+	// ($apr1$, htpasswd -m), SHA-1 ({SHA}, htpasswd -s) or plain text
+	// (htpasswd -p); a file with other hashes, such as bcrypt or {SSHA}, is
+	// refused.
+	UsersFile string
+	// Realm names the protected space in the challenge, for TokenAuth too;
+	// it defaults to "proxy"
+	Realm string
+}
+
+// userDatabase maps user names to their password hashes
+type userDatabase map[string]string
+
+// loadUserDatabase reads an htpasswd-style file, refusing hash formats it
+// cannot verify so a user is never locked out silently
+func loadUserDatabase(path string) (userDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(userDatabase)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+		if err := checkHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v for %s; use htpasswd -m or -s", path, n, err, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// checkHash returns an error unless verify can check passwords against
+// hash: a well-formed Apache MD5 or SHA-1 hash, or a plain text password
+// that cannot be mistaken for a hash of another scheme
+func checkHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, digest, ok := strings.Cut(hash[len("$apr1$"):], "$")
+		if !ok || salt == "" || len(salt) > 8 || len(digest) != 22 {
+			return errors.New("malformed $apr1$ hash")
+		}
+	case strings.HasPrefix(hash, "{SHA}"):
+		if sum, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):]); err != nil || len(sum) != sha1.Size {
+			return errors.New("malformed {SHA} hash")
+		}
+	case hash == "":
+		return errors.New("empty password")
+	case strings.HasPrefix(hash, "$"), strings.HasPrefix(hash, "{"):
+		return errors.New("unsupported hash")
+	}
+	return nil
+}
+
+// unknownUserHash is checked for users not in the database, at the cost of
+// the slowest hash supported
+var unknownUserHash = apr1("", "unknown")
+
+// verify reports whether password matches the hash of user. Unknown users
+// are checked against a dummy hash, so response times do not reveal which
+// names exist.
+func (db userDatabase) verify(user, password string) bool {
+	hash, found := db[user]
+	if !found {
+		hash = unknownUserHash
+	}
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		computed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1 && found
+}
+
+// apr1 computes the Apache MD5-crypt hash of password with salt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := range 1000 {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for range n {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return out.String()
+}
+
+// tunnelUserKey carries the proxy user of the CONNECT tunnel an
+// intercepted request arrived through
+type tunnelUserKey struct{}
+
+// authenticate annotates r with the identity of its valid token or, in
+// forward mode, its valid Basic proxy credentials. Intercepted requests
+// take the identity of their tunnel, as clients send no credentials inside
+// it. It runs before worker admission and egress accounting so both see
+// the identity.
+func (s *Server) authenticate(r *http.Request) {
+	if user, ok := r.Context().Value(tunnelUserKey{}).(string); ok {
+		Annotate(r, ProxyUserAnnotation, user)
+		return
+	}
+	if user, ok := s.proxyTokens.identify(r); ok {
+		Annotate(r, ProxyUserAnnotation, user)
+		return
+	}
+	if s.proxyUsers != nil && s.cfg.Mode != ModeReverse {
+		if user, ok := s.proxyUser(r); ok {
+			Annotate(r, ProxyUserAnnotation, user)
+			return
+		}
+	}
+	if user, ok := s.plugins.authenticate(r); ok {
+		Annotate(r, ProxyUserAnnotation, user)
+	}
+}
+
+// checkProxyAuth answers with a challenge unless authenticate identified
+// the client, and reports whether the request may proceed. Forward-proxy
+// clients are challenged with 407, reverse-proxy clients with 401. Requests
+// the proxy answers itself, such as the PAC file, are exempt.
+func (s *Server) checkProxyAuth(w http.ResponseWriter, r *http.Request) bool {
+	basic := s.proxyUsers != nil && s.cfg.Mode != ModeReverse
+	if !basic && s.proxyTokens == nil && !s.plugins.authenticates() {
+		return true
+	}
+	if _, ok := Annotation(r, ProxyUserAnnotation); ok {
+		return true
+	}
+	s.stats.ProxyAuthFailed.Add(1)
+	realm := s.cfg.ProxyAuth.Realm
+	if realm == "" {
+		realm = "proxy"
+	}
+	if s.cfg.Mode == ModeReverse {
+		s.auditRequest(r, AuditAuth, "missing or invalid token", http.StatusUnauthorized)
+		if s.proxyTokens != nil {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+		}
+		for _, challenge := range s.plugins.challenges() {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		s.httpError(w, r, "Authentication required", http.StatusUnauthorized)
+		return false
+	}
+	s.auditRequest(r, AuditAuth, "missing or invalid proxy credentials", http.StatusProxyAuthRequired)
+	if basic {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	}
+	if s.proxyTokens != nil {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+	}
+	for _, challenge := range s.plugins.challenges() {
+		w.Header().Add("Proxy-Authenticate", challenge)
+	}
+	s.httpError(w, r, "Proxy authentication required", http.StatusProxyAuthRequired)
+	return false
+}
+
+// proxyUser returns the user named by valid Proxy-Authorization credentials
+func (s *Server) proxyUser(r *http.Request) (string, bool) {
+	scheme, encoded, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !s.proxyUsers.verify(user, password) {
+		return "", false
+	}
+	return user, true
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// isRangeRequest reports whether r asks for parts of the representation
+func isRangeRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") != ""
+}
+
+// serveRanges answers a range request from a whole body: one range as a
+// 206, several as a streamed multipart/byteranges, unsatisfiable ones with
+// 416. If-Range is honoured against the ETag already set on w, if any;
+// without one the whole body is sent.
+func serveRanges(w http.ResponseWriter, r *http.Request, body []byte) {
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// writeRangeFill answers a range request whose whole object was fetched in
+// its place: the object is cached and the ranges cut from it. Objects too
+// large to cache are relayed whole, which is also a valid answer.
+func (s *Server) writeRangeFill(w http.ResponseWriter, r *http.Request, resp *http.Response, key string) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, s.cfg.CacheMaxObjectBytes+1))
+	if err != nil {
+		s.httpError(w, r, "Failed to read response", http.StatusInternalServerError)
+		return
+	}
+	if int64(len(body)) > s.cfg.CacheMaxObjectBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		s.writeStreaming(w, resp, key, false)
+		return
+	}
+
+	s.cachePut(key, cachedResponse(resp, body))
+	copyHeaders(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	serveRanges(w, r, body)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// RateLimitConfig limits the request rate of each client, keyed by the
+// identity it authenticated as, else by its IP address
+type RateLimitConfig struct {
+	// Rate is the sustained requests per second allowed per client; zero
+	// disables rate limiting
+	Rate float64
+	// Burst is how many requests a client may send at once; it defaults to
+	// Rate rounded up
+	Burst int
+}
+
+// maxRateLimitClients bounds the clients tracked; beyond it the client seen
+// least recently, whose bucket has most likely refilled, is forgotten
+const maxRateLimitClients = 100000
+
+// RateLimiter holds one token bucket per client
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	mu      sync.Mutex
+	clients map[string]*list.Element
+	// order holds the clients as *limitedClient, most recently seen first
+	order *list.List
+}
+
+// limitedClient is a client and its bucket
+type limitedClient struct {
+	name   string
+	bucket *TokenBucket
+}
+
+// NewRateLimiter creates a limiter for cfg
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	return &RateLimiter{cfg: cfg, clients: make(map[string]*list.Element), order: list.New()}
+}
+
+// bucket returns the bucket of client, creating it on first use
+func (l *RateLimiter) bucket(client string) *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, found := l.clients[client]; found {
+		l.order.MoveToFront(e)
+		return e.Value.(*limitedClient).bucket
+	}
+	if l.order.Len() >= maxRateLimitClients {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.clients, oldest.Value.(*limitedClient).name)
+	}
+	b := NewTokenBucket(float64(l.cfg.Burst), l.cfg.Rate)
+	l.clients[client] = l.order.PushFront(&limitedClient{name: client, bucket: b})
+	return b
+}
+
+// Allow takes a token for client, reporting otherwise how many seconds
+// until one is available
+func (l *RateLimiter) Allow(client string) (bool, int) {
+	b := l.bucket(client)
+	if b.Take(1) {
+		return true, 0
+	}
+	return false, int(math.Ceil(b.Wait(1).Seconds()))
+}
+
+// checkRateLimit answers 429 with Retry-After when the client of r is over
+// its rate, and reports whether the request may proceed
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	l := s.limiter.Load()
+	if l == nil || !s.toggles.Enabled(ToggleRateLimiting, s.arrivalRoute(r)) {
+		return true
+	}
+	client, ok := Annotation(r, ProxyUserAnnotation)
+	if !ok {
+		client = clientIP(r)
+	}
+	allowed, wait := l.Allow(client)
+	if allowed {
+		return true
+	}
+	s.stats.RateLimited.Add(1)
+	s.auditRequest(r, AuditRateLimit, "client "+client, http.StatusTooManyRequests)
+	w.Header().Set("Retry-After", strconv.Itoa(max(wait, 1)))
+	s.httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
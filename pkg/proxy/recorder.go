@@ -0,0 +1,41 @@
+package proxy
+
+import "net/http"
+
+// responseRecorder records the status and body size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	// Interim responses such as 103 Early Hints precede the real status
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Status returns the response status, which is 200 when none was written
+// explicitly, as for hijacked CONNECT tunnels
+func (w *responseRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
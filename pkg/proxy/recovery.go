@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery runs next, turning a panic into a logged stack trace, a
+// Panics count and a 500 naming the request ID, so one failing request
+// never takes down the others. When the response has already started the
+// connection is aborted instead, as a truncated body must not look whole.
+func (s *Server) withRecovery(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
+		id := requestIDOf(r)
+		s.recordPanic(fmt.Sprintf("serving %s %s [request %s]", r.Method, r.URL, id), v)
+		if rec.status != 0 {
+			panic(http.ErrAbortHandler)
+		}
+		rec.Header().Set(requestIDHeader, id)
+		http.Error(rec, "Internal proxy error (request "+id+")", http.StatusInternalServerError)
+	}()
+	next(rec, r)
+}
+
+// goSafe runs fn on a new goroutine that Shutdown waits for, logging
+// instead of crashing the process when it panics; background work has no
+// request to fail
+func (s *Server) goSafe(what string, fn func()) {
+	s.goBackground(func() {
+		defer func() {
+			if v := recover(); v != nil {
+				s.recordPanic("in "+what, v)
+			}
+		}()
+		fn()
+	})
+}
+
+// recoverAttempt runs one upstream attempt started on its own goroutine,
+// returning a panic as an error so the request waiting on it fails alone
+func (s *Server) recoverAttempt(attempt func() (*http.Response, error)) (resp *http.Response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.recordPanic("in upstream attempt", v)
+			resp, err = nil, fmt.Errorf("upstream attempt panicked: %v", v)
+		}
+	}()
+	return attempt()
+}
+
+// recordPanic logs a recovered panic with the stack of the panicking
+// goroutine, counts it and reports it to the error tracker
+func (s *Server) recordPanic(where string, v any) {
+	stack := debug.Stack()
+	s.stats.Panics.Add(1)
+	s.log.Error("Panic "+where, "panic", v, "stack", string(stack))
+	s.errorReports.add("panic", fmt.Sprint("panic: ", v), string(stack))
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/logging"
+)
+
+// errNoSource is returned by reloads when no configuration source is set
+var errNoSource = errors.New("no configuration source to reload from")
+
+// Reload puts the reloadable settings of cfg in force while the proxy
+// runs: the client and destination ACLs, the routes and virtual hosts, the
+// rate limit, the blocklist and the log level, and clears the feature
+// toggles set through the admin API. Every setting is checked
+// before any is applied, so an invalid cfg leaves the running ones in
+// force. Active connections are kept; client ACLs apply to connections
+// accepted from then on, and the other settings to the next request. Other
+// settings take a restart.
+func (s *Server) Reload(cfg Config) error {
+	return s.reload(cfg)
+}
+
+// reloadFromSource reloads the configuration returned by its source
+func (s *Server) reloadFromSource() error {
+	if s.cfg.Source == nil {
+		return errNoSource
+	}
+	cfg, err := s.cfg.Source()
+	if err != nil {
+		return err
+	}
+	return s.reload(cfg)
+}
+
+func (s *Server) reload(cfg Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if _, err := logging.ParseLevel(cfg.Logging.Level); err != nil {
+		return err
+	}
+	acls := ACLs{ClientACL: cfg.ClientACL, ListenerACLs: cfg.ListenerACLs, DestinationACL: cfg.DestinationACL}
+	clients, err := compileClientACLs(acls.ClientACL, acls.ListenerACLs)
+	if err != nil {
+		return fmt.Errorf("invalid client ACL: %w", err)
+	}
+	table, err := newRouteTable(cfg.Routes, cfg.VirtualHosts, s.log.Logger)
+	if err != nil {
+		return fmt.Errorf("invalid routes: %w", err)
+	}
+	if err := s.checkRoutes(table, s.cfg.Mode); err != nil {
+		return fmt.Errorf("invalid routes: %w", err)
+	}
+	// Unchanged limits keep the buckets of the clients
+	var rate *RateLimiter
+	if cfg.RateLimit.Rate > 0 {
+		rate = NewRateLimiter(cfg.RateLimit)
+		if old := s.limiter.Load(); old != nil && old.cfg == rate.cfg {
+			rate = old
+		}
+	}
+	var blocked *hostBlocklist
+	if len(cfg.Blocklist.Sources) > 0 {
+		if blocked, err = s.loadHostBlocklist(cfg.Blocklist); err != nil {
+			return fmt.Errorf("blocklist setup failed: %w", err)
+		}
+	}
+
+	s.log.SetLevel(cfg.Logging.Level)
+	s.clientACLs.Store(&clients)
+	s.activeACLs.Store(&acls)
+	s.replaceRoutes(table)
+	s.startHealthChecks(table)
+	s.limiter.Store(rate)
+	s.toggles.reset()
+	s.replaceBlocklist(blocked)
+	if blocked != nil {
+		s.refreshBlocklist(blocked, cfg.Blocklist.Refresh)
+	}
+	s.reloaded.Store(&cfg)
+	s.log.Info("Configuration reloaded", "routes", len(table.routes), "log_level", s.log.Level())
+	return nil
+}
+
+// handleReload reloads the configuration from its source, answering 400
+// with the reason when it is invalid
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.reloadFromSource(); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errNoSource) {
+			status = http.StatusNotFound
+		}
+		s.log.Warn("Reload failed", "err", err)
+		http.Error(w, "Reload failed: "+err.Error(), status)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "reloaded"})
+}
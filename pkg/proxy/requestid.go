@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/logging"
+)
+
+// requestIDHeader carries the ID that ties a request to the proxy's log
+// lines, the upstream's logs and any error page the client saw
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the IDs accepted from clients
+const maxRequestIDLength = 128
+
+// requestIDOf returns the ID the client sent with r, or a new one when it
+// sent none or one unfit for logs and headers
+func requestIDOf(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+// validRequestID reports whether id is non-empty, bounded and made of
+// printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives r its ID, keeping a valid one from the client, and
+// returns r with the ID in its headers, for the upstream, and in the
+// context its log lines are written with; the response carries it too
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestIDOf(r)
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(logging.WithAttrs(r.Context(), slog.String("request_id", id)))
+}
+
+// httpError answers r with an error page, coded by its status, that names
+// the request ID when the request has one, so that a client's report can
+// be matched to the proxy's logs
+func (s *Server) httpError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	s.proxyError(w, r, errorCodeFor(status), msg, status)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ResolverConfig selects how upstream hostnames are resolved. Hosts and
+// HostsFile are consulted first; then DoH, Servers or the system resolver
+// answers, in that order of preference.
+type ResolverConfig struct {
+	// Servers are DNS servers queried over UDP and TCP, as host or
+	// host:port
+	Servers []string
+	// DoH is the https:// URL of a DNS-over-HTTPS endpoint (RFC 8484). Its
+	// own hostname is resolved by the system resolver, so prefer an IP.
+	DoH string
+	// Timeout bounds each query to Servers or DoH
+	Timeout time.Duration
+	// Hosts maps hostnames to fixed addresses
+	Hosts map[string][]string
+	// HostsFile is read for further fixed addresses, in /etc/hosts format
+	HostsFile string
+}
+
+// configureResolver applies the resolver and DNS cache configuration
+func (s *Server) configureResolver(cfg ResolverConfig, cacheCfg DNSCacheConfig) error {
+	overrides, err := loadHostOverrides(cfg)
+	if err != nil {
+		return err
+	}
+
+	resolve := systemResolve
+	switch {
+	case cfg.DoH != "":
+		u, err := url.Parse(cfg.DoH)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("DoH endpoint %q must be an https:// URL", cfg.DoH)
+		}
+		resolve = newDoHResolver(u.String(), cfg.Timeout).resolve
+	case len(cfg.Servers) > 0:
+		servers := make([]string, len(cfg.Servers))
+		for i, server := range cfg.Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			servers[i] = server
+		}
+		resolve = serverResolver(servers, cfg.Timeout)
+	}
+
+	s.hostOverrides, s.upstreamResolve = overrides, resolve
+	s.dnsCache = nil
+	if cacheCfg.Enabled {
+		s.dnsCache = NewDNSCache(cacheCfg, resolve)
+		s.dnsCache.stats = s.stats
+	}
+	return nil
+}
+
+// loadHostOverrides collects the fixed addresses of cfg
+func loadHostOverrides(cfg ResolverConfig) (map[string][]net.IPAddr, error) {
+	overrides := make(map[string][]net.IPAddr)
+	add := func(host, addr string) error {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("host override %s: invalid address %q", host, addr)
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		overrides[host] = append(overrides[host], net.IPAddr{IP: ip})
+		return nil
+	}
+
+	if cfg.HostsFile != "" {
+		f, err := os.Open(cfg.HostsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			for _, host := range fields[1:] {
+				if err := add(host, fields[0]); err != nil {
+					return nil, fmt.Errorf("%s: %w", cfg.HostsFile, err)
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// Inline hosts replace those of the file
+	for host := range cfg.Hosts {
+		delete(overrides, strings.TrimSuffix(strings.ToLower(host), "."))
+	}
+	for host, addrs := range cfg.Hosts {
+		for _, addr := range addrs {
+			if err := add(host, addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return overrides, nil
+}
+
+// serverResolver resolves names by querying servers in rotation
+func serverResolver(servers []string, timeout time.Duration) resolveFunc {
+	var next atomic.Uint64
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[next.Add(1)%uint64(len(servers))]
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		addrs, err := r.LookupIPAddr(ctx, host)
+		return addrs, 0, err
+	}
+}
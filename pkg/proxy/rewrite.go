@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// RewriteRule rewrites the target URL of matching requests before they are
+// forwarded, e.g. to move a host, force HTTPS or remap paths without
+// touching clients. Rules are tried in order, each seeing the URL left by
+// the previous ones.
+type RewriteRule struct {
+	// Match is a regular expression tested against the full target URL,
+	// e.g. `^http://old\.example\.com/(.*)$`
+	Match string `json:"match"`
+	// Replacement is the new URL, where $1 and ${name} expand to submatches
+	Replacement string `json:"replacement"`
+	// Redirect answers the client with a redirect to the new URL instead of
+	// forwarding to it
+	Redirect bool `json:"redirect,omitempty"`
+	// Status is the redirect status code; it defaults to 302
+	Status int `json:"status,omitempty"`
+	// Last stops rewriting after this rule matches
+	Last bool `json:"last,omitempty"`
+}
+
+// rewriteRule is a compiled RewriteRule
+type rewriteRule struct {
+	RewriteRule
+	re *regexp.Regexp
+}
+
+// compileRewrites validates and compiles rules
+func compileRewrites(rules []RewriteRule) ([]rewriteRule, error) {
+	var compiled []rewriteRule
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if rule.Redirect {
+			if rule.Status == 0 {
+				rule.Status = http.StatusFound
+			}
+			if rule.Status < 300 || rule.Status > 399 {
+				return nil, fmt.Errorf("rule %d: status %d is not a redirect", i+1, rule.Status)
+			}
+		}
+		compiled = append(compiled, rewriteRule{RewriteRule: rule, re: re})
+	}
+	return compiled, nil
+}
+
+// applyRewrites runs rules over target, returning the rewritten URL and,
+// when a redirect rule matched, that rule
+func applyRewrites(rules []rewriteRule, target string) (string, *rewriteRule) {
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.re.MatchString(target) {
+			continue
+		}
+		target = rule.re.ReplaceAllString(target, rule.Replacement)
+		if rule.Redirect {
+			return target, rule
+		}
+		if rule.Last {
+			break
+		}
+	}
+	return target, nil
+}
+
+// rewriteTarget applies the rewrite rules to target. It returns the URL to
+// forward to, or false when it has answered r itself with a redirect or an
+// error.
+func (s *Server) rewriteTarget(w http.ResponseWriter, r *http.Request, target *url.URL) (*url.URL, bool) {
+	if len(s.rewrites) == 0 {
+		return target, true
+	}
+	original := target.String()
+	rewritten, redirect := applyRewrites(s.rewrites, original)
+	if redirect != nil {
+		s.stats.Rewrites.Add(1)
+		http.Redirect(w, r, rewritten, redirect.Status)
+		return nil, false
+	}
+	if rewritten == original {
+		return target, true
+	}
+	u, err := parseRewritten(rewritten)
+	if err != nil {
+		s.httpError(w, r, err.Error(), http.StatusBadGateway)
+		return nil, false
+	}
+	s.stats.Rewrites.Add(1)
+	s.log.InfoContext(r.Context(), "Rewrote request", "from", original, "to", rewritten)
+	return u, true
+}
+
+// parseRewritten parses a rewritten target, which must stay an absolute
+// HTTP URL
+func parseRewritten(rewritten string) (*url.URL, error) {
+	u, err := url.Parse(rewritten)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Rewritten target URL %q is invalid", rewritten)
+	}
+	return u, nil
+}
@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// Proxy operating modes
+const (
+	// ModeForward proxies requests to the destination they name
+	ModeForward = "forward"
+	// ModeReverse proxies requests to backends chosen by the route table
+	ModeReverse = "reverse"
+)
+
+// Route matches requests and carries their per-route settings. In
+// reverse-proxy mode it matches the incoming Host and path and maps them to
+// Backend; in forward mode it matches the destination URL.
+type Route struct {
+	// Name identifies the route in logs and the admin API
+	Name string `json:"name"`
+	// Host matches the request Host header; empty matches any host
+	Host string `json:"host,omitempty"`
+	// PathPrefix matches the start of the request path
+	PathPrefix string `json:"path_prefix"`
+	// Backend is the upstream base URL, e.g. http://api:9000; it or
+	// Backends is required in reverse-proxy mode
+	Backend string `json:"backend,omitempty"`
+	// Backends lists replicas to balance requests over, alongside Backend
+	// when both are set
+	Backends []Backend `json:"backends,omitempty"`
+	// Balance is BalanceRoundRobin (the default), BalanceLeastConn or
+	// BalanceWeighted
+	Balance string `json:"balance,omitempty"`
+	// Terminate answers matching requests at once, tried in order
+	Terminate []TerminateRule `json:"terminate,omitempty"`
+	// Timeouts override the phase timeouts of requests on the route
+	Timeouts *PhaseTimeouts `json:"timeouts,omitempty"`
+	// HealthCheck actively checks the route's backends, taking failing ones
+	// out of rotation
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// Affinity keeps clients on the backend they were first sent to
+	Affinity *AffinityConfig `json:"affinity,omitempty"`
+	// Split divides requests between the versions of the backends
+	Split *TrafficSplit `json:"split,omitempty"`
+	// Shadow mirrors a share of the requests to a shadow backend
+	Shadow *ShadowConfig `json:"shadow,omitempty"`
+	// CachePOST caches the responses to POST requests, which must be
+	// idempotent on the route
+	CachePOST *PostCacheConfig `json:"cache_post,omitempty"`
+	// StripPrefix removes PathPrefix from the path before forwarding
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	// RewritePrefix replaces PathPrefix when StripPrefix is set
+	RewritePrefix string `json:"rewrite_prefix,omitempty"`
+	// Conditions must all hold for the route to match, e.g. a header
+	// condition on X-Beta sending beta users to a separate backend
+	Conditions []RouteCondition `json:"conditions,omitempty"`
+	// When is an expression that must also hold, as in ScriptRule, e.g.
+	// `req.Header["X-Beta"] == "1" || req.Cookie["beta"] != null`
+	When string `json:"when,omitempty"`
+	// Buffering is BufferAuto, BufferFull or BufferStream
+	Buffering string `json:"buffering,omitempty"`
+	// AllowedContentTypes limits the media types the route may return, e.g.
+	// "application/json" or "image/*"; empty allows any
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+	// ContentTypeAction is ContentTypeReject (the default) or
+	// ContentTypeStrip for responses outside AllowedContentTypes
+	ContentTypeAction string `json:"content_type_action,omitempty"`
+	// DeviceClasses buckets clients by viewport and mobile client hints,
+	// tried in order, and caches one variant per bucket
+	DeviceClasses []DeviceClass `json:"device_classes,omitempty"`
+	// Policy names the timeout, retry and hedging policy of the route
+	Policy string `json:"policy,omitempty"`
+	// Mirrors are base URLs serving the same content as the backend, or as
+	// the requested origin in forward mode; they are fetched alongside it
+	// and the first successful response is served and cached
+	Mirrors []string `json:"mirrors,omitempty"`
+	// MirrorStagger delays starting each further mirror; zero fetches from
+	// all of them at once
+	MirrorStagger time.Duration `json:"mirror_stagger,omitempty"`
+	// Session logs in to the route's origins and keeps their session
+	// cookies on behalf of the clients
+	Session *SessionConfig `json:"session,omitempty"`
+	// SchemePolicy is SchemeAllow, SchemeRefuse or SchemeUpgrade for
+	// plaintext upstream requests on the route; empty defers to
+	// Config.SchemeRules
+	SchemePolicy string `json:"scheme_policy,omitempty"`
+	// SecurityHeaders, in reverse-proxy mode, enforces security headers
+	// such as HSTS and CSP on the route's responses
+	SecurityHeaders *SecurityHeaders `json:"security_headers,omitempty"`
+	// RequestHeaders edit the requests sent to the route's upstreams, and
+	// ResponseHeaders the responses relayed to its clients
+	RequestHeaders  HeaderRules `json:"request_headers,omitempty"`
+	ResponseHeaders HeaderRules `json:"response_headers,omitempty"`
+	// Maintenance takes the route down for maintenance
+	Maintenance *MaintenanceConfig `json:"maintenance,omitempty"`
+
+	backend *url.URL
+	pool    *backendPool
+	mirrors []*url.URL
+	session *originSession
+	matches requestMatcher
+	// site is the virtual host of the route, if any
+	site   *site
+	split  *versionSplit
+	shadow *shadowBackend
+	// maintenancePages are the pages of Maintenance, if any
+	maintenancePages *errorTemplates
+}
+
+// Response buffering strategies of a route
+const (
+	// BufferAuto streams responses unless a feature needs the whole body
+	BufferAuto = ""
+	// BufferFull reads the whole response before answering, which allows
+	// retries and length-based decisions at the cost of memory and latency
+	BufferFull = "full"
+	// BufferStream always relays responses as they arrive, with bounded
+	// memory and the lowest latency
+	BufferStream = "stream"
+)
+
+// RouteTable selects the most specific route for a request
+type RouteTable struct {
+	routes []*Route
+	sites  []*site
+	// retired is closed when the table is replaced, stopping its health
+	// checks
+	retired chan struct{}
+}
+
+// replaceRoutes puts table in force and retires the table it replaces
+func (s *Server) replaceRoutes(table *RouteTable) {
+	if old := s.routes.Swap(table); old != nil && old != table {
+		close(old.retired)
+	}
+}
+
+// NewRouteTable validates routes and orders them so that host-specific routes,
+// longer path prefixes and then routes with more conditions are tried first
+func NewRouteTable(routes []Route) (*RouteTable, error) {
+	return newRouteTable(routes, nil, slog.Default())
+}
+
+// newRouteTable is NewRouteTable with the routes of the virtual hosts, which
+// count as host-specific; expressions that fail are logged to log
+func newRouteTable(routes []Route, hosts []VirtualHost, log *slog.Logger) (*RouteTable, error) {
+	sites, routes, err := compileSites(routes, hosts)
+	if err != nil {
+		return nil, err
+	}
+	t := &RouteTable{sites: sites, retired: make(chan struct{})}
+	for i := range routes {
+		route := routes[i]
+		if route.Backend != "" {
+			backend, err := url.Parse(route.Backend)
+			if err != nil || (backend.Scheme != "http" && backend.Scheme != "https") || backend.Host == "" {
+				return nil, fmt.Errorf("route %q: invalid backend %q", route.Name, route.Backend)
+			}
+			route.backend = backend
+		}
+		if !validSchemePolicy(route.SchemePolicy) {
+			return nil, fmt.Errorf("route %q: unknown scheme policy %q", route.Name, route.SchemePolicy)
+		}
+		route.pool = nil
+		if route.HealthCheck != nil {
+			check, err := route.HealthCheck.withDefaults()
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.HealthCheck = &check
+		}
+		if len(route.Backends) > 0 || (route.HealthCheck != nil && route.Backend != "") {
+			replicas := route.Backends
+			if route.Backend != "" {
+				replicas = append([]Backend{{URL: route.Backend}}, replicas...)
+			}
+			pool, err := newBackendPool(route.Balance, replicas)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			pool.log = log
+			route.pool = pool
+			route.backend = pool.backends[0].url
+		}
+		if route.Affinity != nil {
+			if route.pool == nil {
+				return nil, fmt.Errorf("route %q: affinity requires several backends", route.Name)
+			}
+			affinity, err := route.Affinity.withDefaults()
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.Affinity = &affinity
+		}
+		route.split = nil
+		if route.Split != nil {
+			if route.pool == nil {
+				return nil, fmt.Errorf("route %q: a traffic split requires several backends", route.Name)
+			}
+			split, err := compileSplit(*route.Split, route.pool)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.split = split
+		}
+		route.maintenancePages = nil
+		if route.Maintenance != nil {
+			pages, err := compileMaintenance(route.Maintenance)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.maintenancePages = pages
+		}
+		if route.CachePOST != nil {
+			cfg, err := route.CachePOST.withDefaults()
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.CachePOST = &cfg
+		}
+		route.shadow = nil
+		if route.Shadow != nil {
+			shadow, err := compileShadow(*route.Shadow)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.shadow = shadow
+		}
+		route.mirrors = nil
+		for _, mirror := range route.Mirrors {
+			u, err := url.Parse(mirror)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("route %q: invalid mirror %q", route.Name, mirror)
+			}
+			route.mirrors = append(route.mirrors, u)
+		}
+		route.session = nil
+		if route.Session != nil {
+			session, err := newOriginSession(*route.Session)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			route.session = session
+		}
+		switch route.Buffering {
+		case BufferAuto, BufferFull, BufferStream:
+		default:
+			return nil, fmt.Errorf("route %q: unknown buffering %q", route.Name, route.Buffering)
+		}
+
+		switch route.ContentTypeAction {
+		case "", ContentTypeReject, ContentTypeStrip:
+		default:
+			return nil, fmt.Errorf("route %q: unknown content type action %q", route.Name, route.ContentTypeAction)
+		}
+
+		var err error
+		if route.Terminate, err = compileTerminateRules(route.Terminate); err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Name, err)
+		}
+		if route.matches, err = compileConditions(route.Conditions); err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Name, err)
+		}
+		if route.When != "" {
+			when, err := compileScript(route.When)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", route.Name, err)
+			}
+			conditions := route.matches
+			route.matches = func(r *http.Request) bool { return conditions(r) && evalScript(log, when, r) }
+		}
+		t.routes = append(t.routes, &route)
+	}
+
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		a, b := t.routes[i], t.routes[j]
+		if a.hostSpecific() != b.hostSpecific() {
+			return a.hostSpecific()
+		}
+		if len(a.PathPrefix) != len(b.PathPrefix) {
+			return len(a.PathPrefix) > len(b.PathPrefix)
+		}
+		return a.conditionCount() > b.conditionCount()
+	})
+	return t, nil
+}
+
+// hostSpecific reports whether the route matches some hosts only
+func (route *Route) hostSpecific() bool {
+	return route.Host != "" || route.site != nil
+}
+
+// conditionCount is the number of conditions of the route, counting When
+// as one
+func (route *Route) conditionCount() int {
+	if route.When != "" {
+		return len(route.Conditions) + 1
+	}
+	return len(route.Conditions)
+}
+
+// checkRoutes checks that the routes of table refer to defined policies
+// and, in reverse-proxy mode, have a backend, and that its virtual hosts
+// can be served
+func (s *Server) checkRoutes(table *RouteTable, mode string) error {
+	for _, route := range table.routes {
+		if route.Policy != "" && s.policies[route.Policy] == nil {
+			return fmt.Errorf("route %q refers to unknown policy %q", route.Name, route.Policy)
+		}
+		if mode == ModeReverse && route.Backend == "" && len(route.Backends) == 0 {
+			return fmt.Errorf("route %q has no backend", route.Name)
+		}
+	}
+	if len(table.sites) > 0 && mode != ModeReverse {
+		return errors.New("virtual hosts require reverse-proxy mode")
+	}
+	for _, vhost := range table.sites {
+		if vhost.cert != nil && s.cfg.TLSCertFile == "" {
+			return fmt.Errorf("virtual host %q has a certificate but the proxy does not serve TLS", vhost.Name)
+		}
+	}
+	return nil
+}
+
+// Match returns the route for r, if any
+func (t *RouteTable) Match(r *http.Request) (*Route, bool) {
+	site := t.site(r.Host)
+	for _, route := range t.routes {
+		if route.Host != "" && !utils.MatchHost(route.Host, r.Host) {
+			continue
+		}
+		// Sites answer requests for their hosts alone
+		if route.site != site {
+			continue
+		}
+		if strings.HasPrefix(r.URL.Path, route.PathPrefix) && route.matches(r) {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// MatchURL returns the route for a forward-proxy request r to target
+func (t *RouteTable) MatchURL(r *http.Request, target *url.URL) (*Route, bool) {
+	dest := r.Clone(r.Context())
+	dest.Host = target.Host
+	dest.URL = target
+	return t.Match(dest)
+}
+
+// Routes returns the routes in match order
+func (t *RouteTable) Routes() []Route {
+	out := make([]Route, len(t.routes))
+	for i, route := range t.routes {
+		out[i] = *route
+	}
+	return out
+}
+
+// Target returns the URL on the route's first backend that r is forwarded to
+func (route *Route) Target(r *http.Request) *url.URL {
+	return route.targetOn(route.backend, r)
+}
+
+// targetOn returns the URL on backend that r is forwarded to
+func (route *Route) targetOn(backend *url.URL, r *http.Request) *url.URL {
+	path := r.URL.Path
+	if route.StripPrefix {
+		path = route.RewritePrefix + strings.TrimPrefix(path, route.PathPrefix)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	target := *backend
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+	target.RawQuery = r.URL.RawQuery
+	return &target
+}
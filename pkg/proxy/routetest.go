@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+)
+
+// RouteExplanation describes how the proxy would handle a request, worked
+// out from the configuration alone without starting any listener or
+// contacting any upstream
+type RouteExplanation struct {
+	// Mode is the proxy mode
+	Mode string
+	// Listeners are the proxy listeners and whether each accepts the client
+	Listeners []ListenerVerdict
+	// Denied is why the destination ACL refuses the request, if it does
+	Denied string
+	// Redirect is where a rewrite rule redirects the client, if one does
+	Redirect string
+	// Route is the matching route, if any
+	Route string
+	// Target is the URL the request is forwarded to; empty when nothing
+	// would be forwarded
+	Target string
+	// Policy is the upstream policy applied, if any
+	Policy *Policy
+	// Class is the traffic class of the request
+	Class string
+	// Cache is "cacheable" or why the response would not be cached
+	Cache string
+	// Mirrors are fetched alongside the target
+	Mirrors []string
+}
+
+// ListenerVerdict tells whether a listener accepts the client
+type ListenerVerdict struct {
+	Addr    string
+	Accepts bool
+}
+
+// ExplainRequest evaluates cfg for r, whose RemoteAddr is the client, the
+// way a running proxy would, for checking configuration changes before
+// rollout. Runtime state such as toggles, health and learned cache variants
+// is not considered.
+func ExplainRequest(cfg Config, r *http.Request) (*RouteExplanation, error) {
+	table, err := newRouteTable(cfg.Routes, cfg.VirtualHosts, slog.Default())
+	if err != nil {
+		return nil, err
+	}
+	byName, err := compilePolicies(cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+	classes, err := NewTrafficClassifier(cfg.TrafficClasses)
+	if err != nil {
+		return nil, err
+	}
+	acls, err := compileClientACLs(cfg.ClientACL, cfg.ListenerACLs)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := compileRewrites(cfg.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	ex := &RouteExplanation{Mode: cfg.Mode, Class: classes.Classify(r)}
+	client, _ := netip.ParseAddrPort(r.RemoteAddr)
+	for _, addrs := range [][]string{cfg.ListenAddrs, cfg.ListenIPv4, cfg.ListenIPv6} {
+		for _, addr := range addrs {
+			rules, found := acls[addr]
+			if !found {
+				rules = acls[""]
+			}
+			ex.Listeners = append(ex.Listeners, ListenerVerdict{addr, rules == nil || rules.allows(client.Addr())})
+		}
+	}
+
+	rewrite := func(target *url.URL) (*url.URL, error) {
+		rewritten, redirect := applyRewrites(rules, target.String())
+		if redirect != nil {
+			ex.Redirect = rewritten
+			return nil, nil
+		}
+		if rewritten == target.String() {
+			return target, nil
+		}
+		return parseRewritten(rewritten)
+	}
+	var route *Route
+	var target *url.URL
+	if cfg.Mode == ModeReverse {
+		if route, _ = table.Match(r); route != nil {
+			if target, err = rewrite(route.Target(r)); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if target, err = rewrite(r.URL); err != nil || target == nil {
+			return ex, err
+		}
+		if ok, reason := cfg.DestinationACL.Check(target.Hostname()); !ok {
+			ex.Denied = reason
+			return ex, nil
+		}
+		route, _ = table.MatchURL(r, target)
+	}
+	if target == nil {
+		return ex, nil
+	}
+	ex.Target = target.String()
+
+	policyName := cfg.DefaultPolicy
+	if route != nil {
+		ex.Route = route.Name
+		ex.Mirrors = route.Mirrors
+		if route.Policy != "" {
+			policyName = route.Policy
+		}
+	}
+	ex.Policy = byName[policyName]
+
+	override := cfg.UpstreamOverride.Header
+	if override == "" {
+		override = defaultOverrideHeader
+	}
+	switch {
+	case r.Method != http.MethodGet:
+		ex.Cache = "not cached: only GET responses are cached"
+	case NewBypassList(cfg.Bypass).Match(target):
+		ex.Cache = "not cached: destination is on the bypass list"
+	case r.Header.Get("Authorization") != "":
+		ex.Cache = "not cached: request carries Authorization"
+	case cfg.Mode == ModeReverse && r.Header.Get(override) != "":
+		ex.Cache = "not cached: upstream override requested"
+	default:
+		ex.Cache = "cacheable"
+	}
+	return ex, nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderSanitizationConfig removes or masks sensitive headers. Names are
+// matched case-insensitively and may end in "*" to match a prefix, e.g.
+// "X-Internal-*".
+type HeaderSanitizationConfig struct {
+	// Strip lists request headers removed before forwarding upstream
+	Strip []string
+	// Mask lists request headers forwarded with their values replaced by
+	// "[redacted]"
+	Mask []string
+	// StripResponse lists response headers removed before relaying to
+	// clients, e.g. Server and X-Powered-By
+	StripResponse []string
+}
+
+// maskedValue replaces the values of masked headers
+const maskedValue = "[redacted]"
+
+// alwaysMasked are masked in logs whatever the configuration
+var alwaysMasked = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// headerPattern matches header names
+type headerPattern []string
+
+// matches reports whether name matches one of the patterns
+func (p headerPattern) matches(name string) bool {
+	for _, pattern := range p {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeRequestHeaders applies Strip and Mask to h before forwarding
+func (s *Server) sanitizeRequestHeaders(h http.Header) {
+	cfg := s.cfg.HeaderSanitization
+	if len(cfg.Strip) == 0 && len(cfg.Mask) == 0 {
+		return
+	}
+	for name := range h {
+		switch {
+		case headerPattern(cfg.Strip).matches(name):
+			delete(h, name)
+		case headerPattern(cfg.Mask).matches(name):
+			h[name] = []string{maskedValue}
+		}
+	}
+}
+
+// sanitizeResponseHeaders applies StripResponse to h before relaying
+func (s *Server) sanitizeResponseHeaders(h http.Header) {
+	strip := headerPattern(s.cfg.HeaderSanitization.StripResponse)
+	if len(strip) == 0 {
+		return
+	}
+	for name := range h {
+		if strip.matches(name) {
+			delete(h, name)
+		}
+	}
+}
+
+// SanitizeHeaders returns a copy of h fit for logs under the header
+// sanitization of s: stripped headers are left out, and masked ones, as well
+// as credentials and cookies, carry "[redacted]" instead of their values
+func (s *Server) SanitizeHeaders(h http.Header) http.Header {
+	cfg := s.cfg.HeaderSanitization
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		switch {
+		case headerPattern(cfg.Strip).matches(name), headerPattern(cfg.StripResponse).matches(name):
+		case headerPattern(cfg.Mask).matches(name), headerPattern(alwaysMasked).matches(name):
+			out[name] = []string{maskedValue}
+		default:
+			out[name] = append([]string(nil), values...)
+		}
+	}
+	return out
+}
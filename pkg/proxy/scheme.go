@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// Policies for plaintext http:// upstream requests
+const (
+	// SchemeAllow sends them as they are (the default)
+	SchemeAllow = "allow"
+	// SchemeRefuse answers 403 instead of sending them
+	SchemeRefuse = "refuse"
+	// SchemeUpgrade sends them over https://, with the certificate
+	// verified as for any https:// upstream
+	SchemeUpgrade = "upgrade"
+)
+
+// SchemeRule sets the plaintext policy of upstream hosts
+type SchemeRule struct {
+	// Host is an exact host name or a "*.example.com" or ".example.com"
+	// pattern
+	Host string `json:"host"`
+	// Policy is SchemeAllow, SchemeRefuse or SchemeUpgrade
+	Policy string `json:"policy"`
+}
+
+// validSchemePolicy reports whether policy is known; empty is SchemeAllow
+func validSchemePolicy(policy string) bool {
+	switch policy {
+	case "", SchemeAllow, SchemeRefuse, SchemeUpgrade:
+		return true
+	}
+	return false
+}
+
+// validateSchemeRules checks the policies of rules
+func validateSchemeRules(rules []SchemeRule) error {
+	for _, rule := range rules {
+		if !validSchemePolicy(rule.Policy) {
+			return fmt.Errorf("host %q: unknown scheme policy %q", rule.Host, rule.Policy)
+		}
+	}
+	return nil
+}
+
+// schemePolicy returns the plaintext policy for host: that of the route
+// when it sets one, else of the first matching host rule
+func (s *Server) schemePolicy(route *Route, host string) string {
+	if route != nil && route.SchemePolicy != "" {
+		return route.SchemePolicy
+	}
+	for _, rule := range s.cfg.SchemeRules {
+		if utils.MatchHost(rule.Host, host) {
+			return rule.Policy
+		}
+	}
+	return SchemeAllow
+}
+
+// errPlaintextRefused is returned for plaintext requests a policy refuses
+var errPlaintextRefused = errors.New("plaintext upstream refused by scheme policy")
+
+// applySchemePolicy returns the URL upstream is fetched from under the
+// plaintext policy of its host, or errPlaintextRefused
+func (s *Server) applySchemePolicy(route *Route, upstream *url.URL) (*url.URL, error) {
+	if upstream.Scheme != "http" {
+		return upstream, nil
+	}
+	switch s.schemePolicy(route, upstream.Hostname()) {
+	case SchemeRefuse:
+		return nil, errPlaintextRefused
+	case SchemeUpgrade:
+		upgraded := *upstream
+		upgraded.Scheme = "https"
+		upgraded.Host = strings.TrimSuffix(upstream.Host, ":80")
+		return &upgraded, nil
+	}
+	return upstream, nil
+}
+
+// checkRedirectScheme refuses redirects to plaintext hosts whose policy
+// is not SchemeAllow, so an upgraded request is not downgraded again
+func (s *Server) checkRedirectScheme(req *http.Request) error {
+	if req.URL.Scheme == "http" && s.schemePolicy(nil, req.URL.Hostname()) != SchemeAllow {
+		return errPlaintextRefused
+	}
+	return nil
+}
+
+// refusePlaintext answers 403 for a request refused by the scheme policy
+func (s *Server) refusePlaintext(w http.ResponseWriter, r *http.Request, target string) {
+	s.stats.PlaintextRefused.Add(1)
+	s.auditRequest(r, AuditSchemePolicy, "plaintext upstream", http.StatusForbidden)
+	s.log.WarnContext(r.Context(), "Plaintext upstream refused", "url", target)
+	w.Header().Set(denyReasonHeader, "plaintext upstream")
+	s.httpError(w, r, "Plaintext upstream not allowed", http.StatusForbidden)
+}
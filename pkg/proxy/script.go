@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/expr"
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// ScriptRule acts on the requests an expression selects. Expressions
+// inspect the request as req: req.Method, req.Host, req.Hostname, req.Path,
+// req.Scheme, req.URL, req.Proto, req.ClientIP, req.User and
+// req.Header["Name"], req.Query["name"] and req.Cookie["name"], e.g.
+// `req.Host endsWith ".test" && req.Method == "GET"`. Rules apply in order
+// once the client passed the ACLs.
+type ScriptRule struct {
+	// When selects the requests the rule applies to
+	When string `json:"when"`
+	// Block answers selected requests with Status, 403 by default, and
+	// Message; later rules do not apply
+	Block   bool   `json:"block,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	// SetHeaders sets request headers to the values of expressions, so
+	// fixed values are quoted, e.g. "X-Env" = "'test'" or
+	// "X-Client" = "req.ClientIP"
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+	// RemoveHeaders deletes request headers
+	RemoveHeaders []string `json:"remove_headers,omitempty"`
+}
+
+// requestSchema describes req to the expression compiler
+var requestSchema = map[string]any{"req": map[string]any{
+	"Method": "", "Host": "", "Hostname": "", "Path": "", "Scheme": "", "URL": "",
+	"Proto": "", "ClientIP": "", "User": "",
+	"Header": map[string]any(nil), "Query": map[string]any(nil), "Cookie": map[string]any(nil),
+}}
+
+// compileScript compiles an expression over req
+func compileScript(src string) (*expr.Program, error) {
+	p, err := expr.Compile(src, requestSchema)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return p, nil
+}
+
+// scriptRequest is req in expressions
+type scriptRequest struct{ r *http.Request }
+
+func (s scriptRequest) Field(name string) any {
+	r := s.r
+	switch name {
+	case "Method":
+		return r.Method
+	case "Host":
+		return r.Host
+	case "Hostname":
+		return strings.ToLower(utils.StripPort(r.Host))
+	case "Path":
+		return r.URL.Path
+	case "Scheme":
+		if r.URL.Scheme != "" {
+			return r.URL.Scheme
+		}
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	case "URL":
+		return r.URL.String()
+	case "Proto":
+		return r.Proto
+	case "ClientIP":
+		return clientIP(r)
+	case "User":
+		if user, ok := Annotation(r, ProxyUserAnnotation); ok {
+			return user
+		}
+		return nil
+	case "Header":
+		return scriptValues(func(key string) (string, bool) {
+			values := r.Header.Values(key)
+			if len(values) == 0 {
+				return "", false
+			}
+			return values[0], true
+		})
+	case "Query":
+		return scriptValues(func(key string) (string, bool) {
+			values, found := r.URL.Query()[key]
+			if !found || len(values) == 0 {
+				return "", false
+			}
+			return values[0], true
+		})
+	case "Cookie":
+		return scriptValues(func(key string) (string, bool) {
+			c, err := r.Cookie(key)
+			if err != nil {
+				return "", false
+			}
+			return c.Value, true
+		})
+	}
+	return nil
+}
+
+// scriptValues are named request values in expressions, null when absent
+type scriptValues func(key string) (string, bool)
+
+func (f scriptValues) Field(name string) any {
+	if v, ok := f(name); ok {
+		return v
+	}
+	return nil
+}
+
+// evalScript decides whether p selects r; expressions that fail, comparing
+// a string with a number say, select nothing and are logged to log
+func evalScript(log *slog.Logger, p *expr.Program, r *http.Request) bool {
+	ok, err := p.Bool(map[string]any{"req": scriptRequest{r}})
+	if err != nil {
+		log.WarnContext(r.Context(), "Expression failed", "expr", p.String(), "err", err)
+		return false
+	}
+	return ok
+}
+
+// scriptRule is a compiled ScriptRule
+type scriptRule struct {
+	ScriptRule
+	when    *expr.Program
+	setters map[string]*expr.Program
+}
+
+// compileScriptRules compiles the expressions of rules
+func compileScriptRules(rules []ScriptRule) ([]*scriptRule, error) {
+	var out []*scriptRule
+	for i, rule := range rules {
+		if rule.When == "" {
+			return nil, fmt.Errorf("script rule %d: when is required", i+1)
+		}
+		if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+			return nil, fmt.Errorf("script rule %d: status %d is not an error status", i+1, rule.Status)
+		}
+		when, err := compileScript(rule.When)
+		if err != nil {
+			return nil, fmt.Errorf("script rule %d: %w", i+1, err)
+		}
+		compiled := &scriptRule{ScriptRule: rule, when: when, setters: make(map[string]*expr.Program)}
+		for name, src := range rule.SetHeaders {
+			if compiled.setters[name], err = compileScript(src); err != nil {
+				return nil, fmt.Errorf("script rule %d: header %s: %w", i+1, name, err)
+			}
+		}
+		out = append(out, compiled)
+	}
+	return out, nil
+}
+
+// applyScriptRules applies the rules selecting r, reporting false when one
+// blocked it
+func (s *Server) applyScriptRules(w http.ResponseWriter, r *http.Request) bool {
+	for _, rule := range s.scriptRules {
+		if !evalScript(s.log.Logger, rule.when, r) {
+			continue
+		}
+		if rule.Block {
+			status := rule.Status
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			message := rule.Message
+			if message == "" {
+				message = "Request blocked"
+			}
+			s.auditRequest(r, AuditScript, rule.When, status)
+			s.httpError(w, r, message, status)
+			return false
+		}
+		for _, name := range rule.RemoveHeaders {
+			r.Header.Del(name)
+		}
+		for name, p := range rule.setters {
+			v, err := p.Eval(map[string]any{"req": scriptRequest{r}})
+			if err != nil {
+				s.log.WarnContext(r.Context(), "Expression failed", "expr", p.String(), "err", err)
+				continue
+			}
+			if v == nil {
+				r.Header.Del(name)
+				continue
+			}
+			r.Header.Set(name, fmt.Sprint(v))
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import "net/http"
+
+// SecurityHeaders are response security headers a reverse-proxy route
+// enforces on behalf of its backend, on every response it relays or
+// answers itself
+type SecurityHeaders struct {
+	// HSTS is the Strict-Transport-Security value, e.g.
+	// "max-age=31536000; includeSubDomains"
+	HSTS string `json:"hsts,omitempty"`
+	// ContentTypeOptions is the X-Content-Type-Options value, "nosniff"
+	ContentTypeOptions string `json:"content_type_options,omitempty"`
+	// FrameOptions is the X-Frame-Options value, e.g. "DENY" or
+	// "SAMEORIGIN"
+	FrameOptions string `json:"frame_options,omitempty"`
+	// ContentSecurityPolicy is the Content-Security-Policy value
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"`
+	// Override replaces the values the backend sends; by default they are
+	// kept and only missing headers are added
+	Override bool `json:"override,omitempty"`
+}
+
+// apply sets the configured headers in h
+func (s *SecurityHeaders) apply(h http.Header) {
+	for name, value := range map[string]string{
+		"Strict-Transport-Security": s.HSTS,
+		"X-Content-Type-Options":    s.ContentTypeOptions,
+		"X-Frame-Options":           s.FrameOptions,
+		"Content-Security-Policy":   s.ContentSecurityPolicy,
+	} {
+		if value != "" && (s.Override || h.Get(name) == "") {
+			h.Set(name, value)
+		}
+	}
+}
+
+// withSecurityHeaders returns w enforcing the security headers of route
+func withSecurityHeaders(w http.ResponseWriter, route *Route) http.ResponseWriter {
+	if route.SecurityHeaders == nil {
+		return w
+	}
+	return &headerWriter{ResponseWriter: w, edit: route.SecurityHeaders.apply}
+}
+
+// headerWriter edits the headers of the final response head
+type headerWriter struct {
+	http.ResponseWriter
+	edit  func(http.Header)
+	wrote bool
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	// Interim responses pass through untouched
+	if !hw.wrote && status >= http.StatusOK {
+		hw.wrote = true
+		hw.edit(hw.Header())
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if !hw.wrote {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+// Flush sends the response head, with its headers edited, and what was
+// written so far
+func (hw *headerWriter) Flush() {
+	if !hw.wrote {
+		hw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// SegmentedFetchConfig controls parallel segmented cache fills: a large
+// object from an origin that supports ranges is fetched as several ranges
+// at once, which fills the cache far faster over high-latency links
+type SegmentedFetchConfig struct {
+	// MinBytes is the smallest object fetched in segments; zero disables
+	// segmented fetching. Objects must also fit CacheMaxObjectBytes.
+	MinBytes int64
+	// Segments is how many ranges are fetched in parallel
+	Segments int
+}
+
+// segmentable reports whether a cacheable response is filled in segments
+func (s *Server) segmentable(resp *http.Response) bool {
+	cfg := s.cfg.SegmentedFetch
+	return cfg.MinBytes > 0 && cfg.Segments > 1 &&
+		resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.Header.Get("Content-Encoding") == "" && !resp.Uncompressed &&
+		resp.ContentLength >= cfg.MinBytes &&
+		resp.ContentLength <= s.cfg.CacheMaxObjectBytes
+}
+
+// segmentResult is a fetched range or the reason it could not be fetched
+type segmentResult struct {
+	body []byte
+	err  error
+}
+
+// writeSegmented answers with resp while the rest of its body is fetched
+// as parallel ranges. The first segment is read from resp itself; later
+// ones are relayed in order as they arrive and the assembled body is
+// cached. A segment that fails aborts the response, since its headers have
+// been sent.
+func (s *Server) writeSegmented(w http.ResponseWriter, req *http.Request, resp *http.Response, key string, p *Policy) {
+	size := resp.ContentLength
+	parts := int64(s.cfg.SegmentedFetch.Segments)
+	segment := (size + parts - 1) / parts
+
+	// If-Range makes a changed object come back whole instead of mixing
+	// two versions in one body
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	var pending []chan segmentResult
+	for start := segment; start < size; start += segment {
+		end := min(start+segment, size) - 1
+		done := make(chan segmentResult, 1)
+		pending = append(pending, done)
+		go func() {
+			body, err := s.fetchSegment(req, p, start, end, validator)
+			done <- segmentResult{body, err}
+		}()
+	}
+	s.log.DebugContext(req.Context(), "Fetching in segments", "url", req.URL.String(), "bytes", size, "segments", len(pending)+1)
+
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	body := make([]byte, segment, size)
+	if _, err := io.ReadFull(resp.Body, body); err != nil {
+		s.log.WarnContext(req.Context(), "Segmented fetch failed", "url", req.URL.String(), "err", err)
+		panic(http.ErrAbortHandler)
+	}
+	// The rest of the original body is not needed
+	resp.Body.Close()
+	w.Write(body)
+
+	for _, done := range pending {
+		res := <-done
+		if res.err != nil {
+			s.log.WarnContext(req.Context(), "Segmented fetch failed", "url", req.URL.String(), "err", res.err)
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(res.body)
+		body = append(body, res.body...)
+	}
+	s.cachePut(key, cachedResponse(resp, body))
+}
+
+// fetchSegment fetches bytes start through end of req's target
+func (s *Server) fetchSegment(req *http.Request, p *Policy, start, end int64, validator string) ([]byte, error) {
+	segReq := req.Clone(req.Context())
+	segReq.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10))
+	if validator != "" {
+		segReq.Header.Set("If-Range", validator)
+	}
+	// Stop the transport from negotiating gzip, which would re-encode the range
+	segReq.Header.Set("Accept-Encoding", "identity")
+	resp, err := s.doUpstream(segReq, p)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	want := fmt.Sprintf("bytes %d-%d/", start, end)
+	if resp.StatusCode != http.StatusPartialContent || len(resp.Header.Get("Content-Range")) < len(want) || resp.Header.Get("Content-Range")[:len(want)] != want {
+		return nil, fmt.Errorf("range %d-%d answered with %s %q", start, end, resp.Status, resp.Header.Get("Content-Range"))
+	}
+	body := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
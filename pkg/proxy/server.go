@@ -0,0 +1,1732 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/logging"
+)
+
+// Server runs the proxy for an embedding application. Each server holds
+// its own configuration, cache, transports, counters and background
+// services, so several can run in one process.
+type Server struct {
+	cfg Config
+	log *logging.Logger
+
+	cache     *LRUCache
+	transport http.RoundTripper
+	// client sends the proxy's own requests: health checks, prefetches,
+	// blocklist downloads and the like
+	client *http.Client
+	// upstream sends proxied requests. It has no overall timeout of its
+	// own; sendUpstream enforces each phase instead.
+	upstream *http.Client
+	// middleware is added at each stage of the request pipeline
+	middleware [stageCount][]Middleware
+
+	mu            sync.Mutex
+	shutdownHooks []func(context.Context)
+	servers       []*http.Server
+	shutdown      bool
+	done          chan struct{}
+	// listening maps the addresses of the proxy listeners to the error
+	// that stopped them, nil while they serve
+	listening map[string]error
+	prepared  sync.Once
+	// background is canceled by Shutdown, stopping the background services,
+	// and busy counts their goroutines for Shutdown to wait on
+	background     context.Context
+	stopBackground context.CancelFunc
+	busy           sync.WaitGroup
+
+	// operators hold the tokens of the admin API; nil when it is not
+	// authenticated
+	operators *tokenDatabase
+	// accessLog is set when the access log is configured
+	accessLog *logFile
+	// draining is set by POST /drain: health checks fail and responses close
+	// their connections, so load balancers and clients move elsewhere while
+	// in-flight requests finish
+	draining atomic.Bool
+	// auditLog is set when the audit log is configured
+	auditLog *logFile
+	// blocklist holds the active blocklist; nil when blocking is disabled
+	blocklist atomic.Pointer[hostBlocklist]
+	breakers  *breakerTable
+	// bypass is the active bypass list, consulted by every processing stage
+	bypass *BypassList
+	// capture holds the captured exchanges
+	capture *captureBuffer
+	// capturing is set while exchanges are captured
+	capturing atomic.Bool
+	chaos     *chaosInjector
+	// classifier is the active traffic classifier
+	classifier *TrafficClassifier
+	// activeACLs are the lists in force
+	activeACLs atomic.Pointer[ACLs]
+	// clientACLs are the compiled client rule sets of activeACLs by listen
+	// address, with the rules of listeners that have none of their own
+	// under ""
+	clientACLs atomic.Pointer[map[string]*clientRules]
+	// decoders decode the content codings passed with WithDecoder
+	decoders map[string]Decoder
+	// upstreamAcceptEncoding is the Accept-Encoding sent to origins, empty to
+	// let the transport negotiate gzip
+	upstreamAcceptEncoding string
+	// started is when the process began serving, for the runtime report
+	started time.Time
+	// diskCache is set when the disk tier is configured
+	diskCache *DiskCache
+	// integrity is the result of the startup integrity check
+	integrity IntegrityReport
+	// dnsCache caches upstream lookups; nil resolves every name afresh
+	dnsCache *DNSCache
+	// egress is set when egress budgets are configured
+	egress    *EgressBudget
+	endpoints *EndpointSet
+	// errorPages are the error pages in force; nil answers errors as plain
+	// text or ErrorBody
+	errorPages *errorTemplates
+	// errorReports is the active reporter; nil when reporting is disabled
+	errorReports *errorReporter
+	// filter is the active content filter; nil when filtering is disabled
+	filter *contentFilter
+	// geo is the active GeoIP database; nil when GeoIP is disabled
+	geo *geoDatabase
+	// hostHeaderRules are the header rules of Config.HostHeaders
+	hostHeaderRules []HostHeaderRules
+	// hooks are the hooks of the configuration; nil when none is set
+	hooks *Hooks
+	// fastHits reports whether the configuration allows the fast hit path
+	fastHits bool
+	// http3 is the HTTP/3 implementation passed with WithHTTP3, if any
+	http3 HTTP3Provider
+	// altSvc tracks HTTP/3 support of upstream origins
+	altSvc *altSvcCache
+	// icapServices are the active services
+	icapServices []*icapService
+	// journal is set when the request journal is configured
+	journal *Journal
+	// upstreams tracks origins with connections in the shared pool
+	upstreams *upstreamTracker
+	// latencies are the upstream latency histograms of the proxy
+	latencies   *latencyTable
+	maintenance *maintenanceSwitch
+	// minter is set when MITM interception is enabled
+	minter *certMinter
+	// overrides gates the upstream override header
+	overrides *overrideACL
+	parent    *url.URL
+	// pipeline is the request pipeline, built by prepare
+	pipeline requestPipeline
+	// plugins are the enabled plugins, nil when there are none
+	plugins         *pluginSet
+	policies        map[string]*Policy
+	prefetches      *prefetcher
+	assetPrefetches *assetPrefetcher
+	// proxyUsers is the database proxy clients authenticate against; nil when
+	// authentication is disabled
+	proxyUsers userDatabase
+	// limiter holds the limiter when rate limiting is configured; a reload
+	// replaces it
+	limiter atomic.Pointer[RateLimiter]
+	// reloadMu serializes reloads
+	reloadMu sync.Mutex
+	// reloaded is the configuration of the last reload, whose reloadable
+	// settings are in force
+	reloaded atomic.Pointer[Config]
+	// hostOverrides holds the fixed addresses of Hosts and HostsFile
+	hostOverrides map[string][]net.IPAddr
+	// upstreamResolve answers lookups missing from hostOverrides
+	upstreamResolve resolveFunc
+	// rewrites are the active rewrite rules
+	rewrites []rewriteRule
+	// routes holds the active route table used in reverse-proxy mode, which a
+	// reload replaces
+	routes atomic.Pointer[RouteTable]
+	// scriptRules are the active script rules
+	scriptRules []*scriptRule
+	// shedder is set when load shedding is configured
+	shedder *loadShedder
+	// signer is set when response signing is configured
+	signer *ResponseSigner
+	// ssrf guards client-chosen destinations
+	ssrf *ssrfGuard
+	// stats are the counters of the proxy
+	stats     *Stats
+	stubs     []StubRule
+	bandwidth *bandwidthTable
+	toggles   *Toggles
+	// proxyTokens is the token database clients authenticate against; nil when
+	// token authentication is disabled
+	proxyTokens *tokenDatabase
+	// tracer is the active exporter; nil when tracing is disabled
+	tracer *traceExporter
+	// transforms are the active transform rules
+	transforms []transformRule
+	// dialer opens upstream TCP connections
+	dialer *net.Dialer
+	// httpTransport is the shared pool of upstream connections. It
+	// speaks HTTP/2 to origins that negotiate it.
+	httpTransport *http.Transport
+	// http1Transport serves hosts that must be spoken to over HTTP/1.1
+	http1Transport *http.Transport
+	// upstreamTLS are the active upstream TLS policies
+	upstreamTLS []*upstreamTLSPolicy
+	// variants indexes the cached variants of every URL
+	variants *variantIndex
+	// workers is set when the worker pool is configured
+	workers *WorkerPool
+}
+
+// Option customizes a Server built by NewServer
+type Option func(*Server)
+
+// WithCache stores responses in c rather than in a cache of
+// Config.CacheCapacity entries, for applications that share or inspect it
+func WithCache(c *LRUCache) Option {
+	return func(s *Server) { s.cache = c }
+}
+
+// WithTransport sends upstream requests, proxied ones and the proxy's own,
+// through rt rather than the pooled transports Config.Transport configures
+func WithTransport(rt http.RoundTripper) Option {
+	return func(s *Server) { s.transport = rt }
+}
+
+// WithLogger logs through l rather than a logger built from Config.Logging;
+// the handler of l then decides the level logged
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) { s.log = logging.Wrap(l) }
+}
+
+// WithListeners serves the proxy on lns as well as on Config.ListenAddrs
+func WithListeners(lns ...net.Listener) Option {
+	return func(s *Server) {
+		s.cfg.Listeners = append(slices.Clip(s.cfg.Listeners), lns...)
+	}
+}
+
+// NewServer returns a server for cfg customized by opts, or the reason cfg
+// is invalid; ListenAndServe starts it
+func NewServer(cfg Config, opts ...Option) (*Server, error) {
+	s := &Server{
+		cfg:             cfg,
+		done:            make(chan struct{}),
+		breakers:        &breakerTable{breakers: make(map[string]*CircuitBreaker)},
+		started:         time.Now(),
+		altSvc:          &altSvcCache{h3Until: make(map[string]time.Time), broken: make(map[string]time.Time)},
+		upstreams:       &upstreamTracker{lastUsed: make(map[string]time.Time), requests: make(map[string]int64)},
+		latencies:       &latencyTable{},
+		maintenance:     &maintenanceSwitch{overrides: make(map[string]bool)},
+		prefetches:      &prefetcher{started: make(map[string]time.Time)},
+		assetPrefetches: &assetPrefetcher{pending: make(map[string]bool)},
+		upstreamResolve: systemResolve,
+		stats:           &Stats{},
+		bandwidth:       &bandwidthTable{clients: make(map[netip.Addr]*clientBandwidth)},
+		toggles:         NewToggles(),
+		dialer:          &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		httpTransport:   http.DefaultTransport.(*http.Transport).Clone(),
+		variants: &variantIndex{
+			vary:     make(map[string][]string),
+			variants: make(map[string]map[string]variant),
+		},
+	}
+	s.background, s.stopBackground = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.http3 == nil {
+		s.http3 = builtinHTTP3()
+	}
+	if s.log == nil {
+		l, err := logging.New(cfg.Logging)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logging settings: %w", err)
+		}
+		s.log = l
+	} else if _, err := logging.ParseLevel(cfg.Logging.Level); err != nil {
+		return nil, fmt.Errorf("invalid logging settings: %w", err)
+	}
+	s.http1Transport = s.newHTTP1Transport()
+	if s.cache == nil {
+		s.cache = NewLRUCache(max(cfg.CacheCapacity, 1))
+	}
+	s.stats.cache = s.cache
+	if s.transport == nil {
+		s.transport = hostTransport{s}
+	}
+	s.client = &http.Client{Timeout: cfg.Transport.RequestTimeout, Transport: s.transport}
+	s.upstream = &http.Client{Transport: s.transport, CheckRedirect: s.checkRedirect}
+	if err := s.configure(); err != nil {
+		s.stopBackground()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Cache returns the cache the server stores responses in
+func (s *Server) Cache() *LRUCache {
+	return s.cache
+}
+
+// OnShutdown registers fn to run during Shutdown, once the listeners have
+// stopped and in-flight requests have finished or ctx expired. Hooks run
+// in reverse order of registration, like deferred calls, so state set up
+// later is flushed before the state it depends on.
+func (s *Server) OnShutdown(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdownHooks = append(s.shutdownHooks, fn)
+}
+
+// Shutdown stops accepting requests, waits for in-flight ones until ctx
+// expires, stops the background services and waits for them until ctx
+// expires, then runs the OnShutdown hooks.
+// Later calls wait for the first to finish and return nil.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	defer close(s.done)
+	s.shutdown = true
+	servers := s.servers
+	hooks := s.shutdownHooks
+	s.mu.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.stopBackground()
+	stopped := make(chan struct{})
+	go func() {
+		s.busy.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](ctx)
+	}
+	return errors.Join(errs...)
+}
+
+// track registers srv to be shut down with s, reporting false when s is
+// already shutting down
+func (s *Server) track(srv *http.Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.servers = append(s.servers, srv)
+	return true
+}
+
+// goBackground runs fn on a new goroutine that Shutdown waits for; fn
+// must return once s.background is done
+func (s *Server) goBackground(fn func()) {
+	s.busy.Add(1)
+	go func() {
+		defer s.busy.Done()
+		fn()
+	}()
+}
+
+// closeOnShutdown closes ln, a listener served outside net/http, when the
+// server shuts down
+func (s *Server) closeOnShutdown(ln net.Listener) {
+	go func() {
+		<-s.background.Done()
+		ln.Close()
+	}()
+}
+
+// StartServer starts the proxy server with the given configuration, shuts
+// it down gracefully on SIGINT or SIGTERM and reloads it from its source on
+// SIGHUP. It returns the error that stopped the server, or the reason the
+// configuration is invalid.
+func StartServer(cfg Config) error {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			s.log.Info("Reloading configuration", "signal", "hangup")
+			if err := s.reloadFromSource(); err != nil {
+				s.log.Error("Reload failed, keeping the running configuration", "err", err)
+			}
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		s.log.Info("Shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			s.log.Warn("Shutdown incomplete", "err", err)
+		}
+	}()
+	return s.ListenAndServe()
+}
+
+// ListenAndServe applies the configuration and serves the proxy until a
+// listener fails or Shutdown is called, in which case it returns nil once
+// Shutdown has finished. Invalid configuration is fatal. The proxy serves
+// Config.Listeners and either the sockets systemd passed by socket
+// activation or, without any, the configured listen addresses.
+func (s *Server) ListenAndServe() error {
+	s.prepared.Do(s.start)
+	return s.serve(nil)
+}
+
+// Serve is ListenAndServe on lns, which the caller bound, rather than on
+// the configured addresses; it serves no other listener. Passing sockets
+// inherited from a previous process lets a restart drop no connection.
+func (s *Server) Serve(lns ...net.Listener) error {
+	if len(lns) == 0 {
+		return errors.New("no listeners to serve")
+	}
+	s.prepared.Do(s.start)
+	return s.serve(lns)
+}
+
+// serve serves the proxy on lns, or on the listeners the configuration
+// opens when lns is nil
+func (s *Server) serve(lns []net.Listener) error {
+	srv := &http.Server{Handler: http.HandlerFunc(s.serveProxy), ConnState: s.countConnections}
+	if !s.track(srv) {
+		<-s.done
+		return nil
+	}
+	if err := s.serveListeners(srv, lns); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// Handler applies the configuration, starting the background services it
+// enables, and returns the proxy handler, for applications that serve it
+// from their own http.Server
+func (s *Server) Handler() http.Handler {
+	s.prepared.Do(s.start)
+	return http.HandlerFunc(s.serveProxy)
+}
+
+// configure checks and compiles the configuration, opening the files it
+// names; it starts nothing
+func (s *Server) configure() error {
+	if s.cfg.TLSSelfSigned {
+		if err := s.ensureSelfSigned(); err != nil {
+			return fmt.Errorf("self-signed certificate setup failed: %w", err)
+		}
+		s.log.Info("Serving TLS with development certificate", "cert", s.cfg.TLSCertFile)
+	}
+	if s.cfg.CacheCapacity < 1 {
+		return fmt.Errorf("invalid cache capacity %d", s.cfg.CacheCapacity)
+	}
+	if s.cfg.Tape.Mode != "" {
+		tape, err := newTapeTransport(s.cfg.Tape, s.transport)
+		if err != nil {
+			return fmt.Errorf("invalid record and replay settings: %w", err)
+		}
+		tape.log = s.log.Logger
+		s.transport = tape
+		s.client.Transport = tape
+		s.upstream.Transport = tape
+		s.log.Info("Upstream exchanges taped", "mode", s.cfg.Tape.Mode, "dir", s.cfg.Tape.Dir)
+	}
+	loaded, err := s.loadPlugins(s.cfg.Plugins)
+	if err != nil {
+		return fmt.Errorf("plugin setup failed: %w", err)
+	}
+	s.plugins = loaded
+	if loaded != nil {
+		s.OnShutdown(func(context.Context) { loaded.close() })
+	}
+	middleware := s.middleware
+	for stage, filters := range s.plugins.filters() {
+		middleware[stage] = append(slices.Clip(middleware[stage]), filters...)
+	}
+	s.pipeline = s.buildPipeline(&middleware)
+	s.bypass = NewBypassList(s.cfg.Bypass)
+	table, err := newRouteTable(s.cfg.Routes, s.cfg.VirtualHosts, s.log.Logger)
+	if err != nil {
+		return fmt.Errorf("invalid routes: %w", err)
+	}
+	s.routes.Store(table)
+	if s.policies, err = compilePolicies(s.cfg.Policies); err != nil {
+		return fmt.Errorf("invalid policies: %w", err)
+	}
+	if err := s.cfg.CircuitBreaker.Validate(); err != nil {
+		return fmt.Errorf("invalid circuit breaker: %w", err)
+	}
+	if err := validateSchemeRules(s.cfg.SchemeRules); err != nil {
+		return fmt.Errorf("invalid scheme rules: %w", err)
+	}
+	if s.rewrites, err = compileRewrites(s.cfg.Rewrites); err != nil {
+		return fmt.Errorf("invalid rewrite rules: %w", err)
+	}
+	if s.scriptRules, err = compileScriptRules(s.cfg.ScriptRules); err != nil {
+		return fmt.Errorf("invalid script rules: %w", err)
+	}
+	if s.transforms, err = compileTransforms(s.cfg.Transforms); err != nil {
+		return fmt.Errorf("invalid transform rules: %w", err)
+	}
+	if s.filter, err = compileContentFilter(s.cfg.ContentFilter); err != nil {
+		return fmt.Errorf("invalid content filter: %w", err)
+	}
+	if s.icapServices, err = compileICAPServices(s.cfg.ICAP); err != nil {
+		return fmt.Errorf("invalid ICAP services: %w", err)
+	}
+	if err := s.cfg.ResponseLimit.Validate(); err != nil {
+		return fmt.Errorf("invalid response limit: %w", err)
+	}
+	if s.ssrf, err = compileSSRFGuard(s.cfg.SSRF); err != nil {
+		return fmt.Errorf("invalid SSRF settings: %w", err)
+	}
+	if s.overrides, err = compileOverrideACL(s.cfg.UpstreamOverride); err != nil {
+		return fmt.Errorf("invalid upstream override: %w", err)
+	}
+	// A zero timeout would set a read deadline already past, and the peek
+	// would let every tunnel through unchecked
+	if s.cfg.SNIPolicy.PeekTimeout <= 0 {
+		s.cfg.SNIPolicy.PeekTimeout = defaultPeekTimeout
+	}
+	// Nor may auto-detecting listeners wait forever for a silent client
+	if s.cfg.AutoDetectTimeout <= 0 {
+		s.cfg.AutoDetectTimeout = defaultAutoDetectTimeout
+	}
+	if err := s.applyACLs(ACLs{ClientACL: s.cfg.ClientACL, ListenerACLs: s.cfg.ListenerACLs, DestinationACL: s.cfg.DestinationACL}); err != nil {
+		return fmt.Errorf("invalid client ACL: %w", err)
+	}
+	if s.cfg.AccessLog.Path != "" {
+		if s.accessLog, err = openAccessLog(s.cfg.AccessLog); err != nil {
+			return fmt.Errorf("access log setup failed: %w", err)
+		}
+		s.accessLog.log = s.log.Logger
+	}
+	if !s.cfg.Hooks.empty() {
+		s.hooks = &s.cfg.Hooks
+	}
+	s.capture = newCaptureBuffer(s.cfg.Capture)
+	s.capturing.Store(s.cfg.Capture.Enabled)
+	if s.cfg.AuditLog.Path != "" {
+		if s.auditLog, err = openLogFile(s.cfg.AuditLog.Path, s.cfg.AuditLog.MaxBytes, 0); err != nil {
+			return fmt.Errorf("audit log setup failed: %w", err)
+		}
+		s.auditLog.log = s.log.Logger
+	}
+	if len(s.cfg.GeoIP.Blocks) > 0 {
+		if s.geo, err = loadGeoDatabase(s.cfg.GeoIP); err != nil {
+			return fmt.Errorf("GeoIP setup failed: %w", err)
+		}
+	}
+	if s.cfg.ProxyAuth.UsersFile != "" {
+		users, err := loadUserDatabase(s.cfg.ProxyAuth.UsersFile)
+		if err != nil {
+			return fmt.Errorf("proxy authentication setup failed: %w", err)
+		}
+		s.proxyUsers = users
+	}
+	if len(s.cfg.TokenAuth.Identities) > 0 {
+		if s.proxyTokens, err = compileTokens(s.cfg.TokenAuth); err != nil {
+			return fmt.Errorf("token authentication setup failed: %w", err)
+		}
+	}
+	if s.cfg.DefaultPolicy != "" && s.policies[s.cfg.DefaultPolicy] == nil {
+		return fmt.Errorf("invalid policies: default policy %q is not defined", s.cfg.DefaultPolicy)
+	}
+	if err := s.checkRoutes(table, s.cfg.Mode); err != nil {
+		return fmt.Errorf("invalid routes: %w", err)
+	}
+	if s.classifier, err = NewTrafficClassifier(s.cfg.TrafficClasses); err != nil {
+		return fmt.Errorf("invalid traffic classes: %w", err)
+	}
+	if s.endpoints, err = NewEndpointSet(s.cfg.Endpoints); err != nil {
+		return fmt.Errorf("invalid endpoints: %w", err)
+	}
+	s.endpoints.stats, s.endpoints.log, s.endpoints.fail = s.stats, s.log.Logger, s.httpError
+	if s.stubs, err = compileStubs(s.cfg.Stubs); err != nil {
+		return fmt.Errorf("invalid stubs: %w", err)
+	}
+	for i, rules := range s.cfg.HostHeaders {
+		if rules.Host == "" {
+			return fmt.Errorf("invalid host header rules: rule %d has no host pattern", i+1)
+		}
+	}
+	s.hostHeaderRules = s.cfg.HostHeaders
+	if s.errorPages, err = compileErrorPages(s.cfg.ErrorPages); err != nil {
+		return fmt.Errorf("invalid error pages: %w", err)
+	}
+	if s.errorPages != nil {
+		s.errorPages.log = s.log.Logger
+	}
+	if s.chaos, err = newChaosInjector(s.cfg.Chaos); err != nil {
+		return fmt.Errorf("invalid chaos rules: %w", err)
+	}
+	s.configureTransport(s.cfg.Transport)
+	s.configureDecompression(s.cfg.Decompression)
+	if err := s.configureResolver(s.cfg.Resolver, s.cfg.DNSCache); err != nil {
+		return fmt.Errorf("resolver setup failed: %w", err)
+	}
+	if err := s.configureParentProxy(s.cfg.ParentProxy); err != nil {
+		return fmt.Errorf("parent proxy setup failed: %w", err)
+	}
+	if err := s.configureUpstreamTLS(s.cfg.UpstreamTLS); err != nil {
+		return fmt.Errorf("invalid upstream TLS rules: %w", err)
+	}
+	if len(s.cfg.Blocklist.Sources) > 0 {
+		b, err := s.loadHostBlocklist(s.cfg.Blocklist)
+		if err != nil {
+			return fmt.Errorf("blocklist setup failed: %w", err)
+		}
+		s.blocklist.Store(b)
+	}
+	if s.cfg.MITM.Enabled {
+		if err := requireSubsystem("mitm"); err != nil {
+			return err
+		}
+		if s.minter, err = newCertMinter(s.cfg.MITM); err != nil {
+			return fmt.Errorf("MITM setup failed: %w", err)
+		}
+	}
+	if s.cfg.DiskCache.Dir != "" {
+		if err := s.openDiskCache(s.cfg.DiskCache); err != nil {
+			return err
+		}
+	}
+	if len(s.cfg.Signing.Routes) > 0 {
+		if s.signer, err = NewResponseSigner(s.cfg.Signing); err != nil {
+			return fmt.Errorf("response signing setup failed: %w", err)
+		}
+	}
+	if s.cfg.Workers.MaxConcurrent > 0 {
+		s.workers = NewWorkerPool(s.cfg.Workers)
+		s.workers.stats = s.stats
+	}
+	if s.cfg.Journal.Path != "" {
+		if err := s.openJournal(s.cfg.Journal); err != nil {
+			return err
+		}
+	}
+	s.shedder = newLoadShedder(s.cfg.LoadShedding)
+	if s.cfg.RateLimit.Rate > 0 {
+		s.limiter.Store(NewRateLimiter(s.cfg.RateLimit))
+	}
+	if s.cfg.EgressBudget.Bytes > 0 {
+		if err := s.cfg.EgressBudget.Validate(); err != nil {
+			return fmt.Errorf("invalid egress budget: %w", err)
+		}
+		s.egress = NewEgressBudget(s.cfg.EgressBudget)
+	}
+	if len(s.cfg.AdminTokens) > 0 {
+		if s.operators, err = compileTokens(TokenAuthConfig{Header: "Authorization", Identities: s.cfg.AdminTokens}); err != nil {
+			return fmt.Errorf("invalid admin tokens: %w", err)
+		}
+	}
+	if s.cfg.Transparent.Addr != "" && !transparentSupported {
+		return errors.New("transparent proxying is not supported on this platform")
+	}
+	if s.cfg.SOCKS5.Addr != "" || s.cfg.SOCKS5.AutoDetect {
+		if err := requireSubsystem("socks5"); err != nil {
+			return err
+		}
+	}
+	if s.cfg.GRPCAddr != "" {
+		if err := requireSubsystem("grpc"); err != nil {
+			return err
+		}
+	}
+	if s.cfg.ErrorReporting.DSN != "" {
+		if s.errorReports, err = newErrorReporter(s.cfg.ErrorReporting); err != nil {
+			return fmt.Errorf("error reporting setup failed: %w", err)
+		}
+		s.errorReports.log = s.log.Logger
+	}
+	if s.cfg.Tracing.Endpoint != "" {
+		s.tracer = newTraceExporter(s.cfg.Tracing)
+		s.tracer.log = s.log.Logger
+	}
+	if err := s.checkHTTP3(s.cfg.HTTP3); err != nil {
+		return fmt.Errorf("HTTP/3 setup failed: %w", err)
+	}
+	s.fastHits = s.fastHitsAllowed()
+	return nil
+}
+
+// start starts the background services the configuration enables; they
+// run until Shutdown
+func (s *Server) start() {
+	table := s.routes.Load()
+	s.startHealthChecks(table)
+	s.prewarmUpstreams(s.cfg.Prewarm, table)
+	s.startHotPrewarm(s.cfg.Prewarm)
+	s.startKeepalive(s.cfg.Keepalive)
+	if b := s.blocklist.Load(); b != nil {
+		s.refreshBlocklist(b, s.cfg.Blocklist.Refresh)
+	}
+	if s.cfg.AdminAddr != "" {
+		s.track(s.startAdmin(s.cfg.AdminAddr, s.operators))
+	}
+	if s.cfg.DebugAddr != "" {
+		s.track(s.startDebug(s.cfg.DebugAddr))
+	}
+	if s.cfg.Transparent.Addr != "" {
+		s.startTransparent(s.cfg.Transparent.Addr)
+	}
+	if s.cfg.SOCKS5.Addr != "" {
+		s.startSOCKS5(s.cfg.SOCKS5)
+	}
+	if s.cfg.GRPCAddr != "" {
+		s.track(s.startGRPC(s.cfg.GRPCAddr, s.operators))
+	}
+	if reporter := s.errorReports; reporter != nil {
+		s.goBackground(func() { reporter.run(s.background) })
+		s.OnShutdown(reporter.flush)
+	}
+	if exporter := s.tracer; exporter != nil {
+		s.goBackground(func() { exporter.run(s.background) })
+		s.OnShutdown(exporter.flush)
+	}
+	if s.cfg.HTTP3.Listen {
+		s.goBackground(func() {
+			s.log.Info("HTTP/3 listener is running", "addr", s.cfg.HTTP3.Addr)
+			err := s.http3.Serve(s.background, s.cfg.HTTP3.Addr, s.cfg.TLSCertFile, s.cfg.TLSKeyFile, http.HandlerFunc(s.serveProxy))
+			if err != nil && s.background.Err() == nil {
+				s.log.Error("HTTP/3 listener failed", "err", err)
+			}
+		})
+	}
+}
+
+// serveListeners serves the proxy with srv on given, or on the listeners of
+// the configuration without any, until one of them fails or srv is shut
+// down
+func (s *Server) serveListeners(srv *http.Server, given []net.Listener) error {
+	if s.cfg.ClientAuth.CAFile != "" {
+		tlsConfig, err := s.clientAuthTLSConfig(s.cfg.ClientAuth)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	if s.cfg.TLSCertFile != "" && s.cfg.Mode == ModeReverse {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		srv.TLSConfig.GetCertificate = s.siteCertificate
+	}
+	if s.cfg.DisableHTTP2 {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+	}
+
+	var sniffConfig *tls.Config
+	if s.cfg.TLSCertFile != "" && s.cfg.AutoDetectTLS {
+		tlsConfig, err := s.sniffTLSConfig(srv.TLSConfig, s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		sniffConfig = tlsConfig
+	}
+	var socks func(net.Conn)
+	if sniffConfig != nil && s.cfg.SOCKS5.AutoDetect {
+		socks = func(conn net.Conn) { s.serveSOCKS5(conn, s.cfg.SOCKS5) }
+	}
+
+	var listeners []net.Listener
+	if given == nil {
+		opened, err := s.openListeners()
+		if err != nil {
+			return err
+		}
+		listeners = opened
+	}
+	for _, ln := range given {
+		listeners = append(listeners, s.guardListener(ln.Addr().String(), ln))
+	}
+	for i, ln := range listeners {
+		listeners[i] = s.throttleListener(ln)
+	}
+	if len(listeners) == 0 {
+		return errors.New("no listen addresses configured")
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		addr := ln.Addr().String()
+		s.log.Info("Proxy Server is running", "addr", addr)
+		s.setListening(addr, nil)
+		go func() {
+			var err error
+			switch {
+			case sniffConfig != nil:
+				err = srv.Serve(newSniffListener(ln, sniffConfig, s.cfg.AutoDetectTimeout, socks))
+			case s.cfg.TLSCertFile != "":
+				err = srv.ServeTLS(ln, s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+			default:
+				err = srv.Serve(ln)
+			}
+			s.setListening(addr, err)
+			errs <- err
+		}()
+	}
+	return <-errs
+}
+
+// openListeners returns Config.Listeners and the sockets passed by systemd
+// or, when it passed none, those of the configured listen addresses
+func (s *Server) openListeners() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, ln := range s.cfg.Listeners {
+		listeners = append(listeners, s.guardListener(ln.Addr().String(), ln))
+	}
+	activated, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, ln := range activated {
+		listeners = append(listeners, s.guardListener(ln.Addr().String(), ln))
+	}
+	if len(activated) > 0 {
+		s.log.Info("Serving sockets passed by systemd instead of the listen addresses", "sockets", len(activated))
+		return listeners, nil
+	}
+	opened, err := s.listenAll()
+	if err != nil {
+		return nil, err
+	}
+	return append(listeners, opened...), nil
+}
+
+// listenAll binds the configured listen addresses, the family-specific ones
+// on that family alone; it closes what it opened when any of them fails
+func (s *Server) listenAll() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, bind := range []struct {
+		network string
+		addrs   []string
+	}{
+		{"tcp", s.cfg.ListenAddrs},
+		{"tcp4", s.cfg.ListenIPv4},
+		// Go sets IPV6_V6ONLY on tcp6 sockets, so they never take over the
+		// IPv4 port
+		{"tcp6", s.cfg.ListenIPv6},
+	} {
+		for _, addr := range bind.addrs {
+			ln, err := s.listenGuarded(bind.network, addr)
+			if err != nil {
+				for _, opened := range listeners {
+					opened.Close()
+				}
+				return nil, fmt.Errorf("listen on %s %s: %w", bind.network, addr, err)
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+	return listeners, nil
+}
+
+// serveProxy is the entry point for proxy requests, bounding concurrency,
+// journaling them and enforcing egress budgets before dispatching
+func (s *Server) serveProxy(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.RequestIDs {
+		r = withRequestID(w, r)
+	}
+	s.stats.InFlight.Add(1)
+	defer s.stats.InFlight.Add(-1)
+	if s.draining.Load() {
+		w.Header().Set("Connection", "close")
+	}
+	if s.shedder != nil {
+		if !s.shedder.admit(s, w, r) {
+			return
+		}
+		defer s.shedder.done()
+	}
+	if !s.checkRequestLimits(w, r) || s.serveFastHit(w, r) {
+		return
+	}
+	s.withRecovery(w, r, s.serveAnnotated)
+}
+
+// serveAnnotated attaches the per-request state and traces the request
+func (s *Server) serveAnnotated(w http.ResponseWriter, r *http.Request) {
+	r = withPinnedDNS(WithAnnotations(r))
+	if s.tracer != nil {
+		s.withTracing(w, r, s.serveLogged)
+		return
+	}
+	s.serveLogged(w, r)
+}
+
+// serveLogged writes the access log entry of a request
+func (s *Server) serveLogged(w http.ResponseWriter, r *http.Request) {
+	if s.accessLog != nil {
+		s.withAccessLog(w, r, s.serveCaptured)
+		return
+	}
+	s.serveCaptured(w, r)
+}
+
+// serveCaptured captures the exchange while traffic capture is on
+func (s *Server) serveCaptured(w http.ResponseWriter, r *http.Request) {
+	if s.capturing.Load() {
+		s.withCapture(w, r, s.serveIdentified)
+		return
+	}
+	s.serveIdentified(w, r)
+}
+
+// serveIdentified identifies the client of a request before serving it
+func (s *Server) serveIdentified(w http.ResponseWriter, r *http.Request) {
+	if subject := clientSubject(r); subject != "" {
+		Annotate(r, ClientSubjectAnnotation, subject)
+	}
+	s.authenticate(r)
+	if s.cfg.HTTP3.Listen && r.ProtoMajor < 3 {
+		w.Header().Set("Alt-Svc", altSvcHeader(s.cfg.HTTP3.Addr))
+	}
+	s.withTrafficClass(w, r, s.serveHooked)
+}
+
+// serveCompressed compresses responses for clients that accept it
+func (s *Server) serveCompressed(w http.ResponseWriter, r *http.Request) {
+	s.withCompression(w, r, s.serveJournaled)
+}
+
+// serveJournaled records the request in the crash-forensics journal before
+// passing it down the pipeline
+func (s *Server) serveJournaled(w http.ResponseWriter, r *http.Request) {
+	if s.journal != nil {
+		s.withJournal(w, r, s.pipeline.entry.ServeHTTP)
+		return
+	}
+	s.pipeline.entry.ServeHTTP(w, r)
+}
+
+// dispatch routes a request to the handler for the proxy mode and method
+func (s *Server) dispatch(w http.ResponseWriter, r *http.Request) {
+	if s.serveEndpoint(w, r) || !s.checkLoop(w, r) {
+		return
+	}
+	if s.cfg.Mode == ModeReverse {
+		s.handleReverse(w, r)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		s.handleConnect(w, r)
+		return
+	}
+	s.handleRequest(w, r)
+}
+
+// handleRequest forwards a request to the target server it names
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, r.URL.String())
+
+	target, err := s.requestTarget(r)
+	if err != nil {
+		s.httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.forwardTarget(w, r, target)
+}
+
+// logRequest logs a request for target with its traffic class, client
+// certificate subject and proxy user
+func (s *Server) logRequest(r *http.Request, target string) {
+	if !s.log.Enabled(r.Context(), slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{slog.String("url", target)}
+	attrs = appendClientAttrs(attrs, r)
+	s.log.LogAttrs(r.Context(), slog.LevelDebug, "Received request", attrs...)
+}
+
+// logCompleted logs the outcome of a request: its method, host, status,
+// duration, whether the cache answered it and the code of its error
+func (s *Server) logCompleted(r *http.Request, status int, elapsed time.Duration) {
+	if !s.log.Enabled(r.Context(), slog.LevelInfo) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("host", r.Host),
+		slog.String("url", r.URL.String()),
+		slog.Int("status", status),
+		slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+	}
+	if cache, ok := Annotation(r, CacheAnnotation); ok {
+		attrs = append(attrs, slog.String("cache", cache))
+	}
+	if code, ok := Annotation(r, ErrorAnnotation); ok {
+		attrs = append(attrs, slog.String("error", code))
+	}
+	attrs = appendClientAttrs(attrs, r)
+	s.log.LogAttrs(r.Context(), slog.LevelInfo, "Request completed", attrs...)
+}
+
+// appendClientAttrs appends the traffic class, client certificate subject
+// and proxy user of r, where set, to attrs
+func appendClientAttrs(attrs []slog.Attr, r *http.Request) []slog.Attr {
+	if class, ok := Annotation(r, TrafficClassAnnotation); ok && class != defaultTrafficClass {
+		attrs = append(attrs, slog.String("class", class))
+	}
+	if subject := clientSubject(r); subject != "" {
+		attrs = append(attrs, slog.String("subject", subject))
+	}
+	if user, ok := Annotation(r, ProxyUserAnnotation); ok {
+		attrs = append(attrs, slog.String("user", user))
+	}
+	return attrs
+}
+
+// forwardTarget forwards a forward-proxy request using the route, if any,
+// that matches its destination
+func (s *Server) forwardTarget(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	target, ok := s.rewriteTarget(w, r, target)
+	if !ok {
+		return
+	}
+	if !s.checkBlocklist(w, r, target.Host) || !s.checkDestination(w, r, target.Hostname()) || !s.checkDestinationCountry(w, r, target.Host) {
+		return
+	}
+	route, found := s.routes.Load().MatchURL(r, target)
+	if found {
+		Annotate(r, RouteAnnotation, route.Name)
+	}
+	s.forward(w, r, target, route)
+}
+
+// handleReverse forwards a request to the backend of its matching route
+func (s *Server) handleReverse(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, r.Host+r.URL.String())
+
+	if !s.routeBySNI(w, r) {
+		return
+	}
+	route, found := s.routes.Load().Match(r)
+	if !found {
+		s.httpError(w, r, "No route for request", http.StatusNotFound)
+		return
+	}
+	Annotate(r, RouteAnnotation, route.Name)
+	w = withSecurityHeaders(withSiteHeaders(w, route), route)
+	target, ok := s.rewriteTarget(w, r, route.Target(r))
+	if !ok {
+		return
+	}
+	s.forward(w, r, target, route)
+}
+
+// Errors returned by requestTarget
+var (
+	errInvalidEncoding = errors.New("Invalid URL encoding")
+	errInvalidTarget   = errors.New("Invalid target URL")
+)
+
+// requestTarget resolves the destination of r. Absolute-URI request lines, as
+// sent by curl -x and browser proxy settings, are used as is. Origin-form
+// requests are routed by their Host header, unless they address the proxy
+// itself, in which case the legacy /http://example.com path form is accepted
+// when enabled.
+func (s *Server) requestTarget(r *http.Request) (*url.URL, error) {
+	if r.URL.IsAbs() {
+		if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+			return nil, errInvalidTarget
+		}
+		target := *r.URL
+		return &target, nil
+	}
+
+	if r.Host != "" && !isSelf(r) {
+		return &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}, nil
+	}
+	if !s.cfg.LegacyPathMode {
+		return nil, errInvalidTarget
+	}
+
+	// Extract the target URL from the request
+	targetURL := strings.TrimPrefix(r.URL.Path, "/")
+
+	// Decode URL (in case of encoded characters); a + is a plain character
+	// in paths, not an escaped space
+	targetURL, err := url.PathUnescape(targetURL)
+	if err != nil {
+		return nil, errInvalidEncoding
+	}
+
+	// Ensure the URL starts with http:// or https://
+	if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
+		return nil, errInvalidTarget
+	}
+
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, errInvalidTarget
+	}
+	// The query of the embedded URL arrives as the query of the request
+	if target.RawQuery == "" {
+		target.RawQuery = r.URL.RawQuery
+	}
+	return target, nil
+}
+
+// isSelf reports whether the Host header of r names the proxy's own
+// listener. It does not allocate, as the fast hit path relies on.
+func isSelf(r *http.Request) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	self, ok := addrPortOf(local)
+	if !ok {
+		return false
+	}
+
+	// Unlike SplitHostPort, Hostname and Port do not allocate an error for
+	// a Host without a port
+	dest := url.URL{Host: r.Host}
+	port := dest.Port()
+	if port == "" {
+		port = "80"
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || uint16(n) != self.Port() {
+		return false
+	}
+	host := dest.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap().WithZone("")
+	return ip.IsLoopback() || ip.IsUnspecified() || ip == self.Addr().Unmap().WithZone("")
+}
+
+// addrPortOf returns the IP address and port of a listener address
+func addrPortOf(addr net.Addr) (netip.AddrPort, bool) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.AddrPort(), true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	return ap, err == nil
+}
+
+// forward serves target from the cache or fetches it from the origin,
+// applying the settings of route when it is not nil
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, target *url.URL, route *Route) {
+	w = s.withHeaderRules(w, route, target.Hostname())
+	if s.serveMaintenance(w, r, route) || s.terminateEarly(w, r, route) || s.serveStub(w, r) {
+		return
+	}
+	override, ok := s.upstreamOverride(w, r, route)
+	if !ok {
+		return
+	}
+	targetURL := target.String()
+
+	// Shared caches must not store answers to authenticated requests, and
+	// overridden requests and those forcing a version must reach the
+	// backends they name. Routes may cache POST queries under a hash of the
+	// body.
+	policy := route.cachePolicy()
+	cacheURL, cachedMethod := targetURL, r.Method == http.MethodGet
+	if r.Method == http.MethodPost && route != nil && route.CachePOST != nil {
+		cacheURL, cachedMethod = postCacheURL(r, route.CachePOST, targetURL)
+		policy.MaxAge = route.CachePOST.TTL
+	}
+	cacheable := cachedMethod && !s.bypass.Match(target) && r.Header.Get("Authorization") == "" && override == "" && !route.forcesVersion(r) && s.toggles.Enabled(ToggleCaching, route) && !policy.Disabled
+	sign := s.signer != nil && s.signer.Applies(target)
+	// Range requests missing the cache may fetch the whole object to fill it
+	fill := cacheable && !sign && isRangeRequest(r) && s.cfg.CacheRangeRequests
+	var varyOn []string
+	if applyDeviceClass(w, r, route) != "" {
+		varyOn = append(varyOn, deviceClassHeader)
+	}
+
+	// Serve from the cache when possible
+	origin := s.stats.origins.get(target.Host)
+	if cacheable {
+		key := s.variants.Key(cacheURL, r.Header)
+		lookup := startSpan(r.Context(), "cache lookup", spanInternal)
+		cachedResp, found := s.cacheGet(key)
+		found = found && !policy.expired(s.cache, key)
+		lookup.setBool("proxy.cache.hit", found)
+		lookup.end()
+		if found {
+			Annotate(r, CacheAnnotation, "hit")
+			if !s.hooks.cacheHit(w, r) {
+				return
+			}
+			s.log.DebugContext(r.Context(), "Cache hit", "url", targetURL)
+			origin.Hits.Add(1)
+			origin.BytesSaved.Add(int64(len(cachedResp.Body)))
+			s.writeCached(w, r, cacheURL, key, cachedResp, sign)
+			s.maybePrefetch(target, key, cachedResp.Body, route)
+			return
+		}
+		origin.Misses.Add(1)
+		Annotate(r, CacheAnnotation, "miss")
+	}
+
+	ex := &exchange{target: target, cacheURL: cacheURL, route: route, override: override, cacheable: cacheable, sign: sign, fill: fill, varyOn: varyOn, origin: origin}
+	s.pipeline.upstream.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex)))
+}
+
+// exchange is what the cache stage learnt of a request that missed the
+// cache, for the upstream stage
+type exchange struct {
+	target *url.URL
+	// cacheURL is what the response is cached under, which for POST
+	// requests includes a hash of the body
+	cacheURL string
+	route    *Route
+	override string
+	// cacheable, sign and fill are the caching decisions of forward
+	cacheable, sign, fill bool
+	varyOn                []string
+	origin                *originCounters
+}
+
+type exchangeKey struct{}
+
+// serveUpstream fetches a request that missed the cache from its origin or
+// backend and relays the response, storing it where allowed
+func (s *Server) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	ex := r.Context().Value(exchangeKey{}).(*exchange)
+	target, route, override, origin := ex.target, ex.route, ex.override, ex.origin
+	cacheable, sign, fill, varyOn, cacheURL := ex.cacheable, ex.sign, ex.fill, ex.varyOn, ex.cacheURL
+	targetURL := target.String()
+
+	// Balanced routes are cached under their first backend, whichever
+	// replica serves the request
+	upstream := target
+	if route != nil && route.pool != nil && s.cfg.Mode == ModeReverse {
+		var backend *poolBackend
+		if override != "" {
+			if backend = route.pool.pickNamed(override); backend == nil {
+				s.httpError(w, r, "Unknown upstream override", http.StatusBadRequest)
+				return
+			}
+			s.log.InfoContext(r.Context(), "Upstream overridden", "backend", backend.url.String(), "url", targetURL)
+		} else {
+			backend = route.pickBackend(w, r)
+		}
+		defer route.pool.release(backend)
+		upstream = route.targetOn(backend.url, r)
+	}
+	upstream, err := s.applySchemePolicy(route, upstream)
+	if err != nil {
+		s.refusePlaintext(w, r, targetURL)
+		return
+	}
+	s.upstreams.touch(upstream)
+
+	// Destinations chosen by forward-proxy clients must not be internal,
+	// nor may their redirects lead there
+	ctx := r.Context()
+	if s.cfg.Mode != ModeReverse {
+		if err := s.checkSSRF(ctx, upstream, s.upstream.Transport); err != nil {
+			s.refuseInternal(w, r, err)
+			return
+		}
+		ctx = withSSRFGuard(ctx)
+	}
+
+	// Forward the request, cancelling it if the client goes away
+	var body io.Reader
+	if r.ContentLength != 0 {
+		body = r.Body
+	}
+	body, shadowBody, shadowed := route.sampleShadow(r, body)
+	req, err := http.NewRequestWithContext(ctx, r.Method, upstream.String(), body)
+	if err != nil {
+		s.httpError(w, r, "Invalid target URL", http.StatusBadRequest)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	if req.GetBody == nil && r.GetBody != nil {
+		// A body buffered earlier, by ICAP or middleware, can be retried
+		req.GetBody = r.GetBody
+	}
+	req, relay := withInterimRelay(req, w)
+	req = withPhaseTimeouts(req, s.phaseTimeoutsFor(route, upstream.Host))
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+	s.sanitizeRequestHeaders(req.Header)
+	s.privatizeRequest(req.Header, upstream.Host)
+	keepTETrailers(req.Header, r.Header)
+	req.Trailer = r.Trailer
+	s.addForwardedHeaders(req.Header, r)
+	s.editRequestHeaders(req.Header, route, upstream.Hostname())
+
+	// The cache stores bodies without their headers, so let the transport
+	// negotiate compression and hand back decoded bodies, or ask for every
+	// coding decodeBody knows in decompression mode
+	req.Header.Del("Accept-Encoding")
+	if s.upstreamAcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", s.upstreamAcceptEncoding)
+	}
+	if fill {
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+	}
+	if !s.scanRequest(w, r, req, target) {
+		return
+	}
+	if shadowed {
+		route.shadow.send(s, route, r, req, shadowBody)
+	}
+
+	policy := s.routePolicy(route)
+	breaker := s.breakerFor(policy, upstream.Host)
+	if breaker != nil && !breaker.Allow() {
+		s.rejectOpenCircuit(w, r, breaker)
+		return
+	}
+	fetch := startSpan(r.Context(), "upstream fetch", spanClient)
+	defer fetch.end()
+	fetch.setString("http.request.method", req.Method)
+	fetch.setString("server.address", upstream.Host)
+	fetch.inject(req.Header)
+	var timings *upstreamTimings
+	if s.cfg.SlowRequestThreshold > 0 {
+		req, timings = withUpstreamTimings(req)
+	}
+	send := func(req *http.Request) (*http.Response, error) {
+		if route != nil && len(route.mirrors) > 0 && replayable(req) {
+			return s.doMirrored(req, route, policy)
+		}
+		return s.doUpstream(req, policy)
+	}
+	var resp *http.Response
+	sent := time.Now()
+	if route != nil && route.session != nil {
+		resp, err = route.session.do(s, req, send)
+	} else {
+		resp, err = send(req)
+	}
+	relay.finish()
+	if err == nil {
+		s.latencies.record(upstream.Host, time.Since(sent))
+	}
+	if timings != nil {
+		status := http.StatusBadGateway
+		if err == nil {
+			status = resp.StatusCode
+		}
+		defer s.logIfSlow(timings, r, upstream.Host, status)
+	}
+	if route != nil && route.pool != nil && r.Context().Err() == nil {
+		route.pool.report(upstream.Host, err == nil)
+	}
+	if breaker != nil {
+		if r.Context().Err() != nil {
+			breaker.Forget()
+		} else {
+			breaker.Record(err == nil && resp.StatusCode < 500)
+		}
+	}
+	if err != nil {
+		fetch.fail(err)
+		if isBodyLimitError(err) {
+			s.rejectLimit(w, r, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		if isSSRFError(err) {
+			s.refuseInternal(w, r, err)
+			return
+		}
+		if errors.Is(err, errPlaintextRefused) {
+			s.refusePlaintext(w, r, targetURL)
+			return
+		}
+		if isLengthError(err) {
+			s.stats.LengthMismatches.Add(1)
+		}
+		if r.Context().Err() == nil {
+			s.reportUpstreamError(upstream.Host, err)
+		}
+		s.upstreamError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	fetch.setInt("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		s.stats.errorCodes.add(ErrorUpstreamStatus)
+		Annotate(r, ErrorAnnotation, ErrorUpstreamStatus)
+	}
+	removeHopHeaders(resp.Header)
+	if s.cfg.RequestIDs {
+		// The response already carries the ID
+		resp.Header.Del(requestIDHeader)
+	}
+	s.sanitizeResponseHeaders(resp.Header)
+	s.privatizeResponse(resp.Header, upstream.Host)
+	s.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	if !s.hooks.upstreamResponse(w, r, resp) {
+		return
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		origin.NotModified.Add(1)
+	}
+
+	// The cache keeps bodies decoded, so it may only store bodies it could
+	// decode to plaintext. Partial bodies can be neither
+	// decoded nor cached, single part or multipart/byteranges alike.
+	partial := resp.StatusCode == http.StatusPartialContent
+	decoded := !partial && s.decodeBody(resp)
+	if !decoded {
+		cacheable = false
+	}
+	// Nor can it keep trailers
+	if len(resp.Trailer) > 0 {
+		cacheable = false
+	}
+
+	if !s.enforceContentType(w, r, resp, route) {
+		return
+	}
+	if !s.filterContent(w, r, target, resp, decoded) {
+		return
+	}
+	scanned, ok := s.scanResponse(w, r, req, target, resp)
+	if !ok {
+		return
+	}
+	if scanned {
+		cacheable = false
+	}
+
+	// Oversized responses are refused, or relayed without buffering or
+	// caching
+	oversize := s.cfg.ResponseLimit.exceeded(resp.ContentLength)
+	if oversize {
+		if !s.cfg.ResponseLimit.streams(sign) {
+			s.rejectOversize(w, r, targetURL)
+			return
+		}
+		cacheable = false
+	}
+
+	// Server errors are never cached; a close cached variant stands in
+	if resp.StatusCode >= 500 {
+		if cacheable {
+			if key, found := s.variants.Closest(cacheURL, r.Header); found {
+				if cachedResp, found := s.cacheGet(key); found {
+					s.log.InfoContext(r.Context(), "Serving alternate variant after upstream error", "url", targetURL)
+					w.Header().Set("Warning", variantWarning)
+					origin.BytesSaved.Add(int64(len(cachedResp.Body)))
+					s.writeCached(w, r, cacheURL, key, cachedResp, sign)
+					return
+				}
+			}
+		}
+		cacheable = false
+	}
+	// Answers to POST queries are cached only when they succeed
+	if r.Method == http.MethodPost && resp.StatusCode != http.StatusOK {
+		cacheable = false
+	}
+	if !storable(resp) {
+		cacheable = false
+	}
+
+	transformed, err := s.transformResponse(r, target, route, resp, decoded)
+	if err != nil {
+		s.log.WarnContext(r.Context(), "Error transforming response", "url", targetURL, "err", err)
+		s.httpError(w, r, "Error transforming response", http.StatusBadGateway)
+		return
+	}
+	if transformed {
+		cacheable = false
+	}
+
+	key := targetURL
+	if cacheable {
+		key, cacheable = s.variants.Record(cacheURL, r.Header, resp.Header, varyOn...)
+	}
+	if fill && cacheable && resp.StatusCode == http.StatusOK {
+		s.writeRangeFill(w, r, resp, key)
+		return
+	}
+	if cacheable && !sign && s.segmentable(resp) {
+		s.writeSegmented(w, req, resp, key, policy)
+		return
+	}
+	// Partial responses, which may be large, are relayed as they arrive
+	if !oversize && !partial && s.buffered(route, sign, resp) {
+		s.writeBuffered(w, resp, key, cacheable, sign)
+		return
+	}
+	s.writeStreaming(w, resp, key, cacheable)
+}
+
+// cacheableStatuses are the statuses RFC 9111 lets a cache store without
+// explicit freshness information, less 405, 414 and 501, which are
+// answered afresh
+var cacheableStatuses = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusGone: true,
+}
+
+// storable reports whether a shared cache may store resp: its status must
+// be cacheable, and neither the request nor the response may say no-store,
+// nor the response private or set a cookie
+func storable(resp *http.Response) bool {
+	if !cacheableStatuses[resp.StatusCode] || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if hasDirective(resp.Header, "no-store") || hasDirective(resp.Header, "private") {
+		return false
+	}
+	return resp.Request == nil || !hasDirective(resp.Request.Header, "no-store")
+}
+
+// hasDirective reports whether the Cache-Control header of h carries the
+// directive name, with or without an argument
+func hasDirective(h http.Header, name string) bool {
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive, _, _ = strings.Cut(directive, "=")
+			if strings.EqualFold(strings.TrimSpace(directive), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cachedResponse is what the cache stores of resp and its body: the status
+// and the headers, less the length, which the body has once decoded
+func cachedResponse(resp *http.Response, body []byte) CachedResponse {
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	return CachedResponse{Status: resp.StatusCode, Header: header, Body: body}
+}
+
+// writeCached answers r with a cached response stored under key, cutting
+// the requested ranges from a whole body unless it must be signed
+func (s *Server) writeCached(w http.ResponseWriter, r *http.Request, url, key string, cached CachedResponse, sign bool) {
+	copyHeaders(w.Header(), cached.Header)
+	if language := s.variants.Language(url, key); language != "" {
+		w.Header().Set("Content-Language", language)
+	}
+	body := cached.Body
+	if !sign && isRangeRequest(r) && cached.Status == http.StatusOK {
+		serveRanges(w, r, body)
+		return
+	}
+	if sign {
+		w.Header().Set(s.signer.Header(), s.signer.Sign(body))
+	}
+	w.WriteHeader(cached.Status)
+	w.Write(body)
+}
+
+// buffered decides whether a response is read whole before answering.
+// Signatures always need the whole body; otherwise the route's strategy
+// applies, and by default length corrections need it too, which only
+// bodies with a Content-Length can have.
+func (s *Server) buffered(route *Route, sign bool, resp *http.Response) bool {
+	if sign {
+		return true
+	}
+	strategy := BufferAuto
+	if route != nil {
+		strategy = route.Buffering
+	}
+	switch strategy {
+	case BufferFull:
+		return true
+	case BufferStream:
+		return false
+	}
+	return s.cfg.LengthMismatchPolicy != LengthPolicyError && resp.ContentLength >= 0
+}
+
+// writeBuffered reads the whole upstream body before answering the client
+func (s *Server) writeBuffered(w http.ResponseWriter, resp *http.Response, key string, cacheable, sign bool) {
+	// Read response body, no further than the size limit
+	limit := s.cfg.ResponseLimit
+	var src io.Reader = resp.Body
+	if limit.MaxBytes > 0 {
+		src = io.LimitReader(resp.Body, limit.MaxBytes+1)
+	}
+	body, err := readSized(src, resp.ContentLength)
+	if errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength > 0 {
+		s.writeLengthMismatch(w, resp, body)
+		return
+	}
+	if err != nil {
+		s.httpError(w, resp.Request, "Failed to read response", http.StatusInternalServerError)
+		return
+	}
+	if limit.exceeded(int64(len(body))) {
+		if !limit.streams(sign) {
+			s.rejectOversize(w, resp.Request, key)
+			return
+		}
+		// Relay what was read followed by the rest, uncached
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		s.writeStreaming(w, resp, key, false)
+		return
+	}
+
+	// Copy response headers
+	copyHeaders(w.Header(), resp.Header)
+	if sign {
+		w.Header().Set(s.signer.Header(), s.signer.Sign(body))
+	}
+	announceTrailers(w, resp)
+	w.WriteHeader(resp.StatusCode)
+
+	// Store response in cache and write it back to the client
+	if cacheable {
+		s.cachePut(key, cachedResponse(resp, body))
+	}
+	w.Write(body)
+	if cacheable {
+		s.prefetchAssets(resp, body)
+	}
+	copyTrailers(w, resp)
+}
+
+// writeStreaming relays the upstream body as it arrives, keeping a copy for
+// the cache only while it stays under the cacheable size limit
+func (s *Server) writeStreaming(w http.ResponseWriter, resp *http.Response, key string, cacheable bool) {
+	copyHeaders(w.Header(), resp.Header)
+	announceTrailers(w, resp)
+	w.WriteHeader(resp.StatusCode)
+
+	var body io.Reader = resp.Body
+	if limit := s.cfg.ResponseLimit; limit.MaxBytes > 0 && !limit.streams(false) {
+		body = &guardedBody{r: body, max: limit.MaxBytes}
+	}
+	var capture *cacheCapture
+	if cacheable {
+		capture = &cacheCapture{limit: s.cfg.CacheMaxObjectBytes}
+		// A body of known length is captured without growing the buffer
+		if resp.ContentLength > 0 && resp.ContentLength <= min(capture.limit, maxPresize) {
+			capture.buf.Grow(int(resp.ContentLength))
+		}
+		body = io.TeeReader(body, capture)
+	}
+
+	// Flush unbounded bodies as they arrive so streams are not held back
+	if err := copyBody(w, body, resp.ContentLength < 0); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength > 0 {
+			s.stats.LengthMismatches.Add(1)
+			s.log.WarnContext(resp.Request.Context(), "Body length mismatch", "url", key)
+		}
+		if errors.Is(err, errResponseTooLarge) {
+			s.stats.ResponsesTooLarge.Add(1)
+			s.log.WarnContext(resp.Request.Context(), "Response too large, cutting it off", "url", key)
+		}
+		// Headers are already sent; abort so a partial body never looks complete
+		panic(http.ErrAbortHandler)
+	}
+	copyTrailers(w, resp)
+
+	if capture != nil && !capture.overflow {
+		s.cachePut(key, cachedResponse(resp, capture.buf.Bytes()))
+		s.prefetchAssets(resp, capture.buf.Bytes())
+	}
+}
+
+// copyBody copies src to w, flushing after every write when flush is set
+func copyBody(w http.ResponseWriter, src io.Reader, flush bool) error {
+	pooled := getCopyBuffer()
+	defer putCopyBuffer(pooled)
+	buf := *pooled
+	rc := http.NewResponseController(w)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flush {
+				rc.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// cacheCapture collects a streamed body for the cache, giving up once it
+// grows past limit
+type cacheCapture struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (c *cacheCapture) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if int64(c.buf.Len()+len(p)) > c.limit {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// copyHeaders adds every value of src to dst
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// SessionConfig keeps a server-side session with the origins of a route:
+// the proxy logs in with configured credentials and sends the session
+// cookies on every request, so internal clients can fetch session-protected
+// content without logging in themselves
+type SessionConfig struct {
+	// LoginURL receives the login form as a POST
+	LoginURL string `json:"login_url"`
+	// Form holds the login form fields, e.g. username and password. A value
+	// of the form $NAME is read from the environment variable NAME, which
+	// keeps secrets out of the configuration file.
+	Form map[string]string `json:"form"`
+	// ExpiredStatus lists the statuses that mean the session has expired;
+	// the proxy logs in again and repeats replayable requests once. The
+	// default is 401.
+	ExpiredStatus []int `json:"expired_status,omitempty"`
+}
+
+// originSession is the cookie jar of a route and the login that fills it
+type originSession struct {
+	cfg   SessionConfig
+	login *url.URL
+	jar   *cookiejar.Jar
+
+	mu sync.Mutex
+	// generation counts successful logins, so that requests that saw the
+	// same expired session log in only once
+	generation int
+}
+
+// newOriginSession validates cfg and returns an empty session
+func newOriginSession(cfg SessionConfig) (*originSession, error) {
+	login, err := url.Parse(cfg.LoginURL)
+	if err != nil || (login.Scheme != "http" && login.Scheme != "https") || login.Host == "" {
+		return nil, fmt.Errorf("session: invalid login URL %q", cfg.LoginURL)
+	}
+	if len(cfg.ExpiredStatus) == 0 {
+		cfg.ExpiredStatus = []int{http.StatusUnauthorized}
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &originSession{cfg: cfg, login: login, jar: jar}, nil
+}
+
+// do sends req for srv with the session cookies added to the client's
+// own, logging in first when there is no session yet and again when the
+// origin answers that it expired. Cookies the origin sets are kept in the jar rather than
+// passed to the client.
+func (s *originSession) do(srv *Server, req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	clientCookies := slices.Clone(req.Header.Values("Cookie"))
+	generation, err := s.addCookies(srv, req, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(s.cfg.ExpiredStatus, resp.StatusCode) && replayable(req) {
+		resp.Body.Close()
+		srv.log.InfoContext(req.Context(), "Session expired, logging in again", "url", req.URL.String())
+		req.Header.Del("Cookie")
+		for _, cookie := range clientCookies {
+			req.Header.Add("Cookie", cookie)
+		}
+		if _, err := s.addCookies(srv, req, generation); err != nil {
+			return nil, err
+		}
+		if resp, err = send(req); err != nil {
+			return nil, err
+		}
+	}
+	s.jar.SetCookies(req.URL, resp.Cookies())
+	resp.Header.Del("Set-Cookie")
+	return resp, nil
+}
+
+// addCookies adds the session cookies for req's URL, logging in first when
+// the session is still the stale generation, and returns the generation
+// the cookies belong to
+func (s *originSession) addCookies(srv *Server, req *http.Request, stale int) (int, error) {
+	s.mu.Lock()
+	if s.generation == stale {
+		if err := s.logIn(srv, req); err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.generation++
+	}
+	generation := s.generation
+	s.mu.Unlock()
+
+	for _, cookie := range s.jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+	return generation, nil
+}
+
+// logIn posts the login form, storing the cookies set along the way
+func (s *originSession) logIn(srv *Server, req *http.Request) error {
+	form := url.Values{}
+	for name, value := range s.cfg.Form {
+		if env, ok := strings.CutPrefix(value, "$"); ok {
+			value = os.Getenv(env)
+		}
+		form.Set(name, value)
+	}
+	client := srv.client
+	login := &http.Client{Transport: client.Transport, Jar: s.jar, Timeout: client.Timeout}
+	loginReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, s.login.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	loginReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := login.Do(loginReq)
+	if err != nil {
+		srv.log.WarnContext(req.Context(), "Session login failed", "err", err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		srv.log.WarnContext(req.Context(), "Session login failed", "status", resp.StatusCode, "url", s.login.String())
+		return errors.New("session login rejected")
+	}
+	srv.log.InfoContext(req.Context(), "Logged in", "host", s.login.Host)
+	return nil
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ShadowConfig mirrors a share of a route's requests to a shadow backend,
+// to try a new service on production traffic. Shadow requests are sent in
+// the background and their responses discarded, so they neither delay nor
+// change what clients get. Requests the cache answers are not mirrored.
+type ShadowConfig struct {
+	// URL is the base URL of the shadow backend, which receives the path
+	// the route's backend would
+	URL string `json:"url"`
+	// Percent of the requests mirrored, e.g. 10
+	Percent float64 `json:"percent"`
+	// Timeout bounds each shadow request; it defaults to 10s
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// MaxBodyBytes is the largest request body mirrored, 1 MiB by default;
+	// requests with larger bodies are not mirrored
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// MaxInFlight bounds the shadow requests in flight, 64 by default;
+	// requests beyond it are not mirrored
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+}
+
+// shadowBackend is a compiled ShadowConfig
+type shadowBackend struct {
+	ShadowConfig
+	url   *url.URL
+	slots chan struct{}
+}
+
+// compileShadow validates cfg and fills in its defaults
+func compileShadow(cfg ShadowConfig) (*shadowBackend, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid shadow backend %q", cfg.URL)
+	}
+	if cfg.Percent <= 0 || cfg.Percent > 100 {
+		return nil, fmt.Errorf("shadow percent %v is not in (0, 100]", cfg.Percent)
+	}
+	if cfg.Timeout < 0 || cfg.MaxBodyBytes < 0 || cfg.MaxInFlight < 0 {
+		return nil, fmt.Errorf("negative shadow limit")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = 1 << 20
+	}
+	if cfg.MaxInFlight == 0 {
+		cfg.MaxInFlight = 64
+	}
+	return &shadowBackend{ShadowConfig: cfg, url: u, slots: make(chan struct{}, cfg.MaxInFlight)}, nil
+}
+
+// sampleShadow decides whether r is mirrored to the shadow of route. It
+// returns the body to send upstream in place of body and, for mirrored
+// requests, a copy of it for the shadow.
+func (route *Route) sampleShadow(r *http.Request, body io.Reader) (io.Reader, []byte, bool) {
+	if route == nil || route.shadow == nil || rand.Float64()*100 >= route.shadow.Percent {
+		return body, nil, false
+	}
+	if body == nil {
+		return nil, nil, true
+	}
+	limit := route.shadow.MaxBodyBytes
+	if r.ContentLength > limit {
+		return body, nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		// What was read still goes upstream, which reports the error
+		return io.MultiReader(bytes.NewReader(buf), body), nil, false
+	}
+	return bytes.NewReader(buf), buf, true
+}
+
+// send mirrors req, the upstream request for r, to the shadow backend
+// with body through srv, unless MaxInFlight shadow requests are already in
+// flight
+func (s *shadowBackend) send(srv *Server, route *Route, r, req *http.Request, body []byte) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		srv.stats.ShadowDropped.Add(1)
+		return
+	}
+	target := route.targetOn(s.url, r)
+	// The shadow request outlives the client's
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), s.Timeout)
+	shadowReq, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		<-s.slots
+		return
+	}
+	shadowReq.Header = req.Header.Clone()
+	srv.stats.Shadowed.Add(1)
+	srv.goSafe("shadow request", func() {
+		defer func() { <-s.slots }()
+		defer cancel()
+		resp, err := srv.client.Transport.RoundTrip(shadowReq)
+		if err != nil {
+			srv.log.DebugContext(ctx, "Shadow request failed", "url", target.String(), "err", err)
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		srv.log.DebugContext(ctx, "Shadow request completed", "url", target.String(), "status", resp.StatusCode)
+	})
+}
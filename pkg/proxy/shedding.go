@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LoadSheddingConfig caps the proxy's total load, across all clients.
+// Requests beyond a cap are refused at once with 503 and Retry-After rather
+// than queued, so a traffic spike degrades into fast refusals instead of
+// exhausting memory. The worker pool, by contrast, queues briefly.
+type LoadSheddingConfig struct {
+	// MaxInFlight is the number of requests, tunnels included, handled at
+	// once; zero means no cap
+	MaxInFlight int64
+	// MaxRate is the requests per second accepted; zero means no cap
+	MaxRate float64
+	// Burst is how many requests above MaxRate may arrive at once; it
+	// defaults to MaxRate rounded up
+	Burst int
+	// RetryAfter is suggested to refused clients; it defaults to 1s
+	RetryAfter time.Duration
+}
+
+// loadShedder enforces LoadSheddingConfig
+type loadShedder struct {
+	maxInFlight int64
+	inFlight    atomic.Int64
+	rate        *TokenBucket
+	retryAfter  string
+}
+
+// newLoadShedder returns the shedder for cfg, or nil when it sets no cap
+func newLoadShedder(cfg LoadSheddingConfig) *loadShedder {
+	if cfg.MaxInFlight <= 0 && cfg.MaxRate <= 0 {
+		return nil
+	}
+	retryAfter := max(cfg.RetryAfter, time.Second)
+	s := &loadShedder{maxInFlight: cfg.MaxInFlight, retryAfter: strconv.Itoa(int(retryAfter.Seconds()))}
+	if cfg.MaxRate > 0 {
+		burst := cfg.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(cfg.MaxRate))
+		}
+		s.rate = NewTokenBucket(float64(burst), cfg.MaxRate)
+	}
+	return s
+}
+
+// admit claims a slot for a request to srv, answering 503 when the proxy
+// is at a cap; admitted requests must call done when finished
+func (s *loadShedder) admit(srv *Server, w http.ResponseWriter, r *http.Request) bool {
+	n := s.inFlight.Add(1)
+	if (s.maxInFlight <= 0 || n <= s.maxInFlight) && (s.rate == nil || s.rate.Take(1)) {
+		return true
+	}
+	s.inFlight.Add(-1)
+	srv.stats.Shed.Add(1)
+	srv.auditRequest(r, AuditLoadShed, "global load cap", http.StatusServiceUnavailable)
+	w.Header().Set("Retry-After", s.retryAfter)
+	srv.httpError(w, r, "Proxy is overloaded", http.StatusServiceUnavailable)
+	return false
+}
+
+// done releases the slot of an admitted request
+func (s *loadShedder) done() {
+	s.inFlight.Add(-1)
+}
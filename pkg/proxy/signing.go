@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// Supported response signature algorithms
+const (
+	SignHMACSHA256 = "hmac-sha256"
+	SignEd25519    = "ed25519"
+)
+
+// SigningConfig controls response signatures on integrity-sensitive routes
+type SigningConfig struct {
+	// Routes lists the destinations whose responses are signed
+	Routes []SigningRoute
+	// Algorithm is SignHMACSHA256 or SignEd25519
+	Algorithm string
+	// KeyFile holds the raw HMAC secret or a PEM encoded PKCS #8 Ed25519 key
+	KeyFile string
+	// Header receives the signature as "<algorithm>=<base64>"
+	Header string
+}
+
+// SigningRoute selects responses to sign by host and path prefix
+type SigningRoute struct {
+	Host       string
+	PathPrefix string
+}
+
+// ResponseSigner signs response bodies for the configured routes
+type ResponseSigner struct {
+	routes    []SigningRoute
+	algorithm string
+	header    string
+	hmacKey   []byte
+	edKey     ed25519.PrivateKey
+}
+
+// NewResponseSigner loads the signing key described by cfg
+func NewResponseSigner(cfg SigningConfig) (*ResponseSigner, error) {
+	key, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &ResponseSigner{routes: cfg.Routes, algorithm: cfg.Algorithm, header: cfg.Header}
+
+	switch cfg.Algorithm {
+	case SignHMACSHA256:
+		s.hmacKey = []byte(strings.TrimSpace(string(key)))
+	case SignEd25519:
+		block, _ := pem.Decode(key)
+		if block == nil {
+			return nil, errors.New("signing key is not PEM encoded")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("signing key is not an Ed25519 key")
+		}
+		s.edKey = edKey
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm %q", cfg.Algorithm)
+	}
+	return s, nil
+}
+
+// Applies reports whether responses for u must be signed
+func (s *ResponseSigner) Applies(u *url.URL) bool {
+	for _, route := range s.routes {
+		if utils.MatchHost(route.Host, u.Host) && strings.HasPrefix(u.Path, route.PathPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Header returns the name of the header carrying the signature
+func (s *ResponseSigner) Header() string {
+	return s.header
+}
+
+// Sign returns the signature header value for body
+func (s *ResponseSigner) Sign(body []byte) string {
+	var sig []byte
+	if s.algorithm == SignEd25519 {
+		sig = ed25519.Sign(s.edKey, body)
+	} else {
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(body)
+		sig = mac.Sum(nil)
+	}
+	return s.algorithm + "=" + base64.StdEncoding.EncodeToString(sig)
+}
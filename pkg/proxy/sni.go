@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// SNIPolicyConfig applies destination ACLs to the TLS ClientHello sent inside
+// CONNECT tunnels, rather than trusting the CONNECT authority alone
+type SNIPolicyConfig struct {
+	// ACL is evaluated against the SNI server name, or the CONNECT host when
+	// the tunnel carries no TLS or no SNI
+	ACL HostACL
+	// RequireMatch rejects tunnels whose SNI differs from the CONNECT host
+	RequireMatch bool
+	// PeekTimeout bounds the wait for the ClientHello; a tunnel whose TLS
+	// ClientHello is not complete by then is refused. It defaults to 10s.
+	PeekTimeout time.Duration
+}
+
+// defaultPeekTimeout is the PeekTimeout used when none is set
+const defaultPeekTimeout = 10 * time.Second
+
+// errPeekDone stops the TLS handshake once the ClientHello has been read
+var errPeekDone = errors.New("client hello captured")
+
+// errIncompleteHello reports a stream that starts like TLS but whose
+// ClientHello could not be read in time
+var errIncompleteHello = errors.New("incomplete TLS ClientHello")
+
+// recordTypeHandshake is the type of the TLS record carrying a ClientHello
+const recordTypeHandshake = 0x16
+
+// peekClientHello reads the TLS ClientHello from conn without answering it.
+// It returns the SNI server name (empty if the stream is not TLS) and the
+// bytes consumed, which must be replayed to the upstream. A stream that
+// starts with a handshake record but yields no ClientHello before timeout
+// is an error, lest a client evade the SNI policy by sending it slowly or
+// malformed.
+func peekClientHello(conn net.Conn, timeout time.Duration) (string, []byte, error) {
+	var consumed bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var serverName string
+	parsed := false
+	peek := &peekConn{Conn: conn, r: io.TeeReader(conn, &consumed)}
+	tls.Server(peek, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, parsed = hello.ServerName, true
+			return nil, errPeekDone
+		},
+	}).Handshake()
+	if !parsed && consumed.Len() > 0 && consumed.Bytes()[0] == recordTypeHandshake {
+		return "", consumed.Bytes(), errIncompleteHello
+	}
+	return serverName, consumed.Bytes(), nil
+}
+
+// peekConn records reads from a connection and swallows writes, so a TLS
+// server can parse a ClientHello without talking to the client
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *peekConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// checkSNI applies the SNI policy to a tunnel to authority whose ClientHello
+// named serverName. It returns a reason when the tunnel must be refused.
+func (s *Server) checkSNI(authority, serverName string) (bool, string) {
+	policy := s.cfg.SNIPolicy
+	host := utils.StripPort(authority)
+	if serverName == "" {
+		serverName = host
+	} else if policy.RequireMatch && !strings.EqualFold(serverName, host) {
+		return false, "SNI " + serverName + " does not match CONNECT host " + host
+	}
+	return policy.ACL.Check(serverName)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultAutoDetectTimeout is the AutoDetectTimeout used when none is set
+const defaultAutoDetectTimeout = 10 * time.Second
+
+// sniffListener accepts plaintext HTTP and TLS on the same port, telling
+// them apart by the first byte each client sends. TLS connections are
+// handed out as *tls.Conn, so the server negotiates HTTP/2 and reads
+// client certificates exactly as on a TLS-only listener. SOCKS5
+// connections go to socks instead, when it is set.
+type sniffListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	socks     func(net.Conn)
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+	once  sync.Once
+}
+
+// newSniffListener starts accepting on ln. Connections are sniffed
+// concurrently so a silent client cannot hold up the others, and dropped
+// when they send nothing within timeout.
+func newSniffListener(ln net.Listener, tlsConfig *tls.Config, timeout time.Duration, socks func(net.Conn)) *sniffListener {
+	l := &sniffListener{
+		Listener:  ln,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		socks:     socks,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniffListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.once.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+		go l.sniff(conn)
+	}
+}
+
+// sniff peeks at the first byte of conn and queues it for Accept
+func (l *sniffListener) sniff(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn = &bufferedConn{Conn: conn, reader: reader}
+	switch {
+	case first[0] == tlsRecordHandshake:
+		conn = tls.Server(conn, l.tlsConfig)
+	case first[0] == socksVersion && l.socks != nil:
+		l.socks(conn)
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// sniffTLSConfig returns the TLS settings for sniffed TLS connections,
+// starting from base when it is not nil
+func (s *Server) sniffTLSConfig(base *tls.Config, certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	if s.cfg.DisableHTTP2 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,265 @@
+//go:build !minimal && !nosocks
+
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func init() {
+	registerSubsystem("socks5")
+}
+
+// startSOCKS5 serves SOCKS5 CONNECT tunnels on addr in the background
+// until the server shuts down
+func (s *Server) startSOCKS5(cfg SOCKS5Config) {
+	ln, err := s.listenGuarded("tcp", cfg.Addr)
+	if err != nil {
+		s.log.Error("SOCKS5 listener failed", "err", err)
+		return
+	}
+	ln = s.throttleListener(ln)
+	s.closeOnShutdown(ln)
+	s.goBackground(func() {
+		s.log.Info("SOCKS5 listener is running", "addr", ln.Addr().String())
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if s.background.Err() == nil {
+					s.log.Error("SOCKS5 listener failed", "err", err)
+				}
+				return
+			}
+			go s.serveSOCKS5(conn, cfg)
+		}
+	})
+}
+
+// serveSOCKS5 negotiates a SOCKS5 session and tunnels it to its
+// destination, under the same proxy authentication, rate limit, worker
+// pool, host and country ACLs and egress budget as CONNECT tunnels
+func (s *Server) serveSOCKS5(conn net.Conn, cfg SOCKS5Config) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	user, err := s.socksAuthenticate(conn, cfg)
+	if err != nil {
+		s.log.Warn("SOCKS5 handshake failed", "err", err)
+		return
+	}
+	addr, code, err := socksReadRequest(conn)
+	if err != nil {
+		s.log.Warn("SOCKS5 request failed", "err", err)
+		socksReply(conn, code)
+		return
+	}
+	s.log.Debug("Received SOCKS5 CONNECT", "host", addr)
+
+	host, _, _ := net.SplitHostPort(addr)
+	if ok, reason := s.cfg.SNIPolicy.ACL.Check(host); !ok {
+		s.log.Info("Tunnel refused", "host", addr, "reason", reason)
+		socksReply(conn, socksNotAllowed)
+		return
+	}
+	if b := s.blocklist.Load(); b != nil && b.blocks(host) {
+		s.stats.Blocklisted.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), addr, AuditBlocklist, host)
+		socksReply(conn, socksNotAllowed)
+		return
+	}
+	if ok, reason := s.currentDestinationACL().Check(host); !ok {
+		s.stats.DestinationDenied.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), addr, AuditDestinationACL, reason)
+		s.log.Info("Destination refused", "host", addr, "reason", reason)
+		socksReply(conn, socksNotAllowed)
+		return
+	}
+	ctx := pinnedContext(context.Background())
+	if country, ok := s.destinationCountry(ctx, addr); !ok {
+		s.stats.GeoDenied.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), addr, AuditGeoIP, "destination country "+country)
+		s.log.Info("Destination refused", "host", addr, "country", country)
+		socksReply(conn, socksNotAllowed)
+		return
+	}
+
+	tenant := user
+	if tenant == "" {
+		tenant, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	// Rate limiting follows the toggles of the route a CONNECT to addr
+	// would take
+	connect := &http.Request{Method: http.MethodConnect, Host: addr, URL: &url.URL{Host: addr}, Header: http.Header{}, RemoteAddr: conn.RemoteAddr().String()}
+	limited := s.toggles.Enabled(ToggleRateLimiting, s.arrivalRoute(connect))
+	if l := s.limiter.Load(); l != nil && limited {
+		if ok, _ := l.Allow(tenant); !ok {
+			s.stats.RateLimited.Add(1)
+			s.auditConnection(conn.RemoteAddr().String(), addr, AuditRateLimit, "client "+tenant)
+			socksReply(conn, socksNotAllowed)
+			return
+		}
+	}
+	if s.egress != nil && limited {
+		if ok, _ := s.egress.Allow(tenant); !ok {
+			socksReply(conn, socksNotAllowed)
+			return
+		}
+	}
+	if s.workers != nil {
+		if !s.workers.Acquire(nil) {
+			s.stats.Rejected.Add(1)
+			socksReply(conn, socksGeneralFailure)
+			return
+		}
+		defer s.workers.Release()
+		s.stats.Active.Add(1)
+		defer s.stats.Active.Add(-1)
+	}
+
+	if err := s.checkSSRF(ctx, &url.URL{Scheme: "https", Host: addr}, nil); err != nil {
+		if !isSSRFError(err) {
+			s.log.Warn("SOCKS5 lookup failed", "host", host, "err", err)
+			socksReply(conn, socksHostUnreachable)
+			return
+		}
+		s.stats.InternalDenied.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), addr, AuditSSRF, err.Error())
+		s.log.Info("Destination refused", "reason", err)
+		socksReply(conn, socksNotAllowed)
+		return
+	}
+	upstream, err := s.dialTunnel(ctx, addr)
+	if err != nil {
+		s.log.Warn("SOCKS5 dial failed", "host", addr, "err", err)
+		socksReply(conn, socksHostUnreachable)
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		upstream.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	received := tunnel(conn, upstream)
+	if s.egress != nil {
+		s.egress.Charge(tenant, received)
+	}
+}
+
+// socksAuthenticate negotiates the authentication method and returns the
+// authenticated user name, if any. Username and password authentication is
+// required when the listener has its own credentials or the proxy
+// authenticates its clients.
+func (s *Server) socksAuthenticate(conn net.Conn, cfg SOCKS5Config) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socksAuthNone)
+	if cfg.Username != "" || s.proxyUsers != nil || s.proxyTokens != nil {
+		want = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthNoneUsable})
+		return "", errors.New("client offered no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", err
+	}
+	if want == socksAuthNone {
+		return "", nil
+	}
+
+	// Username/password sub-negotiation: VER ULEN UNAME PLEN PASSWD
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", err
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return "", err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", err
+	}
+	identity, ok := s.socksUser(cfg, string(user), string(pass))
+	if ver[0] != socksPasswordAuthVersion || !ok {
+		s.stats.ProxyAuthFailed.Add(1)
+		conn.Write([]byte{socksPasswordAuthVersion, 1})
+		return "", errors.New("invalid SOCKS5 credentials")
+	}
+	_, err := conn.Write([]byte{socksPasswordAuthVersion, 0})
+	return identity, err
+}
+
+// socksUser returns the identity of SOCKS5 credentials: the listener's own
+// user, a user of the proxy's users file, or the identity of a proxy token
+// sent as the password
+func (s *Server) socksUser(cfg SOCKS5Config, user, password string) (string, bool) {
+	switch {
+	case cfg.Username != "" && secretEqual(user, cfg.Username) && secretEqual(password, cfg.Password):
+		return user, true
+	case s.proxyUsers != nil && s.proxyUsers.verify(user, password):
+		return user, true
+	}
+	return s.proxyTokens.lookup(password)
+}
+
+// socksReadRequest reads a request and returns its destination, or the
+// reply code to refuse it with
+func socksReadRequest(conn net.Conn) (string, byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", socksGeneralFailure, err
+	}
+	if header[1] != socksCmdConnect {
+		return "", socksCmdNotSupported, fmt.Errorf("unsupported SOCKS5 command %d", header[1])
+	}
+
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6, socksAddrDomain:
+	default:
+		return "", socksAddrNotSupported, fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+	}
+	addr, err := readSOCKSAddr(conn, header[3])
+	if err != nil {
+		return "", socksGeneralFailure, err
+	}
+	return addr, 0, nil
+}
+
+// socksReply answers a request with code and an unspecified bound address
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// secretEqual compares credentials in constant time
+func secretEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
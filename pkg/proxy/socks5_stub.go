@@ -0,0 +1,12 @@
+//go:build minimal || nosocks
+
+package proxy
+
+import "net"
+
+// startSOCKS5 is never reached in builds without the SOCKS5 listener,
+// since requireSubsystem rejects the configuration first
+func (s *Server) startSOCKS5(cfg SOCKS5Config) {}
+
+// serveSOCKS5 is not reached either, for the same reason
+func (s *Server) serveSOCKS5(conn net.Conn, cfg SOCKS5Config) { conn.Close() }
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929
+const (
+	socksVersion        = 5
+	socksAuthNone       = 0
+	socksAuthPassword   = 2
+	socksAuthNoneUsable = 0xff
+	socksCmdConnect     = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksNotAllowed          = 2
+	socksHostUnreachable     = 4
+	socksCmdNotSupported     = 7
+	socksAddrNotSupported    = 8
+	socksHandshakeTimeout    = 30 * time.Second
+	socksPasswordAuthVersion = 1
+)
+
+// socksReplyErrors describe the failure codes of SOCKS5 replies
+var socksReplyErrors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// dialSOCKS5 opens a connection to addr through the SOCKS5 server via. The
+// socks5 scheme resolves addr locally; socks5h leaves it to the server, as
+// routing through Tor requires.
+func (s *Server) dialSOCKS5(ctx context.Context, via *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	if via.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].IP.String()
+	}
+
+	viaAddr := via.Host
+	if via.Port() == "" {
+		viaAddr = net.JoinHostPort(via.Hostname(), "1080")
+	}
+	conn, err := s.dialer.DialContext(ctx, "tcp", viaAddr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(socksHandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if err := socksConnect(conn, via.User, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", via.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socksConnect performs the client side of a SOCKS5 CONNECT on conn
+func socksConnect(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	method := byte(socksAuthNone)
+	if user != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion || choice[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == socksAuthPassword {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("credentials too long")
+		}
+		msg := []byte{socksPasswordAuthVersion, byte(len(user.Username()))}
+		msg = append(msg, user.Username()...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return err
+		}
+		if status[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socksSucceeded {
+		reason, ok := socksReplyErrors[reply[1]]
+		if !ok {
+			reason = "error " + strconv.Itoa(int(reply[1]))
+		}
+		return errors.New(reason)
+	}
+	_, err := readSOCKSAddr(conn, reply[3])
+	return err
+}
+
+// readSOCKSAddr reads an address of type atyp followed by a port
+func readSOCKSAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, 4)
+		if atyp == socksAddrIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", atyp)
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// SSRFConfig stops clients from using the proxy to reach internal networks:
+// destinations they choose that resolve to loopback, private, link-local,
+// carrier-grade NAT, 0.0.0.0/8 or cloud metadata addresses are refused. Reverse-proxy backends and other
+// configured upstreams are trusted and not checked.
+type SSRFConfig struct {
+	// Disabled turns the protection off
+	Disabled bool
+	// Allow lists internal destinations that may still be reached, as
+	// networks such as "10.1.2.0/24" or host patterns such as
+	// "*.internal.corp"
+	Allow []string
+}
+
+// metadataAddrs are cloud metadata services outside the private ranges
+var metadataAddrs = []netip.Addr{
+	netip.MustParseAddr("100.100.100.200"),
+}
+
+// internalNetworks are the internal ranges netip does not classify: carrier
+// grade NAT, which cloud providers use for internal services, and "this
+// network", which many systems route to the local host
+var internalNetworks = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("0.0.0.0/8"),
+}
+
+// ssrfGuard is the compiled SSRFConfig
+type ssrfGuard struct {
+	disabled bool
+	networks []netip.Prefix
+	hosts    []string
+}
+
+// compileSSRFGuard validates cfg
+func compileSSRFGuard(cfg SSRFConfig) (*ssrfGuard, error) {
+	g := &ssrfGuard{disabled: cfg.Disabled}
+	for _, allow := range cfg.Allow {
+		if prefix, err := netip.ParsePrefix(allow); err == nil {
+			g.networks = append(g.networks, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(allow); err == nil {
+			g.networks = append(g.networks, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if allow == "" {
+			return nil, errors.New("empty allow entry")
+		}
+		g.hosts = append(g.hosts, allow)
+	}
+	return g, nil
+}
+
+// privateAddressError reports a destination that resolves to an internal
+// address
+type privateAddressError struct {
+	host string
+	addr netip.Addr
+}
+
+func (e *privateAddressError) Error() string {
+	if e.host == e.addr.String() {
+		return "internal address " + e.host
+	}
+	return fmt.Sprintf("%s resolves to internal address %s", e.host, e.addr)
+}
+
+// internal reports whether addr belongs to a range clients may not reach
+func internal(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, metadata := range metadataAddrs {
+		if addr == metadata {
+			return true
+		}
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	// Link-local covers 169.254.169.254, the common metadata address
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsUnspecified()
+}
+
+// check resolves host with lookup, which goes through the request's DNS
+// pins so that the connection later uses the addresses checked here, and
+// returns a privateAddressError when any of them is internal and not
+// allowed. A failed lookup is returned as is.
+func (g *ssrfGuard) check(ctx context.Context, host string, lookup func(context.Context, string) ([]net.IPAddr, error)) error {
+	if g.disabled {
+		return nil
+	}
+	for _, pattern := range g.hosts {
+		if utils.MatchHost(pattern, host) {
+			return nil
+		}
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ipAddr := range addrs {
+		addr, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok || !internal(addr) || g.allows(addr.Unmap()) {
+			continue
+		}
+		return &privateAddressError{host: host, addr: addr.Unmap()}
+	}
+	return nil
+}
+
+// allows reports whether addr is in an allowed network
+func (g *ssrfGuard) allows(addr netip.Addr) bool {
+	for _, network := range g.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSSRF applies the SSRF guard to target, which rt carries requests to,
+// or dialTunnel connects to when rt is nil. A name the guard cannot resolve
+// is refused when the proxy dials it: nothing is pinned then, and the dial
+// would resolve it afresh without a check. A parent proxy, or a transport
+// the application gave, resolves the name itself otherwise.
+func (s *Server) checkSSRF(ctx context.Context, target *url.URL, rt http.RoundTripper) error {
+	err := s.ssrf.check(ctx, target.Hostname(), s.lookupPinned)
+	if err == nil || isSSRFError(err) {
+		return err
+	}
+	if via, _ := s.parentProxy(target); via != nil {
+		return nil
+	}
+	if rt != nil && !dialsDestinations(rt) {
+		return nil
+	}
+	return err
+}
+
+// dialsDestinations reports whether rt reaches origins through the dialer
+// of its server
+func dialsDestinations(rt http.RoundTripper) bool {
+	switch t := rt.(type) {
+	case hostTransport:
+		return true
+	case *tapeTransport:
+		return t.Mode == TapeRecord && dialsDestinations(t.next)
+	}
+	return false
+}
+
+// ssrfGuardedKey marks the context of a request to a client-chosen
+// destination, whose redirects are checked too
+type ssrfGuardedKey struct{}
+
+// withSSRFGuard marks ctx as carrying a request to a client-chosen
+// destination
+func withSSRFGuard(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ssrfGuardedKey{}, true)
+}
+
+// checkRedirect stops redirect chains after 10 hops, as http.Client does by
+// default, refuses plaintext hops the scheme policy forbids and applies the
+// SSRF guard to every hop of guarded requests
+func (s *Server) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if err := s.checkRedirectScheme(req); err != nil {
+		return err
+	}
+	if guarded, _ := req.Context().Value(ssrfGuardedKey{}).(bool); guarded {
+		return s.checkSSRF(req.Context(), req.URL, s.upstream.Transport)
+	}
+	return nil
+}
+
+// isSSRFError reports whether err comes from the SSRF guard
+func isSSRFError(err error) bool {
+	var private *privateAddressError
+	return errors.As(err, &private)
+}
+
+// refuseInternal answers 403 for a destination refused by the SSRF guard,
+// or as an upstream failure when the guard could not resolve it
+func (s *Server) refuseInternal(w http.ResponseWriter, r *http.Request, err error) {
+	var private *privateAddressError
+	if !errors.As(err, &private) {
+		s.upstreamError(w, r, err)
+		return
+	}
+	s.stats.InternalDenied.Add(1)
+	s.auditRequest(r, AuditSSRF, private.Error(), http.StatusForbidden)
+	s.log.InfoContext(r.Context(), "Destination refused", "reason", private.Error())
+	w.Header().Set(denyReasonHeader, private.Error())
+	s.httpError(w, r, "Destination not allowed", http.StatusForbidden)
+}
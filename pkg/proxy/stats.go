@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats holds the proxy's operational counters
+type Stats struct {
+	// LengthMismatches counts upstream bodies that disagreed with their
+	// Content-Length header
+	LengthMismatches atomic.Int64
+	// Connections is the number of client connections open on the proxy
+	// listeners
+	Connections atomic.Int64
+	// InFlight is the number of requests being served, tunnels included
+	InFlight atomic.Int64
+	// Active is the number of requests holding a worker
+	Active atomic.Int64
+	// QueueDepth is the number of requests waiting for a worker
+	QueueDepth atomic.Int64
+	// Rejected counts requests refused because the worker pool was saturated
+	Rejected atomic.Int64
+	// ContentTypeBlocked counts responses outside a route's content types
+	ContentTypeBlocked atomic.Int64
+	// ContentBlocked counts responses refused by the content filter
+	ContentBlocked atomic.Int64
+	// ICAPModified counts messages modified or answered by ICAP services
+	ICAPModified atomic.Int64
+	// ICAPErrors counts failed ICAP exchanges
+	ICAPErrors atomic.Int64
+	// Retries counts upstream attempts repeated under a retry policy
+	Retries atomic.Int64
+	// LimitRejected counts requests refused for exceeding request limits
+	LimitRejected atomic.Int64
+	// BreakerRejected counts requests failed fast by an open circuit
+	BreakerRejected atomic.Int64
+	// DestinationDenied counts requests refused by the destination ACL
+	DestinationDenied atomic.Int64
+	// InternalDenied counts requests refused for reaching internal addresses
+	InternalDenied atomic.Int64
+	// ClientDenied counts connections refused by the client ACLs
+	ClientDenied atomic.Int64
+	// Blocklisted counts requests and tunnels to blocklisted hosts
+	Blocklisted atomic.Int64
+	// GeoDenied counts requests refused for their client or destination
+	// country
+	GeoDenied atomic.Int64
+	// RateLimited counts requests refused for exceeding the client rate
+	RateLimited atomic.Int64
+	// Shed counts requests refused by the global load caps
+	Shed atomic.Int64
+	// PlaintextRefused counts requests refused by the scheme policy
+	PlaintextRefused atomic.Int64
+	// UpstreamErrors counts failed exchanges with upstreams
+	UpstreamErrors atomic.Int64
+	// PinMismatches counts upstream TLS connections refused by their pins
+	PinMismatches atomic.Int64
+	// Rewrites counts requests rewritten or redirected by rewrite rules
+	Rewrites atomic.Int64
+	// Transformed counts responses modified by transform rules
+	Transformed atomic.Int64
+	// Panics counts recovered panics in request handlers and background work
+	Panics atomic.Int64
+	// ProxyAuthFailed counts requests refused for missing or invalid proxy
+	// credentials
+	ProxyAuthFailed atomic.Int64
+	// ResponsesTooLarge counts responses refused or cut off for exceeding
+	// the response size limit
+	ResponsesTooLarge atomic.Int64
+	// Shadowed counts requests mirrored to shadow backends, and
+	// ShadowDropped those not mirrored for too many in flight
+	Shadowed      atomic.Int64
+	ShadowDropped atomic.Int64
+	// DNSHits, DNSMisses and DNSNegativeHits count DNS cache lookups
+	DNSHits         atomic.Int64
+	DNSMisses       atomic.Int64
+	DNSNegativeHits atomic.Int64
+
+	// origins breaks cache effectiveness down by origin host
+	origins originTable
+	// countries counts requests by client country when GeoIP is enabled
+	countries countryTable
+	// classes breaks requests down by traffic class
+	classes classTable
+	// errors keeps the latest failed requests for the dashboard
+	errors errorRing
+	// errorCodes counts error responses by error code
+	errorCodes codeTable
+	// cache is the memory cache whose storage snapshots report, if any
+	cache *LRUCache
+}
+
+// StatsSnapshot is a point-in-time copy of Stats
+type StatsSnapshot struct {
+	LengthMismatches   int64 `json:"length_mismatches"`
+	Connections        int64 `json:"connections"`
+	InFlight           int64 `json:"in_flight"`
+	Active             int64 `json:"active"`
+	QueueDepth         int64 `json:"queue_depth"`
+	Rejected           int64 `json:"rejected"`
+	ContentTypeBlocked int64 `json:"content_type_blocked"`
+	ContentBlocked     int64 `json:"content_blocked"`
+	ICAPModified       int64 `json:"icap_modified"`
+	ICAPErrors         int64 `json:"icap_errors"`
+	Retries            int64 `json:"retries"`
+	LimitRejected      int64 `json:"limit_rejected"`
+	BreakerRejected    int64 `json:"breaker_rejected"`
+	ResponsesTooLarge  int64 `json:"responses_too_large"`
+	DestinationDenied  int64 `json:"destination_denied"`
+	InternalDenied     int64 `json:"internal_denied"`
+	ClientDenied       int64 `json:"client_denied"`
+	Blocklisted        int64 `json:"blocklisted"`
+	GeoDenied          int64 `json:"geo_denied"`
+	RateLimited        int64 `json:"rate_limited"`
+	Shed               int64 `json:"shed"`
+	PlaintextRefused   int64 `json:"plaintext_refused"`
+	UpstreamErrors     int64 `json:"upstream_errors"`
+	PinMismatches      int64 `json:"pin_mismatches"`
+	Rewrites           int64 `json:"rewrites"`
+	Transformed        int64 `json:"transformed"`
+	Panics             int64 `json:"panics"`
+	ProxyAuthFailed    int64 `json:"proxy_auth_failed"`
+	Shadowed           int64 `json:"shadowed"`
+	ShadowDropped      int64 `json:"shadow_dropped"`
+	DNSHits            int64 `json:"dns_hits"`
+	DNSMisses          int64 `json:"dns_misses"`
+	DNSNegativeHits    int64 `json:"dns_negative_hits"`
+	// Cache describes the memory held by the cache
+	Cache CacheStorage `json:"cache"`
+	// Origins holds cache statistics by origin host
+	Origins map[string]OriginStats `json:"origins,omitempty"`
+	// Countries counts requests by client country code
+	Countries map[string]int64 `json:"countries,omitempty"`
+	// Classes holds request statistics by traffic class
+	Classes map[string]ClassStats `json:"classes,omitempty"`
+	// Errors counts error responses by error code
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+// Snapshot returns the current counter values
+func (s *Stats) Snapshot() StatsSnapshot {
+	var storage CacheStorage
+	if s.cache != nil {
+		storage = s.cache.Storage()
+	}
+	return StatsSnapshot{
+		LengthMismatches:   s.LengthMismatches.Load(),
+		Connections:        s.Connections.Load(),
+		InFlight:           s.InFlight.Load(),
+		Active:             s.Active.Load(),
+		QueueDepth:         s.QueueDepth.Load(),
+		Rejected:           s.Rejected.Load(),
+		ContentTypeBlocked: s.ContentTypeBlocked.Load(),
+		ContentBlocked:     s.ContentBlocked.Load(),
+		ICAPModified:       s.ICAPModified.Load(),
+		ICAPErrors:         s.ICAPErrors.Load(),
+		Retries:            s.Retries.Load(),
+		LimitRejected:      s.LimitRejected.Load(),
+		BreakerRejected:    s.BreakerRejected.Load(),
+		ResponsesTooLarge:  s.ResponsesTooLarge.Load(),
+		DestinationDenied:  s.DestinationDenied.Load(),
+		InternalDenied:     s.InternalDenied.Load(),
+		ClientDenied:       s.ClientDenied.Load(),
+		Blocklisted:        s.Blocklisted.Load(),
+		GeoDenied:          s.GeoDenied.Load(),
+		RateLimited:        s.RateLimited.Load(),
+		Shed:               s.Shed.Load(),
+		PlaintextRefused:   s.PlaintextRefused.Load(),
+		UpstreamErrors:     s.UpstreamErrors.Load(),
+		PinMismatches:      s.PinMismatches.Load(),
+		Rewrites:           s.Rewrites.Load(),
+		Transformed:        s.Transformed.Load(),
+		Panics:             s.Panics.Load(),
+		ProxyAuthFailed:    s.ProxyAuthFailed.Load(),
+		Shadowed:           s.Shadowed.Load(),
+		ShadowDropped:      s.ShadowDropped.Load(),
+		DNSHits:            s.DNSHits.Load(),
+		DNSMisses:          s.DNSMisses.Load(),
+		DNSNegativeHits:    s.DNSNegativeHits.Load(),
+		Cache:              storage,
+		Origins:            s.origins.snapshot(),
+		Countries:          s.countries.snapshot(),
+		Classes:            s.classes.snapshot(),
+		Errors:             s.errorCodes.snapshot(),
+	}
+}
+
+// trafficTotals sums the per-class and per-origin breakdowns
+type trafficTotals struct {
+	requests, clientErrors, serverErrors, bytes int64
+	cacheHits, cacheMisses                      int64
+}
+
+// totals sums the breakdowns of s
+func (s *Stats) totals() trafficTotals {
+	var t trafficTotals
+	for _, c := range s.classes.snapshot() {
+		t.requests += c.Requests
+		t.clientErrors += c.ClientErrors
+		t.serverErrors += c.ServerErrors
+		t.bytes += c.Bytes
+	}
+	for _, o := range s.origins.snapshot() {
+		t.cacheHits += o.Hits
+		t.cacheMisses += o.Misses
+	}
+	return t
+}
+
+// Counters returns the numeric fields of the snapshot keyed by their JSON name
+func (s StatsSnapshot) Counters() map[string]int64 {
+	data, _ := json.Marshal(s)
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+
+	counters := make(map[string]int64)
+	for name, value := range fields {
+		if n, ok := value.(float64); ok {
+			counters[name] = int64(n)
+		}
+	}
+	return counters
+}
+
+// handleStats reports the proxy counters
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.stats.Snapshot())
+}
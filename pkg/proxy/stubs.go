@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// StubRule answers matching requests with a canned response instead of
+// fetching them, in forward and reverse mode alike: to test clients
+// against responses upstreams do not give, or to keep answering for a
+// decommissioned endpoint. Stubs apply after a route's terminate rules and
+// before the cache.
+type StubRule struct {
+	// Name identifies the rule in logs and the admin API
+	Name string `json:"name"`
+	// Methods restricts the rule to these methods; empty matches any
+	Methods []string `json:"methods,omitempty"`
+	// Host is a host pattern such as api.example.com or *.example.com;
+	// empty matches any host
+	Host string `json:"host,omitempty"`
+	// Path is a path.Match pattern as for terminate rules; empty matches
+	// any path
+	Path string `json:"path,omitempty"`
+	// Status defaults to 200
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is a text/template executed with StubData
+	Body string `json:"body,omitempty"`
+
+	tmpl *template.Template
+	hits *atomic.Int64
+}
+
+// StubData is the data available to stub body templates
+type StubData struct {
+	Method string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Client string
+	Now    time.Time
+}
+
+// compileStubs validates rules and parses their body templates
+func compileStubs(rules []StubRule) ([]StubRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	out := make([]StubRule, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("stub %d has no name", i)
+		}
+		if err := checkPathPattern(rule.Path); err != nil {
+			return nil, fmt.Errorf("stub %q: %w", rule.Name, err)
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusOK
+		}
+		if rule.Status < 200 || rule.Status > 599 {
+			return nil, fmt.Errorf("stub %q: invalid status %d", rule.Name, rule.Status)
+		}
+		tmpl, err := template.New(rule.Name).Funcs(endpointFuncs).Parse(rule.Body)
+		if err != nil {
+			return nil, fmt.Errorf("stub %q: %w", rule.Name, err)
+		}
+		rule.tmpl = tmpl
+		rule.hits = new(atomic.Int64)
+		out[i] = rule
+	}
+	return out, nil
+}
+
+// matches reports whether r, whose host is host, falls under the rule
+func (rule *StubRule) matches(r *http.Request, host string) bool {
+	return matchRequest(r, host, rule.Methods, rule.Host, rule.Path)
+}
+
+// matchRequest reports whether r, whose host is host, has one of methods
+// and matches the host and path patterns; empty ones match any request
+func matchRequest(r *http.Request, host string, methods []string, hostPattern, pathPattern string) bool {
+	if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+		return false
+	}
+	if hostPattern != "" && !utils.MatchHost(hostPattern, host) {
+		return false
+	}
+	return pathPattern == "" || matchPathPattern(pathPattern, r.URL.Path)
+}
+
+// checkPathPattern validates a pattern for matchPathPattern, which may be
+// empty
+func checkPathPattern(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("path %q must start with /", pattern)
+	}
+	_, err := path.Match(strings.TrimSuffix(pattern, "/**"), "/")
+	return err
+}
+
+// serveStub answers r with the first stub that matches it, reporting
+// whether one did. Stubs match the host and path the client asked for,
+// not those of the backend of a route.
+func (s *Server) serveStub(w http.ResponseWriter, r *http.Request) bool {
+	host := utils.StripPort(r.Host)
+	for i := range s.stubs {
+		rule := &s.stubs[i]
+		if !rule.matches(r, host) {
+			continue
+		}
+		rule.hits.Add(1)
+		var body bytes.Buffer
+		err := rule.tmpl.Execute(&body, StubData{
+			Method: r.Method,
+			Host:   host,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Header: r.Header,
+			Client: clientIP(r),
+			Now:    time.Now(),
+		})
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "Stub template failed", "stub", rule.Name, "err", err)
+			s.httpError(w, r, "Stub template failed", http.StatusInternalServerError)
+			return true
+		}
+		s.log.DebugContext(r.Context(), "Answered by stub", "stub", rule.Name, "path", r.URL.Path)
+		for name, value := range rule.Headers {
+			w.Header().Set(name, value)
+		}
+		if body.Len() > 0 && w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.WriteHeader(rule.Status)
+		if r.Method != http.MethodHead {
+			w.Write(body.Bytes())
+		}
+		return true
+	}
+	return false
+}
+
+// StubStatus reports how often a stub answered
+type StubStatus struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Hits   int64  `json:"hits"`
+}
+
+// handleStubs reports the stubs
+func (s *Server) handleStubs(w http.ResponseWriter, r *http.Request) {
+	out := []StubStatus{}
+	for _, rule := range s.stubs {
+		out = append(out, StubStatus{Name: rule.Name, Status: rule.Status, Hits: rule.hits.Load()})
+	}
+	writeJSON(w, out)
+}
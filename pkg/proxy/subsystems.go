@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Optional subsystems live in files behind build tags so that a minimal
+// binary can leave them out. Build with -tags minimal to drop all of them,
+// or with a single nomitm, nogrpc, nosocks or noplugins tag to drop one.
+// Each subsystem registers itself from an init function when it is
+// compiled in.
+//
+// The proxy has no Lua, WASM or Redis integration to gate: scripting uses
+// the built-in expression language of internal/expr, and all state is kept
+// in process. HTTP/3 is the one subsystem that is opt in, as http3, since it
+// needs quic-go: build with -tags quic to add it.
+
+// subsystems holds the names of the compiled-in optional subsystems
+var subsystems = make(map[string]bool)
+
+// registerSubsystem marks an optional subsystem as compiled in
+func registerSubsystem(name string) {
+	subsystems[name] = true
+}
+
+// Subsystems returns the names of the optional subsystems compiled into the
+// binary
+func Subsystems() []string {
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requireSubsystem returns an error when the configuration uses a
+// subsystem that was left out of the build
+func requireSubsystem(name string) error {
+	if !subsystems[name] {
+		return fmt.Errorf("subsystem %s is enabled in the configuration but not compiled into this binary", name)
+	}
+	return nil
+}
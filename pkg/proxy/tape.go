@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record-and-replay modes
+const (
+	// TapeRecord relays upstream responses and saves each exchange
+	TapeRecord = "record"
+	// TapeReplay answers from the saved exchanges without contacting
+	// upstreams
+	TapeReplay = "replay"
+)
+
+// TapeConfig records upstream exchanges to a directory and replays them,
+// so integration tests and demos can run offline against captured traffic.
+// Exchanges are matched by method, URL and request body; recording a
+// request again replaces the earlier exchange. The proxy's own requests,
+// such as health checks and prefetches, are recorded and replayed too.
+type TapeConfig struct {
+	// Mode is TapeRecord or TapeReplay; empty sends requests upstream as
+	// usual
+	Mode string
+	// Dir holds the exchanges, one JSON file each
+	Dir string
+	// MaxBodyBytes bounds the request and response bodies recorded, 10 MiB
+	// by default; exchanges with larger ones are relayed unrecorded
+	MaxBodyBytes int64
+}
+
+// TapeEntry is a recorded exchange
+type TapeEntry struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	RequestBody []byte      `json:"request_body,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	Recorded    time.Time   `json:"recorded"`
+}
+
+// tapeTransport records or replays the exchanges of the transport it wraps
+type tapeTransport struct {
+	TapeConfig
+	next http.RoundTripper
+	log  *slog.Logger
+}
+
+// newTapeTransport validates cfg and returns next wrapped to record or
+// replay its exchanges
+func newTapeTransport(cfg TapeConfig, next http.RoundTripper) (*tapeTransport, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("a directory is required")
+	}
+	if cfg.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("negative body limit")
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = 10 << 20
+	}
+	switch cfg.Mode {
+	case TapeRecord:
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+	case TapeReplay:
+		if _, err := os.Stat(cfg.Dir); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	return &tapeTransport{TapeConfig: cfg, next: next}, nil
+}
+
+// path returns the file of the exchange of req, whose body is body
+func (t *tapeTransport) path(req *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, req.Method+"\x00"+req.URL.String()+"\x00")
+	h.Write(body)
+	return filepath.Join(t.Dir, hex.EncodeToString(h.Sum(nil)[:16])+".json")
+}
+
+// readBody reads the body of req, which is restored for the upstream,
+// reporting false when it is over the limit
+func (t *tapeTransport) readBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, t.MaxBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > t.MaxBodyBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+func (t *tapeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, fits, err := t.readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.Mode == TapeReplay {
+		if !fits {
+			return nil, fmt.Errorf("no recorded response to %s %s: body over the limit", req.Method, req.URL)
+		}
+		return t.replay(req, t.path(req, body))
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !fits {
+		return resp, err
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, t.MaxBodyBytes+1))
+	if err != nil || int64(len(respBody)) > t.MaxBodyBytes {
+		// What was read is still relayed, and the client sees the error
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(respBody), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	entry := TapeEntry{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		RequestBody: body,
+		Status:      resp.StatusCode,
+		Header:      resp.Header,
+		Body:        respBody,
+		Recorded:    time.Now(),
+	}
+	if err := t.save(t.path(req, body), entry); err != nil {
+		t.log.WarnContext(req.Context(), "Error recording exchange", "url", entry.URL, "err", err)
+	}
+	return resp, nil
+}
+
+// save writes entry to path
+func (t *tapeTransport) save(path string, entry TapeEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// replay answers req with the exchange recorded at path
+func (t *tapeTransport) replay(req *http.Request, path string) (*http.Response, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no recorded response to %s %s", req.Method, req.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry TapeEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+)
+
+// tenantOf identifies the tenant a request is accounted to: the identity
+// the client authenticated as, else the value of the configured tenant
+// header, else the client certificate subject, else the client IP
+func (s *Server) tenantOf(r *http.Request) string {
+	if user, ok := Annotation(r, ProxyUserAnnotation); ok {
+		return user
+	}
+	if s.cfg.TenantHeader != "" {
+		if tenant := r.Header.Get(s.cfg.TenantHeader); tenant != "" {
+			return tenant
+		}
+	}
+	if subject := clientSubject(r); subject != "" {
+		return subject
+	}
+	return clientIP(r)
+}
+
+// clientIP returns the IP address of the connecting client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// peerCert returns the client certificate presented on the connection, if any
+func peerCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// clientSubject returns the subject of the verified client certificate, or
+// an empty string when the client presented none
+func clientSubject(r *http.Request) string {
+	if cert := peerCert(r); cert != nil {
+		return cert.Subject.String()
+	}
+	return ""
+}
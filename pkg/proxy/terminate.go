@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// TerminateRule answers matching requests on a route at once, without
+// consulting the cache or the upstream, e.g. 404 for /wp-login.php probes
+// or 410 for a retired API
+type TerminateRule struct {
+	// Name identifies the rule in the admin API
+	Name string `json:"name"`
+	// Path is a path.Match pattern such as /wp-login.php or /api/v1/*; a
+	// pattern ending in /** matches everything below its prefix
+	Path string `json:"path"`
+	// Methods restricts the rule to these methods; empty matches any
+	Methods []string `json:"methods,omitempty"`
+	// Status defaults to 403
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+
+	hits *atomic.Int64
+}
+
+// compileTerminateRules validates rules and gives each its counter
+func compileTerminateRules(rules []TerminateRule) ([]TerminateRule, error) {
+	out := make([]TerminateRule, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("terminate rule %d has no name", i)
+		}
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("terminate rule %q: path %q must start with /", rule.Name, rule.Path)
+		}
+		if _, err := path.Match(strings.TrimSuffix(rule.Path, "/**"), "/"); err != nil {
+			return nil, fmt.Errorf("terminate rule %q: %w", rule.Name, err)
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusForbidden
+		}
+		if rule.Status < 200 || rule.Status > 599 {
+			return nil, fmt.Errorf("terminate rule %q: invalid status %d", rule.Name, rule.Status)
+		}
+		rule.hits = new(atomic.Int64)
+		out[i] = rule
+	}
+	return out, nil
+}
+
+// matches reports whether r falls under the rule
+func (rule *TerminateRule) matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	return matchPathPattern(rule.Path, r.URL.Path)
+}
+
+// matchPathPattern reports whether p matches pattern, a path.Match pattern
+// or a prefix ending in /** that matches everything below it
+func matchPathPattern(pattern, p string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+// terminateEarly answers r with the first of the route's rules that
+// matches it, reporting whether one did
+func (s *Server) terminateEarly(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if route == nil {
+		return false
+	}
+	for i := range route.Terminate {
+		rule := &route.Terminate[i]
+		if !rule.matches(r) {
+			continue
+		}
+		rule.hits.Add(1)
+		s.log.InfoContext(r.Context(), "Terminated by rule", "rule", rule.Name, "path", r.URL.Path)
+		for name, value := range rule.Headers {
+			w.Header().Set(name, value)
+		}
+		if rule.Body != "" && w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(rule.Status)
+		if r.Method != http.MethodHead {
+			w.Write([]byte(rule.Body))
+		}
+		return true
+	}
+	return false
+}
+
+// TerminateStatus reports how often a terminate rule answered
+type TerminateStatus struct {
+	Route  string `json:"route"`
+	Rule   string `json:"rule"`
+	Status int    `json:"status"`
+	Hits   int64  `json:"hits"`
+}
+
+// handleTerminations reports the terminate rules of every route
+func (s *Server) handleTerminations(w http.ResponseWriter, r *http.Request) {
+	out := []TerminateStatus{}
+	for _, route := range s.routes.Load().Routes() {
+		for _, rule := range route.Terminate {
+			out = append(out, TerminateStatus{Route: route.Name, Rule: rule.Name, Status: rule.Status, Hits: rule.hits.Load()})
+		}
+	}
+	writeJSON(w, out)
+}
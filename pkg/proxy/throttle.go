@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig limits bandwidth in bytes per second on the HTTP and SOCKS5
+// client connections, tunnels included, so one bulk transfer can't saturate
+// the shared uplink. Download is what the proxy sends to clients, upload what
+// it receives from them; zero leaves a limit off.
+type ThrottleConfig struct {
+	// ConnectionDownload and ConnectionUpload limit each connection
+	ConnectionDownload int64
+	ConnectionUpload   int64
+	// ClientDownload and ClientUpload are shared by all connections from
+	// one client IP
+	ClientDownload int64
+	ClientUpload   int64
+}
+
+// Enabled reports whether any limit is set
+func (cfg ThrottleConfig) Enabled() bool {
+	return cfg.ConnectionDownload > 0 || cfg.ConnectionUpload > 0 || cfg.ClientDownload > 0 || cfg.ClientUpload > 0
+}
+
+// throttleChunk bounds the bytes moved between waits, so throttled
+// transfers flow steadily instead of in bursts
+const throttleChunk = 16 << 10
+
+// newRateBucket returns a bucket for bytesPerSec holding one second's worth,
+// or nil for no limit
+func newRateBucket(bytesPerSec int64) *TokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return NewTokenBucket(float64(bytesPerSec), float64(bytesPerSec))
+}
+
+// clientBandwidth is the shared budget of one client's connections
+type clientBandwidth struct {
+	down, up *TokenBucket
+	conns    int
+}
+
+// bandwidthTable tracks the clients with open throttled connections
+type bandwidthTable struct {
+	mu      sync.Mutex
+	clients map[netip.Addr]*clientBandwidth
+}
+
+// acquire returns the budget of client, counting one more connection
+func (t *bandwidthTable) acquire(client netip.Addr, cfg ThrottleConfig) *clientBandwidth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, found := t.clients[client]
+	if !found {
+		c = &clientBandwidth{down: newRateBucket(cfg.ClientDownload), up: newRateBucket(cfg.ClientUpload)}
+		t.clients[client] = c
+	}
+	c.conns++
+	return c
+}
+
+// release forgets client once its last connection closes
+func (t *bandwidthTable) release(client netip.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.clients[client]; c != nil {
+		if c.conns--; c.conns == 0 {
+			delete(t.clients, client)
+		}
+	}
+}
+
+// throttleListener applies the configured bandwidth limits to the
+// connections ln accepts
+func (s *Server) throttleListener(ln net.Listener) net.Listener {
+	if !s.cfg.Throttle.Enabled() {
+		return ln
+	}
+	return &throttledListener{Listener: ln, cfg: s.cfg.Throttle, bandwidth: s.bandwidth}
+}
+
+type throttledListener struct {
+	net.Listener
+	cfg       ThrottleConfig
+	bandwidth *bandwidthTable
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &throttledConn{
+		Conn: conn,
+		down: newRateBucket(l.cfg.ConnectionDownload),
+		up:   newRateBucket(l.cfg.ConnectionUpload),
+	}
+	if peer, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		tc.client = peer.Addr().Unmap()
+		tc.bandwidth = l.bandwidth
+		tc.shared = l.bandwidth.acquire(tc.client, l.cfg)
+	}
+	return tc, nil
+}
+
+// throttledConn waits out its own and its client's budgets after every
+// chunk it reads or writes
+type throttledConn struct {
+	net.Conn
+	down, up  *TokenBucket
+	client    netip.Addr
+	bandwidth *bandwidthTable
+	shared    *clientBandwidth
+	closeOnce sync.Once
+}
+
+// pace charges n bytes to the buckets and sleeps until neither is in debt
+func pace(n int, buckets ...*TokenBucket) {
+	var wait time.Duration
+	for _, b := range buckets {
+		if b != nil {
+			b.Charge(float64(n))
+			wait = max(wait, b.Wait(0))
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// sharedBucket returns the client's bucket for one direction
+func (c *throttledConn) sharedBucket(download bool) *TokenBucket {
+	switch {
+	case c.shared == nil:
+		return nil
+	case download:
+		return c.shared.down
+	}
+	return c.shared.up
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		pace(n, c.up, c.sharedBucket(false))
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if n > 0 {
+			pace(n, c.down, c.sharedBucket(true))
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.shared != nil {
+			c.bandwidth.release(c.client)
+		}
+	})
+	return c.Conn.Close()
+}
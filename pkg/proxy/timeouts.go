@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// PhaseTimeouts bound the phases of an upstream exchange. Zero fields fall
+// back to the next broader setting: a route's to its host's, a host's to
+// the global TransportConfig, which sets no Total.
+type PhaseTimeouts struct {
+	// Dial bounds establishing the TCP connection
+	Dial time.Duration `json:"dial,omitempty"`
+	// TLSHandshake bounds the TLS handshake with the origin
+	TLSHandshake time.Duration `json:"tls_handshake,omitempty"`
+	// ResponseHeader bounds the wait for response headers after the
+	// request is written
+	ResponseHeader time.Duration `json:"response_header,omitempty"`
+	// BodyIdle bounds the wait for each read of the response body
+	BodyIdle time.Duration `json:"body_idle,omitempty"`
+	// Total bounds the whole exchange, including the body; zero means no
+	// limit, leaving long downloads to BodyIdle
+	Total time.Duration `json:"total,omitempty"`
+}
+
+// HostTimeouts sets the phase timeouts of upstream hosts matching Host
+type HostTimeouts struct {
+	Host string
+	PhaseTimeouts
+}
+
+// over returns t with the non-zero fields of o replacing its own
+func (t PhaseTimeouts) over(o PhaseTimeouts) PhaseTimeouts {
+	for _, f := range []struct{ dst, src *time.Duration }{
+		{&t.Dial, &o.Dial},
+		{&t.TLSHandshake, &o.TLSHandshake},
+		{&t.ResponseHeader, &o.ResponseHeader},
+		{&t.BodyIdle, &o.BodyIdle},
+		{&t.Total, &o.Total},
+	} {
+		if *f.src > 0 {
+			*f.dst = *f.src
+		}
+	}
+	return t
+}
+
+// phaseTimeoutsFor resolves the timeouts of a request to host under route
+func (s *Server) phaseTimeoutsFor(route *Route, host string) PhaseTimeouts {
+	cfg := s.cfg.Transport
+	t := PhaseTimeouts{
+		Dial:           cfg.DialTimeout,
+		TLSHandshake:   cfg.TLSHandshakeTimeout,
+		ResponseHeader: cfg.ResponseHeaderTimeout,
+		BodyIdle:       cfg.BodyIdleTimeout,
+	}
+	for _, h := range s.cfg.HostTimeouts {
+		if utils.MatchHost(h.Host, host) {
+			t = t.over(h.PhaseTimeouts)
+			break
+		}
+	}
+	if route != nil && route.Timeouts != nil {
+		t = t.over(*route.Timeouts)
+	}
+	return t
+}
+
+type phaseTimeoutsKey struct{}
+
+// withPhaseTimeouts returns req carrying the timeouts sendUpstream applies
+func withPhaseTimeouts(req *http.Request, t PhaseTimeouts) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), phaseTimeoutsKey{}, t))
+}
+
+// phaseTimeoutsOf returns the timeouts carried by ctx, or the global ones
+func (s *Server) phaseTimeoutsOf(ctx context.Context) PhaseTimeouts {
+	if t, ok := ctx.Value(phaseTimeoutsKey{}).(PhaseTimeouts); ok {
+		return t
+	}
+	return s.phaseTimeoutsFor(nil, "")
+}
+
+// phaseError reports the phase that timed out
+type phaseError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *phaseError) Error() string {
+	return fmt.Sprintf("upstream %s timed out after %v", e.phase, e.timeout)
+}
+
+// phaseTimer cancels an exchange when the phase it is timing overruns
+type phaseTimer struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+}
+
+func (p *phaseTimer) start(phase string, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(timeout, func() { p.cancel(&phaseError{phase, timeout}) })
+}
+
+func (p *phaseTimer) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// sendUpstream sends req, enforcing the phase timeouts it carries and
+// Transport.RequestTimeout until the response headers arrive. Dial timeouts
+// are applied by dialPinned.
+func (s *Server) sendUpstream(req *http.Request) (*http.Response, error) {
+	t := s.phaseTimeoutsOf(req.Context())
+	ctx, cancel := context.WithCancelCause(req.Context())
+	var total *time.Timer
+	if t.Total > 0 {
+		total = time.AfterFunc(t.Total, func() { cancel(&phaseError{"request", t.Total}) })
+	}
+	phase := &phaseTimer{cancel: cancel}
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart:    func() { phase.start("TLS handshake", t.TLSHandshake) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { phase.stop() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { phase.start("response header", t.ResponseHeader) },
+		GotFirstResponseByte: func() { phase.stop() },
+	}
+
+	var headers *time.Timer
+	if d := s.cfg.Transport.RequestTimeout; d > 0 {
+		headers = time.AfterFunc(d, func() { cancel(&phaseError{"request", d}) })
+	}
+
+	resp, err := s.upstream.Do(req.Clone(httptrace.WithClientTrace(ctx, trace)))
+	phase.stop()
+	if headers != nil {
+		headers.Stop()
+	}
+	release := func() {
+		if total != nil {
+			total.Stop()
+		}
+		cancel(nil)
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); ctx.Err() != nil && cause != ctx.Err() {
+			err = fmt.Errorf("%s: %w", req.URL, cause)
+		}
+		release()
+		return nil, err
+	}
+	resp.Body = &phasedBody{ReadCloser: resp.Body, ctx: ctx, phase: phase, idle: t.BodyIdle, release: release}
+	return resp, nil
+}
+
+// phasedBody times each read of a response body and releases the
+// exchange's timers once the body is closed
+type phasedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	phase   *phaseTimer
+	idle    time.Duration
+	release func()
+}
+
+func (b *phasedBody) Read(p []byte) (int, error) {
+	b.phase.start("body read", b.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.phase.stop()
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		if cause := context.Cause(b.ctx); cause != b.ctx.Err() {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *phasedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
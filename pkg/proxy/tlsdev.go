@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// selfSignedValidity is how long a generated development certificate lasts
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// ensureSelfSigned writes a self-signed certificate for local development to
+// the configured TLS files unless they already exist, defaulting the paths
+// to the temp directory. Existing files are reused so clients that trusted
+// the certificate keep trusting it across restarts.
+func (s *Server) ensureSelfSigned() error {
+	if s.cfg.TLSCertFile == "" && s.cfg.TLSKeyFile == "" {
+		dir := filepath.Join(os.TempDir(), "go-multithreaded-proxy")
+		s.cfg.TLSCertFile = filepath.Join(dir, "dev.crt")
+		s.cfg.TLSKeyFile = filepath.Join(dir, "dev.key")
+	}
+	if s.cfg.TLSCertFile == "" || s.cfg.TLSKeyFile == "" {
+		return errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+	_, certErr := os.Stat(s.cfg.TLSCertFile)
+	_, keyErr := os.Stat(s.cfg.TLSKeyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{s.cfg.TLSCertFile, s.cfg.TLSKeyFile} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(s.cfg.TLSKeyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(s.cfg.TLSCertFile, certPEM, 0o644)
+}
+
+// generateSelfSigned creates a PEM certificate and key valid for localhost,
+// the loopback addresses and this machine's hostname
+func generateSelfSigned(now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "go-multithreaded-proxy development"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Features that can be switched off at runtime through the admin API
+const (
+	ToggleCaching      = "caching"
+	ToggleCompression  = "compression"
+	ToggleRateLimiting = "rate_limiting"
+	TogglePrefetching  = "prefetching"
+)
+
+// toggleFeatures lists every feature that can be toggled
+var toggleFeatures = []string{ToggleCaching, ToggleCompression, ToggleRateLimiting, TogglePrefetching}
+
+// Toggles switches features on and off at runtime, globally or per route,
+// so incidents can be mitigated without a config deploy. Every feature
+// starts enabled; overrides last until the configuration is reloaded.
+type Toggles struct {
+	mu     sync.RWMutex
+	global map[string]bool
+	routes map[string]map[string]bool
+}
+
+// NewToggles returns toggles with every feature enabled
+func NewToggles() *Toggles {
+	return &Toggles{global: make(map[string]bool), routes: make(map[string]map[string]bool)}
+}
+
+// Enabled reports whether feature is on for requests on route, which may
+// be nil. A route override takes precedence over the global setting.
+func (t *Toggles) Enabled(feature string, route *Route) bool {
+	if route == nil {
+		return t.enabledFor(feature, "")
+	}
+	return t.enabledFor(feature, route.Name)
+}
+
+// enabledFor is Enabled for the route named routeName, if any
+func (t *Toggles) enabledFor(feature, routeName string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if routeName != "" {
+		if enabled, found := t.routes[routeName][feature]; found {
+			return enabled
+		}
+	}
+	if enabled, found := t.global[feature]; found {
+		return enabled
+	}
+	return true
+}
+
+// Set switches feature globally, or for one route when route is not empty
+func (t *Toggles) Set(feature, route string, enabled bool) error {
+	if !slices.Contains(toggleFeatures, feature) {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if route == "" {
+		t.global[feature] = enabled
+		return nil
+	}
+	if t.routes[route] == nil {
+		t.routes[route] = make(map[string]bool)
+	}
+	t.routes[route][feature] = enabled
+	return nil
+}
+
+// Clear removes an override, so the feature falls back to the global
+// setting for a route, or to enabled globally
+func (t *Toggles) Clear(feature, route string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if route == "" {
+		delete(t.global, feature)
+		return
+	}
+	delete(t.routes[route], feature)
+	if len(t.routes[route]) == 0 {
+		delete(t.routes, route)
+	}
+}
+
+// reset removes every override, enabling every feature again
+func (t *Toggles) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.global)
+	clear(t.routes)
+}
+
+// TogglesSnapshot is the effective global state and the route overrides
+type TogglesSnapshot struct {
+	Global map[string]bool            `json:"global"`
+	Routes map[string]map[string]bool `json:"routes,omitempty"`
+}
+
+// Snapshot returns the global state of every feature and the overrides
+func (t *Toggles) Snapshot() TogglesSnapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s := TogglesSnapshot{Global: make(map[string]bool), Routes: make(map[string]map[string]bool)}
+	for _, feature := range toggleFeatures {
+		enabled, found := t.global[feature]
+		s.Global[feature] = enabled || !found
+	}
+	for route, overrides := range t.routes {
+		s.Routes[route] = make(map[string]bool)
+		for feature, enabled := range overrides {
+			s.Routes[route][feature] = enabled
+		}
+	}
+	return s
+}
+
+// handleToggles reports the feature toggles
+func (s *Server) handleToggles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.toggles.Snapshot())
+}
+
+// handleSetToggle switches a feature, e.g.
+// POST /toggles?feature=caching&enabled=false&route=api
+func (s *Server) handleSetToggle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	enabled, err := strconv.ParseBool(q.Get("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid enabled parameter", http.StatusBadRequest)
+		return
+	}
+	route := q.Get("route")
+	if route != "" && !s.routeExists(route) {
+		http.Error(w, "Unknown route", http.StatusNotFound)
+		return
+	}
+	if err := s.toggles.Set(q.Get("feature"), route, enabled); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.log.Info("Toggled feature", "feature", q.Get("feature"), "enabled", enabled, "route", route)
+	writeJSON(w, s.toggles.Snapshot())
+}
+
+// handleClearToggle removes an override, e.g.
+// DELETE /toggles?feature=caching&route=api
+func (s *Server) handleClearToggle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.toggles.Clear(q.Get("feature"), q.Get("route"))
+	writeJSON(w, s.toggles.Snapshot())
+}
+
+// arrivalRoute returns the route, or nil, matching r as it arrived, for the
+// stages that run before the request is routed
+func (s *Server) arrivalRoute(r *http.Request) *Route {
+	route, _ := s.routes.Load().Match(r)
+	return route
+}
+
+// routeExists reports whether a route with the given name is configured
+func (s *Server) routeExists(name string) bool {
+	for _, route := range s.routes.Load().Routes() {
+		if route.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TokenAuthConfig authenticates clients by a token in a request header, for
+// service-to-service use where Basic credentials are awkward. It applies in
+// both proxy modes; in forward mode a client may use either tokens or
+// ProxyAuth credentials.
+type TokenAuthConfig struct {
+	// Header carries the token; it defaults to Proxy-Authorization. In
+	// Authorization and Proxy-Authorization the token follows "Bearer ".
+	Header string
+	// Identities maps identity names, used for rate limiting, quotas and
+	// logging, to their tokens; a token of the form $NAME is read from the
+	// environment variable NAME. Empty disables token authentication.
+	Identities map[string]string
+}
+
+// tokenDatabase maps token hashes to identities, so lookups don't leak
+// how much of a guessed token matched
+type tokenDatabase struct {
+	header     string
+	identities map[[sha256.Size]byte]string
+}
+
+// compileTokens builds the token database, rejecting empty and shared tokens
+func compileTokens(cfg TokenAuthConfig) (*tokenDatabase, error) {
+	db := &tokenDatabase{header: cfg.Header, identities: make(map[[sha256.Size]byte]string)}
+	if db.header == "" {
+		db.header = "Proxy-Authorization"
+	}
+	for name, token := range cfg.Identities {
+		if env, ok := strings.CutPrefix(token, "$"); ok {
+			token = os.Getenv(env)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("identity %q has no token", name)
+		}
+		sum := sha256.Sum256([]byte(token))
+		if other, found := db.identities[sum]; found {
+			return nil, errors.New("identities " + other + " and " + name + " share a token")
+		}
+		db.identities[sum] = name
+	}
+	return db, nil
+}
+
+// identify returns the identity of the token r presents, removing the token
+// so it never reaches the upstream
+func (db *tokenDatabase) identify(r *http.Request) (string, bool) {
+	if db == nil {
+		return "", false
+	}
+	token := r.Header.Get(db.header)
+	if strings.EqualFold(db.header, "Authorization") || strings.EqualFold(db.header, "Proxy-Authorization") {
+		scheme, value, ok := strings.Cut(token, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return "", false
+		}
+		token = strings.TrimSpace(value)
+	}
+	name, found := db.lookup(token)
+	if found {
+		r.Header.Del(db.header)
+	}
+	return name, found
+}
+
+// lookup returns the identity token belongs to
+func (db *tokenDatabase) lookup(token string) (string, bool) {
+	if db == nil || token == "" {
+		return "", false
+	}
+	name, found := db.identities[sha256.Sum256([]byte(token))]
+	return name, found
+}
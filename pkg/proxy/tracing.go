@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TracingConfig exports a span per proxied request, with child spans for
+// the cache lookup and the upstream fetch, to an OpenTelemetry collector
+// over OTLP/HTTP with JSON encoding. W3C traceparent headers from clients
+// are continued and passed on to upstreams.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces URL, e.g.
+	// http://collector:4318/v1/traces; empty disables tracing
+	Endpoint string
+	// ServiceName names the proxy in traces; it defaults to
+	// "go-multithreaded-proxy"
+	ServiceName string
+	// Headers are added to export requests, e.g. for collector
+	// authentication
+	Headers map[string]string
+	// SampleRate is the fraction of new traces recorded; zero records all
+	// of them. Traces continued from a client keep the client's decision.
+	SampleRate float64
+	// FlushInterval is how often spans are exported; it defaults to 5s
+	FlushInterval time.Duration
+	// MaxQueue bounds the spans held between flushes, dropping the rest;
+	// it defaults to 2048
+	MaxQueue int
+}
+
+// traceparentHeader carries the W3C trace context
+const traceparentHeader = "Traceparent"
+
+// Span kinds and status codes of the OTLP data model
+const (
+	spanInternal    = 1
+	spanServer      = 2
+	spanClient      = 3
+	spanStatusError = 2
+)
+
+// span is one timed operation of a trace; its methods do nothing on a nil
+// span, which is what startSpan returns when tracing is off
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpAttribute
+	failure  string
+	// exporter exports the span once it ends
+	exporter *traceExporter
+}
+
+// otlpAttribute is a key-value pair in OTLP JSON encoding
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// otlpSpan is a finished span in OTLP JSON encoding
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       map[string]any  `json:"status,omitempty"`
+}
+
+// traceExporter queues finished spans and posts them on every flush
+type traceExporter struct {
+	cfg    TracingConfig
+	client *http.Client
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	queue   []otlpSpan
+	dropped int
+}
+
+// newTraceExporter applies the defaults of cfg
+func newTraceExporter(cfg TracingConfig) *traceExporter {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "go-multithreaded-proxy"
+	}
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		cfg.SampleRate = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = 2048
+	}
+	return &traceExporter{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span ctx carries, or nil
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// withTracing serves r with next inside a server span, continuing the trace
+// of the client's traceparent header when it carries a valid one
+func (s *Server) withTracing(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	sp := &span{kind: spanServer, start: time.Now(), exporter: s.tracer}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		sp.traceID, sp.parentID, sp.sampled = traceID, parentID, sampled
+	} else {
+		putRandom(sp.traceID[:])
+		sp.sampled = rand.Float64() < s.tracer.cfg.SampleRate
+	}
+	putRandom(sp.spanID[:])
+	sp.setString("http.request.method", r.Method)
+	sp.setString("url.full", auditURL(r))
+	sp.setString("client.address", clientIP(r))
+	if ua := r.UserAgent(); ua != "" {
+		sp.setString("user_agent.original", ua)
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		sp.name = r.Method
+		if route, ok := Annotation(r, RouteAnnotation); ok {
+			sp.name += " " + route
+			sp.setString("http.route", route)
+		}
+		if cache, ok := Annotation(r, CacheAnnotation); ok {
+			sp.setString("proxy.cache", cache)
+		}
+		status := rec.Status()
+		sp.setInt("http.response.status_code", status)
+		if status >= http.StatusInternalServerError {
+			sp.failure = http.StatusText(status)
+		}
+		sp.end()
+	}()
+	next(rec, r.WithContext(context.WithValue(r.Context(), spanKey{}, sp)))
+}
+
+// startSpan starts a child of the span in ctx, returning nil when there is
+// none
+func startSpan(ctx context.Context, name string, kind int) *span {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return nil
+	}
+	s := &span{traceID: parent.traceID, parentID: parent.spanID, sampled: parent.sampled, name: name, kind: kind, start: time.Now(), exporter: parent.exporter}
+	putRandom(s.spanID[:])
+	return s
+}
+
+// traceparent formats the header that makes s the parent of the receiver's
+// spans
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// inject sets the traceparent header of an upstream request to s
+func (s *span) inject(h http.Header) {
+	if s != nil {
+		h.Set(traceparentHeader, s.traceparent())
+	}
+}
+
+func (s *span) setString(key, value string) {
+	if s != nil {
+		s.attrs = append(s.attrs, otlpAttribute{key, map[string]any{"stringValue": value}})
+	}
+}
+
+func (s *span) setInt(key string, value int) {
+	if s != nil {
+		// OTLP JSON encodes 64-bit integers as strings
+		s.attrs = append(s.attrs, otlpAttribute{key, map[string]any{"intValue": strconv.Itoa(value)}})
+	}
+}
+
+func (s *span) setBool(key string, value bool) {
+	if s != nil {
+		s.attrs = append(s.attrs, otlpAttribute{key, map[string]any{"boolValue": value}})
+	}
+}
+
+// fail marks s as failed with err
+func (s *span) fail(err error) {
+	if s != nil {
+		s.failure = err.Error()
+	}
+}
+
+// end finishes s and queues it for export when its trace is sampled
+func (s *span) end() {
+	if s == nil || !s.sampled || s.exporter == nil {
+		return
+	}
+	out := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes: s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failure != "" {
+		out.Status = map[string]any{"code": spanStatusError, "message": s.failure}
+	}
+	s.exporter.add(out)
+}
+
+// add queues a finished span, dropping it when the queue is full
+func (e *traceExporter) add(s otlpSpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= e.cfg.MaxQueue {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, s)
+}
+
+// run exports the queued spans every FlushInterval until ctx is done
+func (e *traceExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.flush(ctx)
+		}
+	}
+}
+
+// flush posts the queued spans as one OTLP export request
+func (e *traceExporter) flush(ctx context.Context) {
+	e.mu.Lock()
+	spans, dropped := e.queue, e.dropped
+	e.queue, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.log.Warn("Spans dropped", "count", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	if err := e.send(ctx, spans); err != nil {
+		e.log.Warn("Span export failed", "spans", len(spans), "err", err)
+	}
+}
+
+// send posts spans to the collector
+func (e *traceExporter) send(ctx context.Context, spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{
+				{"service.name", map[string]any{"stringValue": e.cfg.ServiceName}},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/Simply-kk/go-multithreaded-proxy"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// parseTraceparent parses a W3C traceparent header, rejecting the invalid
+// all-zero IDs and the reserved version ff
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	// version-traceid-parentid-flags, where later versions may append
+	// fields after the flags
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' || (len(header) > 55 && header[55] != '-') {
+		return traceID, parentID, false, false
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(header[:2])); err != nil || version[0] == 0xff {
+		return traceID, parentID, false, false
+	}
+	if version[0] == 0 && len(header) != 55 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(header[3:35])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(header[36:52])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(header[53:55])); err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// putRandom fills b with random bytes
+func putRandom(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// announceTrailers declares the trailers resp announced, so the client
+// response is chunked and can carry them. Call it before WriteHeader.
+func announceTrailers(w http.ResponseWriter, resp *http.Response) {
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+}
+
+// copyTrailers relays the trailers received after resp's body. Trailers
+// that were not announced are sent too where the protocol allows it.
+func copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	var announced []string
+	for _, value := range w.Header().Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			announced = append(announced, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
+	for name, values := range resp.Trailer {
+		if slices.Contains(announced, http.CanonicalHeaderKey(name)) {
+			w.Header()[name] = values
+			continue
+		}
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+}
+
+// keepTETrailers restores "TE: trailers" on an upstream request after the
+// hop-by-hop headers were removed. gRPC servers require it to know that
+// trailers will get through.
+func keepTETrailers(dst, src http.Header) {
+	for _, value := range src.Values("TE") {
+		for _, coding := range strings.Split(value, ",") {
+			coding, _, _ = strings.Cut(coding, ";")
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				dst.Set("TE", "trailers")
+				return
+			}
+		}
+	}
+}
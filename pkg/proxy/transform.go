@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ResponseTransform modifies an upstream response before it reaches the
+// client. It may change StatusCode and Header and replace Body, setting
+// ContentLength to the new length or -1; the proxy closes the original body.
+// r is the client request and target the upstream URL. Transformed responses
+// are not cached.
+type ResponseTransform func(r *http.Request, target *url.URL, resp *http.Response) error
+
+// transformers are the registered transforms, by name
+var transformers = map[string]ResponseTransform{}
+
+// RegisterTransform installs a transform that TransformRules may name. It
+// must be called before StartServer.
+func RegisterTransform(name string, t ResponseTransform) {
+	transformers[name] = t
+}
+
+// TransformRule modifies matching responses, e.g. to inject a banner into
+// HTML pages or to point the absolute links of a backend at the proxy.
+// Rules apply in order, each to the response left by the previous ones.
+type TransformRule struct {
+	// Route limits the rule to the route of this name; empty matches every
+	// request
+	Route string `json:"route,omitempty"`
+	// ContentType limits the rule to responses whose media type starts with
+	// it, e.g. "text/html"
+	ContentType string `json:"content_type,omitempty"`
+	// Status replaces the response status
+	Status int `json:"status,omitempty"`
+	// SetHeaders sets response headers
+	SetHeaders map[string]string `json:"set_headers,omitempty"`
+	// RemoveHeaders deletes response headers
+	RemoveHeaders []string `json:"remove_headers,omitempty"`
+	// Replace rewrites the body by regular expression, e.g. matching
+	// `(?i)<body[^>]*>` with "$0<div class=banner>Staging</div>"
+	Replace []BodyReplacement `json:"replace,omitempty"`
+	// RewriteLinks, in reverse mode, replaces absolute links to the backend
+	// in the body and in Location headers with links to the proxy
+	RewriteLinks bool `json:"rewrite_links,omitempty"`
+	// Transform names a transform installed with RegisterTransform
+	Transform string `json:"transform,omitempty"`
+}
+
+// BodyReplacement replaces every match of a regular expression in a body
+type BodyReplacement struct {
+	Match string `json:"match"`
+	// Replacement may refer to submatches as $1 or ${name}
+	Replacement string `json:"replacement"`
+}
+
+// inspectBodyLimit bounds the bodies buffered for rewriting or inspection
+// when no response limit is configured; larger bodies are relayed unchanged
+const inspectBodyLimit = 16 << 20
+
+// transformRule is a compiled TransformRule
+type transformRule struct {
+	TransformRule
+	patterns []*regexp.Regexp
+	fn       ResponseTransform
+}
+
+// rewritesBody reports whether the rule needs the body in memory
+func (rule *transformRule) rewritesBody() bool {
+	return len(rule.patterns) > 0 || rule.RewriteLinks
+}
+
+// compileTransforms validates rules against the registered transforms
+func compileTransforms(rules []TransformRule) ([]transformRule, error) {
+	var compiled []transformRule
+	for i, rule := range rules {
+		c := transformRule{TransformRule: rule}
+		if rule.Status != 0 && (rule.Status < 100 || rule.Status > 999) {
+			return nil, fmt.Errorf("rule %d: invalid status %d", i+1, rule.Status)
+		}
+		for _, replace := range rule.Replace {
+			re, err := regexp.Compile(replace.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			c.patterns = append(c.patterns, re)
+		}
+		if rule.Transform != "" {
+			fn, found := transformers[rule.Transform]
+			if !found {
+				return nil, fmt.Errorf("rule %d: unknown transform %q", i+1, rule.Transform)
+			}
+			c.fn = fn
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// matches reports whether the rule applies to resp
+func (rule *transformRule) matches(route *Route, resp *http.Response) bool {
+	if rule.Route != "" && (route == nil || route.Name != rule.Route) {
+		return false
+	}
+	if rule.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if !strings.HasPrefix(mediaType, strings.ToLower(rule.ContentType)) {
+			return false
+		}
+	}
+	return true
+}
+
+// transformResponse applies the matching transform rules to resp. decoded
+// tells whether the body is plaintext; rules rewriting the body skip it
+// otherwise. Bypassed destinations are never transformed. It reports
+// whether any rule applied.
+func (s *Server) transformResponse(r *http.Request, target *url.URL, route *Route, resp *http.Response, decoded bool) (bool, error) {
+	if len(s.transforms) == 0 || s.bypass.Match(target) {
+		return false, nil
+	}
+	applied := false
+	var body []byte
+	for i := range s.transforms {
+		rule := &s.transforms[i]
+		if !rule.matches(route, resp) {
+			continue
+		}
+		applied = true
+		if rule.Status != 0 {
+			resp.StatusCode = rule.Status
+			resp.Status = ""
+		}
+		for _, name := range rule.RemoveHeaders {
+			resp.Header.Del(name)
+		}
+		for name, value := range rule.SetHeaders {
+			resp.Header.Set(name, value)
+		}
+		if rule.RewriteLinks && s.cfg.Mode == ModeReverse {
+			rewriteLocation(r, target, resp.Header)
+		}
+		if rule.rewritesBody() && decoded {
+			if body == nil {
+				var ok bool
+				if body, ok = bufferBody(resp, s.inspectLimit()); !ok {
+					decoded = false
+					continue
+				}
+			}
+			for j, re := range rule.patterns {
+				body = re.ReplaceAll(body, []byte(rule.Replace[j].Replacement))
+			}
+			if rule.RewriteLinks && s.cfg.Mode == ModeReverse {
+				body = bytes.ReplaceAll(body, []byte(backendOrigin(target)), []byte(publicOrigin(r)))
+			}
+			replaceBody(resp, body)
+		}
+		if rule.fn != nil {
+			if err := rule.fn(r, target, resp); err != nil {
+				return applied, fmt.Errorf("transform %s: %w", rule.Transform, err)
+			}
+			body = nil
+			if resp.ContentLength >= 0 {
+				resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+			} else {
+				resp.Header.Del("Content-Length")
+			}
+		}
+	}
+	if applied {
+		s.stats.Transformed.Add(1)
+	}
+	return applied, nil
+}
+
+// inspectLimit is the largest body buffered for rewriting or inspection
+func (s *Server) inspectLimit() int64 {
+	if s.cfg.ResponseLimit.MaxBytes > 0 {
+		return s.cfg.ResponseLimit.MaxBytes
+	}
+	return inspectBodyLimit
+}
+
+// bufferBody reads the body of resp for rewriting or inspection. Bodies
+// over limit are restored unread and reported as false.
+func bufferBody(resp *http.Response, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, false
+	}
+	return body, true
+}
+
+// replaceBody replaces the body of resp with body
+func replaceBody(resp *http.Response, body []byte) {
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), resp.Body}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// backendOrigin returns the scheme and host of the backend URL target
+func backendOrigin(target *url.URL) string {
+	return target.Scheme + "://" + target.Host
+}
+
+// publicOrigin returns the scheme and host clients address the proxy by
+func publicOrigin(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// rewriteLocation points Location and Content-Location headers naming the
+// backend at the proxy
+func rewriteLocation(r *http.Request, target *url.URL, h http.Header) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if rest, ok := strings.CutPrefix(h.Get(name), backendOrigin(target)); ok {
+			h.Set(name, publicOrigin(r)+rest)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// TransparentConfig controls transparent interception of traffic that the
+// kernel redirects to the proxy, so clients need no proxy settings, e.g.
+//
+//	iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner proxy \
+//		-m multiport --dports 80,443 -j REDIRECT --to-ports 8081
+//
+// Plain HTTP is proxied like any forward request; TLS is tunneled to the
+// original destination, or intercepted when MITM is enabled.
+type TransparentConfig struct {
+	// Addr enables the transparent listener, e.g. ":8081"
+	Addr string
+}
+
+// tlsRecordHandshake is the first byte of a TLS connection
+const tlsRecordHandshake = 0x16
+
+// startTransparent accepts redirected connections on addr in the background
+// until the server shuts down
+func (s *Server) startTransparent(addr string) {
+	ln, err := s.listenGuarded("tcp", addr)
+	if err != nil {
+		s.log.Error("Transparent listener failed", "err", err)
+		return
+	}
+	s.closeOnShutdown(ln)
+	s.goBackground(func() {
+		s.log.Info("Transparent listener is running", "addr", ln.Addr().String())
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if s.background.Err() == nil {
+					s.log.Error("Transparent listener failed", "err", err)
+				}
+				return
+			}
+			go s.serveTransparent(conn)
+		}
+	})
+}
+
+// serveTransparent recovers the original destination of a redirected
+// connection and proxies it as HTTP or TLS depending on its first byte
+func (s *Server) serveTransparent(conn net.Conn) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		s.log.Warn("Transparent connection without original destination", "err", err)
+		conn.Close()
+		return
+	}
+	// A connection made straight to the listener would loop back to it
+	if dst == conn.LocalAddr().String() {
+		s.log.Warn("Transparent connection was not redirected", "client", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(s.cfg.SNIPolicy.PeekTimeout))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn = &bufferedConn{Conn: conn, reader: reader}
+
+	if first[0] == tlsRecordHandshake {
+		s.transparentTLS(conn, dst)
+		return
+	}
+	http.Serve(&singleConnListener{conn: conn}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			r.Host = dst
+		}
+		s.serveProxy(w, r)
+	}))
+}
+
+// transparentTLS intercepts or tunnels a redirected TLS connection to dst,
+// naming the destination by its SNI where the client sent one
+func (s *Server) transparentTLS(conn net.Conn, dst string) {
+	serverName, hello, err := peekClientHello(conn, s.cfg.SNIPolicy.PeekTimeout)
+	if err != nil {
+		s.log.Info("Tunnel refused", "host", dst, "reason", err.Error())
+		conn.Close()
+		return
+	}
+	authority := dst
+	if serverName != "" {
+		_, port, _ := net.SplitHostPort(dst)
+		authority = net.JoinHostPort(serverName, port)
+	}
+	s.log.Debug("Received transparent TLS", "host", authority, "destination", dst)
+	conn = &bufferedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(hello), conn)}
+
+	if s.minter != nil && !s.bypass.Match(&url.URL{Host: authority}) {
+		s.intercept(conn, authority, nil)
+		return
+	}
+	if ok, reason := s.cfg.SNIPolicy.ACL.Check(utils.StripPort(authority)); !ok {
+		s.log.Info("Tunnel refused", "host", authority, "reason", reason)
+		conn.Close()
+		return
+	}
+	if b := s.blocklist.Load(); b != nil && b.blocks(authority) {
+		s.stats.Blocklisted.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), authority, AuditBlocklist, authority)
+		conn.Close()
+		return
+	}
+	if ok, reason := s.currentDestinationACL().Check(utils.StripPort(authority)); !ok {
+		s.stats.DestinationDenied.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), authority, AuditDestinationACL, reason)
+		s.log.Info("Destination refused", "host", authority, "reason", reason)
+		conn.Close()
+		return
+	}
+
+	ctx := pinnedContext(context.Background())
+	if err := s.checkSSRF(ctx, &url.URL{Scheme: "https", Host: dst}, nil); err != nil {
+		s.stats.InternalDenied.Add(1)
+		s.auditConnection(conn.RemoteAddr().String(), dst, AuditSSRF, err.Error())
+		s.log.Info("Destination refused", "reason", err)
+		conn.Close()
+		return
+	}
+	upstream, err := s.dialTunnel(ctx, dst)
+	if err != nil {
+		s.log.Warn("Transparent dial failed", "destination", dst, "err", err)
+		conn.Close()
+		return
+	}
+	tunnel(conn, upstream)
+}
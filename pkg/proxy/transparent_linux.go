@@ -0,0 +1,67 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which shares
+// its value with IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// transparentSupported reports whether originalDst works on this platform
+const transparentSupported = true
+
+// originalDst returns the destination a connection had before netfilter
+// redirected it to the proxy
+func originalDst(conn net.Conn) (string, error) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv4 := tcp.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var ip net.IP
+	var port uint16
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// The getsockopt wrappers for these structures happen to have the
+		// size of the sockaddr_in and sockaddr_in6 the kernel fills in
+		if ipv4 {
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := mreq.Multiaddr
+			port = binary.BigEndian.Uint16(sa[2:4])
+			ip = net.IPv4(sa[4], sa[5], sa[6], sa[7])
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		var b [2]byte
+		binary.NativeEndian.PutUint16(b[:], info.Addr.Port)
+		port = binary.BigEndian.Uint16(b[:])
+		ip = net.IP(info.Addr.Addr[:])
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// transparentSupported reports whether originalDst works on this platform
+const transparentSupported = false
+
+// originalDst is only implemented on Linux, where netfilter records it
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("transparent proxying requires Linux")
+}
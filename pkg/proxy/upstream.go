@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// TransportConfig tunes the upstream connection pool
+type TransportConfig struct {
+	// RequestTimeout bounds a proxied exchange until its response headers
+	// arrive, and the proxy's own requests, such as health checks, whole
+	RequestTimeout time.Duration
+	// DialTimeout bounds establishing a TCP connection
+	DialTimeout time.Duration
+	// DialKeepAlive is the TCP keep-alive period of upstream connections
+	DialKeepAlive time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with origins
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for response headers after the
+	// request is sent; zero means no limit
+	ResponseHeaderTimeout time.Duration
+	// BodyIdleTimeout bounds the wait for each read of a response body;
+	// zero means no limit
+	BodyIdleTimeout time.Duration
+	// ExpectContinueTimeout bounds the wait for a 100 Continue response
+	ExpectContinueTimeout time.Duration
+	// MaxIdleConns bounds idle connections across all hosts
+	MaxIdleConns int
+	// MaxIdleConnsPerHost bounds idle connections kept for each host
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost bounds all connections to each host; zero means no limit
+	MaxConnsPerHost int
+	// IdleConnTimeout closes pooled connections idle this long. Set it below
+	// the origins' own idle timeouts so the proxy never reuses a connection
+	// an origin is about to drop.
+	IdleConnTimeout time.Duration
+	// DisableCompression stops the transport from requesting gzip
+	DisableCompression bool
+}
+
+// configureTransport applies cfg to the upstream transports and client
+func (s *Server) configureTransport(cfg TransportConfig) {
+	s.dialer = &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.DialKeepAlive}
+	s.httpTransport.DialContext = s.dialPinned
+	// Proxied requests time their TLS handshake and response headers in
+	// sendUpstream, where routes and hosts may lengthen them
+	s.httpTransport.TLSHandshakeTimeout = 0
+	s.httpTransport.ResponseHeaderTimeout = 0
+	s.httpTransport.ExpectContinueTimeout = cfg.ExpectContinueTimeout
+	s.httpTransport.MaxIdleConns = cfg.MaxIdleConns
+	s.httpTransport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	s.httpTransport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	s.httpTransport.IdleConnTimeout = cfg.IdleConnTimeout
+	s.httpTransport.DisableCompression = cfg.DisableCompression
+
+	s.http1Transport = s.newHTTP1Transport()
+}
+
+// newHTTP1Transport derives an HTTP/1.1-only transport from transport
+func (s *Server) newHTTP1Transport() *http.Transport {
+	t := s.httpTransport.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP1(true)
+	return t
+}
+
+// hostTransport picks the upstream transport of its server for each
+// destination host
+type hostTransport struct {
+	s *Server
+}
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := t.s
+	h2, h1 := s.httpTransport, s.http1Transport
+	policy := s.upstreamTLSFor(req.URL.Host)
+	if policy != nil {
+		h2, h1 = policy.transport, policy.http1
+	}
+	for _, pattern := range s.cfg.HTTP1Hosts {
+		if utils.MatchHost(pattern, req.URL.Host) {
+			return h1.RoundTrip(req)
+		}
+	}
+	if policy != nil {
+		return h2.RoundTrip(req)
+	}
+	if resp, ok := s.roundTripHTTP3(req); ok {
+		return resp, nil
+	}
+
+	resp, err := s.httpTransport.RoundTrip(req)
+	if err == nil && s.cfg.HTTP3.Upstream {
+		s.altSvc.learn(req.URL.Host, resp.Header)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes idle connections in both pools
+func (t hostTransport) CloseIdleConnections() {
+	s := t.s
+	s.httpTransport.CloseIdleConnections()
+	s.http1Transport.CloseIdleConnections()
+	for _, p := range s.upstreamTLS {
+		p.transport.CloseIdleConnections()
+		p.http1.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// UpstreamTLSRule sets how the TLS connections to upstream hosts matching
+// Host are verified. The first matching rule applies; matching hosts are
+// spoken to over HTTP/1.1 or HTTP/2, never HTTP/3.
+type UpstreamTLSRule struct {
+	// Host is an upstream host pattern, e.g. "*.lab.internal"
+	Host string `json:"host"`
+	// CAFile is a PEM bundle of the authorities trusted instead of the
+	// system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// Pins are base64 SHA-256 hashes of the SubjectPublicKeyInfo of a
+	// certificate in the chain, optionally prefixed "sha256/"; one must
+	// match
+	Pins []string `json:"pins,omitempty"`
+	// MinVersion is the lowest TLS version accepted: "1.0", "1.1", "1.2"
+	// (the default) or "1.3"
+	MinVersion string `json:"min_version,omitempty"`
+	// CipherSuites limits the TLS 1.2 cipher suites offered, by their Go
+	// names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	// InsecureSkipVerify accepts any certificate, for lab environments
+	// only; every such connection is logged. Pins are still enforced.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// tlsVersions maps MinVersion values to their protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSPolicy carries the transports of one UpstreamTLSRule
+type upstreamTLSPolicy struct {
+	host      string
+	transport *http.Transport
+	http1     *http.Transport
+}
+
+// configureUpstreamTLS derives a pair of transports from the shared ones
+// for each rule. It must run after the shared transports are configured.
+func (s *Server) configureUpstreamTLS(rules []UpstreamTLSRule) error {
+	s.upstreamTLS = nil
+	for _, rule := range rules {
+		tlsConfig, err := s.upstreamTLSConfig(rule)
+		if err != nil {
+			return fmt.Errorf("host %q: %w", rule.Host, err)
+		}
+		if rule.InsecureSkipVerify {
+			s.log.Warn("Upstream TLS certificates are not verified", "host", rule.Host)
+		}
+		p := &upstreamTLSPolicy{host: rule.Host, transport: s.httpTransport.Clone(), http1: s.http1Transport.Clone()}
+		p.transport.TLSClientConfig = tlsConfig
+		p.http1.TLSClientConfig = tlsConfig.Clone()
+		s.upstreamTLS = append(s.upstreamTLS, p)
+	}
+	return nil
+}
+
+// upstreamTLSConfig builds the client TLS configuration of rule
+func (s *Server) upstreamTLSConfig(rule UpstreamTLSRule) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: rule.InsecureSkipVerify}
+	if rule.MinVersion != "" {
+		version, found := tlsVersions[rule.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown TLS version %q", rule.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if rule.CAFile != "" {
+		pem, err := os.ReadFile(rule.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", rule.CAFile)
+		}
+	}
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, name := range rule.CipherSuites {
+		i := slices.IndexFunc(suites, func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, suites[i].ID)
+	}
+	var pins [][]byte
+	for _, pin := range rule.Pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q", pin)
+		}
+		pins = append(pins, hash)
+	}
+	if len(pins) > 0 || rule.InsecureSkipVerify {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if rule.InsecureSkipVerify {
+				s.log.Debug("Unverified upstream TLS connection", "host", cs.ServerName)
+			}
+			if len(pins) == 0 {
+				return nil
+			}
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if slices.ContainsFunc(pins, func(pin []byte) bool { return string(pin) == string(sum[:]) }) {
+					return nil
+				}
+			}
+			s.stats.PinMismatches.Add(1)
+			return errPinMismatch
+		}
+	}
+	return cfg, nil
+}
+
+// errPinMismatch reports an upstream certificate chain matching no pin
+var errPinMismatch = errors.New("upstream certificate matches no pin")
+
+// upstreamTLSFor returns the policy of host, or nil to use the defaults
+func (s *Server) upstreamTLSFor(host string) *upstreamTLSPolicy {
+	for _, p := range s.upstreamTLS {
+		if utils.MatchHost(p.host, host) {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// variantWarning is sent when an alternate variant stands in for a failed
+// upstream response
+const variantWarning = `199 - "Alternate cached variant served after upstream error"`
+
+// variantIndex tracks URLs whose responses vary on request headers, so each
+// variant is cached under its own key and a close variant can stand in when
+// the origin fails
+type variantIndex struct {
+	mu       sync.Mutex
+	vary     map[string][]string
+	variants map[string]map[string]variant
+}
+
+// variant describes one cached representation of a URL
+type variant struct {
+	// language is the Content-Language of the cached response
+	language string
+}
+
+// parseVary returns the request headers named by a Vary response header and
+// whether the response may be cached at all. Accept-Encoding is ignored
+// because bodies are stored decoded.
+func parseVary(h http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "":
+			case "*":
+				return nil, false
+			case "Accept-Encoding":
+			default:
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// variantKey builds the cache key of url for the given header names and
+// request header values
+func variantKey(url string, names []string, h http.Header) string {
+	if len(names) == 0 {
+		return url
+	}
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.ToLower(strings.ReplaceAll(strings.Join(h.Values(name), ","), " ", "")))
+	}
+	return b.String()
+}
+
+// Key returns the cache key for a request to url with headers h
+func (v *variantIndex) Key(url string, h http.Header) string {
+	v.mu.Lock()
+	names := v.vary[url]
+	v.mu.Unlock()
+	return variantKey(url, names, h)
+}
+
+// plain reports whether url is cached under the URL alone, as it is when
+// its responses vary on no request headers
+func (v *variantIndex) plain(url []byte) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.vary[string(url)]) == 0
+}
+
+// Record notes a response to url and returns the key to cache it under, or
+// false when the response varies on everything and must not be cached.
+// Extra names request headers to vary on besides those in Vary.
+func (v *variantIndex) Record(url string, req, resp http.Header, extra ...string) (string, bool) {
+	names, ok := parseVary(resp)
+	if !ok {
+		return "", false
+	}
+	if len(extra) > 0 {
+		names = append(names, extra...)
+		sort.Strings(names)
+	}
+	key := variantKey(url, names, req)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.vary[url] = names
+	if len(names) > 0 {
+		if v.variants[url] == nil {
+			v.variants[url] = make(map[string]variant)
+		}
+		v.variants[url][key] = variant{language: resp.Get("Content-Language")}
+	}
+	return key, true
+}
+
+// Language returns the Content-Language recorded for a cached variant
+func (v *variantIndex) Language(url, key string) string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.variants[url][key].language
+}
+
+// Closest returns the cached variant of url that best satisfies the
+// Accept-Language of h, if any is acceptable
+func (v *variantIndex) Closest(url string, h http.Header) (string, bool) {
+	v.mu.Lock()
+	candidates := make(map[string]variant, len(v.variants[url]))
+	for key, vr := range v.variants[url] {
+		candidates[key] = vr
+	}
+	v.mu.Unlock()
+
+	ranges := parseAcceptLanguage(h.Get("Accept-Language"))
+	best, bestQ := "", 0.0
+	for key, vr := range candidates {
+		if q := languageQuality(ranges, vr.language); q > bestQ || (q == bestQ && q > 0 && key < best) {
+			best, bestQ = key, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// Forget drops the variants of url and returns their cache keys
+func (v *variantIndex) Forget(url string) []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.variants[url]))
+	for key := range v.variants[url] {
+		keys = append(keys, key)
+	}
+	delete(v.vary, url)
+	delete(v.variants, url)
+	return keys
+}
+
+// languageRange is one entry of an Accept-Language header
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage parses an Accept-Language header
+func parseAcceptLanguage(value string) []languageRange {
+	var ranges []languageRange
+	for _, part := range strings.Split(value, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, languageRange{tag: strings.ToLower(tag), q: q})
+	}
+	return ranges
+}
+
+// languageQuality returns how acceptable language is under ranges. An
+// absent Accept-Language or Content-Language accepts anything.
+func languageQuality(ranges []languageRange, language string) float64 {
+	if len(ranges) == 0 || language == "" {
+		return 1
+	}
+	language = strings.ToLower(language)
+	primary, _, _ := strings.Cut(language, "-")
+
+	best := 0.0
+	for _, r := range ranges {
+		var q float64
+		switch {
+		case r.tag == language:
+			q = r.q
+		case r.tag == primary || strings.HasPrefix(language, r.tag+"-"):
+			q = r.q * 0.9
+		case r.tag == "*":
+			q = r.q * 0.5
+		}
+		if q > best {
+			best = q
+		}
+	}
+	return best
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import "runtime/debug"
+
+// Version is the release the proxy was built as, set at link time with
+// -ldflags "-X github.com/Simply-kk/go-multithreaded-proxy/pkg/proxy.Version=v1.2.3"
+var Version string
+
+// BuildVersion returns Version, or the module version and VCS revision
+// recorded by the Go toolchain when it is not set
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	version := info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			version += " (" + s.Value[:12] + ")"
+		}
+	}
+	return version
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/utils"
+)
+
+// VirtualHost is a site fronted in reverse-proxy mode, so that one proxy
+// serves several. Requests whose Host names one of Hosts go to its routes
+// alone, and over TLS its certificate is presented to clients naming it by
+// SNI.
+type VirtualHost struct {
+	// Name identifies the site in logs; it defaults to the first host
+	Name string `json:"name,omitempty"`
+	// Hosts are host names, exact or "*.example.com" wildcards
+	Hosts []string `json:"hosts"`
+	// TLSCertFile and TLSKeyFile are the certificate of the site; without
+	// them TLS clients get the proxy's own
+	TLSCertFile string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `json:"tls_key_file,omitempty"`
+	// Routes map paths of the site to backends; they may not set Host
+	Routes []Route `json:"routes"`
+	// Cache controls caching of the site's responses
+	Cache CachePolicy `json:"cache,omitempty"`
+	// Timeouts and Policy apply to routes that do not set their own
+	Timeouts *PhaseTimeouts `json:"timeouts,omitempty"`
+	Policy   string         `json:"policy,omitempty"`
+	// RequestHeaders edit requests sent to the site's backends, and
+	// ResponseHeaders the responses relayed to its clients
+	RequestHeaders  HeaderRules `json:"request_headers,omitempty"`
+	ResponseHeaders HeaderRules `json:"response_headers,omitempty"`
+}
+
+// CachePolicy controls caching of the responses of a site
+type CachePolicy struct {
+	// Disabled never caches the responses
+	Disabled bool `json:"disabled,omitempty"`
+	// MaxAge refetches responses cached for longer; zero keeps them until
+	// evicted
+	MaxAge time.Duration `json:"max_age,omitempty"`
+}
+
+// expired reports whether the response cached in c under key is older
+// than the policy allows
+func (p CachePolicy) expired(c *LRUCache, key string) bool {
+	if p.MaxAge <= 0 {
+		return false
+	}
+	age, found := c.Age(key)
+	return found && age > p.MaxAge
+}
+
+// site is a virtual host of a route table
+type site struct {
+	VirtualHost
+	cert *tls.Certificate
+}
+
+// compileSites checks hosts and adds the routes of each site to routes,
+// returning the sites and all routes
+func compileSites(routes []Route, hosts []VirtualHost) ([]*site, []Route, error) {
+	var sites []*site
+	for i, vhost := range hosts {
+		if len(vhost.Hosts) == 0 {
+			return nil, nil, fmt.Errorf("virtual host %d: hosts are required", i+1)
+		}
+		if vhost.Name == "" {
+			vhost.Name = vhost.Hosts[0]
+		}
+		s := &site{VirtualHost: vhost}
+		if vhost.TLSCertFile != "" || vhost.TLSKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(vhost.TLSCertFile, vhost.TLSKeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("virtual host %q: %w", vhost.Name, err)
+			}
+			s.cert = &cert
+		}
+		if vhost.Cache.MaxAge < 0 {
+			return nil, nil, fmt.Errorf("virtual host %q: negative cache max age", vhost.Name)
+		}
+		for _, route := range vhost.Routes {
+			if route.Host != "" {
+				return nil, nil, fmt.Errorf("virtual host %q: route %q may not set a host", vhost.Name, route.Name)
+			}
+			if route.Policy == "" {
+				route.Policy = vhost.Policy
+			}
+			if vhost.Timeouts != nil {
+				timeouts := *vhost.Timeouts
+				if route.Timeouts != nil {
+					timeouts = timeouts.over(*route.Timeouts)
+				}
+				route.Timeouts = &timeouts
+			}
+			route.site = s
+			routes = append(routes, route)
+		}
+		sites = append(sites, s)
+	}
+	return sites, routes, nil
+}
+
+// site returns the virtual host serving host, preferring exact host names
+// to wildcards, or nil
+func (t *RouteTable) site(host string) *site {
+	if len(t.sites) == 0 {
+		return nil
+	}
+	host = strings.ToLower(utils.StripPort(host))
+	for _, s := range t.sites {
+		for _, name := range s.Hosts {
+			if strings.EqualFold(name, host) {
+				return s
+			}
+		}
+	}
+	for _, s := range t.sites {
+		for _, name := range s.Hosts {
+			if utils.MatchHost(name, host) {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// Sites returns the virtual hosts of the table
+func (t *RouteTable) Sites() []VirtualHost {
+	out := make([]VirtualHost, len(t.sites))
+	for i, s := range t.sites {
+		out[i] = s.VirtualHost
+	}
+	return out
+}
+
+// siteCertificate presents the certificate of the virtual host a TLS
+// client names, leaving others to the proxy's own certificate
+func (s *Server) siteCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if vhost := s.routes.Load().site(hello.ServerName); vhost != nil && vhost.cert != nil {
+		return vhost.cert, nil
+	}
+	return nil, nil
+}
+
+// routeBySNI routes a TLS request by its server name when its Host names
+// no virtual host, and answers 421 when the two name different ones, as
+// clients reusing a connection for another site may send
+func (s *Server) routeBySNI(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS == nil || r.TLS.ServerName == "" {
+		return true
+	}
+	t := s.routes.Load()
+	bySNI := t.site(r.TLS.ServerName)
+	if bySNI == nil {
+		return true
+	}
+	switch byHost := t.site(r.Host); byHost {
+	case bySNI:
+	case nil:
+		r.Host = r.TLS.ServerName
+	default:
+		s.httpError(w, r, "Request misdirected to "+bySNI.Name, http.StatusMisdirectedRequest)
+		return false
+	}
+	return true
+}
+
+// cachePolicy returns the cache policy of the site of route
+func (route *Route) cachePolicy() CachePolicy {
+	if route == nil || route.site == nil {
+		return CachePolicy{}
+	}
+	return route.site.Cache
+}
+
+// withSiteHeaders returns w applying the response header rules of the site
+// of route
+func withSiteHeaders(w http.ResponseWriter, route *Route) http.ResponseWriter {
+	if route.site == nil || route.site.ResponseHeaders.empty() {
+		return w
+	}
+	return &headerWriter{ResponseWriter: w, edit: route.site.ResponseHeaders.apply}
+}
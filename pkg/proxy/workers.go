@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WorkerPoolConfig bounds the number of requests processed concurrently
+type WorkerPoolConfig struct {
+	// MaxConcurrent is the number of requests served at once; zero disables
+	// the pool
+	MaxConcurrent int
+	// MaxQueue is the number of requests that may wait for a free worker;
+	// beyond it requests are rejected immediately
+	MaxQueue int
+	// QueueTimeout is how long a queued request waits before it is
+	// rejected; zero waits until the client goes away
+	QueueTimeout time.Duration
+	// RetryAfter is suggested to rejected clients, rounded up to whole
+	// seconds; zero suggests nothing
+	RetryAfter time.Duration
+}
+
+// WorkerPool is a semaphore with a bounded wait queue
+type WorkerPool struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+	// stats count the requests queued
+	stats *Stats
+}
+
+// NewWorkerPool creates a pool for cfg
+func NewWorkerPool(cfg WorkerPoolConfig) *WorkerPool {
+	return &WorkerPool{
+		slots:   make(chan struct{}, cfg.MaxConcurrent),
+		queue:   make(chan struct{}, cfg.MaxQueue),
+		timeout: cfg.QueueTimeout,
+		stats:   &Stats{},
+	}
+}
+
+// Acquire claims a worker, queueing while all are busy. It reports false
+// when the queue is full, the wait times out or done is closed.
+func (p *WorkerPool) Acquire(done <-chan struct{}) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		return false
+	}
+	p.stats.QueueDepth.Add(1)
+	defer func() {
+		<-p.queue
+		p.stats.QueueDepth.Add(-1)
+	}()
+
+	var expired <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-expired:
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// Release frees a worker claimed by Acquire
+func (p *WorkerPool) Release() {
+	<-p.slots
+}
+
+// withWorker runs next on a pooled worker, answering 503 with Retry-After
+// when the pool and its queue are saturated
+func (s *Server) withWorker(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	if !s.workers.Acquire(r.Context().Done()) {
+		s.stats.Rejected.Add(1)
+		if after := s.cfg.Workers.RetryAfter; after > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(after.Seconds()))))
+		}
+		s.httpError(w, r, "Proxy is overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.workers.Release()
+
+	s.stats.Active.Add(1)
+	defer s.stats.Active.Add(-1)
+	next(w, r)
+}
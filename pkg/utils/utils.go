@@ -1 +1,35 @@
 package utils
+
+import "strings"
+
+// MatchHost reports whether host matches pattern. A pattern of the form
+// "*.example.com" matches any subdomain of example.com but not example.com
+// itself, and ".example.com" matches example.com and all its subdomains;
+// any other pattern must match exactly. Comparison ignores case and a port
+// on host.
+func MatchHost(pattern, host string) bool {
+	host = strings.ToLower(StripPort(host))
+	pattern = strings.ToLower(pattern)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	if strings.HasPrefix(pattern, ".") {
+		return strings.HasSuffix(host, pattern) || host == pattern[1:]
+	}
+	return host == pattern
+}
+
+// StripPort removes a trailing :port from host, if any
+func StripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]"); end != -1 {
+			return host[1:end]
+		}
+		return host
+	}
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.Contains(host[:i], ":") {
+		return host[:i]
+	}
+	return host
+}
@@ -1 +1,999 @@
 package tests
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/pkg/proxy"
+)
+
+func TestDiskCacheVerifyRepairs(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := proxy.OpenDiskCache(proxy.DiskCacheConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"http://a/", "http://b/", "http://c/"} {
+		if err := disk.Put(key, []byte("body of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt one body, delete another and leave an orphan behind
+	bodies, _ := filepath.Glob(filepath.Join(dir, "*.body"))
+	os.WriteFile(bodies[0], []byte("garbage"), 0o644)
+	os.Remove(bodies[1])
+	os.WriteFile(filepath.Join(dir, "deadbeef.body"), []byte("orphan"), 0o644)
+
+	reopened, _ := proxy.OpenDiskCache(proxy.DiskCacheConfig{Dir: dir})
+	report, err := reopened.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := proxy.IntegrityReport{Checked: 3, Valid: 1, Corrupt: 1, Missing: 1, Orphans: 1, Quarantined: 3}
+	if report != want {
+		t.Errorf("Verify() = %+v, want %+v", report, want)
+	}
+
+	again, _ := reopened.Verify()
+	if again.Checked != 1 || again.Valid != 1 {
+		t.Errorf("second Verify() = %+v, want one valid entry", again)
+	}
+}
+
+func TestCacheDigest(t *testing.T) {
+	d := proxy.NewCacheDigest(1000)
+	for i := range 1000 {
+		if !d.Add(fmt.Sprintf("http://origin.example/%d", i)) {
+			t.Fatalf("Add failed after %d keys", i)
+		}
+	}
+
+	data, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := proxy.ParseCacheDigest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 1000 {
+		if !parsed.Contains(fmt.Sprintf("http://origin.example/%d", i)) {
+			t.Fatalf("digest lost key %d", i)
+		}
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if parsed.Contains(fmt.Sprintf("http://other.example/%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("%d false positives in 10000 lookups", falsePositives)
+	}
+}
+
+// discardWriter is a ResponseWriter that allocates nothing
+type discardWriter struct {
+	header http.Header
+	n      int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) WriteHeader(int)             {}
+func (w *discardWriter) Write(p []byte) (int, error) { w.n += len(p); return len(p), nil }
+
+// silenceStdout discards the proxy's logging until the test ends
+func silenceStdout(tb testing.TB) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	tb.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
+
+// localConfig is the default configuration with the loopback origins of
+// the tests exempt from the SSRF guard
+func localConfig() proxy.Config {
+	cfg := proxy.DefaultConfig()
+	cfg.SSRF.Allow = []string{"127.0.0.0/8"}
+	return cfg
+}
+
+// newServer returns a proxy server for cfg that shuts down with the test
+func newServer(tb testing.TB, cfg proxy.Config, opts ...proxy.Option) *proxy.Server {
+	tb.Helper()
+	s, err := proxy.NewServer(cfg, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// cachedHandler returns a proxy handler with the response of an origin to
+// the returned request already cached, and silences the proxy's logging
+func cachedHandler(tb testing.TB) (http.Handler, *http.Request) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello, cache"))
+	}))
+	tb.Cleanup(origin.Close)
+
+	silenceStdout(tb)
+	cfg := localConfig()
+	handler := newServer(tb, cfg).Handler()
+	r := httptest.NewRequest(http.MethodGet, origin.URL+"/hit", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	return handler, r
+}
+
+func TestCacheHitAllocations(t *testing.T) {
+	handler, r := cachedHandler(t)
+	// Another server whose configuration rules out fast hits leaves this
+	// one's alone
+	cfg := localConfig()
+	cfg.RequestIDs = true
+	other := newServer(t, cfg).Handler()
+	other.ServeHTTP(httptest.NewRecorder(), r)
+	hit := httptest.NewRecorder()
+	other.ServeHTTP(hit, r)
+	if hit.Header().Get("X-Request-Id") == "" {
+		t.Error("hit on a server with request IDs answered without one")
+	}
+
+	// AllocsPerRun counts the allocations of the whole process, so
+	// goroutines left winding down by earlier tests can add to a run; the
+	// best of a few runs is the handler's own count
+	allocs := math.Inf(1)
+	for range 5 {
+		w := &discardWriter{header: http.Header{}}
+		allocs = min(allocs, testing.AllocsPerRun(100, func() {
+			handler.ServeHTTP(w, r)
+		}))
+		if w.n != 101*len("hello, cache") {
+			t.Fatalf("wrote %d bytes, want the cached body on every request", w.n)
+		}
+	}
+	if allocs != 0 {
+		t.Errorf("cache hit allocated %v times, want 0", allocs)
+	}
+}
+
+func TestFastHitsYieldToFeatures(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello, cache"))
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+	dir := t.TempDir()
+	users := filepath.Join(dir, "htpasswd")
+	os.WriteFile(users, []byte("bob:{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=\n"), 0o600)
+	signingKey := filepath.Join(dir, "signing.key")
+	os.WriteFile(signingKey, []byte("secret\n"), 0o600)
+	geoBlocks := filepath.Join(dir, "geo.csv")
+	os.WriteFile(geoBlocks, []byte("192.0.2.0/24,cn\n"), 0o644)
+	certFile, keyFile, _ := writeTestCA(t, dir)
+	proxy.RegisterPlugin("test-fasthit-auth", func(map[string]any) (any, error) {
+		return headerAuth{header: "X-User"}, nil
+	})
+	passThrough := func(next http.Handler) http.Handler { return next }
+
+	// Every case but the first turns on one feature that acts on every
+	// request, which the allocation-free fast hit path would skip over
+	tests := []struct {
+		name      string
+		configure func(*proxy.Config)
+		opts      []proxy.Option
+		header    http.Header
+		fast      bool
+	}{
+		{name: "plain configuration", fast: true},
+		{name: "reverse mode", configure: func(cfg *proxy.Config) {
+			cfg.Mode = proxy.ModeReverse
+			cfg.Routes = []proxy.Route{{Name: "app", PathPrefix: "/", Backend: origin.URL}}
+		}},
+		{name: "hooks", configure: func(cfg *proxy.Config) {
+			cfg.Hooks.OnCacheHit = func(http.ResponseWriter, *http.Request) bool { return true }
+		}},
+		{name: "journal", configure: func(cfg *proxy.Config) { cfg.Journal.Path = filepath.Join(dir, "journal") }},
+		{name: "access log", configure: func(cfg *proxy.Config) { cfg.AccessLog.Path = filepath.Join(dir, "access.log") }},
+		{name: "tracing", configure: func(cfg *proxy.Config) {
+			cfg.Tracing = proxy.TracingConfig{Endpoint: "http://127.0.0.1:1/v1/traces", FlushInterval: time.Hour}
+		}},
+		{name: "workers", configure: func(cfg *proxy.Config) { cfg.Workers.MaxConcurrent = 4 }},
+		{name: "egress budget", configure: func(cfg *proxy.Config) {
+			cfg.EgressBudget = proxy.EgressBudgetConfig{Bytes: 1 << 30, Window: time.Hour}
+		}},
+		{name: "signing", configure: func(cfg *proxy.Config) {
+			cfg.Signing = proxy.SigningConfig{Routes: []proxy.SigningRoute{{Host: "signed.example"}}, Algorithm: proxy.SignHMACSHA256, KeyFile: signingKey, Header: "X-Signature"}
+		}},
+		{name: "rewrites", configure: func(cfg *proxy.Config) {
+			cfg.Rewrites = []proxy.RewriteRule{{Match: `^http://old\.example/`, Replacement: "http://new.example/"}}
+		}},
+		{name: "GeoIP", configure: func(cfg *proxy.Config) {
+			cfg.GeoIP = proxy.GeoIPConfig{Blocks: []string{geoBlocks}, DenyClients: []string{"CN"}}
+		}},
+		{name: "proxy auth", configure: func(cfg *proxy.Config) { cfg.ProxyAuth.UsersFile = users }},
+		{name: "token auth", configure: func(cfg *proxy.Config) {
+			cfg.TokenAuth = proxy.TokenAuthConfig{Header: "X-Api-Key", Identities: map[string]string{"search": "s-456"}}
+		}},
+		{name: "authenticating plugin", configure: func(cfg *proxy.Config) {
+			cfg.Plugins = []proxy.PluginConfig{{Name: "test-fasthit-auth"}}
+		}},
+		{name: "middleware", opts: []proxy.Option{proxy.WithMiddleware(proxy.StageACL, passThrough)}},
+		{name: "script rules", configure: func(cfg *proxy.Config) {
+			cfg.ScriptRules = []proxy.ScriptRule{{When: `req.Method == "DELETE"`, Block: true}}
+		}},
+		{name: "stubs", configure: func(cfg *proxy.Config) {
+			cfg.Stubs = []proxy.StubRule{{Name: "retired", Host: "retired.example"}}
+		}},
+		{name: "host headers", configure: func(cfg *proxy.Config) {
+			cfg.HostHeaders = []proxy.HostHeaderRules{{Host: "api.example", Request: proxy.HeaderRules{Add: map[string]string{"X-Api": "1"}}}}
+		}},
+		{name: "HTTP/3 listener", configure: func(cfg *proxy.Config) {
+			cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+			cfg.HTTP3 = proxy.HTTP3Config{Listen: true, Addr: "127.0.0.1:8443"}
+		}, opts: []proxy.Option{proxy.WithHTTP3(&fakeHTTP3{served: make(chan string, 1)})}},
+		{name: "prefetch refresh", configure: func(cfg *proxy.Config) { cfg.Prefetch.MinAge = time.Minute }},
+		{name: "PAC file", configure: func(cfg *proxy.Config) { cfg.PAC.Enabled = true }},
+		{name: "logger", opts: []proxy.Option{proxy.WithLogger(slog.New(slog.DiscardHandler))}},
+		{name: "capture", configure: func(cfg *proxy.Config) { cfg.Capture.Enabled = true }},
+		{name: "rate limit", configure: func(cfg *proxy.Config) {
+			cfg.RateLimit = proxy.RateLimitConfig{Rate: 1e6, Burst: 1e6}
+		}},
+		{name: "chaos", configure: func(cfg *proxy.Config) {
+			cfg.Chaos = proxy.ChaosConfig{Enabled: true, Rules: []proxy.ChaosRule{{Name: "elsewhere", Path: "/chaos", Percent: 100, Fault: proxy.FaultStatus, Status: http.StatusBadGateway}}}
+		}},
+		{name: "compression", configure: func(cfg *proxy.Config) { cfg.Compression.Enabled = true },
+			header: http.Header{"Accept-Encoding": {"gzip"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The hit is cached by a server of the plain configuration
+			cache := proxy.NewLRUCache(10)
+			r := httptest.NewRequest(http.MethodGet, origin.URL+"/hit", nil)
+			newServer(t, localConfig(), proxy.WithCache(cache)).Handler().ServeHTTP(httptest.NewRecorder(), r)
+			if cache.Storage().Entries != 1 {
+				t.Fatal("hit not cached")
+			}
+
+			cfg := localConfig()
+			if tt.configure != nil {
+				tt.configure(&cfg)
+			}
+			handler := newServer(t, cfg, append(tt.opts, proxy.WithCache(cache))...).Handler()
+			maps.Copy(r.Header, tt.header)
+			allocs := math.Inf(1)
+			for range 5 {
+				w := &discardWriter{header: http.Header{}}
+				allocs = min(allocs, testing.AllocsPerRun(20, func() {
+					handler.ServeHTTP(w, r)
+				}))
+			}
+			if fast := allocs == 0; fast != tt.fast {
+				t.Errorf("fast hit path taken: %v, want %v", fast, tt.fast)
+			}
+		})
+	}
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	handler, r := cachedHandler(b)
+	w := &discardWriter{header: http.Header{}}
+	b.ReportAllocs()
+	for b.Loop() {
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// BenchmarkCacheHitParallel measures hit throughput under concurrency, where
+// allocations would also cost GC work shared by every request
+func BenchmarkCacheHitParallel(b *testing.B) {
+	handler, r := cachedHandler(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := &discardWriter{header: http.Header{}}
+		for pb.Next() {
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// encodeBody returns body encoded with the content coding coding, with
+// "raw-deflate" standing for the unwrapped deflate some origins send
+func encodeBody(t *testing.T, coding, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		t.Fatalf("unknown coding %q", coding)
+	}
+	io.WriteString(w, body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeUpstreamBodies(t *testing.T) {
+	const plaintext = "plaintext body, long enough to be worth compressing"
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		coding := strings.TrimPrefix(r.URL.Path, "/")
+		switch coding {
+		case "mislabelled":
+			// Not gzip at all, so it must reach the client byte for byte
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte(plaintext))
+		case "raw-deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			w.Write(encodeBody(t, coding, plaintext))
+		default:
+			w.Header().Set("Content-Encoding", coding)
+			w.Write(encodeBody(t, coding, plaintext))
+		}
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	// Without transport compression every coding reaches decodeBody unasked
+	transport := &http.Transport{DisableCompression: true}
+	handler := newServer(t, localConfig(), proxy.WithTransport(transport)).Handler()
+	cases := []struct {
+		path, encoding string
+	}{
+		{"/gzip", ""},
+		{"/deflate", ""},
+		{"/raw-deflate", ""},
+		{"/mislabelled", "gzip"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, origin.URL+c.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != plaintext {
+			t.Errorf("%s: got %d %q, want 200 with the plaintext body", c.path, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Encoding"); got != c.encoding {
+			t.Errorf("%s: Content-Encoding = %q, want %q", c.path, got, c.encoding)
+		}
+	}
+}
+
+func TestDecompressionCachesPlaintext(t *testing.T) {
+	fetches := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "x-base64") {
+			t.Errorf("Accept-Encoding = %q, want the registered coding offered", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "x-base64")
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("plaintext body"))))
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	cfg := localConfig()
+	cfg.Decompression.Enabled = true
+	base64Decoder := proxy.WithDecoder("x-base64", func(r io.Reader) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	})
+	handler := newServer(t, cfg, base64Decoder).Handler()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, origin.URL+"/encoded", nil))
+		if got := w.Body.String(); got != "plaintext body" {
+			t.Errorf("request %d: body = %q, want it decoded", i, got)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("request %d: Content-Encoding = %q, want none", i, got)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("origin fetched %d times, want the decoded body cached", fetches)
+	}
+}
+
+func TestDecompressionBuiltinCodings(t *testing.T) {
+	const plaintext = "plaintext body, long enough to be worth compressing"
+	var fetches sync.Map
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Each path names the coding the origin picks from those offered
+		coding := strings.TrimPrefix(r.URL.Path, "/")
+		n, _ := fetches.LoadOrStore(coding, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		offered := strings.Split(r.Header.Get("Accept-Encoding"), ", ")
+		if !slices.Contains(offered, coding) {
+			t.Errorf("Accept-Encoding = %q, want %s offered", r.Header.Get("Accept-Encoding"), coding)
+		}
+		w.Header().Set("Content-Encoding", coding)
+		w.Write(encodeBody(t, coding, plaintext))
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	cfg := localConfig()
+	cfg.Decompression.Enabled = true
+	handler := newServer(t, cfg).Handler()
+	for _, coding := range []string{"gzip", "deflate"} {
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, origin.URL+"/"+coding, nil))
+			if w.Code != http.StatusOK || w.Body.String() != plaintext {
+				t.Errorf("%s request %d: got %d %q, want 200 with the plaintext body", coding, i, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("%s request %d: Content-Encoding = %q, want none", coding, i, got)
+			}
+		}
+		if n, _ := fetches.Load(coding); n == nil || n.(*atomic.Int32).Load() != 1 {
+			t.Errorf("%s: origin not fetched exactly once, want the decoded body cached", coding)
+		}
+	}
+}
+
+func TestCacheStoresOnlySharedResponses(t *testing.T) {
+	var fetches atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "max-age=60, private")
+		case "/cookie":
+			w.Header().Set("Set-Cookie", "session=secret")
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/missing":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Origin", "replayed")
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Origin", "replayed")
+		}
+		io.WriteString(w, "{}")
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	// Request IDs take hits off the fast path, so both paths are covered
+	for _, requestIDs := range []bool{false, true} {
+		cfg := localConfig()
+		cfg.RequestIDs = requestIDs
+		handler := newServer(t, cfg).Handler()
+		send := func(path string, header http.Header) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, origin.URL+path, nil)
+			maps.Copy(r.Header, header)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		for _, path := range []string{"/no-store", "/private", "/cookie", "/created"} {
+			send(path, nil)
+			before := fetches.Load()
+			send(path, nil)
+			if fetches.Load() == before {
+				t.Errorf("request IDs %v: %s served from the cache", requestIDs, path)
+			}
+		}
+		send("/client-no-store", http.Header{"Cache-Control": {"no-store"}})
+		before := fetches.Load()
+		send("/client-no-store", nil)
+		if fetches.Load() == before {
+			t.Errorf("request IDs %v: response to a no-store request served from the cache", requestIDs)
+		}
+
+		for _, tc := range []struct {
+			path, contentType string
+			status            int
+		}{
+			{"/ok", "application/json", http.StatusOK},
+			{"/missing", "text/plain", http.StatusNotFound},
+		} {
+			send(tc.path, nil)
+			before := fetches.Load()
+			w := send(tc.path, nil)
+			if fetches.Load() != before {
+				t.Errorf("request IDs %v: %s not served from the cache", requestIDs, tc.path)
+			}
+			if w.Code != tc.status || w.Header().Get("Content-Type") != tc.contentType || w.Header().Get("X-Origin") != "replayed" || w.Body.String() != "{}" {
+				t.Errorf("request IDs %v: hit on %s = %d %v %q", requestIDs, tc.path, w.Code, w.Header(), w.Body.String())
+			}
+		}
+	}
+}
+
+func TestDeviceClassVariants(t *testing.T) {
+	var mu sync.Mutex
+	var fetches []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := r.Header.Get("X-Device-Class")
+		mu.Lock()
+		fetches = append(fetches, class)
+		mu.Unlock()
+		io.WriteString(w, "page for "+class)
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	cfg := localConfig()
+	cfg.Routes = []proxy.Route{{
+		Name:       "site",
+		Host:       "127.0.0.1",
+		PathPrefix: "/",
+		DeviceClasses: []proxy.DeviceClass{
+			{Name: "mobile", Mobile: true},
+			{Name: "tablet", MaxViewportWidth: 1024},
+		},
+	}}
+	handler := newServer(t, cfg).Handler()
+	cases := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"mobile", http.Header{"Sec-Ch-Ua-Mobile": {"?1"}, "Sec-Ch-Viewport-Width": {"390"}}, "page for mobile"},
+		{"desktop", http.Header{"Sec-Ch-Ua-Mobile": {"?0"}, "Sec-Ch-Viewport-Width": {"1920"}}, "page for default"},
+		// Other clients in the same buckets share their entries
+		{"another mobile", http.Header{"Sec-Ch-Ua-Mobile": {"?1"}, "Sec-Ch-Viewport-Width": {"414"}}, "page for mobile"},
+		{"another desktop", http.Header{"Viewport-Width": {"2560"}}, "page for default"},
+		{"tablet", http.Header{"Sec-Ch-Viewport-Width": {"800"}}, "page for tablet"},
+		// The class comes from the hints, not from the client
+		{"claimed class", http.Header{"X-Device-Class": {"mobile"}}, "page for default"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, origin.URL+"/page", nil)
+		maps.Copy(r.Header, c.header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != c.want {
+			t.Errorf("%s: body = %q, want %q", c.name, w.Body.String(), c.want)
+		}
+		if w.Header().Get("Accept-CH") == "" {
+			t.Errorf("%s: no Accept-CH asking for the hints", c.name)
+		}
+	}
+	if want := []string{"mobile", "default", "tablet"}; !slices.Equal(fetches, want) {
+		t.Errorf("origin fetched for %q, want one entry per class", fetches)
+	}
+}
+
+func TestVariantFallback(t *testing.T) {
+	var down atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		language := "en-US"
+		if strings.HasPrefix(r.Header.Get("Accept-Language"), "de") {
+			language = "de"
+		}
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", language)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "page in "+language)
+	}))
+	defer origin.Close()
+	handler := newServer(t, localConfig()).Handler()
+	silenceStdout(t)
+	get := func(language string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, origin.URL+"/page", nil)
+		r.Header.Set("Accept-Language", language)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, language := range []string{"de", "en-US"} {
+		if w := get(language); w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+			t.Fatalf("%s variant: %d, Warning %q", language, w.Code, w.Header().Get("Warning"))
+		}
+	}
+
+	// Languages without a cached variant reach the failing origin, which
+	// the closest acceptable variant stands in for
+	down.Store(true)
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"fr, de;q=0.5", "page in de"},
+		{"en;q=0.8", "page in en-US"},
+		{"ja", "down\n"},
+	}
+	for _, tt := range tests {
+		w := get(tt.language)
+		if w.Body.String() != tt.want {
+			t.Errorf("%s: %d %q, want %q", tt.language, w.Code, w.Body.String(), tt.want)
+		}
+		if warned, fallback := w.Header().Get("Warning") != "", w.Code == http.StatusOK; warned != fallback {
+			t.Errorf("%s: status %d with Warning %q", tt.language, w.Code, w.Header().Get("Warning"))
+		}
+	}
+}
+
+func TestHottestURLs(t *testing.T) {
+	log := strings.Join([]string{
+		"Received request for: http://a.example/x",
+		"Received request for: http://a.example/x [static]",
+		"Cache hit: http://a.example/x",
+		`10.0.0.1 - - [16/Oct/2026:10:00:00 +0000] "GET /y HTTP/1.1" 200 512 "-" "curl/8"`,
+		`10.0.0.1 - - [16/Oct/2026:10:00:01 +0000] "GET /y HTTP/1.1" 200 512 "-" "curl/8"`,
+		`10.0.0.1 - - [16/Oct/2026:10:00:02 +0000] "GET /y HTTP/1.1" 200 512 "-" "curl/8"`,
+		`10.0.0.1 - - [16/Oct/2026:10:00:03 +0000] "GET /missing HTTP/1.1" 404 0 "-" "curl/8"`,
+		`10.0.0.1 - - [16/Oct/2026:10:00:04 +0000] "POST /form HTTP/1.1" 200 0 "-" "curl/8"`,
+		"Received request for: http://b.example/z",
+	}, "\n")
+
+	urls, err := proxy.HottestURLs(strings.NewReader(log), "https://www.example.com", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://www.example.com/y", "http://a.example/x"}
+	if fmt.Sprint(urls) != fmt.Sprint(want) {
+		t.Errorf("HottestURLs = %v, want %v", urls, want)
+	}
+}
+
+func TestCacheDeduplicatesBodies(t *testing.T) {
+	lru := proxy.NewLRUCache(3)
+	asset := []byte(strings.Repeat("x", 100))
+	lru.Put("http://cdn/app.js?v=1", asset)
+	lru.Put("http://cdn/app.js?v=2", append([]byte(nil), asset...))
+	lru.Put("http://cdn/other.js", []byte("other"))
+
+	want := proxy.CacheStorage{Entries: 3, Bodies: 2, Bytes: 105, SavedBytes: 100}
+	if got := lru.Storage(); got != want {
+		t.Fatalf("storage = %+v, want %+v", got, want)
+	}
+	if body, ok := lru.Get("http://cdn/app.js?v=2"); !ok || string(body) != string(asset) {
+		t.Fatalf("shared body = %q, %v", body, ok)
+	}
+
+	// Overwriting and evicting release the shared body
+	lru.Put("http://cdn/app.js?v=1", []byte("changed"))
+	lru.Delete("http://cdn/app.js?v=2")
+	want = proxy.CacheStorage{Entries: 2, Bodies: 2, Bytes: 12}
+	if got := lru.Storage(); got != want {
+		t.Fatalf("storage after release = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheSetCapacity(t *testing.T) {
+	lru := proxy.NewLRUCache(4)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lru.Put(key, []byte(key))
+	}
+	lru.Get("a")
+	lru.SetCapacity(2)
+	if got := lru.Storage().Entries; got != 2 {
+		t.Fatalf("entries = %d after shrinking, want 2", got)
+	}
+	for key, want := range map[string]bool{"a": true, "d": true, "b": false, "c": false} {
+		if _, ok := lru.Get(key); ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	lru.SetCapacity(3)
+	lru.Put("e", []byte("e"))
+	if got := lru.Storage().Entries; got != 3 {
+		t.Errorf("entries = %d after growing, want 3", got)
+	}
+}
+
+func TestCacheSecondChanceEviction(t *testing.T) {
+	// cached lists the keys held, without counting as hits
+	cached := func(lru *proxy.LRUCache) []string {
+		keys := lru.Keys()
+		slices.Sort(keys)
+		return keys
+	}
+	lru := proxy.NewLRUCache(3)
+	for _, key := range []string{"a", "b", "c"} {
+		lru.Put(key, []byte(key))
+	}
+
+	// A hit spares the oldest item once; the next oldest goes instead
+	lru.Get("a")
+	lru.Put("d", []byte("d"))
+	if got := cached(lru); !slices.Equal(got, []string{"a", "c", "d"}) {
+		t.Fatalf("after a hit on a: cached %v, want [a c d]", got)
+	}
+	// Sparing it cleared its flag, so without a new hit it ages out again
+	lru.Put("e", []byte("e"))
+	lru.Put("f", []byte("f"))
+	if got := cached(lru); !slices.Equal(got, []string{"d", "e", "f"}) {
+		t.Fatalf("without further hits: cached %v, want [d e f]", got)
+	}
+
+	// When every item was hit, the order of the hits is not kept and the
+	// oldest item goes, where a strict LRU would drop the first hit
+	lru.Get("f")
+	lru.Get("d")
+	lru.Get("e")
+	lru.Put("g", []byte("g"))
+	if got := cached(lru); !slices.Equal(got, []string{"e", "f", "g"}) {
+		t.Errorf("after hits on every item: cached %v, want [e f g]", got)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	const object = "0123456789abcdefghij"
+	var fetches, ranged atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		http.ServeContent(w, r, "doc.pdf", time.Time{}, strings.NewReader(object))
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	send := func(handler http.Handler, url, ranges string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if ranges != "" {
+			r.Header.Set("Range", ranges)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	parts := func(t *testing.T, w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		mediaType, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if w.Code != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+			t.Fatalf("multi-range answer: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		var got []string
+		mr := multipart.NewReader(w.Body, params["boundary"])
+		for part, err := mr.NextPart(); err == nil; part, err = mr.NextPart() {
+			data, _ := io.ReadAll(part)
+			got = append(got, part.Header.Get("Content-Range")+" "+string(data))
+		}
+		return got
+	}
+	want := []string{"bytes 0-1/20 01", "bytes 5-6/20 56"}
+
+	handler := newServer(t, localConfig()).Handler()
+	url := origin.URL + "/relayed.pdf"
+	if got := parts(t, send(handler, url, "bytes=0-1,5-6")); !slices.Equal(got, want) {
+		t.Errorf("relayed parts = %q, want %q", got, want)
+	}
+	if w := send(handler, url, ""); w.Body.String() != object {
+		t.Fatalf("full body after a partial response = %q, want it uncached by the partial", w.Body.String())
+	}
+	before := fetches.Load()
+	if got := parts(t, send(handler, url, "bytes=0-1,5-6")); !slices.Equal(got, want) {
+		t.Errorf("cached parts = %q, want %q", got, want)
+	}
+	w := send(handler, url, "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" || w.Header().Get("Content-Range") != "bytes 2-4/20" {
+		t.Errorf("cached single range: %d %q %q", w.Code, w.Header().Get("Content-Range"), w.Body.String())
+	}
+	if w := send(handler, url, "bytes=50-60"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: status = %d, want 416", w.Code)
+	}
+	if fetches.Load() != before {
+		t.Error("ranges of a cached object reached the origin")
+	}
+
+	cfg := localConfig()
+	cfg.CacheRangeRequests = true
+	handler = newServer(t, cfg).Handler()
+	url = origin.URL + "/filled.pdf"
+	ranged.Store(0)
+	if w := send(handler, url, "bytes=2-3"); w.Code != http.StatusPartialContent || w.Body.String() != "23" {
+		t.Errorf("filled range: %d %q", w.Code, w.Body.String())
+	}
+	before = fetches.Load()
+	if w := send(handler, url, ""); w.Body.String() != object || fetches.Load() != before || ranged.Load() != 0 {
+		t.Errorf("range miss did not fill the cache with the whole object")
+	}
+}
+
+func TestSegmentedFetch(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 100)
+	var mu sync.Mutex
+	var ranges []string
+	var version atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		etag := `"v1"`
+		if r.URL.Path == "/changing.iso" {
+			// Every fetch sees a new version of the object
+			etag = fmt.Sprintf(`"v%d"`, version.Add(1))
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	}))
+	defer origin.Close()
+	silenceStdout(t)
+
+	cfg := localConfig()
+	cfg.SegmentedFetch = proxy.SegmentedFetchConfig{MinBytes: 100, Segments: 4}
+	front := httptest.NewServer(newServer(t, cfg, proxy.WithLogger(slog.New(slog.DiscardHandler))).Handler())
+	defer front.Close()
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}}
+	get := func(path string) ([]byte, []string, error) {
+		mu.Lock()
+		ranges = nil
+		mu.Unlock()
+		var body []byte
+		resp, err := client.Get(origin.URL + path)
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fetched := slices.Clone(ranges)
+		slices.Sort(fetched)
+		return body, fetched, err
+	}
+
+	body, fetched, err := get("/image.iso")
+	if err != nil || !bytes.Equal(body, object) {
+		t.Fatalf("segmented fetch: %v, body of %d bytes intact: %v", err, len(body), bytes.Equal(body, object))
+	}
+	if want := []string{"", "bytes=250-499", "bytes=500-749", "bytes=750-999"}; !slices.Equal(fetched, want) {
+		t.Errorf("origin fetches = %q, want %q", fetched, want)
+	}
+	if body, fetched, err := get("/image.iso"); err != nil || !bytes.Equal(body, object) || len(fetched) != 0 {
+		t.Errorf("assembled object not served from the cache: %v, fetches %q", err, fetched)
+	}
+
+	// Ranges of a changed object come back whole; the response is cut off
+	// rather than mixing versions, and nothing is cached
+	if _, _, err := get("/changing.iso"); err == nil {
+		t.Error("object changed mid-fetch relayed as complete")
+	}
+	if _, fetched, _ := get("/changing.iso"); !slices.Contains(fetched, "") {
+		t.Error("object changed mid-fetch was cached")
+	}
+}
+
+// upstreamHandler returns a proxy handler whose upstream answers every
+// request with size bytes, declaring the length unless chunked
+func upstreamHandler(tb testing.TB, size int, chunked bool) http.Handler {
+	silenceStdout(tb)
+	body := bytes.Repeat([]byte("x"), size)
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		length := int64(size)
+		if chunked {
+			length = -1
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: length,
+			Request:       r,
+		}, nil
+	})
+	return newServer(tb, localConfig(), proxy.WithTransport(transport)).Handler()
+}
+
+// BenchmarkStreamedMiss relays uncacheable responses, which are copied
+// through a buffer on every request
+func BenchmarkStreamedMiss(b *testing.B) {
+	handler := upstreamHandler(b, 256<<10, true)
+	r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/stream", nil)
+	r.Header.Set("Authorization", "Bearer uncacheable")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := &discardWriter{header: http.Header{}}
+		for pb.Next() {
+			clear(w.header)
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// BenchmarkCacheFill relays responses of known length into the cache
+func BenchmarkCacheFill(b *testing.B) {
+	handler := upstreamHandler(b, 64<<10, false)
+	var n atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := &discardWriter{header: http.Header{}}
+		for pb.Next() {
+			clear(w.header)
+			r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/fill?n="+strconv.FormatInt(n.Add(1), 10), nil)
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// BenchmarkAccessLogged serves cache hits written to the access log
+func BenchmarkAccessLogged(b *testing.B) {
+	silenceStdout(b)
+	for _, format := range []string{proxy.AccessLogCombined, proxy.AccessLogJSON} {
+		b.Run(format, func(b *testing.B) {
+			cfg := localConfig()
+			cfg.AccessLog = proxy.AccessLogConfig{Path: filepath.Join(b.TempDir(), "access.log"), Format: format}
+			transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("logged")), ContentLength: 6, Request: r}, nil
+			})
+			handler := newServer(b, cfg, proxy.WithTransport(transport)).Handler()
+			r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/logged", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				w := &discardWriter{header: http.Header{}}
+				for pb.Next() {
+					clear(w.header)
+					handler.ServeHTTP(w, r)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkLRUCacheReadHeavy measures the cache under concurrent lookups
+// with an occasional store, as a busy proxy serving mostly hits sees it
+func BenchmarkLRUCacheReadHeavy(b *testing.B) {
+	const keys = 1024
+	lru := proxy.NewLRUCache(keys)
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "http://origin/item/" + strconv.Itoa(i)
+		lru.Put(names[i], []byte(names[i]))
+	}
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(7919))
+		for pb.Next() {
+			i++
+			key := names[i%keys]
+			if i%16 == 0 {
+				lru.Put(key, []byte(key))
+			} else {
+				lru.Get(key)
+			}
+		}
+	})
+}
@@ -0,0 +1,306 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/configfile"
+)
+
+func TestTOMLValues(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"basic string", `"plain"`, "plain"},
+		{"empty string", `""`, ""},
+		{"escapes", `"tab\there \"quoted\" back\\slash"`, "tab\there \"quoted\" back\\slash"},
+		{"unicode escapes", `"caf\u00e9 \U0001F600"`, "café 😀"},
+		{"literal string", `'C:\path\n'`, `C:\path\n`},
+		{"literal with double quotes", `'say "hi"'`, `say "hi"`},
+		{"multiline basic", "\"\"\"\nfirst\nsecond\"\"\"", "first\nsecond"},
+		{"multiline line continuation", "\"\"\"one \\\n     two\"\"\"", "one two"},
+		{"multiline literal", "'''\nraw \\d+\n'''", "raw \\d+\n"},
+		{"integer", `42`, int64(42)},
+		{"negative integer", `-7`, int64(-7)},
+		{"underscored integer", `1_000_000`, int64(1000000)},
+		{"hex integer", `0x1f`, int64(31)},
+		{"float", `-3.5`, -3.5},
+		{"exponent", `1e3`, 1000.0},
+		{"true", `true`, true},
+		{"false", `false`, false},
+		{"array", `[1, 2, 3]`, []any{int64(1), int64(2), int64(3)}},
+		{"empty array", `[]`, []any{}},
+		{"trailing comma", `["a", "b",]`, []any{"a", "b"}},
+		{"array over lines", "[\n  \"a\", # first\n  \"b\",\n]", []any{"a", "b"}},
+		{"nested arrays", `[[1, 2], ["x"]]`, []any{[]any{int64(1), int64(2)}, []any{"x"}}},
+		{"inline table", `{ a = 1, b.c = "x" }`, map[string]any{"a": int64(1), "b": map[string]any{"c": "x"}}},
+		{"empty inline table", `{}`, map[string]any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := configfile.Parse([]byte("v = "+tt.src+"\n"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := doc.Values["v"]; !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("v = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOMLTables(t *testing.T) {
+	src := `# settings
+name = "edge" # trailing comment
+"quoted key" = 1
+site.region = "eu"
+
+[cache]
+capacity = 100
+
+[cache.disk]
+dir = "/var/cache"
+
+[[routes]]
+name = "api"
+
+[[routes]]
+name = "web"
+weight = 2
+
+[[routes.backends]]
+url = "http://web:80"
+`
+	doc, err := configfile.Parse([]byte(src), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"name":       "edge",
+		"quoted key": int64(1),
+		"site":       map[string]any{"region": "eu"},
+		"cache": map[string]any{
+			"capacity": int64(100),
+			"disk":     map[string]any{"dir": "/var/cache"},
+		},
+		"routes": []any{
+			map[string]any{"name": "api"},
+			map[string]any{
+				"name":     "web",
+				"weight":   int64(2),
+				"backends": []any{map[string]any{"url": "http://web:80"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(doc.Values, want) {
+		t.Fatalf("values = %#v, want %#v", doc.Values, want)
+	}
+}
+
+func TestTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"duplicate key", "a = 1\na = 2\n", "line 2: key a defined twice"},
+		{"duplicate table", "[t]\n[t]\n", "line 2: table t defined twice"},
+		{"unterminated string", "a = \"open\n", "line 1: unterminated string"},
+		{"unterminated literal", "a = 'open\n", "line 1: unterminated string"},
+		{"unterminated multiline", "a = \"\"\"open\n", "unterminated string"},
+		{"invalid escape", `a = "\q"`, "line 1: invalid escape \\q"},
+		{"invalid unicode escape", `a = "\uZZZZ"`, "line 1: invalid \\u escape"},
+		{"unterminated array", "a = [1, 2\n", "unterminated array"},
+		{"missing comma", "a = [1 2]\n", "line 1: expected , or ] in array"},
+		{"bare string", "a = bare\n", "line 1: invalid value bare; strings must be quoted"},
+		{"date", "\n\na = 2024-01-01\n", "line 3: dates and times are not supported"},
+		{"infinity", "a = inf\n", "line 1: inf is not a supported number"},
+		{"leading zero", "a = 012\n", "line 1: integer 012 has a leading zero"},
+		{"two values on a line", "a = 1 b = 2\n", "line 1: unexpected"},
+		{"array of tables over an array", "a = [1]\n[[a]]\n", "line 2: a is an array, not an array of tables"},
+		{"not UTF-8", "a = \"\xff\"\n", "file is not UTF-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := configfile.Parse([]byte(tt.src), false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// testSettings is a settings struct shaped like the proxy's configuration
+type testSettings struct {
+	ListenAddr     string
+	MaxObjectBytes int64
+	Ratio          float64
+	Verbose        bool
+	Timeout        time.Duration
+	Tags           []string
+	Labels         map[string]string
+	Cache          struct {
+		Capacity int
+		TTL      time.Duration
+	}
+	Routes []struct {
+		Name    string
+		Backend string `json:"upstream"`
+	}
+}
+
+func TestDecode(t *testing.T) {
+	src := `listen_addr = ":8080"
+max-object-bytes = 1048576
+ratio = 1
+verbose = true
+timeout = "1m30s"
+tags = ["a", "b"]
+labels = { env = "prod" }
+
+[cache]
+ttl = "5s"
+
+[[routes]]
+name = "api"
+upstream = "http://api:9000"
+`
+	doc, err := configfile.Parse([]byte(src), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got testSettings
+	got.Cache.Capacity = 500
+	got.Tags = []string{"replaced"}
+	if err := doc.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	var want testSettings
+	want.ListenAddr = ":8080"
+	want.MaxObjectBytes = 1 << 20
+	want.Ratio = 1
+	want.Verbose = true
+	want.Timeout = 90 * time.Second
+	want.Tags = []string{"a", "b"}
+	want.Labels = map[string]string{"env": "prod"}
+	want.Cache.Capacity = 500 // absent keys keep the default
+	want.Cache.TTL = 5 * time.Second
+	want.Routes = append(want.Routes, struct {
+		Name    string
+		Backend string `json:"upstream"`
+	}{"api", "http://api:9000"})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeProblems(t *testing.T) {
+	src := `listen_adr = ":8080"
+max_object_bytes = "big"
+timeout = 30
+
+[cache]
+ttl = "soon"
+
+[[routes]]
+name = 1
+`
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var settings testSettings
+	err := configfile.Load(path, &settings)
+	var decodeErr *configfile.Error
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("error = %v, want a *configfile.Error", err)
+	}
+	if decodeErr.File != path {
+		t.Errorf("File = %q, want %q", decodeErr.File, path)
+	}
+	want := []struct {
+		path    string
+		line    int
+		message string
+	}{
+		{"listen_adr", 1, "unknown key (did you mean listen_addr?)"},
+		{"max_object_bytes", 2, "expected an integer"},
+		{"timeout", 3, "expected a duration string"},
+		{"cache.ttl", 6, `invalid duration "soon"`},
+		{"routes[0].name", 9, "expected a string, got number 1"},
+	}
+	if len(decodeErr.Problems) != len(want) {
+		t.Fatalf("problems = %+v, want %d", decodeErr.Problems, len(want))
+	}
+	for i, w := range want {
+		p := decodeErr.Problems[i]
+		if p.Path != w.path || p.Line != w.line || !strings.Contains(p.Message, w.message) {
+			t.Errorf("problem %d = %+v, want %s at line %d: %s", i, p, w.path, w.line, w.message)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), path+": 5 problems\n  line 1: listen_adr: unknown key") {
+		t.Errorf("error text = %q", err.Error())
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	src := `{"listen_addr": ":9090", "max_object_bytes": 2048, "ratio": 0.5, "cache": {"ttl": "1s"}}`
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var got testSettings
+	if err := configfile.Load(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ListenAddr != ":9090" || got.MaxObjectBytes != 2048 || got.Ratio != 0.5 || got.Cache.TTL != time.Second {
+		t.Fatalf("decoded %+v", got)
+	}
+
+	// JSON problems have no line to report
+	doc, err := configfile.Parse([]byte(`{"ratio": "half"}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Decode(&got)
+	var decodeErr *configfile.Error
+	if !errors.As(err, &decodeErr) || len(decodeErr.Problems) != 1 || decodeErr.Problems[0].Line != 0 {
+		t.Fatalf("error = %v, want one problem without a line", err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"PROXY_LISTEN_ADDR=:7070",
+		"PROXY_CACHE_TTL=2s",
+		"PROXY_TAGS=a,b",
+		`PROXY_ROUTES=[{"name": "api", "upstream": "http://api:9000"}]`,
+		"PROXY_UNRELATED=1",
+	}
+	var got testSettings
+	unknown, err := configfile.LoadEnv("PROXY_", environ, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unknown, []string{"PROXY_UNRELATED"}) {
+		t.Errorf("unknown = %v", unknown)
+	}
+	if got.ListenAddr != ":7070" || got.Cache.TTL != 2*time.Second || !reflect.DeepEqual(got.Tags, []string{"a", "b"}) ||
+		len(got.Routes) != 1 || got.Routes[0].Backend != "http://api:9000" {
+		t.Fatalf("decoded %+v", got)
+	}
+
+	_, err = configfile.LoadEnv("PROXY_", []string{"PROXY_CACHE_TTL=soon"}, &got)
+	var decodeErr *configfile.Error
+	if !errors.As(err, &decodeErr) || len(decodeErr.Problems) != 1 || decodeErr.Problems[0].Source != "PROXY_CACHE_TTL" {
+		t.Fatalf("error = %v, want one problem from PROXY_CACHE_TTL", err)
+	}
+}
@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Simply-kk/go-multithreaded-proxy/internal/expr"
+)
+
+// testRequest is an expr.Object whose fields are looked up when evaluated
+type testRequest map[string]any
+
+func (r testRequest) Field(name string) any { return r[name] }
+
+// exprSchema describes the variables of exprVars
+var exprSchema = map[string]any{
+	"req": map[string]any{
+		"Method": "",
+		"Host":   "",
+		"Path":   "",
+		"Size":   0,
+		"Header": nil,
+		"Cookie": nil,
+	},
+	"tags":  "",
+	"extra": nil,
+}
+
+func exprVars() map[string]any {
+	return map[string]any{
+		"req": testRequest{
+			"Method": "GET",
+			"Host":   "api.example.test",
+			"Path":   "/admin/users",
+			"Size":   int64(512),
+			"Header": map[string]string{"X-Env": "Staging"},
+			"Cookie": map[string]string{"beta": "1"},
+		},
+		"tags":  []any{"a", "b"},
+		"extra": map[string]any{"weight": 2.5},
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want any
+	}{
+		// Literals
+		{`"double"`, "double"},
+		{`'single "quoted"'`, `single "quoted"`},
+		{`'it\'s'`, "it's"},
+		{`"tab\t"`, "tab\t"},
+		{`1_000`, int64(1000)},
+		{`1.5`, 1.5},
+		{`null`, nil},
+		{`[1, "a", [true]]`, []any{int64(1), "a", []any{true}}},
+
+		// Arithmetic and precedence
+		{`1 + 2 - 4`, int64(-1)},
+		{`1 + 0.5`, 1.5},
+		{`-req.Size + 12`, int64(-500)},
+		{`'env ' + req.Header["X-Env"]`, "env Staging"},
+		{`1 + 2 == 3 && !false`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+
+		// Comparisons
+		{`req.Method == "GET"`, true},
+		{`req.Method != "GET"`, false},
+		{`req.Size == 512.0`, true},
+		{`req.Size > 100 && req.Size <= 512`, true},
+		{`"abc" < "abd"`, true},
+		{`[1, 2] == [1, 2.0]`, true},
+		{`req.Cookie["beta"] != null`, true},
+		{`req.Cookie["alpha"] == null`, true},
+		{`extra.missing == null`, true},
+
+		// Word operators
+		{`req.Path startsWith "/admin"`, true},
+		{`req.Host endsWith ".test"`, true},
+		{`req.Host contains "example"`, true},
+		{`"b" in tags`, true},
+		{`"c" in tags`, false},
+		{`"weight" in extra`, true},
+		{`lower(req.Header["X-Env"]) in ["staging", "test"]`, true},
+		{`req.Path matches "^/admin/[a-z]+$"`, true},
+		{`req.Path matches "^/" + "users"`, false},
+		{`req.Cookie["alpha"] startsWith ""`, true},
+
+		// Functions, fields and indexing
+		{`upper(req.Method)`, "GET"},
+		{`lower(null)`, ""},
+		{`len(req.Path)`, int64(12)},
+		{`len(tags)`, int64(2)},
+		{`len(null)`, int64(0)},
+		{`tags[1]`, "b"},
+		{`extra.weight`, 2.5},
+		{`extra["weight"]`, 2.5},
+
+		// The right operand of a decided && or || is not evaluated
+		{`false && req.Size`, false},
+		{`true || req.Size`, true},
+	}
+	vars := exprVars()
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p, err := expr.Compile(tt.src, exprSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.String() != tt.src {
+				t.Errorf("String() = %q, want %q", p.String(), tt.src)
+			}
+			got, err := p.Eval(vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Eval = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprCompileErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`"open`, "column 1: unterminated string"},
+		{`req.Method == "x" # comment`, "column 19: unexpected '#'"},
+		{`unknown == 1`, "column 1: unknown name unknown"},
+		{`req.Verb == "GET"`, "column 5: req has no field Verb"},
+		{`req.Method.Length`, "column 12: req.Method has no fields"},
+		{`req.`, "column 5: expected a field name, found the end"},
+		{`1 +`, "column 4: expected a value, found the end"},
+		{`req.Method "GET"`, `column 12: expected an operator, found "GET"`},
+		{`(1 + 2`, `expected ")"`},
+		{`[1, 2`, `expected ","`},
+		{`req.Path matches "("`, "column 10: error parsing regexp"},
+		{`req.Path matches 1`, "column 10: matches needs a pattern string"},
+		{`req.Method()`, "column 11: only functions may be called"},
+		{`1.2.3`, "column 1: invalid number 1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := expr.Compile(tt.src, exprSchema)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`req.Method + 1`, "column 12: cannot apply + to a string and a number"},
+		{`-req.Method`, "column 1: cannot apply - to a string"},
+		{`!req.Size`, "column 1: cannot apply ! to a number"},
+		{`req.Size && true`, "operands of && must be booleans, not a number"},
+		{`req.Size < "big"`, "column 10: cannot compare a number and a string"},
+		{`req.Size startsWith "5"`, "column 10: startsWith needs strings, not a number"},
+		{`1 in req.Path`, "a string can only contain strings, not a number"},
+		{`tags["first"]`, "lists are indexed by integers, not a string"},
+		{`len(req.Size)`, "column 1: len: cannot take the length of a number"},
+		{`upper(1, 2)`, "column 1: upper: takes one argument"},
+		{`req.Path matches req.Method + "("`, "error parsing regexp"},
+	}
+	vars := exprVars()
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p, err := expr.Compile(tt.src, exprSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.Eval(vars)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprBool(t *testing.T) {
+	p, err := expr.Compile(`req.Method == "GET" && req.Path startsWith "/admin"`, exprSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := p.Bool(exprVars()); !ok || err != nil {
+		t.Fatalf("Bool = %v, %v; want true", ok, err)
+	}
+
+	p, err = expr.Compile(`req.Host`, exprSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Bool(exprVars()); err == nil || !strings.Contains(err.Error(), "expression yields a string, not a boolean") {
+		t.Fatalf("error = %v, want a non-boolean result refused", err)
+	}
+
+	// A variable the schema allows but the caller did not set
+	if _, err := p.Bool(map[string]any{}); err == nil || !strings.Contains(err.Error(), "req is not set") {
+		t.Fatalf("error = %v, want the unset variable reported", err)
+	}
+}